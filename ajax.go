@@ -0,0 +1,190 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package caddyesi
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/corestoreio/caddy-esi/esitag"
+	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log"
+)
+
+// DefaultAjaxTTL defines how long the signed URL of an AJAX placeholder stays
+// valid. Only when config value ajax_ttl in Caddyfile has not been supplied.
+const DefaultAjaxTTL = time.Minute
+
+// DefaultAjaxLoader JavaScript function which loads the content of a tag with
+// onerror="ajax" and replaces the placeholder element with it. The function
+// gets called with the ID of the placeholder element and the signed URL. Only
+// when config value ajax_loader in Caddyfile has not been supplied.
+const DefaultAjaxLoader = `function(id,url){var x=new XMLHttpRequest();x.open("GET",url);x.onload=function(){var p=document.getElementById(id);if(p&&x.status===200){var t=document.createElement("template");t.innerHTML=x.responseText;p.parentNode.replaceChild(t.content,p)}};x.send()}`
+
+// ajaxSecretLen length of the random key to sign the AJAX URLs.
+const ajaxSecretLen = 32
+
+func newAjaxSecret() ([]byte, error) {
+	s := make([]byte, ajaxSecretLen)
+	if _, err := rand.Read(s); err != nil {
+		return nil, errors.Fatal.New(err, "[caddyesi] Failed to create the ajax secret")
+	}
+	return s, nil
+}
+
+// ajaxPath returns the URL path under which the middleware serves the content
+// of the tags with onerror="ajax".
+func (pc *PathConfig) ajaxPath() string {
+	if pc.AjaxPath != "" {
+		return pc.AjaxPath
+	}
+	return path.Join(pc.Scope, "_esi/ajax")
+}
+
+// ajaxSign calculates the HMAC of the parameters of an AJAX URL. The path
+// scope is part of the signature, so an URL cannot be replayed against
+// another scope which shares the same secret.
+func (pc *PathConfig) ajaxSign(pageID uint64, idx int, expires int64, pageURI string) string {
+	mac := hmac.New(sha256.New, pc.ajaxSecret)
+	fmt.Fprintf(mac, "%s\x00%d\x00%d\x00%d\x00%s", pc.Scope, pageID, idx, expires, pageURI)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ajaxURL creates the signed URL to load the content of the tag at position
+// idx of the walked entities of a page. pageURI gets used to resolve the
+// resources of the tag as if the page itself has been requested.
+func (pc *PathConfig) ajaxURL(pageID uint64, idx int, pageURI string, now time.Time) string {
+	ttl := pc.AjaxTTL
+	if ttl < 1 {
+		ttl = DefaultAjaxTTL
+	}
+	expires := now.Add(ttl).Unix()
+	q := url.Values{}
+	q.Set("p", strconv.FormatUint(pageID, 10))
+	q.Set("i", strconv.Itoa(idx))
+	q.Set("x", strconv.FormatInt(expires, 10))
+	q.Set("u", pageURI)
+	q.Set("s", pc.ajaxSign(pageID, idx, expires, pageURI))
+	return pc.ajaxPath() + "?" + q.Encode()
+}
+
+// ajaxPlaceholder returns the function which creates the placeholder element
+// and the script calling the loader for the tag at position idx of the walked
+// entities of a page.
+func (pc *PathConfig) ajaxPlaceholder(pageID uint64, idx int) func(*http.Request) []byte {
+	id := fmt.Sprintf("esi-ajax-%d-%d", pageID, idx)
+	loader := pc.AjaxLoader
+	if loader == "" {
+		loader = DefaultAjaxLoader
+	}
+	return func(r *http.Request) []byte {
+		u := pc.ajaxURL(pageID, idx, r.URL.RequestURI(), time.Now())
+		return []byte(fmt.Sprintf(`<esi-ajax id="%s"></esi-ajax><script>(%s)("%s","%s");</script>`,
+			id, loader, id, template.JSEscapeString(u)))
+	}
+}
+
+// ajaxEntity returns the entity at position idx of the walked entities of a
+// page or nil if the page is unknown or the tag does not have onerror="ajax".
+func (pc *PathConfig) ajaxEntity(pageID uint64, idx int) *esitag.Entity {
+	pc.esiMU.RLock()
+	entities := pc.esiCache[pageID]
+	pc.esiMU.RUnlock()
+
+	var et *esitag.Entity
+	i := 0
+	entities.Walk(func(e *esitag.Entity) {
+		if i == idx && e.OnErrorAjax {
+			et = e
+		}
+		i++
+	})
+	return et
+}
+
+// serveAjax verifies the signed URL of an AJAX placeholder and writes the
+// content of the tag queried from its resources. The browser never sees the
+// addresses of the resources. A purged page returns 404.
+func (mw *Middleware) serveAjax(cfg *PathConfig, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	q := r.URL.Query()
+	pageID, err := strconv.ParseUint(q.Get("p"), 10, 64)
+	if err != nil {
+		return http.StatusForbidden, nil
+	}
+	idx, err := strconv.Atoi(q.Get("i"))
+	if err != nil {
+		return http.StatusForbidden, nil
+	}
+	expires, err := strconv.ParseInt(q.Get("x"), 10, 64)
+	if err != nil {
+		return http.StatusForbidden, nil
+	}
+	pageURI := q.Get("u")
+	wantSig := cfg.ajaxSign(pageID, idx, expires, pageURI)
+	if !hmac.Equal([]byte(wantSig), []byte(q.Get("s"))) || time.Now().Unix() > expires {
+		if cfg.Log.IsDebug() {
+			cfg.Log.Debug("caddyesi.Middleware.serveAjax.Forbidden", log.String("url", r.URL.String()))
+		}
+		return http.StatusForbidden, nil
+	}
+	pageURL, err := url.ParseRequestURI(pageURI)
+	if err != nil {
+		return http.StatusForbidden, nil
+	}
+
+	et := cfg.ajaxEntity(pageID, idx)
+	if et == nil {
+		return http.StatusNotFound, nil
+	}
+
+	// The resources get resolved with the URL of the page but with the
+	// headers and cookies of the AJAX request.
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = pageURL
+	r2.RequestURI = pageURI
+
+	hdr, data, err := et.QueryResourcesHeader(r2)
+	if err != nil {
+		return http.StatusBadGateway, errors.Wrapf(err, "[caddyesi] Failed to query the resources for the ajax tag %q", et.RawTag)
+	}
+
+	for k, v := range hdr {
+		if k != esitag.SurrogateKeyHeader {
+			w.Header()[k] = v
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "[caddyesi] Failed to write the ajax tag %q", et.RawTag)
+	}
+	return http.StatusOK, nil
+}
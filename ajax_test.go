@@ -0,0 +1,120 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package caddyesi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/corestoreio/caddy-esi/esitag"
+	"github.com/corestoreio/caddy-esi/esitesting"
+	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ajaxURLRegex = regexp.MustCompile(`"(/_esi/ajax[^"]+)"`)
+
+func TestMiddleware_Ajax(t *testing.T) {
+	// t.Parallel() not possible due to the global map in backend
+
+	var failing int32 = 1
+	defer esitag.RegisterResourceHandler("ajaxtest01", esitesting.MockRequestContentCB("AjaxService", func() error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.Timeout.Newf("ajaxTest01: Too slow")
+		}
+		return nil
+	})).DeferredDeregister()
+
+	pc := NewPathConfig()
+	pc.Scope = "/"
+	pc.Log = log.BlackHole{}
+	pc.ajaxSecret = []byte("test-secret")
+
+	entities, err := esitag.Parse(strings.NewReader(`<p><esi:include src="ajaxTest01://micro.service/cart" timeout="5ms" onerror="ajax"/></p>`))
+	require.NoError(t, err)
+	pc.UpsertESITags(42, entities)
+	require.NotNil(t, entities[0].AjaxPlaceholder)
+
+	mw := &Middleware{PathConfigs: PathConfigs{pc}}
+
+	// The first request fails and injects the placeholder with the signed URL.
+	chanTag := make(chan esitag.DataTag)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- entities.QueryResources(chanTag, httptest.NewRequest("GET", "/page.html?page=2", nil))
+	}()
+	dt := <-chanTag
+	require.NoError(t, <-errCh)
+
+	assert.Contains(t, string(dt.Data), `<esi-ajax id="esi-ajax-42-0"></esi-ajax><script>(`+DefaultAjaxLoader+`)("esi-ajax-42-0","/_esi/ajax?`)
+	assert.NotContains(t, string(dt.Data), "micro.service", "Internal address must not leak")
+	m := ajaxURLRegex.FindSubmatch(dt.Data)
+	require.Len(t, m, 2, "%s", dt.Data)
+	ajaxURL := strings.NewReplacer(`\u0026`, "&", `\u003D`, "=").Replace(string(m[1]))
+
+	serve := func(method, target string) (*httptest.ResponseRecorder, int, error) {
+		rec := httptest.NewRecorder()
+		code, err := mw.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec, code, err
+	}
+
+	t.Run("signed URL returns the content", func(t *testing.T) {
+		atomic.StoreInt32(&failing, 0)
+		defer atomic.StoreInt32(&failing, 1)
+
+		rec, code, err := serve("GET", ajaxURL)
+		require.NoError(t, err)
+		assert.Exactly(t, http.StatusOK, code)
+		assert.Contains(t, rec.Body.String(), "AjaxService")
+		assert.Exactly(t, "private, no-store", rec.Header().Get("Cache-Control"))
+	})
+
+	t.Run("resources still failing", func(t *testing.T) {
+		_, code, err := serve("GET", ajaxURL)
+		assert.Exactly(t, http.StatusBadGateway, code)
+		assert.True(t, errors.Temporary.Match(err), "%+v", err)
+	})
+
+	t.Run("tampered signature", func(t *testing.T) {
+		_, code, err := serve("GET", strings.Replace(ajaxURL, "i=0", "i=1", 1))
+		assert.NoError(t, err)
+		assert.Exactly(t, http.StatusForbidden, code)
+	})
+
+	t.Run("expired URL", func(t *testing.T) {
+		_, code, err := serve("GET", pc.ajaxURL(42, 0, "/page.html", time.Now().Add(-time.Hour)))
+		assert.NoError(t, err)
+		assert.Exactly(t, http.StatusForbidden, code)
+	})
+
+	t.Run("unknown page", func(t *testing.T) {
+		_, code, err := serve("GET", pc.ajaxURL(4711, 0, "/page.html", time.Now()))
+		assert.NoError(t, err)
+		assert.Exactly(t, http.StatusNotFound, code)
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		_, code, err := serve("POST", ajaxURL)
+		assert.NoError(t, err)
+		assert.Exactly(t, http.StatusMethodNotAllowed, code)
+	})
+}
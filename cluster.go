@@ -0,0 +1,95 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package caddyesi
+
+import (
+	"strings"
+
+	"github.com/corestoreio/caddy-esi/esibus"
+	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log"
+)
+
+// publishCommand sends an executed command to all other nodes of the cluster.
+// A failure gets only logged because the command has already been executed
+// on this node.
+func (pc *PathConfig) publishCommand(cmd []string) {
+	if pc.clusterBus == nil {
+		return
+	}
+	err := pc.clusterBus.Publish(esibus.Message{
+		NodeID:  esibus.NodeID,
+		Scope:   pc.Scope,
+		Command: strings.Join(cmd, " "),
+	})
+	if err != nil && pc.Log.IsInfo() {
+		pc.Log.Info("caddyesi.PathConfig.publishCommand.Error", log.Err(err), log.String("path_scope", pc.Scope), log.String("command", strings.Join(cmd, " ")))
+	}
+}
+
+// receiveCommand executes a command published by another node. Own messages
+// and messages for other path scopes get ignored. A reconnect of the bus gets
+// logged because the commands of the other nodes in between are lost.
+func (pc *PathConfig) receiveCommand(m esibus.Message) {
+	if m.NodeID == esibus.NodeID && m.Command == esibus.CommandReconnected {
+		if pc.Log.IsInfo() {
+			pc.Log.Info("caddyesi.PathConfig.receiveCommand.Reconnected", log.String("path_scope", pc.Scope),
+				log.String("warning", "Commands of other nodes, like a purge, might have been missed. Cached fragments might be stale."))
+		}
+		return
+	}
+	if m.NodeID == esibus.NodeID || m.Scope != pc.Scope {
+		return
+	}
+	cmd := strings.Fields(m.Command)
+	if len(cmd) == 0 {
+		return
+	}
+	res, err := pc.executeCommand(cmd)
+	if err != nil && pc.Log.IsInfo() {
+		pc.Log.Info("caddyesi.PathConfig.receiveCommand.Error", log.Err(err), log.String("path_scope", pc.Scope), log.String("node_id", m.NodeID), log.String("command", m.Command))
+	}
+	if err == nil && pc.Log.IsDebug() {
+		pc.Log.Debug("caddyesi.PathConfig.receiveCommand", log.String("path_scope", pc.Scope), log.String("node_id", m.NodeID), log.String("command", m.Command), log.String("result", res))
+	}
+}
+
+// startClusterBus subscribes each PathConfig to its cluster bus.
+func (mw *Middleware) startClusterBus() error {
+	for _, pc := range mw.PathConfigs {
+		if pc.clusterBus == nil {
+			continue
+		}
+		if err := pc.clusterBus.Subscribe(pc.receiveCommand); err != nil {
+			return errors.Wrapf(err, "[caddyesi] Failed to subscribe to the cluster bus of scope %q", pc.Scope)
+		}
+	}
+	return nil
+}
+
+// closeClusterBus closes the cluster buses. Can be called multiple times. The
+// field clusterBus stays set because a concurrent request might publish a
+// command, which then fails with a closed bus.
+func (mw *Middleware) closeClusterBus() error {
+	for _, pc := range mw.PathConfigs {
+		if pc.clusterBus == nil {
+			continue
+		}
+		if err := pc.clusterBus.Close(); err != nil {
+			return errors.Wrapf(err, "[caddyesi] Failed to close the cluster bus of scope %q", pc.Scope)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package caddyesi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/corestoreio/caddy-esi/esibus"
+	"github.com/corestoreio/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ esibus.Bus = (*mockBus)(nil)
+
+type mockBus struct {
+	mu        sync.Mutex
+	published []esibus.Message
+	fn        func(esibus.Message)
+	closed    bool
+}
+
+func (mb *mockBus) Publish(m esibus.Message) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.published = append(mb.published, m)
+	return nil
+}
+
+func (mb *mockBus) Subscribe(fn func(esibus.Message)) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.fn = fn
+	return nil
+}
+
+func (mb *mockBus) Close() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.closed = true
+	return nil
+}
+
+func TestPathConfig_ClusterBus(t *testing.T) {
+	t.Parallel()
+
+	newPC := func(mb *mockBus) *PathConfig {
+		pc := NewPathConfig()
+		pc.Scope = "/cluster"
+		pc.CmdHeaderName = "X-Esi-Cmd"
+		pc.Log = log.BlackHole{}
+		if mb != nil {
+			pc.clusterBus = mb
+		}
+		pc.esiCache[1] = nil
+		return pc
+	}
+
+	t.Run("header command gets published", func(t *testing.T) {
+		mb := new(mockBus)
+		pc := newPC(mb)
+
+		req := httptest.NewRequest("GET", "/cluster/page.html", nil)
+		req.Header.Set("X-Esi-Cmd", "purge-keys product-42  cart")
+		rec := httptest.NewRecorder()
+		require.NoError(t, handleHeaderCommands(pc, rec, req))
+
+		assert.Exactly(t, "purge-keys-ok-0", rec.Header().Get("X-Esi-Cmd"))
+		require.Len(t, mb.published, 1)
+		assert.Exactly(t, esibus.Message{
+			NodeID:  esibus.NodeID,
+			Scope:   "/cluster",
+			Command: "purge-keys product-42 cart",
+		}, mb.published[0])
+	})
+
+	t.Run("unknown command not published", func(t *testing.T) {
+		mb := new(mockBus)
+		pc := newPC(mb)
+
+		req := httptest.NewRequest("GET", "/cluster/page.html", nil)
+		req.Header.Set("X-Esi-Cmd", "reboot")
+		rec := httptest.NewRecorder()
+		require.NoError(t, handleHeaderCommands(pc, rec, req))
+		assert.Empty(t, rec.Header().Get("X-Esi-Cmd"))
+		assert.Empty(t, mb.published)
+	})
+
+	t.Run("stats command not published", func(t *testing.T) {
+		mb := new(mockBus)
+		pc := newPC(mb)
+
+		req := httptest.NewRequest("GET", "/cluster/page.html", nil)
+		req.Header.Set("X-Esi-Cmd", "stats")
+		rec := httptest.NewRecorder()
+		require.NoError(t, handleHeaderCommands(pc, rec, req))
+		assert.Exactly(t, "stats-ok-0", rec.Header().Get("X-Esi-Cmd"))
+		assert.Empty(t, mb.published)
+	})
+
+	t.Run("received command gets executed", func(t *testing.T) {
+		mb := new(mockBus)
+		pc := newPC(mb)
+		mw := &Middleware{PathConfigs: PathConfigs{pc}}
+		require.NoError(t, mw.startClusterBus())
+		require.NotNil(t, mb.fn)
+
+		// own echo and other scopes get ignored
+		mb.fn(esibus.Message{NodeID: esibus.NodeID, Scope: "/cluster", Command: "purge"})
+		mb.fn(esibus.Message{NodeID: "node2", Scope: "/other", Command: "purge"})
+		assert.Len(t, pc.esiCache, 1)
+
+		// a reconnect gets only logged
+		pc.esiCache[2] = nil
+		mb.fn(esibus.Message{NodeID: esibus.NodeID, Command: esibus.CommandReconnected})
+		assert.Len(t, pc.esiCache, 2)
+
+		mb.fn(esibus.Message{NodeID: "node2", Scope: "/cluster", Command: "purge"})
+		assert.Len(t, pc.esiCache, 0)
+		assert.Empty(t, mb.published, "received commands must not be published again")
+
+		require.NoError(t, mw.closeClusterBus())
+		assert.True(t, mb.closed)
+		require.NoError(t, mw.closeClusterBus())
+	})
+
+	t.Run("close while publishing", func(t *testing.T) {
+		mb := new(mockBus)
+		pc := newPC(mb)
+		mw := &Middleware{PathConfigs: PathConfigs{pc}}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					pc.publishCommand([]string{"purge"})
+				}
+			}()
+		}
+		require.NoError(t, mw.closeClusterBus())
+		wg.Wait()
+		assert.True(t, mb.closed)
+	})
+
+	t.Run("without bus", func(t *testing.T) {
+		pc := newPC(nil)
+		req := httptest.NewRequest("GET", "/cluster/page.html", nil)
+		req.Header.Set("X-Esi-Cmd", "purge")
+		rec := httptest.NewRecorder()
+		require.NoError(t, handleHeaderCommands(pc, rec, req))
+		assert.Exactly(t, "purge-ok-1", rec.Header().Get("X-Esi-Cmd"))
+		assert.Exactly(t, http.StatusOK, rec.Code)
+	})
+}
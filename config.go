@@ -18,13 +18,18 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/corestoreio/caddy-esi/bufpool"
+	"github.com/corestoreio/caddy-esi/esibus"
+	"github.com/corestoreio/caddy-esi/esicache"
 	"github.com/corestoreio/caddy-esi/esitag"
 	"github.com/corestoreio/caddy-esi/helper"
 	"github.com/corestoreio/errors"
@@ -86,10 +91,54 @@ type PathConfig struct {
 	// zero, caching globally disabled until an Tag tag or this configuration
 	// value contains the TTL attribute.
 	TTL time.Duration
+	// NegativeTTL global time how long a failure of all resources of an ESI
+	// tag gets cached. Defaults to zero, negative caching disabled.
+	NegativeTTL time.Duration
+	// RefreshAhead global time before the TTL expires within which a
+	// requested fragment gets refreshed in the background.
+	RefreshAhead time.Duration
+	// Warmup enables the prefetching of the fragments of the known pages and
+	// of the WarmupURLs once after the start and then every WarmupInterval.
+	// The known pages are the pages already parsed for ESI tags.
+	Warmup bool
+	// WarmupInterval zero warms the caches only once after the start.
+	WarmupInterval time.Duration
+	// WarmupURLs full URLs of pages to request during the warm-up.
+	WarmupURLs []string
+	// Streaming sends the page with chunked encoding: the page gets written
+	// up to the next tag and waits only for the data of that tag. The
+	// Content-Length gets removed and the headers returned by the resources
+	// do not get merged.
+	Streaming bool
+	// HTTPCache enables for all ESI tags the HTTP cache mode: without a TTL
+	// the headers Cache-Control and Expires of the HTTP resources define how
+	// long a fragment stays in the cache and stale fragments get revalidated.
+	HTTPCache bool
+	// MaxDepth defines how many levels of ESI tags in fragments returned by
+	// the resources get processed. Defaults to zero, processing of nested tags
+	// disabled.
+	MaxDepth int
+	// ParseLenient if true, malformed ESI tags get skipped and logged instead
+	// of failing the whole page with a 500 status code.
+	ParseLenient bool
+	// Syntax enables the accepted tag syntaxes for this path: ESI tags, HTML
+	// custom elements and/or SSI includes. Zero defaults to ESI tags.
+	Syntax esitag.Syntax
+	// SSIUpstream base URL like http://127.0.0.1:8080 from which the virtual
+	// paths of SSI includes get requested. Defaults to the site address. The
+	// Host header of the request never gets used because the client controls
+	// it.
+	SSIUpstream string
+	// siteAddress the configured address of the site like
+	// https://example.com:443, set during the setup.
+	siteAddress string
 	// CmdHeaderName if set allows to execute certain maintenance functions to
 	// e.g. purge the cache. For security reasons an empty string means, feature
 	// has been disabled.
 	CmdHeaderName string
+	// clusterBus if set, publishes the commands of the CmdHeaderName to all
+	// other nodes of the cluster and executes their commands.
+	clusterBus esibus.Bus
 
 	// PageIDSource defines a slice of possible parameters which gets extracted
 	// from the http.Request object. All these parameters will be used to
@@ -98,8 +147,35 @@ type PathConfig struct {
 	PageIDSource []string
 	// AllowedMethods list of all benchIsResponseAllowed methods, defaults to GET
 	AllowedMethods []string
+	// Except contains path prefixes or glob patterns of requests which never
+	// get processed.
+	Except []string
+	// ContentTypes media types of the responses which get processed, matched
+	// against the Content-Type header of the next handler. A type can end with
+	// a wildcard like "text/*". If empty, the content type gets detected from
+	// the first bytes of the page and only text gets processed.
+	ContentTypes []string
+	// StatusCodes of the responses which get processed. If empty, responses
+	// with any status code get processed.
+	StatusCodes []int
+	// MaxPageSize responses larger than this size in bytes get passed through
+	// unprocessed. Zero disables the limit.
+	MaxPageSize uint64
 	// OnError gets output when a request to a backend service fails.
 	OnError []byte
+	// AjaxPath URL path under which the middleware serves the content of the
+	// tags with onerror="ajax". Must be within the Scope. Defaults to the
+	// Scope plus "_esi/ajax".
+	AjaxPath string
+	// AjaxTTL defines how long the signed URL of an AJAX placeholder stays
+	// valid. Defaults to DefaultAjaxTTL.
+	AjaxTTL time.Duration
+	// AjaxLoader JavaScript function which gets called with the ID of the
+	// placeholder element and the signed URL. Defaults to DefaultAjaxLoader.
+	AjaxLoader string
+	// ajaxSecret key to sign the AJAX URLs. Random per process if not set via
+	// ajax_secret. All nodes of a cluster must share the same secret.
+	ajaxSecret []byte
 	// LogFile where to write the log output? Either any file name or stderr or
 	// stdout. If empty logging disabled.
 	LogFile string
@@ -116,6 +192,8 @@ type PathConfig struct {
 	// gets filled fast without dropping old entries. This will blow up the
 	// memory.
 	esiCache map[uint64]esitag.Entities // TODO after refacotring other stuff replace with EntitiesMap but run before benchmarks and after ;-)
+	// esiPages contains the URL of each page in esiCache for the warm-up.
+	esiPages map[uint64]string
 }
 
 // NewPathConfig creates a configuration for a unique path prefix and
@@ -124,6 +202,7 @@ func NewPathConfig() *PathConfig {
 	return &PathConfig{
 		Timeout:  DefaultTimeOut,
 		esiCache: make(map[uint64]esitag.Entities),
+		esiPages: make(map[uint64]string),
 	}
 }
 
@@ -162,24 +241,37 @@ func (pc *PathConfig) ESITagsByRequest(r *http.Request) (pageID uint64, t esitag
 // happens in a locked environment. So there should be no race condition.
 func (pc *PathConfig) UpsertESITags(pageID uint64, entities esitag.Entities) {
 
-	for _, et := range entities {
+	// Walk includes the entities nested in block tags like esi:choose. The
+	// position in the walk identifies a tag in the AJAX URL.
+	idx := 0
+	entities.Walk(func(et *esitag.Entity) {
 
 		et.Log = pc.Log
 
 		if len(et.OnError) == 0 {
 			et.OnError = pc.OnError
 		}
+		if et.OnErrorAjax {
+			et.AjaxPlaceholder = pc.ajaxPlaceholder(pageID, idx)
+		}
+		idx++
 		// add here the KVFetcher ...
 
 		// create sync.pool of arguments for the resources. Now with all correct
 		// default values.
 		et.SetDefaultConfig(esitag.Config{
-			Log:         pc.Log,
-			MaxBodySize: pc.MaxBodySize,
-			Timeout:     pc.Timeout,
-			TTL:         pc.TTL,
+			Log:          pc.Log,
+			MaxBodySize:  pc.MaxBodySize,
+			Timeout:      pc.Timeout,
+			TTL:          pc.TTL,
+			Cache:        esicache.MainRegistry.Get(pc.Scope),
+			CacheScope:   pc.Scope,
+			HTTPCache:    pc.HTTPCache,
+			NegativeTTL:  pc.NegativeTTL,
+			RefreshAhead: pc.RefreshAhead,
+			MaxDepth:     pc.MaxDepth,
 		})
-	}
+	})
 
 	pc.esiMU.Lock()
 	pc.esiCache[pageID] = entities
@@ -293,6 +385,7 @@ func (pc *PathConfig) purgeESICache() (itemsInMap int) {
 	pc.esiMU.Lock()
 	itemsInMap = len(pc.esiCache)
 	pc.esiCache = make(map[uint64]esitag.Entities)
+	pc.esiPages = make(map[uint64]string)
 	pc.esiMU.Unlock()
 	if pc.Log.IsDebug() {
 		pc.Log.Debug("caddyesi.PathConfig.purgeESICache", log.String("path_scope", pc.Scope))
@@ -300,6 +393,90 @@ func (pc *PathConfig) purgeESICache() (itemsInMap int) {
 	return
 }
 
+// ssiUpstream returns the base URL for the virtual paths of SSI includes.
+func (pc *PathConfig) ssiUpstream() string {
+	if pc.SSIUpstream != "" {
+		return pc.SSIUpstream
+	}
+	return pc.siteAddress
+}
+
+// IsPathExcluded returns true if the path matches one of the Except
+// patterns. A pattern with the characters *, ? or [ gets matched with
+// path.Match, otherwise as a path prefix.
+func (pc *PathConfig) IsPathExcluded(urlPath string) bool {
+	for _, e := range pc.Except {
+		if strings.ContainsAny(e, "*?[") {
+			if ok, _ := path.Match(e, urlPath); ok {
+				return true
+			}
+			continue
+		}
+		if httpserver.Path(urlPath).Matches(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHeaderAllowed decides with the status code and the header written by the
+// next handler, if a response gets processed. Gets evaluated before the page
+// gets buffered. A nil PathConfig allows all responses.
+func (pc *PathConfig) isHeaderAllowed(code int, h http.Header) bool {
+	if pc == nil {
+		return true
+	}
+	if code == 0 {
+		code = http.StatusOK
+	}
+	if len(pc.StatusCodes) > 0 {
+		allowed := false
+		for _, c := range pc.StatusCodes {
+			if c == code {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if pc.MaxPageSize > 0 {
+		if cl, err := strconv.ParseUint(h.Get("Content-Length"), 10, 64); err == nil && cl > pc.MaxPageSize {
+			return false
+		}
+	}
+	if len(pc.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, ct := range pc.ContentTypes {
+		if ct == mediaType || ct == "*/*" ||
+			(strings.HasSuffix(ct, "/*") && strings.HasPrefix(mediaType, ct[:len(ct)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// isContentAllowed detects the content type of the page only if no
+// ContentTypes have been configured, otherwise the Content-Type header has
+// already been checked by isHeaderAllowed.
+func (pc *PathConfig) isContentAllowed(buf []byte) bool {
+	if pc != nil && len(pc.ContentTypes) > 0 {
+		return true
+	}
+	return isResponseAllowed(buf)
+}
+
+// isPageTooLarge returns true if the page exceeds the MaxPageSize.
+func (pc *PathConfig) isPageTooLarge(size int) bool {
+	return pc != nil && pc.MaxPageSize > 0 && uint64(size) > pc.MaxPageSize
+}
+
 // isResponseAllowed uses https://golang.org/pkg/net/http/#DetectContentType
 // it must read at least 512 bytes.
 func isResponseAllowed(buf []byte) bool {
@@ -247,6 +247,53 @@ func TestPathConfig_isRequestAllowed(t *testing.T) {
 	))
 }
 
+func TestPathConfig_IsPathExcluded(t *testing.T) {
+	t.Parallel()
+
+	pc := NewPathConfig()
+	pc.Except = []string{"/api", "/static/*.html", "*.json"}
+
+	assert.True(t, pc.IsPathExcluded("/api"))
+	assert.True(t, pc.IsPathExcluded("/api/products"))
+	assert.True(t, pc.IsPathExcluded("/static/page.html"))
+	assert.False(t, pc.IsPathExcluded("/static/sub/page.html"))
+	assert.False(t, pc.IsPathExcluded("/feed.json"), "* does not match the slash")
+	assert.False(t, pc.IsPathExcluded("/catalog/page.html"))
+	assert.False(t, NewPathConfig().IsPathExcluded("/api"))
+}
+
+func TestPathConfig_isHeaderAllowed(t *testing.T) {
+	t.Parallel()
+
+	runner := func(pc *PathConfig, code int, contentType, contentLength string, want bool) func(*testing.T) {
+		return func(t *testing.T) {
+			t.Parallel()
+			h := http.Header{}
+			if contentType != "" {
+				h.Set("Content-Type", contentType)
+			}
+			if contentLength != "" {
+				h.Set("Content-Length", contentLength)
+			}
+			assert.Exactly(t, want, pc.isHeaderAllowed(code, h))
+		}
+	}
+	filtered := &PathConfig{
+		ContentTypes: []string{"text/html", "application/xhtml+xml", "application/*"},
+		StatusCodes:  []int{200, 404},
+		MaxPageSize:  100,
+	}
+	t.Run("nil PathConfig allows all", runner(nil, 500, "", "", true))
+	t.Run("no filter allows all", runner(NewPathConfig(), 500, "image/png", "100000", true))
+	t.Run("HTML with parameter", runner(filtered, 200, "text/html; charset=utf-8", "100", true))
+	t.Run("XHTML not found", runner(filtered, 404, "application/xhtml+xml", "", true))
+	t.Run("JSON via wildcard", runner(filtered, 0, "application/json", "", true))
+	t.Run("status code not allowed", runner(filtered, 500, "text/html", "", false))
+	t.Run("content type not allowed", runner(filtered, 200, "text/plain", "", false))
+	t.Run("content type missing", runner(filtered, 200, "", "", false))
+	t.Run("page too large", runner(filtered, 200, "text/html", "101", false))
+}
+
 func TestPathConfigs_ConfigForPath(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,123 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+// Package esibus distributes the maintenance commands, like purging the
+// caches, to all Caddy nodes of a cluster.
+package esibus
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/corestoreio/errors"
+)
+
+// Message contains a command published to all nodes of the cluster. A node
+// ignores its own messages by comparing the NodeID.
+type Message struct {
+	NodeID string `json:"node_id"`
+	// Scope the path prefix of the esi directive in the Caddyfile.
+	Scope string `json:"scope"`
+	// Command same format as the value of the command header, e.g.
+	// "purge-keys product-42 cart".
+	Command string `json:"command"`
+}
+
+// Encode encodes the message for the transport.
+func (m Message) Encode() ([]byte, error) {
+	data, err := json.Marshal(m)
+	return data, errors.Wrap(err, "[esibus] Message.Encode")
+}
+
+// DecodeMessage decodes the message received from the transport.
+func DecodeMessage(data []byte) (Message, error) {
+	var m Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Message{}, errors.NotValid.New(err, "[esibus] DecodeMessage: Invalid message %q", data)
+	}
+	return m, nil
+}
+
+// CommandReconnected gets received from the own NodeID after a Bus has
+// established a lost connection again. The messages published in between,
+// e.g. a purge, are lost.
+const CommandReconnected = "reconnected"
+
+// Bus publishes messages to all subscribed nodes, including the publishing
+// node itself. A Bus must be thread safe.
+type Bus interface {
+	Publish(m Message) error
+	// Subscribe calls fn in a background goroutine for each received message
+	// until the Bus gets closed. Subscribe can be called only once.
+	Subscribe(fn func(Message)) error
+	// Close can be called multiple times.
+	io.Closer
+}
+
+// FactoryFunc creates a new Bus from the provided URL.
+type FactoryFunc func(url string) (Bus, error)
+
+var factories = struct {
+	sync.RWMutex
+	factories map[string]FactoryFunc
+}{
+	factories: make(map[string]FactoryFunc),
+}
+
+// RegisterFactory registers a new factory function to create a new Bus for the
+// given URL scheme. The package backend registers for example the scheme
+// redis, depending on the build tags.
+func RegisterFactory(scheme string, f FactoryFunc) {
+	factories.Lock()
+	factories.factories[scheme] = f
+	factories.Unlock()
+}
+
+// New creates a new Bus as defined by its URL. The scheme of the URL selects
+// the registered factory function, e.g.:
+//		redis://localhost:6379/?channel=caddyesi
+func New(url string) (Bus, error) {
+	var scheme string
+	if idx := strings.Index(url, "://"); idx > 0 {
+		scheme = url[:idx]
+	}
+
+	factories.RLock()
+	f, ok := factories.factories[scheme]
+	factories.RUnlock()
+	if !ok {
+		return nil, errors.NotSupported.Newf("[esibus] Scheme %q not supported in factory registry. URL: %q", scheme, url)
+	}
+	b, err := f(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "[esibus] Failed to create new Bus object: %q", url)
+	}
+	return b, nil
+}
+
+// NodeID identifies this process in the cluster. It consists of the host name
+// and a random part, so multiple processes on the same host differ.
+var NodeID = newNodeID()
+
+func newNodeID() string {
+	host, _ := os.Hostname()
+	var buf [6]byte
+	_, _ = rand.Read(buf[:])
+	return host + "-" + hex.EncodeToString(buf[:])
+}
@@ -15,7 +15,9 @@
 package esicache
 
 import (
-	"context"
+	"io"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,31 +27,195 @@ import (
 // Cacher used to cache the response of a micro service as found in the src
 // attribute of an ESI tag. But the Cacher gets only involved if the additional
 // attribute ttl has been set for each ESI tag. A Cacher must be thread safe.
+// Get must return an error with behaviour NotFound if the key does not exists
+// or has been expired.
 type Cacher interface {
 	Set(key string, value []byte, expiration time.Duration) error
 	Get(key string) ([]byte, error)
 }
 
+// TTLGetter gets implemented by a Cacher which knows the remaining time to live
+// of a value. GetTTL returns the value and its remaining time to live. A zero
+// TTL means the value never expires. Caches uses the TTL to back-fill the upper
+// tiers. The same error rules as for Cacher.Get apply.
+type TTLGetter interface {
+	GetTTL(key string) ([]byte, time.Duration, error)
+}
+
+// ttlUnknown gets returned by getTTL if the Cacher does not implement the
+// TTLGetter interface.
+const ttlUnknown time.Duration = -1
+
+func getTTL(c Cacher, key string) ([]byte, time.Duration, error) {
+	if tg, ok := c.(TTLGetter); ok {
+		return tg.GetTTL(key)
+	}
+	v, err := c.Get(key)
+	return v, ttlUnknown, err
+}
+
+// PinnedSetter gets implemented by a Cacher which evicts values when its size
+// limit has been reached. A pinned value does not get evicted by the LRU, it
+// gets only removed when it expires, gets overwritten or when the pinned values
+// exceed half of the size limit, the oldest first. Used for the small values
+// which must not get lost, like the purge markers of the surrogate keys.
+type PinnedSetter interface {
+	SetPinned(key string, value []byte, expiration time.Duration) error
+}
+
+// pinnedMaxSize returns how many bytes of a Cacher with the maximum size can be
+// used by pinned values. A Cacher drops then the oldest pinned values, so that
+// many pinned values cannot take the space of the evictable values.
+func pinnedMaxSize(maxSize uint64) uint64 {
+	return maxSize / 2
+}
+
+// SetPinned stores the value pinned if the Cacher implements the PinnedSetter
+// interface, otherwise with a normal Set.
+func SetPinned(c Cacher, key string, value []byte, expiration time.Duration) error {
+	if ps, ok := c.(PinnedSetter); ok {
+		return ps.SetPinned(key, value, expiration)
+	}
+	return c.Set(key, value, expiration)
+}
+
+// CacherFactoryFunc creates a new Cacher from the provided URL.
+type CacherFactoryFunc func(url string) (Cacher, error)
+
+var factoryCachers = struct {
+	sync.RWMutex
+	factories map[string]CacherFactoryFunc
+}{
+	factories: map[string]CacherFactoryFunc{
+		"inmemory": NewInMemory,
+		"file":     NewOnDisk,
+	},
+}
+
+// RegisterCacherFactory registers a new factory function to create a new Cacher
+// for the given URL scheme. The package backend registers for example the
+// schemes redis and memcache, depending on the build tags.
+func RegisterCacherFactory(scheme string, f CacherFactoryFunc) {
+	factoryCachers.Lock()
+	factoryCachers.factories[scheme] = f
+	factoryCachers.Unlock()
+}
+
 // NewCacher creates a new cache service object and its connection as defined by
-// its URL.
+// its URL. The scheme of the URL selects the registered factory function. An
+// URL without :// gets treated as a scheme, e.g.:
+//		redis://localhost:6379/?db=3
+//		memcache://localhost:11211
+//		inmemory
+//		inmemory?max_size=128MB
+//		file:///var/cache/caddy-esi?max_size=2GB
 func NewCacher(url string) (Cacher, error) {
+	scheme := url
+	if idx := strings.Index(url, "://"); idx >= 0 {
+		scheme = url[:idx]
+	} else if idx := strings.IndexByte(url, '?'); idx >= 0 {
+		scheme = url[:idx]
+	}
+
+	factoryCachers.RLock()
+	f, ok := factoryCachers.factories[scheme]
+	factoryCachers.RUnlock()
+	if !ok || scheme == "" {
+		return nil, errors.NotSupported.Newf("[esicache] Scheme %q not supported in factory registry. URL: %q", scheme, url)
+	}
 
-	return nil, nil
+	c, err := f(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "[esicache] Failed to create new Cacher object: %q", url)
+	}
+	return c, nil
 }
 
-// Caches gets set during config reading and implements Cacher interface
+// Caches gets set during config reading and implements Cacher interface. Each
+// Cacher represents a tier in the order of the cache directives in the
+// Caddyfile. The first tier, L1, should be the fastest one, e.g. inmemory,
+// followed by L2 tiers like Redis or Memcache.
 type Caches []Cacher
 
-// Set writes to the cache service
+// Set writes to all tiers. A tier wrapped with NewWriteBehind returns
+// immediately and writes in the background. It returns the collected errors of
+// all failed writes.
 func (c Caches) Set(key string, value []byte, expiration time.Duration) error {
-	// write to all
+	var mErr *errors.MultiErr
+	for _, cc := range c {
+		if err := cc.Set(key, value, expiration); err != nil {
+			mErr = mErr.AppendErrors(err)
+		}
+	}
+	if mErr != nil {
+		return errors.Wrapf(mErr, "[esicache] Caches.Set failed for key %q", key)
+	}
+	return nil
+}
+
+// SetPinned same as Set but pins the value in all tiers which implement the
+// PinnedSetter interface. A back-fill of a pinned value into an upper tier
+// does not pin it there, but the lower tier still has it.
+func (c Caches) SetPinned(key string, value []byte, expiration time.Duration) error {
+	var mErr *errors.MultiErr
+	for _, cc := range c {
+		if err := SetPinned(cc, key, value, expiration); err != nil {
+			mErr = mErr.AppendErrors(err)
+		}
+	}
+	if mErr != nil {
+		return errors.Wrapf(mErr, "[esicache] Caches.SetPinned failed for key %q", key)
+	}
 	return nil
 }
 
-// Get fetches from the cache service
+// Get same as GetTTL but without the remaining time to live.
 func (c Caches) Get(key string) ([]byte, error) {
-	// race condition which cache returns first
-	return nil, nil
+	v, _, err := c.GetTTL(key)
+	return v, err
+}
+
+// GetTTL reads the tiers in their order: L1, L2, ... The first hit wins and
+// back-fills all tiers above it with the remaining time to live of the value. A
+// tier without the TTLGetter interface does not back-fill. A failing tier gets
+// treated as a miss, so the next tier gets asked. The returned TTL is negative
+// if the tier does not know the TTL. Returns a NotFound error if no
+// tier contains the key. If a tier fails and no other has the key, its error
+// gets returned.
+func (c Caches) GetTTL(key string) ([]byte, time.Duration, error) {
+	var lastErr error
+	for i, cc := range c {
+		v, ttl, err := getTTL(cc, key)
+		switch {
+		case err == nil:
+			if ttl >= 0 {
+				// A failing upper tier must not break the read, the next
+				// Set will try again.
+				_ = c[:i].Set(key, v, ttl)
+			}
+			return v, ttl, nil
+		case !errors.NotFound.Match(err):
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return nil, 0, errors.Wrapf(lastErr, "[esicache] Caches.Get failed for key %q", key)
+	}
+	return nil, 0, errors.NotFound.Newf("[esicache] Caches.Get key %q not found", key)
+}
+
+// Close closes all tiers which implement the io.Closer interface and returns
+// the first error.
+func (c Caches) Close() error {
+	var firstErr error
+	for _, cc := range c {
+		if cl, ok := cc.(io.Closer); ok {
+			if err := cl.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return errors.Wrap(firstErr, "[esicache] Caches.Close")
 }
 
 // MainRegistry global cache registry
@@ -64,14 +230,22 @@ type registry struct {
 	caches map[string]Caches
 }
 
-func (r *registry) Get(ctx context.Context, scope, alias, key string) error {
-	return errors.New("TODO IMPLEMENT")
+// Get returns the caches of a scope. Returns nil if no caches have been
+// registered for the scope.
+func (r *registry) Get(scope string) Cacher {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if c := r.caches[scope]; len(c) > 0 {
+		return c
+	}
+	return nil
 }
 
-// Register registers a new key-value service. Scope refers to the URL provided
-// in the Caddyfile after the `esi` keyword. URL represents the destination to
-// Redis or Memcache etc
-func (r *registry) Register(scope, url string) error {
+// Register registers a new key-value service as the next tier. Scope refers to
+// the URL provided in the Caddyfile after the `esi` keyword. URL represents the
+// destination to Redis or Memcache etc. If writeBehind is true, writes to this
+// tier happen in the background.
+func (r *registry) Register(scope, url string, writeBehind bool) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -79,6 +253,9 @@ func (r *registry) Register(scope, url string) error {
 	if err != nil {
 		return errors.Wrapf(err, "[esikv] NewCacher URL %q", url)
 	}
+	if writeBehind {
+		c = NewWriteBehind(c, WriteBehindQueueSize)
+	}
 
 	if _, ok := r.caches[scope]; !ok {
 		r.caches[scope] = make(Caches, 0, 2)
@@ -88,6 +265,18 @@ func (r *registry) Register(scope, url string) error {
 	return nil
 }
 
+// Scopes returns the sorted scopes which have registered caches.
+func (r *registry) Scopes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	scopes := make([]string, 0, len(r.caches))
+	for scope := range r.caches {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
 // Len returns number of registered caches.
 func (r *registry) Len(scope string) int {
 	r.mu.RLock()
@@ -95,9 +284,17 @@ func (r *registry) Len(scope string) int {
 	return len(r.caches[scope])
 }
 
-// Clear removes all cache service objects
-func (r *registry) Clear() {
+// Clear closes and removes all cache service objects. Returns the first error
+// of a failed Close.
+func (r *registry) Clear() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	var firstErr error
+	for scope, c := range r.caches {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "[esicache] Failed to close caches of scope %q", scope)
+		}
+	}
 	r.caches = make(map[string]Caches)
+	return firstErr
 }
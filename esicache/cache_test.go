@@ -14,12 +14,246 @@
 
 package esicache
 
-import "testing"
+import (
+	"testing"
+	"time"
+
+	"github.com/corestoreio/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type cacherMock struct {
+	SetFn func(key string, value []byte, expiration time.Duration) error
+	GetFn func(key string) ([]byte, error)
+}
+
+func (cm cacherMock) Set(key string, value []byte, expiration time.Duration) error {
+	return cm.SetFn(key, value, expiration)
+}
+
+func (cm cacherMock) Get(key string) ([]byte, error) {
+	return cm.GetFn(key)
+}
 
 func TestNewCacher(t *testing.T) {
-	t.Skip("TODO")
+
+	t.Run("inmemory", func(t *testing.T) {
+		c, err := NewCacher("inmemory")
+		require.NoError(t, err)
+		assert.IsType(t, &InMemory{}, c)
+	})
+	t.Run("inmemory with parameters", func(t *testing.T) {
+		c, err := NewCacher("inmemory?max_size=1KiB")
+		require.NoError(t, err)
+		assert.Exactly(t, uint64(1024), c.(*InMemory).Stats().MaxSize)
+	})
+	t.Run("scheme not supported", func(t *testing.T) {
+		c, err := NewCacher("mysql://localhost")
+		assert.Nil(t, c)
+		assert.True(t, errors.NotSupported.Match(err), "%+v", err)
+	})
+	t.Run("empty URL", func(t *testing.T) {
+		c, err := NewCacher("")
+		assert.Nil(t, c)
+		assert.True(t, errors.NotSupported.Match(err), "%+v", err)
+	})
+	t.Run("registered factory", func(t *testing.T) {
+		var haveURL string
+		RegisterCacherFactory("testfactory", func(url string) (Cacher, error) {
+			haveURL = url
+			return NewInMemory(url)
+		})
+		c, err := NewCacher("testfactory://localhost:1234")
+		require.NoError(t, err)
+		assert.NotNil(t, c)
+		assert.Exactly(t, "testfactory://localhost:1234", haveURL)
+	})
+	t.Run("factory error", func(t *testing.T) {
+		RegisterCacherFactory("testfail", func(url string) (Cacher, error) {
+			return nil, errors.ConnectionFailed.Newf("Ups")
+		})
+		c, err := NewCacher("testfail://localhost:1234")
+		assert.Nil(t, c)
+		assert.True(t, errors.ConnectionFailed.Match(err), "%+v", err)
+	})
+}
+
+func TestCaches(t *testing.T) {
+
+	notFound := cacherMock{
+		SetFn: func(string, []byte, time.Duration) error { return nil },
+		GetFn: func(key string) ([]byte, error) { return nil, errors.NotFound.Newf("Key %q not found", key) },
+	}
+	failing := cacherMock{
+		SetFn: func(string, []byte, time.Duration) error { return errors.ConnectionFailed.Newf("Set down") },
+		GetFn: func(string) ([]byte, error) { return nil, errors.ConnectionFailed.Newf("Get down") },
+	}
+	var setCalls int
+	found := cacherMock{
+		SetFn: func(string, []byte, time.Duration) error { setCalls++; return nil },
+		GetFn: func(string) ([]byte, error) { return []byte(`Found`), nil },
+	}
+
+	t.Run("first hit wins", func(t *testing.T) {
+		v, err := Caches{notFound, failing, found}.Get("k")
+		require.NoError(t, err)
+		assert.Exactly(t, `Found`, string(v))
+	})
+	t.Run("not found", func(t *testing.T) {
+		v, err := Caches{notFound, notFound}.Get("k")
+		assert.Nil(t, v)
+		assert.True(t, errors.NotFound.Match(err), "%+v", err)
+	})
+	t.Run("error wins over not found", func(t *testing.T) {
+		v, err := Caches{notFound, failing}.Get("k")
+		assert.Nil(t, v)
+		assert.True(t, errors.ConnectionFailed.Match(err), "%+v", err)
+	})
+	t.Run("set writes to all", func(t *testing.T) {
+		setCalls = 0
+		assert.NoError(t, Caches{found, notFound, found}.Set("k", nil, time.Second))
+		assert.Exactly(t, 2, setCalls)
+	})
+	t.Run("set collects errors", func(t *testing.T) {
+		setCalls = 0
+		err := Caches{failing, found}.Set("k", nil, time.Second)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "Set down")
+		assert.Exactly(t, 1, setCalls)
+	})
+}
+
+func TestCaches_Tiers(t *testing.T) {
+
+	newTiers := func() (*InMemory, *InMemory, Caches) {
+		l1 := NewInMemoryLRU(DefaultInMemoryMaxSize)
+		l2 := NewInMemoryLRU(DefaultInMemoryMaxSize)
+		return l1, l2, Caches{l1, l2}
+	}
+
+	t.Run("L2 hit back-fills L1 with the remaining TTL", func(t *testing.T) {
+		l1, l2, c := newTiers()
+		now := time.Unix(1500000000, 0)
+		l1.now = func() time.Time { return now }
+		l2.now = func() time.Time { return now }
+
+		require.NoError(t, l2.Set("k", []byte(`Cart`), time.Minute))
+		now = now.Add(20 * time.Second)
+
+		v, ttl, err := c.GetTTL("k")
+		require.NoError(t, err)
+		assert.Exactly(t, `Cart`, string(v))
+		assert.Exactly(t, 40*time.Second, ttl)
+
+		v, ttl, err = l1.GetTTL("k")
+		require.NoError(t, err)
+		assert.Exactly(t, `Cart`, string(v))
+		assert.Exactly(t, 40*time.Second, ttl)
+
+		now = now.Add(40 * time.Second)
+		_, err = l1.Get("k")
+		assert.True(t, errors.NotFound.Match(err), "%+v", err)
+	})
+
+	t.Run("L2 without TTL does not back-fill", func(t *testing.T) {
+		l1 := NewInMemoryLRU(DefaultInMemoryMaxSize)
+		l2 := cacherMock{
+			GetFn: func(string) ([]byte, error) { return []byte(`Cart`), nil },
+		}
+		v, err := Caches{l1, l2}.Get("k")
+		require.NoError(t, err)
+		assert.Exactly(t, `Cart`, string(v))
+		assert.Exactly(t, 0, l1.Stats().Items)
+	})
+
+	t.Run("failing L2 degrades to the next tier", func(t *testing.T) {
+		l1, l3 := NewInMemoryLRU(DefaultInMemoryMaxSize), NewInMemoryLRU(DefaultInMemoryMaxSize)
+		l2 := cacherMock{
+			SetFn: func(string, []byte, time.Duration) error { return errors.ConnectionFailed.Newf("L2 down") },
+			GetFn: func(string) ([]byte, error) { return nil, errors.ConnectionFailed.Newf("L2 down") },
+		}
+		require.NoError(t, l3.Set("k", []byte(`Cart`), 0))
+
+		v, err := Caches{l1, l2, l3}.Get("k")
+		require.NoError(t, err)
+		assert.Exactly(t, `Cart`, string(v))
+		v, err = l1.Get("k")
+		require.NoError(t, err, "L1 must be back-filled although L2 fails")
+		assert.Exactly(t, `Cart`, string(v))
+	})
+}
+
+func TestWriteBehind(t *testing.T) {
+
+	t.Run("writes in the background", func(t *testing.T) {
+		im := NewInMemoryLRU(DefaultInMemoryMaxSize)
+		wb := NewWriteBehind(im, 10)
+		value := []byte(`Cart`)
+		require.NoError(t, wb.Set("k", value, time.Minute))
+		value[0] = 'X' // must not change the queued value
+		require.NoError(t, wb.Close())
+
+		v, ttl, err := wb.GetTTL("k")
+		require.NoError(t, err)
+		assert.Exactly(t, `Cart`, string(v))
+		assert.True(t, ttl > 0, "TTL %s", ttl)
+
+		err = wb.Set("k", value, time.Minute)
+		assert.True(t, errors.AlreadyClosed.Match(err), "%+v", err)
+		assert.NoError(t, wb.Close(), "Second Close must not fail")
+	})
+
+	t.Run("full queue drops writes", func(t *testing.T) {
+		block := make(chan struct{})
+		wb := NewWriteBehind(cacherMock{
+			SetFn: func(string, []byte, time.Duration) error { <-block; return nil },
+		}, 1)
+
+		var tempErrs int
+		for i := 0; i < 5; i++ {
+			if err := wb.Set("k", nil, 0); errors.Temporary.Match(err) {
+				tempErrs++
+			}
+		}
+		assert.True(t, tempErrs >= 3, "Expected at least 3 dropped writes, got %d", tempErrs)
+		close(block)
+		require.NoError(t, wb.Close())
+	})
+
+	t.Run("unknown TTL", func(t *testing.T) {
+		wb := NewWriteBehind(cacherMock{
+			GetFn: func(string) ([]byte, error) { return []byte(`Cart`), nil },
+		}, 1)
+		defer wb.Close()
+		_, ttl, err := wb.GetTTL("k")
+		require.NoError(t, err)
+		assert.True(t, ttl < 0, "TTL %s", ttl)
+	})
 }
 
 func TestRegistry(t *testing.T) {
-	t.Skip("TODO")
+	defer MainRegistry.Clear()
+
+	assert.Nil(t, MainRegistry.Get("/"), "Empty scope must return nil")
+
+	require.NoError(t, MainRegistry.Register("/", "inmemory", false))
+	require.NoError(t, MainRegistry.Register("/", "inmemory?max_size=1MB", true))
+	assert.Exactly(t, 2, MainRegistry.Len("/"))
+	assert.Exactly(t, 0, MainRegistry.Len("/catalog"))
+	assert.Exactly(t, []string{"/"}, MainRegistry.Scopes())
+
+	err := MainRegistry.Register("/catalog", "mysql://localhost", false)
+	assert.True(t, errors.NotSupported.Match(err), "%+v", err)
+
+	c := MainRegistry.Get("/")
+	require.NotNil(t, c)
+	require.NoError(t, c.Set("k", []byte(`Cart`), time.Minute))
+	v, err := c.Get("k")
+	require.NoError(t, err)
+	assert.Exactly(t, `Cart`, string(v))
+
+	require.NoError(t, MainRegistry.Clear())
+	assert.Nil(t, MainRegistry.Get("/"))
+	assert.Empty(t, MainRegistry.Scopes())
 }
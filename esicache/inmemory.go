@@ -0,0 +1,319 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package esicache
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/corestoreio/errors"
+	"github.com/dustin/go-humanize"
+)
+
+// DefaultInMemoryMaxSize maximum amount of bytes the InMemory cache can store
+// if the URL does not contain the parameter max_size.
+const DefaultInMemoryMaxSize = 64 << 20 // 64 MiB
+
+// inMemoryEntryOverhead approximates the bytes needed for the bookkeeping of
+// one entry. It gets added to the size of each entry, so that many tiny
+// fragments cannot exceed the limit.
+const inMemoryEntryOverhead = 64
+
+// InMemory stores the values in the memory of the Caddy process. The total
+// size of all keys and values is bounded. When the limit has been reached, the
+// expired entries get removed first and then the least recently used entries
+// get evicted. Pinned entries count to the size and get only evicted, oldest
+// first, when they exceed half of the size.
+// Expired entries get also removed during the next Get of the same key. All
+// methods are thread safe.
+type InMemory struct {
+	// hits, misses, evictions and expirations get accessed atomically.
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+
+	maxSize uint64
+	// now can be replaced in tests.
+	now func() time.Time
+
+	mu    sync.Mutex
+	size  uint64
+	ll    *list.List // front is the most recently used entry
+	items map[string]*list.Element
+	// pinned contains the entries which do not get evicted by the LRU, front
+	// is the newest entry. pinnedSize is their part of size.
+	pinned     *list.List
+	pinnedSize uint64
+	// expiring contains the entries with an expiration, the next to expire
+	// first.
+	expiring inMemoryExpHeap
+}
+
+type inMemoryItem struct {
+	key     string
+	value   []byte
+	expires time.Time // zero means no expiration
+	heapIdx int       // position in InMemory.expiring, -1 if not expiring
+	pinned  bool
+}
+
+func (itm *inMemoryItem) size() uint64 {
+	return uint64(len(itm.key)+len(itm.value)) + inMemoryEntryOverhead
+}
+
+// InMemoryStats contains the counters of an InMemory cache.
+type InMemoryStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Items       int
+	Size        uint64
+	MaxSize     uint64
+}
+
+// NewInMemory creates a new Cacher which stores the values in the memory of
+// the current process. The optional parameter max_size limits the total size,
+// e.g.:
+//		inmemory
+//		inmemory?max_size=256MB
+//		inmemory://?max_size=1GiB
+func NewInMemory(rawURL string) (Cacher, error) {
+	maxSize := uint64(DefaultInMemoryMaxSize)
+	if idx := strings.IndexByte(rawURL, '?'); idx >= 0 {
+		params, err := url.ParseQuery(rawURL[idx+1:])
+		if err != nil {
+			return nil, errors.NotValid.Newf("[esicache] NewInMemory: Failed to parse parameters in URL %q with error %s", rawURL, err)
+		}
+		if ms := params.Get("max_size"); ms != "" {
+			maxSize, err = humanize.ParseBytes(ms)
+			if err != nil || maxSize == 0 {
+				return nil, errors.NotValid.Newf("[esicache] NewInMemory: Parameter max_size %q not valid in URL %q", ms, rawURL)
+			}
+		}
+	}
+	return NewInMemoryLRU(maxSize), nil
+}
+
+// NewInMemoryLRU creates a new InMemory cache which can store up to maxSize
+// bytes.
+func NewInMemoryLRU(maxSize uint64) *InMemory {
+	return &InMemory{
+		maxSize: maxSize,
+		now:     time.Now,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+		pinned:  list.New(),
+	}
+}
+
+// Set copies the value into the cache. An expiration lower than one means the
+// value never expires. A value larger than the maximum size does not get
+// stored and removes a previously stored value of the same key.
+func (im *InMemory) Set(key string, value []byte, expiration time.Duration) error {
+	im.set(key, value, expiration, false)
+	return nil
+}
+
+// SetPinned same as Set but the value does not get evicted when the maximum
+// size has been reached. It implements the PinnedSetter interface.
+func (im *InMemory) SetPinned(key string, value []byte, expiration time.Duration) error {
+	im.set(key, value, expiration, true)
+	return nil
+}
+
+func (im *InMemory) set(key string, value []byte, expiration time.Duration, pinned bool) {
+	itm := &inMemoryItem{
+		key:     key,
+		value:   make([]byte, len(value)),
+		heapIdx: -1,
+		pinned:  pinned,
+	}
+	copy(itm.value, value)
+	if expiration > 0 {
+		itm.expires = im.now().Add(expiration)
+	}
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	if e, ok := im.items[key]; ok {
+		im.removeElement(e)
+	}
+	if itm.size() > im.maxSize {
+		return
+	}
+	if pinned {
+		im.items[key] = im.pinned.PushFront(itm)
+	} else {
+		im.items[key] = im.ll.PushFront(itm)
+	}
+	im.size += itm.size()
+	if pinned {
+		im.pinnedSize += itm.size()
+	}
+	if !itm.expires.IsZero() {
+		heap.Push(&im.expiring, itm)
+	}
+
+	now := im.now()
+	for im.size > im.maxSize && len(im.expiring) > 0 && im.expiring[0].isExpired(now) {
+		im.removeElement(im.items[im.expiring[0].key])
+		atomic.AddUint64(&im.expirations, 1)
+	}
+	for im.pinnedSize > pinnedMaxSize(im.maxSize) {
+		im.removeElement(im.pinned.Back())
+		atomic.AddUint64(&im.evictions, 1)
+	}
+	for im.size > im.maxSize && im.ll.Len() > 0 {
+		im.removeElement(im.ll.Back())
+		atomic.AddUint64(&im.evictions, 1)
+	}
+}
+
+// Get returns the value or a NotFound error if the key does not exists or has
+// been expired. The returned slice must not be modified.
+func (im *InMemory) Get(key string) ([]byte, error) {
+	v, _, err := im.GetTTL(key)
+	return v, err
+}
+
+// GetTTL same as Get but returns additionally the remaining time to live. Zero
+// means the value never expires.
+func (im *InMemory) GetTTL(key string) ([]byte, time.Duration, error) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	e, ok := im.items[key]
+	if !ok {
+		atomic.AddUint64(&im.misses, 1)
+		return nil, 0, errors.NotFound.Newf("[esicache] InMemory key %q not found", key)
+	}
+	itm := e.Value.(*inMemoryItem)
+	now := im.now()
+	if itm.isExpired(now) {
+		im.removeElement(e)
+		atomic.AddUint64(&im.expirations, 1)
+		atomic.AddUint64(&im.misses, 1)
+		return nil, 0, errors.NotFound.Newf("[esicache] InMemory key %q expired", key)
+	}
+	if !itm.pinned {
+		im.ll.MoveToFront(e)
+	}
+	atomic.AddUint64(&im.hits, 1)
+
+	var ttl time.Duration
+	if !itm.expires.IsZero() {
+		ttl = itm.expires.Sub(now)
+	}
+	// The full slice expression forces an append of the caller to allocate.
+	return itm.value[:len(itm.value):len(itm.value)], ttl, nil
+}
+
+// Stats returns the current counters.
+func (im *InMemory) Stats() InMemoryStats {
+	im.mu.Lock()
+	items, size := im.ll.Len()+im.pinned.Len(), im.size
+	im.mu.Unlock()
+	return InMemoryStats{
+		Hits:        atomic.LoadUint64(&im.hits),
+		Misses:      atomic.LoadUint64(&im.misses),
+		Evictions:   atomic.LoadUint64(&im.evictions),
+		Expirations: atomic.LoadUint64(&im.expirations),
+		Items:       items,
+		Size:        size,
+		MaxSize:     im.maxSize,
+	}
+}
+
+// String formats the counters for the stats command of the command header.
+func (s InMemoryStats) String() string {
+	return fmt.Sprintf("hits=%d misses=%d evictions=%d expirations=%d items=%d size=%d max_size=%d",
+		s.Hits, s.Misses, s.Evictions, s.Expirations, s.Items, s.Size, s.MaxSize)
+}
+
+// InMemoryStatsOf returns the counters of all InMemory tiers of c, including
+// the tiers wrapped by a WriteBehind, in the order of the tiers.
+func InMemoryStatsOf(c Cacher) []InMemoryStats {
+	switch ct := c.(type) {
+	case *InMemory:
+		return []InMemoryStats{ct.Stats()}
+	case *WriteBehind:
+		return InMemoryStatsOf(ct.Cacher)
+	case Caches:
+		var sts []InMemoryStats
+		for _, cc := range ct {
+			sts = append(sts, InMemoryStatsOf(cc)...)
+		}
+		return sts
+	}
+	return nil
+}
+
+// removeElement must be called with a locked mutex.
+func (im *InMemory) removeElement(e *list.Element) {
+	l := im.ll
+	if e.Value.(*inMemoryItem).pinned {
+		l = im.pinned
+	}
+	itm := l.Remove(e).(*inMemoryItem)
+	delete(im.items, itm.key)
+	im.size -= itm.size()
+	if itm.pinned {
+		im.pinnedSize -= itm.size()
+	}
+	if itm.heapIdx >= 0 {
+		heap.Remove(&im.expiring, itm.heapIdx)
+	}
+}
+
+func (itm *inMemoryItem) isExpired(now time.Time) bool {
+	return !itm.expires.IsZero() && !now.Before(itm.expires)
+}
+
+// inMemoryExpHeap implements heap.Interface as a min-heap of the expiration
+// times.
+type inMemoryExpHeap []*inMemoryItem
+
+func (h inMemoryExpHeap) Len() int           { return len(h) }
+func (h inMemoryExpHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h inMemoryExpHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIdx = i
+	h[j].heapIdx = j
+}
+
+func (h *inMemoryExpHeap) Push(x interface{}) {
+	itm := x.(*inMemoryItem)
+	itm.heapIdx = len(*h)
+	*h = append(*h, itm)
+}
+
+func (h *inMemoryExpHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	itm := old[n-1]
+	old[n-1] = nil
+	itm.heapIdx = -1
+	*h = old[:n-1]
+	return itm
+}
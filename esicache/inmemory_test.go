@@ -0,0 +1,234 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package esicache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corestoreio/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewInMemory(t *testing.T) {
+
+	runner := func(url string, wantMaxSize uint64, wantErrBhf errors.Kind) func(*testing.T) {
+		return func(t *testing.T) {
+			c, err := NewInMemory(url)
+			if wantErrBhf > 0 {
+				assert.Nil(t, c)
+				assert.True(t, wantErrBhf.Match(err), "%+v", err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Exactly(t, wantMaxSize, c.(*InMemory).Stats().MaxSize)
+		}
+	}
+	t.Run("default", runner("inmemory", DefaultInMemoryMaxSize, errors.NoKind))
+	t.Run("max_size", runner("inmemory?max_size=2MB", 2000000, errors.NoKind))
+	t.Run("max_size with scheme", runner("inmemory://?max_size=1KiB", 1024, errors.NoKind))
+	t.Run("invalid max_size", runner("inmemory?max_size=∏", 0, errors.NotValid))
+	t.Run("zero max_size", runner("inmemory?max_size=0", 0, errors.NotValid))
+}
+
+func TestInMemory_Expiration(t *testing.T) {
+	im := NewInMemoryLRU(DefaultInMemoryMaxSize)
+	now := time.Unix(1500000000, 0)
+	im.now = func() time.Time { return now }
+
+	v, err := im.Get("k1")
+	assert.Nil(t, v)
+	assert.True(t, errors.NotFound.Match(err), "%+v", err)
+
+	value := []byte(`Cart`)
+	require.NoError(t, im.Set("k1", value, time.Second))
+	require.NoError(t, im.Set("k2", []byte(`Forever`), 0))
+	value[0] = 'X' // must not change the cached value
+
+	v, err = im.Get("k1")
+	require.NoError(t, err)
+	assert.Exactly(t, `Cart`, string(v))
+
+	now = now.Add(time.Second)
+	v, err = im.Get("k1")
+	assert.Nil(t, v)
+	assert.True(t, errors.NotFound.Match(err), "%+v", err)
+
+	v, err = im.Get("k2")
+	require.NoError(t, err)
+	assert.Exactly(t, `Forever`, string(v))
+
+	assert.Exactly(t, InMemoryStats{
+		Hits:        2,
+		Misses:      2,
+		Expirations: 1,
+		Items:       1,
+		Size:        2 + 7 + inMemoryEntryOverhead,
+		MaxSize:     DefaultInMemoryMaxSize,
+	}, im.Stats())
+}
+
+func TestInMemory_LRU(t *testing.T) {
+	// room for three entries with a key of 2 and a value of 10 bytes.
+	im := NewInMemoryLRU(3 * (2 + 10 + inMemoryEntryOverhead))
+	val := []byte(`0123456789`)
+
+	require.NoError(t, im.Set("k1", val, 0))
+	require.NoError(t, im.Set("k2", val, 0))
+	require.NoError(t, im.Set("k3", val, 0))
+	_, err := im.Get("k1") // k2 becomes the least recently used
+	require.NoError(t, err)
+	require.NoError(t, im.Set("k4", val, 0))
+
+	_, err = im.Get("k2")
+	assert.True(t, errors.NotFound.Match(err), "%+v", err)
+	for _, k := range []string{"k1", "k3", "k4"} {
+		_, err := im.Get(k)
+		assert.NoError(t, err, "Key %q", k)
+	}
+
+	// overwriting a key must not count twice
+	require.NoError(t, im.Set("k4", val, 0))
+	st := im.Stats()
+	assert.Exactly(t, 3, st.Items)
+	assert.Exactly(t, uint64(1), st.Evictions)
+	assert.Exactly(t, st.MaxSize, st.Size)
+
+	// too large values do not get stored and remove the old value
+	require.NoError(t, im.Set("k4", make([]byte, st.MaxSize), 0))
+	_, err = im.Get("k4")
+	assert.True(t, errors.NotFound.Match(err), "%+v", err)
+	assert.Exactly(t, 2, im.Stats().Items)
+}
+
+func TestInMemory_EvictExpiredFirst(t *testing.T) {
+	// room for three entries with a key of 2 and a value of 10 bytes.
+	im := NewInMemoryLRU(3 * (2 + 10 + inMemoryEntryOverhead))
+	now := time.Unix(1500000000, 0)
+	im.now = func() time.Time { return now }
+	val := []byte(`0123456789`)
+
+	require.NoError(t, im.Set("k1", val, time.Hour)) // live LRU tail
+	require.NoError(t, im.Set("k2", val, time.Second))
+	require.NoError(t, im.Set("k3", val, 0))
+	now = now.Add(2 * time.Second) // k2 expires but is not the tail
+
+	require.NoError(t, im.Set("k4", val, 0))
+
+	for _, k := range []string{"k1", "k3", "k4"} {
+		_, err := im.Get(k)
+		assert.NoError(t, err, "Key %q", k)
+	}
+	st := im.Stats()
+	assert.Exactly(t, 3, st.Items)
+	assert.Exactly(t, uint64(1), st.Expirations)
+	assert.Exactly(t, uint64(0), st.Evictions)
+
+	// without expired entries the LRU tail gets evicted: k1 after the Gets.
+	require.NoError(t, im.Set("k5", val, 0))
+	_, err := im.Get("k1")
+	assert.True(t, errors.NotFound.Match(err), "%+v", err)
+	assert.Exactly(t, uint64(1), im.Stats().Evictions)
+}
+
+func TestInMemory_SetPinned(t *testing.T) {
+	// room for three entries with a key of 2 and a value of 10 bytes.
+	im := NewInMemoryLRU(3 * (2 + 10 + inMemoryEntryOverhead))
+	now := time.Unix(1500000000, 0)
+	im.now = func() time.Time { return now }
+	val := []byte(`0123456789`)
+
+	require.NoError(t, SetPinned(im, "p1", val, time.Minute))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, im.Set(fmt.Sprintf("k%d", i), val, 0))
+	}
+	_, err := im.Get("p1")
+	assert.NoError(t, err, "Pinned key must not get evicted")
+	st := im.Stats()
+	assert.Exactly(t, 3, st.Items)
+	assert.Exactly(t, uint64(8), st.Evictions)
+
+	// an expired pinned entry gets removed before the LRU entries.
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, im.Set("ka", val, 0))
+	for _, k := range []string{"k8", "k9", "ka"} {
+		_, err := im.Get(k)
+		assert.NoError(t, err, "Key %q", k)
+	}
+	assert.Exactly(t, uint64(1), im.Stats().Expirations)
+
+	// pinned entries cannot occupy more than half of the size, the oldest get
+	// evicted first.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, im.SetPinned(fmt.Sprintf("p%d", i), val, 0))
+	}
+	for _, k := range []string{"p0", "p1"} {
+		_, err := im.Get(k)
+		assert.True(t, errors.NotFound.Match(err), "Key %q: %+v", k, err)
+	}
+	_, err = im.Get("p2")
+	assert.NoError(t, err)
+	st = im.Stats()
+	assert.Exactly(t, 3, st.Items)
+	assert.Exactly(t, st.MaxSize, st.Size)
+}
+
+func TestInMemoryStatsOf(t *testing.T) {
+	im1 := NewInMemoryLRU(1024)
+	im2 := NewInMemoryLRU(2048)
+	require.NoError(t, im1.Set("k1", []byte(`v1`), 0))
+	_, err := im1.Get("k1")
+	require.NoError(t, err)
+	_, err = im2.Get("k1")
+	assert.True(t, errors.NotFound.Match(err), "%+v", err)
+
+	wb := NewWriteBehind(im2, 1)
+	defer wb.Close()
+	sts := InMemoryStatsOf(Caches{im1, wb})
+	require.Len(t, sts, 2)
+	assert.Exactly(t, "hits=1 misses=0 evictions=0 expirations=0 items=1 size=68 max_size=1024", sts[0].String())
+	assert.Exactly(t, "hits=0 misses=1 evictions=0 expirations=0 items=0 size=0 max_size=2048", sts[1].String())
+
+	assert.Nil(t, InMemoryStatsOf(nil))
+}
+
+func TestInMemory_Concurrent(t *testing.T) {
+	im := NewInMemoryLRU(10 * (4 + 4 + inMemoryEntryOverhead))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				k := fmt.Sprintf("k%03d", (i*j)%50)
+				if err := im.Set(k, []byte(k), time.Minute); err != nil {
+					t.Error(err)
+				}
+				if v, err := im.Get(k); err == nil && len(v) != 4 {
+					t.Errorf("Key %q invalid value %q", k, v)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	st := im.Stats()
+	assert.True(t, st.Size <= st.MaxSize, "Size %d exceeds MaxSize %d", st.Size, st.MaxSize)
+	assert.True(t, st.Items <= 10, "Items %d", st.Items)
+}
@@ -0,0 +1,474 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package esicache
+
+import (
+	"container/heap"
+	"container/list"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corestoreio/errors"
+	"github.com/dustin/go-humanize"
+)
+
+// DefaultOnDiskMaxSize maximum amount of bytes the OnDisk cache can store if
+// the URL does not contain the parameter max_size.
+const DefaultOnDiskMaxSize = 1 << 30 // 1 GiB
+
+// onDiskVersion identifies the format of a cache file. Files of other
+// versions get removed when the cache gets opened.
+const onDiskVersion byte = 2
+
+// onDiskHeaderLen version byte, flags byte, the expiration time in Unix nano
+// seconds and the length of the key.
+const onDiskHeaderLen = 1 + 1 + 8 + 2
+
+// onDiskFlagPinned marks a file which does not get evicted.
+const onDiskFlagPinned byte = 1 << 0
+
+// onDiskTempPrefix prefix of the files which get written and then renamed.
+// Left over files of a crash get removed when the cache gets opened.
+const onDiskTempPrefix = ".tmp-"
+
+// OnDisk stores the values in files below a directory. Each value gets first
+// written into a temporary file and then renamed, so a reader or a crash sees
+// either the old or the new value. The files survive a restart of the
+// process. The total size of all files is bounded. When the limit has been
+// reached, the least recently used files get removed. Pinned files count to
+// the size and get only removed, oldest first, when they exceed half of the
+// size or when they have been expired. All methods are thread safe.
+type OnDisk struct {
+	dir     string
+	maxSize uint64
+	// now can be replaced in tests.
+	now func() time.Time
+
+	mu    sync.Mutex
+	size  uint64
+	ll    *list.List // front is the most recently used entry
+	items map[string]*list.Element
+	// pinned contains the entries which do not get evicted by the LRU, front
+	// is the newest entry. pinnedSize is their part of size.
+	pinned     *list.List
+	pinnedSize uint64
+	// expiring contains the entries with an expiration, the next to expire
+	// first.
+	expiring onDiskExpHeap
+}
+
+type onDiskItem struct {
+	key     string
+	size    uint64
+	expires time.Time // zero means no expiration
+	pinned  bool
+	heapIdx int // position in OnDisk.expiring, -1 if not expiring
+}
+
+// NewOnDisk creates a new Cacher which stores the values in the directory of
+// the URL. The directory gets created if it does not exist. The optional
+// parameter max_size limits the total size of the files, e.g.:
+//		file:///var/cache/caddy-esi
+//		file:///var/cache/caddy-esi?max_size=2GB
+func NewOnDisk(rawURL string) (Cacher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.NotValid.Newf("[esicache] NewOnDisk: Failed to parse URL %q with error %s", rawURL, err)
+	}
+	dir := u.Host + u.Path // file://relative/dir has the first part in the host
+	if dir == "" {
+		return nil, errors.Empty.Newf("[esicache] NewOnDisk: Directory missing in URL %q", rawURL)
+	}
+	maxSize := uint64(DefaultOnDiskMaxSize)
+	if ms := u.Query().Get("max_size"); ms != "" {
+		maxSize, err = humanize.ParseBytes(ms)
+		if err != nil || maxSize == 0 {
+			return nil, errors.NotValid.Newf("[esicache] NewOnDisk: Parameter max_size %q not valid in URL %q", ms, rawURL)
+		}
+	}
+	return OpenOnDisk(dir, maxSize)
+}
+
+// OpenOnDisk opens the cache directory and loads the index of the stored
+// files. Expired, damaged and temporary files get removed. The most recently
+// modified files count as the most recently used ones.
+func OpenOnDisk(dir string, maxSize uint64) (*OnDisk, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Fatal.New(err, "[esicache] OpenOnDisk: Failed to create directory %q", dir)
+	}
+	od := &OnDisk{
+		dir:     filepath.Clean(dir),
+		maxSize: maxSize,
+		now:     time.Now,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+		pinned:  list.New(),
+	}
+	if err := od.load(); err != nil {
+		return nil, errors.Wrapf(err, "[esicache] OpenOnDisk: Failed to load directory %q", dir)
+	}
+	return od, nil
+}
+
+type onDiskFile struct {
+	item    *onDiskItem
+	modTime time.Time
+}
+
+func (od *OnDisk) load() error {
+	var files []onDiskFile
+	now := od.now()
+	err := filepath.Walk(od.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), onDiskTempPrefix) {
+			return os.Remove(path)
+		}
+		itm, err := readOnDiskHeader(path)
+		if err != nil || od.fileName(itm.key) != path || itm.isExpired(now) {
+			return os.Remove(path)
+		}
+		itm.size = uint64(fi.Size())
+		files = append(files, onDiskFile{item: itm, modTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return errors.Fatal.New(err, "[esicache] OnDisk.load")
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	for _, f := range files {
+		od.pushFront(f.item)
+	}
+	od.evict()
+	return nil
+}
+
+func readOnDiskHeader(path string) (*onDiskItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hdr [onDiskHeaderLen]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil {
+		return nil, err
+	}
+	itm, keyLen, err := decodeOnDiskHeader(hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(f, key); err != nil {
+		return nil, err
+	}
+	itm.key = string(key)
+	return itm, nil
+}
+
+func decodeOnDiskHeader(buf []byte) (*onDiskItem, int, error) {
+	if len(buf) < onDiskHeaderLen || buf[0] != onDiskVersion {
+		return nil, 0, errors.NotValid.Newf("[esicache] OnDisk: Invalid file header with length %d", len(buf))
+	}
+	itm := &onDiskItem{
+		pinned:  buf[1]&onDiskFlagPinned != 0,
+		heapIdx: -1,
+	}
+	if exp := int64(binary.BigEndian.Uint64(buf[2:10])); exp > 0 {
+		itm.expires = time.Unix(0, exp)
+	}
+	return itm, int(binary.BigEndian.Uint16(buf[10:12])), nil
+}
+
+// fileName hashes the key and distributes the files over 256 sub directories.
+func (od *OnDisk) fileName(key string) string {
+	h := sha1.Sum([]byte(key))
+	name := hex.EncodeToString(h[:])
+	return filepath.Join(od.dir, name[:2], name)
+}
+
+// Set writes the value atomically into its file. An expiration lower than one
+// means the value never expires. A value larger than the maximum size does not
+// get stored and removes a previously stored value of the same key.
+func (od *OnDisk) Set(key string, value []byte, expiration time.Duration) error {
+	return od.set(key, value, expiration, false)
+}
+
+// SetPinned same as Set but the file does not get evicted when the maximum
+// size has been reached. It implements the PinnedSetter interface.
+func (od *OnDisk) SetPinned(key string, value []byte, expiration time.Duration) error {
+	return od.set(key, value, expiration, true)
+}
+
+func (od *OnDisk) set(key string, value []byte, expiration time.Duration, pinned bool) error {
+	if len(key) > 1<<16-1 {
+		return errors.NotValid.Newf("[esicache] OnDisk: Key too long with %d bytes", len(key))
+	}
+	itm := &onDiskItem{
+		key:     key,
+		size:    uint64(onDiskHeaderLen + len(key) + len(value)),
+		pinned:  pinned,
+		heapIdx: -1,
+	}
+	if expiration > 0 {
+		itm.expires = od.now().Add(expiration)
+	}
+
+	fileName := od.fileName(key)
+	if itm.size > od.maxSize {
+		od.mu.Lock()
+		defer od.mu.Unlock()
+		if e, ok := od.items[key]; ok {
+			od.removeElement(e)
+		}
+		return nil
+	}
+
+	tmpName, err := od.writeTemp(filepath.Dir(fileName), itm, value)
+	if err != nil {
+		return errors.Wrapf(err, "[esicache] OnDisk.Set failed for key %q", key)
+	}
+
+	od.mu.Lock()
+	if err := os.Rename(tmpName, fileName); err != nil {
+		od.mu.Unlock()
+		_ = os.Remove(tmpName)
+		return errors.WriteFailed.New(err, "[esicache] OnDisk.Set failed to rename the file of key %q", key)
+	}
+	if e, ok := od.items[key]; ok {
+		od.unlink(e)
+	}
+	od.pushFront(itm)
+	od.evict()
+	od.mu.Unlock()
+
+	if err := syncDir(filepath.Dir(fileName)); err != nil {
+		return errors.WriteFailed.New(err, "[esicache] OnDisk.Set failed to sync the directory of key %q", key)
+	}
+	return nil
+}
+
+// syncDir flushes the directory entries, so that a renamed file survives a
+// crash. Windows does not support to sync a directory.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cErr := d.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+func (od *OnDisk) writeTemp(dir string, itm *onDiskItem, value []byte) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.WriteFailed.New(err, "[esicache] OnDisk: Failed to create directory %q", dir)
+	}
+	f, err := ioutil.TempFile(dir, onDiskTempPrefix)
+	if err != nil {
+		return "", errors.WriteFailed.New(err, "[esicache] OnDisk: Failed to create a temporary file")
+	}
+
+	buf := make([]byte, onDiskHeaderLen, int(itm.size))
+	buf[0] = onDiskVersion
+	if itm.pinned {
+		buf[1] |= onDiskFlagPinned
+	}
+	if !itm.expires.IsZero() {
+		binary.BigEndian.PutUint64(buf[2:10], uint64(itm.expires.UnixNano()))
+	}
+	binary.BigEndian.PutUint16(buf[10:12], uint16(len(itm.key)))
+	buf = append(buf, itm.key...)
+	buf = append(buf, value...)
+
+	// The content must be on the disk before the rename makes it visible.
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", errors.WriteFailed.New(err, "[esicache] OnDisk: Failed to write the temporary file %q", f.Name())
+	}
+	return f.Name(), nil
+}
+
+// Get returns the value or a NotFound error if the key does not exists or has
+// been expired.
+func (od *OnDisk) Get(key string) ([]byte, error) {
+	v, _, err := od.GetTTL(key)
+	return v, err
+}
+
+// GetTTL same as Get but returns additionally the remaining time to live. Zero
+// means the value never expires.
+func (od *OnDisk) GetTTL(key string) ([]byte, time.Duration, error) {
+	now := od.now()
+	od.mu.Lock()
+	e, ok := od.items[key]
+	if ok && e.Value.(*onDiskItem).isExpired(now) {
+		od.removeElement(e)
+		ok = false
+	}
+	if ok && !e.Value.(*onDiskItem).pinned {
+		od.ll.MoveToFront(e)
+	}
+	od.mu.Unlock()
+	if !ok {
+		return nil, 0, errors.NotFound.Newf("[esicache] OnDisk key %q not found", key)
+	}
+
+	// A concurrent Set replaces the file atomically and a concurrent
+	// eviction lets the read fail, which counts as a miss.
+	buf, err := ioutil.ReadFile(od.fileName(key))
+	if err != nil {
+		return nil, 0, errors.NotFound.Newf("[esicache] OnDisk key %q not readable: %s", key, err)
+	}
+	itm, keyLen, err := decodeOnDiskHeader(buf)
+	if err != nil || len(buf) < onDiskHeaderLen+keyLen || string(buf[onDiskHeaderLen:onDiskHeaderLen+keyLen]) != key {
+		return nil, 0, errors.NotFound.Newf("[esicache] OnDisk key %q has an invalid file", key)
+	}
+	if itm.isExpired(now) {
+		return nil, 0, errors.NotFound.Newf("[esicache] OnDisk key %q expired", key)
+	}
+	var ttl time.Duration
+	if !itm.expires.IsZero() {
+		ttl = itm.expires.Sub(now)
+	}
+	return buf[onDiskHeaderLen+keyLen:], ttl, nil
+}
+
+// Size returns the total size of all files in bytes.
+func (od *OnDisk) Size() uint64 {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	return od.size
+}
+
+// evict must be called with a locked mutex. The expired files, pinned or not,
+// get removed before the least recently used files. The oldest pinned files
+// get removed when they exceed half of the maximum size.
+func (od *OnDisk) evict() {
+	for od.pinnedSize > pinnedMaxSize(od.maxSize) {
+		od.removeElement(od.pinned.Back())
+	}
+	now := od.now()
+	for od.size > od.maxSize && len(od.expiring) > 0 && od.expiring[0].isExpired(now) {
+		od.removeElement(od.items[od.expiring[0].key])
+	}
+	for od.size > od.maxSize && od.ll.Len() > 0 {
+		od.removeElement(od.ll.Back())
+	}
+}
+
+// list returns the list which contains the item.
+func (od *OnDisk) list(itm *onDiskItem) *list.List {
+	if itm.pinned {
+		return od.pinned
+	}
+	return od.ll
+}
+
+// pushFront must be called with a locked mutex.
+func (od *OnDisk) pushFront(itm *onDiskItem) {
+	od.items[itm.key] = od.list(itm).PushFront(itm)
+	od.size += itm.size
+	if itm.pinned {
+		od.pinnedSize += itm.size
+	}
+	if !itm.expires.IsZero() {
+		heap.Push(&od.expiring, itm)
+	}
+}
+
+// unlink must be called with a locked mutex. It does not remove the file.
+func (od *OnDisk) unlink(e *list.Element) *onDiskItem {
+	itm := od.list(e.Value.(*onDiskItem)).Remove(e).(*onDiskItem)
+	delete(od.items, itm.key)
+	od.size -= itm.size
+	if itm.pinned {
+		od.pinnedSize -= itm.size
+	}
+	if itm.heapIdx >= 0 {
+		heap.Remove(&od.expiring, itm.heapIdx)
+	}
+	return itm
+}
+
+// removeElement must be called with a locked mutex.
+func (od *OnDisk) removeElement(e *list.Element) {
+	itm := od.unlink(e)
+	_ = os.Remove(od.fileName(itm.key))
+}
+
+func (itm *onDiskItem) isExpired(now time.Time) bool {
+	return !itm.expires.IsZero() && !now.Before(itm.expires)
+}
+
+// onDiskExpHeap implements heap.Interface as a min-heap of the expiration
+// times.
+type onDiskExpHeap []*onDiskItem
+
+func (h onDiskExpHeap) Len() int           { return len(h) }
+func (h onDiskExpHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h onDiskExpHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIdx = i
+	h[j].heapIdx = j
+}
+
+func (h *onDiskExpHeap) Push(x interface{}) {
+	itm := x.(*onDiskItem)
+	itm.heapIdx = len(*h)
+	*h = append(*h, itm)
+}
+
+func (h *onDiskExpHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	itm := old[n-1]
+	old[n-1] = nil
+	itm.heapIdx = -1
+	*h = old[:n-1]
+	return itm
+}
@@ -0,0 +1,260 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package esicache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corestoreio/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "caddyesi-ondisk-")
+	require.NoError(t, err)
+	return dir, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestNewOnDisk(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	runner := func(url string, wantMaxSize uint64, wantErrBhf errors.Kind) func(*testing.T) {
+		return func(t *testing.T) {
+			c, err := NewCacher(url)
+			if wantErrBhf > 0 {
+				assert.Nil(t, c)
+				assert.True(t, wantErrBhf.Match(err), "%+v", err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Exactly(t, wantMaxSize, c.(*OnDisk).maxSize)
+		}
+	}
+	t.Run("default", runner("file://"+dir, DefaultOnDiskMaxSize, errors.NoKind))
+	t.Run("max_size", runner("file://"+dir+"?max_size=2MB", 2000000, errors.NoKind))
+	t.Run("missing directory", runner("file://?max_size=2MB", 0, errors.Empty))
+	t.Run("invalid max_size", runner("file://"+dir+"?max_size=∏", 0, errors.NotValid))
+}
+
+func TestOnDisk_SetGet(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	od, err := OpenOnDisk(dir, DefaultOnDiskMaxSize)
+	require.NoError(t, err)
+	now := time.Unix(1500000000, 0)
+	od.now = func() time.Time { return now }
+
+	v, err := od.Get("k1")
+	assert.Nil(t, v)
+	assert.True(t, errors.NotFound.Match(err), "%+v", err)
+
+	require.NoError(t, od.Set("k1", []byte(`Cart`), time.Second))
+	require.NoError(t, od.Set("k2", []byte(`Forever`), 0))
+	require.NoError(t, od.Set("k2", []byte(`Forever and ever`), 0))
+
+	v, ttl, err := od.GetTTL("k1")
+	require.NoError(t, err)
+	assert.Exactly(t, `Cart`, string(v))
+	assert.Exactly(t, time.Second, ttl)
+
+	v, ttl, err = od.GetTTL("k2")
+	require.NoError(t, err)
+	assert.Exactly(t, `Forever and ever`, string(v))
+	assert.Exactly(t, time.Duration(0), ttl)
+
+	now = now.Add(time.Second)
+	v, err = od.Get("k1")
+	assert.Nil(t, v)
+	assert.True(t, errors.NotFound.Match(err), "%+v", err)
+	_, err = os.Stat(od.fileName("k1"))
+	assert.True(t, os.IsNotExist(err), "file of the expired key must be removed: %v", err)
+
+	assert.Exactly(t, uint64(onDiskHeaderLen+len("k2")+len("Forever and ever")), od.Size())
+}
+
+func TestOnDisk_Restart(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	od, err := OpenOnDisk(dir, DefaultOnDiskMaxSize)
+	require.NoError(t, err)
+	require.NoError(t, od.Set("k1", []byte(`Cart`), time.Hour))
+	require.NoError(t, od.Set("k2", []byte(`Expired`), time.Millisecond))
+	// left over of a crash during a write and a damaged file.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, onDiskTempPrefix+"123"), []byte(`half`), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "damaged"), []byte(`x`), 0600))
+	time.Sleep(5 * time.Millisecond)
+
+	od2, err := OpenOnDisk(dir, DefaultOnDiskMaxSize)
+	require.NoError(t, err)
+	v, err := od2.Get("k1")
+	require.NoError(t, err)
+	assert.Exactly(t, `Cart`, string(v))
+
+	_, err = od2.Get("k2")
+	assert.True(t, errors.NotFound.Match(err), "%+v", err)
+	assert.Exactly(t, uint64(onDiskHeaderLen+len("k1")+len("Cart")), od2.Size())
+
+	for _, name := range []string{onDiskTempPrefix + "123", "damaged"} {
+		_, err = os.Stat(filepath.Join(dir, name))
+		assert.True(t, os.IsNotExist(err), "%s: %v", name, err)
+	}
+}
+
+func TestOnDisk_MaxSize(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	const itemSize = onDiskHeaderLen + 2 + 10
+	od, err := OpenOnDisk(dir, 3*itemSize)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, od.Set(fmt.Sprintf("k%d", i), []byte(`0123456789`), 0))
+	}
+	_, err = od.Get("k0") // k0 becomes the most recently used
+	require.NoError(t, err)
+	require.NoError(t, od.Set("k3", []byte(`0123456789`), 0))
+
+	_, err = od.Get("k1")
+	assert.True(t, errors.NotFound.Match(err), "k1 must be evicted: %+v", err)
+	for _, k := range []string{"k0", "k2", "k3"} {
+		_, err = od.Get(k)
+		assert.NoError(t, err, k)
+	}
+	assert.Exactly(t, uint64(3*itemSize), od.Size())
+
+	// too large for the cache removes the old value
+	require.NoError(t, od.Set("k0", make([]byte, 4*itemSize), 0))
+	_, err = od.Get("k0")
+	assert.True(t, errors.NotFound.Match(err), "%+v", err)
+
+	// after a restart the limit applies, too.
+	od2, err := OpenOnDisk(dir, itemSize)
+	require.NoError(t, err)
+	assert.Exactly(t, uint64(itemSize), od2.Size())
+}
+
+func TestOnDisk_EvictExpiredFirst(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	const itemSize = onDiskHeaderLen + 2 + 10
+	od, err := OpenOnDisk(dir, 3*itemSize)
+	require.NoError(t, err)
+	now := time.Now()
+	od.now = func() time.Time { return now }
+	val := []byte(`0123456789`)
+
+	require.NoError(t, od.Set("k1", val, time.Hour)) // live LRU tail
+	require.NoError(t, od.Set("k2", val, time.Second))
+	require.NoError(t, od.Set("k3", val, 0))
+	now = now.Add(2 * time.Second) // k2 expires but is not the tail
+
+	require.NoError(t, od.Set("k4", val, 0))
+	for _, k := range []string{"k1", "k3", "k4"} {
+		_, err = od.Get(k)
+		assert.NoError(t, err, k)
+	}
+	_, err = os.Stat(od.fileName("k2"))
+	assert.True(t, os.IsNotExist(err), "%v", err)
+	assert.Exactly(t, uint64(3*itemSize), od.Size())
+}
+
+func TestOnDisk_SetPinned(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	const itemSize = onDiskHeaderLen + 2 + 10
+	od, err := OpenOnDisk(dir, 3*itemSize)
+	require.NoError(t, err)
+	now := time.Now()
+	od.now = func() time.Time { return now }
+
+	require.NoError(t, SetPinned(od, "p1", []byte(`0123456789`), time.Minute))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, od.Set(fmt.Sprintf("k%d", i), []byte(`0123456789`), 0))
+	}
+	_, err = od.Get("p1")
+	assert.NoError(t, err, "Pinned key must not get evicted")
+	assert.Exactly(t, uint64(3*itemSize), od.Size())
+
+	// the pinned flag survives a restart.
+	od2, err := OpenOnDisk(dir, 3*itemSize)
+	require.NoError(t, err)
+	od2.now = func() time.Time { return now }
+	for i := 5; i < 8; i++ {
+		require.NoError(t, od2.Set(fmt.Sprintf("k%d", i), []byte(`0123456789`), 0))
+	}
+	_, err = od2.Get("p1")
+	assert.NoError(t, err, "Pinned key must not get evicted after a restart")
+
+	// an expired pinned file gets removed before the LRU files.
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, od2.Set("k8", []byte(`0123456789`), 0))
+	for _, k := range []string{"k6", "k7", "k8"} {
+		_, err = od2.Get(k)
+		assert.NoError(t, err, k)
+	}
+	_, err = os.Stat(od2.fileName("p1"))
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	// pinned files cannot occupy more than half of the size, the oldest get
+	// removed first.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, SetPinned(od2, fmt.Sprintf("p%d", i), []byte(`0123456789`), 0))
+	}
+	for _, k := range []string{"p0", "p1"} {
+		_, err = os.Stat(od2.fileName(k))
+		assert.True(t, os.IsNotExist(err), "Key %q: %v", k, err)
+	}
+	_, err = od2.Get("p2")
+	assert.NoError(t, err)
+	assert.Exactly(t, uint64(3*itemSize), od2.Size())
+}
+
+func TestOnDisk_Parallel(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	od, err := OpenOnDisk(dir, DefaultOnDiskMaxSize)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				want := fmt.Sprintf("value %d", i)
+				assert.NoError(t, od.Set("shared", []byte(want), 0))
+				v, err := od.Get("shared")
+				if assert.NoError(t, err) {
+					assert.Contains(t, string(v), "value ")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
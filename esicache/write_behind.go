@@ -0,0 +1,123 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package esicache
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/corestoreio/errors"
+)
+
+// WriteBehindQueueSize defines the number of pending writes of a write-behind
+// tier. When the queue is full, further writes get dropped until the
+// background writer catches up.
+var WriteBehindQueueSize = 1024
+
+type writeBehindItem struct {
+	key        string
+	value      []byte
+	expiration time.Duration
+	pinned     bool
+}
+
+// WriteBehind wraps a Cacher and writes the values in a background goroutine.
+// Reads get passed directly to the wrapped Cacher. Errors of the background
+// writes get ignored because nobody waits for them. A slow L2 tier does then
+// not delay the response.
+type WriteBehind struct {
+	Cacher
+	mu     sync.RWMutex
+	closed bool
+	queue  chan writeBehindItem
+	done   chan struct{}
+}
+
+// NewWriteBehind creates a new write-behind tier and starts its background
+// writer. Close stops the writer after the pending writes have been flushed.
+func NewWriteBehind(c Cacher, queueSize int) *WriteBehind {
+	wb := &WriteBehind{
+		Cacher: c,
+		queue:  make(chan writeBehindItem, queueSize),
+		done:   make(chan struct{}),
+	}
+	go wb.run()
+	return wb
+}
+
+func (wb *WriteBehind) run() {
+	defer close(wb.done)
+	for itm := range wb.queue {
+		if itm.pinned {
+			_ = SetPinned(wb.Cacher, itm.key, itm.value, itm.expiration)
+		} else {
+			_ = wb.Cacher.Set(itm.key, itm.value, itm.expiration)
+		}
+	}
+}
+
+// Set queues the value for the background writer. Returns an error with
+// behaviour Temporary if the queue is full and AlreadyClosed after Close has
+// been called.
+func (wb *WriteBehind) Set(key string, value []byte, expiration time.Duration) error {
+	return wb.enqueue(key, value, expiration, false)
+}
+
+// SetPinned same as Set but the background writer pins the value, if the
+// wrapped Cacher implements the PinnedSetter interface.
+func (wb *WriteBehind) SetPinned(key string, value []byte, expiration time.Duration) error {
+	return wb.enqueue(key, value, expiration, true)
+}
+
+func (wb *WriteBehind) enqueue(key string, value []byte, expiration time.Duration, pinned bool) error {
+	wb.mu.RLock()
+	defer wb.mu.RUnlock()
+	if wb.closed {
+		return errors.AlreadyClosed.Newf("[esicache] WriteBehind already closed. Key %q", key)
+	}
+	select {
+	// the caller might reuse the value after Set returns.
+	case wb.queue <- writeBehindItem{key: key, value: append([]byte(nil), value...), expiration: expiration, pinned: pinned}:
+		return nil
+	default:
+		return errors.Temporary.Newf("[esicache] WriteBehind queue full, dropped key %q", key)
+	}
+}
+
+// GetTTL implements the TTLGetter interface. The returned TTL is negative if the
+// wrapped Cacher does not implement TTLGetter.
+func (wb *WriteBehind) GetTTL(key string) ([]byte, time.Duration, error) {
+	return getTTL(wb.Cacher, key)
+}
+
+// Close flushes the pending writes and closes the wrapped Cacher, if it
+// implements io.Closer.
+func (wb *WriteBehind) Close() error {
+	wb.mu.Lock()
+	if wb.closed {
+		wb.mu.Unlock()
+		return nil
+	}
+	wb.closed = true
+	close(wb.queue)
+	wb.mu.Unlock()
+
+	<-wb.done
+	if cl, ok := wb.Cacher.(io.Closer); ok {
+		return errors.Wrap(cl.Close(), "[esicache] WriteBehind.Close")
+	}
+	return nil
+}
@@ -74,7 +74,9 @@ type fetchHTTP struct {
 // DoRequest implements ResourceHandler and is registered in RegisterResourceHandler for
 // http and https scheme. The only allowed response code from the queried server
 // is http.StatusOK. All other response codes trigger a NotSupported error
-// behaviour.
+// behaviour. If the arguments contain the validators of a cached fragment, the
+// request becomes conditional and the response code http.StatusNotModified
+// sets the field NotModified and returns an empty body.
 func (fh *fetchHTTP) DoRequest(args *esitag.ResourceArgs) (http.Header, []byte, error) {
 	if err := args.Validate(); err != nil {
 		return nil, nil, errors.Wrap(err, "[esibackend] FetchHTTP.args.Validate")
@@ -92,6 +94,13 @@ func (fh *fetchHTTP) DoRequest(args *esitag.ResourceArgs) (http.Header, []byte,
 	for hdr, i := args.PrepareForwardHeaders(), 0; i < len(hdr); i = i + 2 {
 		req.Header.Set(hdr[i], hdr[i+1])
 	}
+	conditional := args.IfNoneMatch != "" || args.IfModifiedSince != ""
+	if args.IfNoneMatch != "" {
+		req.Header.Set("If-None-Match", args.IfNoneMatch)
+	}
+	if args.IfModifiedSince != "" {
+		req.Header.Set("If-Modified-Since", args.IfModifiedSince)
+	}
 
 	// do we overwrite here the Timeout from args.ExternalReq ? or just adding our
 	// own timeout?
@@ -121,6 +130,11 @@ func (fh *fetchHTTP) DoRequest(args *esitag.ResourceArgs) (http.Header, []byte,
 		return nil, nil, errors.Wrapf(err, "[esibackend] FetchHTTP error for URL %q", args.URL)
 	}
 
+	args.ResponseHeader = resp.Header
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		args.NotModified = true
+		return args.PrepareReturnHeaders(resp.Header), nil, nil
+	}
 	if resp.StatusCode != http.StatusOK { // this can be made configurable in an Tag tag
 		return nil, nil, errors.NotSupported.Newf("[backend] FetchHTTP: Response Code %q not supported for URL %q", resp.StatusCode, args.URL)
 	}
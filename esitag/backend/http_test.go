@@ -107,6 +107,43 @@ func TestNewFetchHTTP_Serial(t *testing.T) {
 		assert.True(t, errors.NotSupported.Match(err), "%+v", err)
 	})
 
+	t.Run("Conditional request Not Modified", func(t *testing.T) {
+
+		rfa2 := new(esitag.ResourceArgs)
+		*rfa2 = *rfa
+		rfa2.IfNoneMatch = `"v1"`
+		rfa2.IfModifiedSince = "Sun, 28 Dec 2036 08:58:08 GMT"
+
+		hdr, content, err := backend.NewFetchHTTP(&esitesting.HTTPTrip{
+			GenerateResponse: func(req *http.Request) *http.Response {
+				assert.Exactly(t, `"v1"`, req.Header.Get("If-None-Match"))
+				assert.Exactly(t, "Sun, 28 Dec 2036 08:58:08 GMT", req.Header.Get("If-Modified-Since"))
+				return &http.Response{
+					StatusCode: http.StatusNotModified,
+					Header:     http.Header{"Cache-Control": []string{"max-age=60"}},
+					Body:       ioutil.NopCloser(&bytes.Buffer{}),
+				}
+			},
+			RequestCache: make(map[*http.Request]struct{}),
+		}).DoRequest(rfa2)
+		assert.NoError(t, err)
+		assert.Empty(t, hdr, "Header")
+		assert.Empty(t, content)
+		assert.True(t, rfa2.NotModified, "NotModified")
+		assert.Exactly(t, "max-age=60", rfa2.ResponseHeader.Get("Cache-Control"))
+	})
+
+	t.Run("Status Code 304 without validators", func(t *testing.T) {
+
+		rfa2 := new(esitag.ResourceArgs)
+		*rfa2 = *rfa
+
+		_, content, err := backend.NewFetchHTTP(esitesting.NewHTTPTrip(304, "", nil)).DoRequest(rfa2)
+		assert.Empty(t, content)
+		assert.False(t, rfa2.NotModified, "NotModified")
+		assert.True(t, errors.NotSupported.Match(err), "%+v", err)
+	})
+
 	t.Run("Request context cancel", func(t *testing.T) {
 
 		rfa2 := new(esitag.ResourceArgs)
@@ -22,12 +22,14 @@ import (
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/corestoreio/caddy-esi/esicache"
 	"github.com/corestoreio/caddy-esi/esitag"
 	"github.com/corestoreio/errors"
 )
 
 func init() {
 	esitag.RegisterResourceHandlerFactory("memcache", NewMemCache)
+	esicache.RegisterCacherFactory("memcache", NewMemCacheCacher)
 }
 
 type esiMemCache struct {
@@ -72,6 +74,58 @@ func NewMemCache(opt *esitag.ResourceOptions) (esitag.ResourceHandler, error) {
 	return mc, nil
 }
 
+// NewMemCacheCacher creates a new fragment cache for the cache directive in the
+// Caddyfile. The URL supports the same parameters as NewMemCache.
+func NewMemCacheCacher(url string) (esicache.Cacher, error) {
+	rh, err := NewMemCache(esitag.NewResourceOptions(url))
+	if err != nil {
+		return nil, errors.Wrap(err, "[backend] NewMemCacheCacher")
+	}
+	return rh.(*esiMemCache), nil
+}
+
+// Set writes the value to memcache. Memcache supports only seconds, so the
+// expiration gets rounded up to the next full second. An expiration lower than
+// one means the value never expires. Memcache cannot return the TTL of an item,
+// so the Unix time of the expiration gets stored in the flags of the item.
+func (mc *esiMemCache) Set(key string, value []byte, expiration time.Duration) error {
+	itm := &memcache.Item{
+		Key:   key,
+		Value: value,
+	}
+	if expiration > 0 {
+		itm.Expiration = int32((expiration + time.Second - 1) / time.Second)
+		itm.Flags = uint32(time.Now().Add(time.Duration(itm.Expiration) * time.Second).Unix())
+	}
+	return errors.Wrapf(mc.pool.Set(itm), "[backend] MemCache.Set %q => %q", mc.url, key)
+}
+
+// Get returns the value from memcache or a NotFound error if the key does not
+// exists.
+func (mc *esiMemCache) Get(key string) ([]byte, error) {
+	value, _, err := mc.GetTTL(key)
+	return value, err
+}
+
+// GetTTL same as Get but returns additionally the remaining time to live as
+// stored in the flags by Set. Zero means the value never expires.
+func (mc *esiMemCache) GetTTL(key string) ([]byte, time.Duration, error) {
+	itm, err := mc.pool.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil, 0, errors.NotFound.Newf("[backend] URL %q: Key %q not found", mc.url, key)
+	}
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "[backend] MemCache.Get %q => %q", mc.url, key)
+	}
+	var ttl time.Duration
+	if itm.Flags > 0 {
+		if ttl = time.Unix(int64(itm.Flags), 0).Sub(time.Now()); ttl <= 0 {
+			return nil, 0, errors.NotFound.Newf("[backend] URL %q: Key %q expired", mc.url, key)
+		}
+	}
+	return itm.Value, ttl, nil
+}
+
 // Closes closes the resource when Caddy restarts or reloads. If supported
 // by the resource.
 func (mc *esiMemCache) Close() error {
@@ -22,6 +22,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/corestoreio/caddy-esi/esicache"
 	"github.com/corestoreio/caddy-esi/esitag"
 	"github.com/corestoreio/errors"
 	"github.com/gomodule/redigo/redis"
@@ -34,15 +35,21 @@ import (
 
 func init() {
 	esitag.RegisterResourceHandlerFactory("redis", NewRedis)
+	esicache.RegisterCacherFactory("redis", NewRedisCacher)
 }
 
 type esiRedis struct {
 	isCancellable bool
 	url           string
 	pool          *redis.Pool
+	// inv is nil if the invalidation has not been enabled.
+	inv *redisInvalidator
 }
 
 // NewRedis provides, for now, a basic implementation for simple key fetching.
+// The parameter invalidate=1 enables the invalidation of the cached fragments
+// via keyspace notifications: DoRequest returns a surrogate key for the
+// requested key and a SET or DEL of the key purges its fragments.
 func NewRedis(opt *esitag.ResourceOptions) (esitag.ResourceHandler, error) {
 	addr, pw, params, err := opt.ParseNoSQLURL()
 	if err != nil {
@@ -89,6 +96,10 @@ func NewRedis(opt *esitag.ResourceOptions) (esitag.ResourceHandler, error) {
 		},
 	}
 
+	if params.Get("invalidate") == "1" {
+		r.inv = newRedisInvalidator(r, addr, params.Get("db"))
+	}
+
 	if params.Get("lazy") == "1" {
 		return r, nil
 	}
@@ -107,12 +118,113 @@ func NewRedis(opt *esitag.ResourceOptions) (esitag.ResourceHandler, error) {
 	return r, nil
 }
 
+// NewRedisCacher creates a new fragment cache for the cache directive in the
+// Caddyfile. The URL supports the same parameters as NewRedis.
+func NewRedisCacher(url string) (esicache.Cacher, error) {
+	rh, err := NewRedis(esitag.NewResourceOptions(url))
+	if err != nil {
+		return nil, errors.Wrap(err, "[backend] NewRedisCacher")
+	}
+	return rh.(*esiRedis), nil
+}
+
+// Set writes the value with the expiration in milliseconds to Redis. An
+// expiration lower than one means the value never expires.
+func (er *esiRedis) Set(key string, value []byte, expiration time.Duration) error {
+	conn := er.pool.Get()
+	defer conn.Close()
+
+	args := []interface{}{key, value}
+	if expiration > 0 {
+		ms := int64(expiration / time.Millisecond)
+		if ms < 1 {
+			ms = 1
+		}
+		args = append(args, "PX", ms)
+	}
+	_, err := conn.Do("SET", args...)
+	return errors.Wrapf(err, "[backend] Redis.Set %q => %q", er.url, key)
+}
+
+// Get returns the value from Redis or a NotFound error if the key does not
+// exists.
+func (er *esiRedis) Get(key string) ([]byte, error) {
+	value, _, err := er.GetTTL(key)
+	return value, err
+}
+
+// GetTTL same as Get but returns additionally the remaining time to live. Zero
+// means the value never expires. Both commands get sent in one round trip.
+func (er *esiRedis) GetTTL(key string) ([]byte, time.Duration, error) {
+	conn := er.pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("GET", key); err != nil {
+		return nil, 0, errors.Wrapf(err, "[backend] Redis.GetTTL.Send GET %q => %q", er.url, key)
+	}
+	if err := conn.Send("PTTL", key); err != nil {
+		return nil, 0, errors.Wrapf(err, "[backend] Redis.GetTTL.Send PTTL %q => %q", er.url, key)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, 0, errors.Wrapf(err, "[backend] Redis.GetTTL.Flush %q => %q", er.url, key)
+	}
+	value, err := redis.Bytes(conn.Receive())
+	pttl, pErr := redis.Int64(conn.Receive())
+	if err == redis.ErrNil {
+		return nil, 0, errors.NotFound.Newf("[backend] URL %q: Key %q not found", er.url, key)
+	}
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "[backend] Redis.Get %q => %q", er.url, key)
+	}
+	if pErr != nil {
+		return nil, 0, errors.Wrapf(pErr, "[backend] Redis.PTTL %q => %q", er.url, key)
+	}
+
+	var ttl time.Duration
+	switch {
+	case pttl > 0:
+		ttl = time.Duration(pttl) * time.Millisecond
+	case pttl == -2:
+		// key expired between GET and PTTL
+		return nil, 0, errors.NotFound.Newf("[backend] URL %q: Key %q expired", er.url, key)
+	}
+	return value, ttl, nil
+}
+
 // Closes closes the resource when Caddy restarts or reloads. If supported
 // by the resource.
 func (er *esiRedis) Close() error {
+	if er.inv != nil {
+		_ = er.inv.Close()
+	}
 	return errors.Wrapf(er.pool.Close(), "[backend] Redis Close. URI %q", er.url)
 }
 
+// watch subscribes to the keyspace notifications of the key, if the
+// invalidation has been enabled, and waits until Redis has confirmed the
+// subscription. Only then the value can be read, otherwise a change between
+// the GET and the SUBSCRIBE gets lost and the stale value stays cached. Returns
+// the header with the surrogate key of the key.
+func (er *esiRedis) watch(args *esitag.ResourceArgs) (http.Header, error) {
+	if er.inv == nil {
+		return nil, nil
+	}
+	hdr, ready, err := er.inv.watch(args.Tag.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "[backend] Redis subscription of key %q failed. URL %q", args.Tag.Key, er.url)
+	}
+	t := time.NewTimer(args.Tag.Timeout)
+	defer t.Stop()
+	select {
+	case <-ready:
+		return hdr, nil
+	case <-args.ExternalReq.Context().Done():
+		return nil, errors.Wrapf(args.ExternalReq.Context().Err(), "[backend] Redis subscription of key %q cancelled. URL %q", args.Tag.Key, er.url)
+	case <-t.C:
+		return nil, errors.Timeout.Newf("[backend] Redis subscription of key %q not confirmed within %s. URL %q", args.Tag.Key, args.Tag.Timeout, er.url)
+	}
+}
+
 // DoRequest returns a value from the field Key in the args argument. Header is
 // not supported. Request cancellation through a timeout (when the client
 // request gets cancelled) is supported.
@@ -130,6 +242,11 @@ func (er *esiRedis) doRequest(args *esitag.ResourceArgs) (_ http.Header, _ []byt
 		return nil, nil, errors.Wrap(err, "[backend] doRequest.ValidateWithKey")
 	}
 
+	hdr, err := er.watch(args)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "[backend] doRequest.watch")
+	}
+
 	conn := er.pool.Get()
 	defer conn.Close()
 
@@ -145,7 +262,7 @@ func (er *esiRedis) doRequest(args *esitag.ResourceArgs) (_ http.Header, _ []byt
 		value = value[:mbs]
 	}
 
-	return nil, value, err
+	return hdr, value, err
 }
 
 // DoRequest returns a value from the field Key in the args argument. Header is
@@ -156,6 +273,11 @@ func (er *esiRedis) doRequestCancel(args *esitag.ResourceArgs) (_ http.Header, _
 		return nil, nil, errors.Wrap(err, "[backend] doRequest.ValidateWithKey")
 	}
 
+	hdr, err := er.watch(args)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "[backend] doRequestCancel.watch")
+	}
+
 	// See git history for a version without context.WithTimeout. A bit faster and less allocs.
 	ctx, cancel := context.WithTimeout(args.ExternalReq.Context(), args.Tag.Timeout)
 	defer cancel()
@@ -188,6 +310,7 @@ func (er *esiRedis) doRequestCancel(args *esitag.ResourceArgs) (_ http.Header, _
 	case <-ctx.Done():
 		err = errors.Wrapf(ctx.Err(), "[backend] Redits Get Context cancelled. Previous possible error: %+v", retErr)
 	case value = <-content:
+		return hdr, value, nil
 	case err = <-retErr:
 	}
 	return nil, value, err
@@ -0,0 +1,170 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+// +build esiall esiredis
+
+package backend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/corestoreio/caddy-esi/esibus"
+	"github.com/corestoreio/caddy-esi/esitag"
+	"github.com/corestoreio/errors"
+	"github.com/gomodule/redigo/redis"
+)
+
+func init() {
+	esibus.RegisterFactory("redis", NewRedisBus)
+}
+
+// DefaultRedisBusChannel name of the Redis channel if the URL does not
+// contain the parameter channel.
+const DefaultRedisBusChannel = "caddyesi"
+
+// redisBusReconnectDelay waits between the attempts to subscribe again after
+// the connection to Redis has been lost.
+var redisBusReconnectDelay = time.Second
+
+type redisBus struct {
+	er      *esiRedis
+	channel string
+
+	mu     sync.Mutex
+	closed bool
+	psc    *redis.PubSubConn
+	done   chan struct{}
+}
+
+// NewRedisBus creates a new esibus.Bus which uses the Redis pub/sub commands.
+// The URL supports the same parameters as NewRedis and additionally the
+// parameter channel, e.g.:
+//		redis://localhost:6379/?channel=caddyesi_shop
+func NewRedisBus(url string) (esibus.Bus, error) {
+	opt := esitag.NewResourceOptions(url)
+	_, _, params, err := opt.ParseNoSQLURL()
+	if err != nil {
+		return nil, errors.NotValid.Newf("[backend] NewRedisBus error parsing URL %q => %s", url, err)
+	}
+	rh, err := NewRedis(opt)
+	if err != nil {
+		return nil, errors.Wrap(err, "[backend] NewRedisBus")
+	}
+	channel := params.Get("channel")
+	if channel == "" {
+		channel = DefaultRedisBusChannel
+	}
+	return &redisBus{
+		er:      rh.(*esiRedis),
+		channel: channel,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Publish sends the message to all subscribed nodes.
+func (rb *redisBus) Publish(m esibus.Message) error {
+	data, err := m.Encode()
+	if err != nil {
+		return errors.Wrap(err, "[backend] RedisBus.Publish")
+	}
+	conn := rb.er.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("PUBLISH", rb.channel, data)
+	return errors.Wrapf(err, "[backend] RedisBus.Publish %q => %q", rb.er.url, rb.channel)
+}
+
+// Subscribe subscribes to the channel and starts the receiving goroutine. A
+// lost connection gets established again and fn receives then a message with
+// the esibus.CommandReconnected. Invalid messages get dropped.
+func (rb *redisBus) Subscribe(fn func(esibus.Message)) error {
+	if err := rb.subscribe(); err != nil {
+		return errors.Wrap(err, "[backend] RedisBus.Subscribe")
+	}
+	go rb.receive(fn)
+	return nil
+}
+
+func (rb *redisBus) subscribe() error {
+	conn, err := rb.er.pool.Dial()
+	if err != nil {
+		return errors.Wrapf(err, "[backend] RedisBus Dial %q", rb.er.url)
+	}
+	psc := &redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(rb.channel); err != nil {
+		_ = conn.Close()
+		return errors.Wrapf(err, "[backend] RedisBus SUBSCRIBE %q => %q", rb.er.url, rb.channel)
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.closed {
+		_ = conn.Close()
+		return errors.AlreadyClosed.Newf("[backend] RedisBus %q already closed", rb.er.url)
+	}
+	rb.psc = psc
+	return nil
+}
+
+func (rb *redisBus) receive(fn func(esibus.Message)) {
+	defer close(rb.done)
+	for {
+		rb.mu.Lock()
+		psc := rb.psc
+		rb.mu.Unlock()
+
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			if m, err := esibus.DecodeMessage(v.Data); err == nil {
+				fn(m)
+			}
+		case error:
+			_ = psc.Close()
+			for {
+				if rb.isClosed() {
+					return
+				}
+				time.Sleep(redisBusReconnectDelay)
+				if err := rb.subscribe(); err == nil {
+					fn(esibus.Message{NodeID: esibus.NodeID, Command: esibus.CommandReconnected})
+					break
+				}
+			}
+		}
+	}
+}
+
+func (rb *redisBus) isClosed() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.closed
+}
+
+// Close unsubscribes and closes the connections to Redis.
+func (rb *redisBus) Close() error {
+	rb.mu.Lock()
+	if rb.closed {
+		rb.mu.Unlock()
+		return nil
+	}
+	rb.closed = true
+	psc := rb.psc
+	rb.mu.Unlock()
+
+	if psc != nil {
+		_ = psc.Close() // lets Receive return with an error
+		<-rb.done
+	}
+	return errors.Wrap(rb.er.Close(), "[backend] RedisBus.Close")
+}
@@ -0,0 +1,297 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+// +build esiall esiredis
+
+package backend
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corestoreio/caddy-esi/esitag"
+	"github.com/corestoreio/errors"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pierrec/xxHash/xxHash64"
+)
+
+// redisInvalidateEvents lists the keyspace events which change or remove a
+// key and therefore invalidate the fragments containing its value.
+var redisInvalidateEvents = map[string]bool{
+	"set":     true,
+	"del":     true,
+	"unlink":  true,
+	"expired": true,
+	"evicted": true,
+}
+
+// redisInvalidateMaxKeys limits the number of watched keys per Redis database.
+// Once exceeded, the least recently served key gets unsubscribed and its
+// fragments get purged, because a change of it would go unnoticed.
+var redisInvalidateMaxKeys = 10000
+
+// redisInvalidator subscribes to the keyspace notifications of the keys served
+// by DoRequest. The Redis server must publish them, e.g. with the
+// configuration notify-keyspace-events K$gxe. A changed key gets purged via its
+// surrogate key from all caches and gets unsubscribed until it gets served
+// again. The number of watched keys is limited by redisInvalidateMaxKeys.
+type redisInvalidator struct {
+	er     *esiRedis
+	prefix string // of the keyspace channel, contains the database
+	addrDB string // identifies the Redis database in the surrogate keys
+
+	mu      sync.Mutex
+	closed  bool
+	running bool
+	psc     *redis.PubSubConn
+	// keys maps the watched keys to their element in lru.
+	keys map[string]*list.Element
+	// lru contains the *redisWatch values, the most recently served key at
+	// the front.
+	lru  *list.List
+	done chan struct{}
+}
+
+// redisWatch a watched key and a channel which gets closed once Redis has
+// confirmed the subscription.
+type redisWatch struct {
+	key   string
+	ready chan struct{}
+}
+
+func newRedisInvalidator(er *esiRedis, addr, db string) *redisInvalidator {
+	return &redisInvalidator{
+		er:     er,
+		prefix: "__keyspace@" + db + "__:",
+		addrDB: addr + "/" + db + "/",
+		keys:   make(map[string]*list.Element),
+		lru:    list.New(),
+		done:   make(chan struct{}),
+	}
+}
+
+// surrogateKey hashes the key because a surrogate key must not contain spaces.
+func (ri *redisInvalidator) surrogateKey(key string) string {
+	return "esi_redis_" + strconv.FormatUint(xxHash64.Checksum([]byte(ri.addrDB+key), 0), 36)
+}
+
+// watch subscribes to the notifications of the key and returns the header
+// with the surrogate key of the key and a channel which gets closed once Redis
+// has confirmed the subscription. The value of the key must be read only after
+// the confirmation, otherwise a change in between gets lost. The first call
+// starts the receiving goroutine. A failed SUBSCRIBE closes the connection,
+// so the receiving goroutine reconnects, and returns the error.
+func (ri *redisInvalidator) watch(key string) (http.Header, <-chan struct{}, error) {
+	var evicted []string
+	defer func() { ri.purge(evicted...) }()
+
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	if ri.closed {
+		return nil, nil, errors.AlreadyClosed.Newf("[backend] RedisInvalidator %q already closed", ri.er.url)
+	}
+	if e, ok := ri.keys[key]; ok {
+		ri.lru.MoveToFront(e)
+		return ri.header(key), e.Value.(*redisWatch).ready, nil
+	}
+
+	w := &redisWatch{key: key, ready: make(chan struct{})}
+	ri.keys[key] = ri.lru.PushFront(w)
+	switch {
+	case !ri.running:
+		ri.running = true
+		go ri.run()
+	case ri.psc != nil:
+		if err := ri.psc.Subscribe(ri.prefix + key); err != nil {
+			ri.remove(key)
+			// lets Receive return with an error and the reconnect subscribes
+			// all keys again.
+			_ = ri.psc.Close()
+			ri.psc = nil
+			return nil, nil, errors.ConnectionFailed.New(err, "[backend] RedisInvalidator SUBSCRIBE %q. URL %q", key, ri.er.url)
+		}
+	}
+	for ri.lru.Len() > redisInvalidateMaxKeys {
+		old := ri.lru.Back().Value.(*redisWatch).key
+		ri.remove(old)
+		evicted = append(evicted, old)
+	}
+	return ri.header(key), w.ready, nil
+}
+
+func (ri *redisInvalidator) header(key string) http.Header {
+	return http.Header{esitag.SurrogateKeyHeader: []string{ri.surrogateKey(key)}}
+}
+
+// remove stops watching the key. ri.mu must be locked.
+func (ri *redisInvalidator) remove(key string) {
+	e, ok := ri.keys[key]
+	if !ok {
+		return
+	}
+	ri.lru.Remove(e)
+	delete(ri.keys, key)
+	if ri.psc != nil {
+		_ = ri.psc.Unsubscribe(ri.prefix + key)
+	}
+}
+
+// confirm marks the subscription of the key as active.
+func (ri *redisInvalidator) confirm(key string) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	if e, ok := ri.keys[key]; ok {
+		if w := e.Value.(*redisWatch); !isConfirmed(w.ready) {
+			close(w.ready)
+		}
+	}
+}
+
+func isConfirmed(ready chan struct{}) bool {
+	select {
+	case <-ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ri *redisInvalidator) run() {
+	defer close(ri.done)
+	var missed []string
+	for {
+		psc, err := ri.subscribe()
+		if err != nil {
+			if ri.isClosed() {
+				return
+			}
+			time.Sleep(redisBusReconnectDelay)
+			continue
+		}
+		// Notifications got lost while the connection was down. The requests
+		// for those keys wait for the new subscription, so no stale value gets
+		// cached again after the purge.
+		ri.purge(missed...)
+		missed = ri.receive(psc)
+	}
+}
+
+// subscribe opens a new connection and subscribes all watched keys.
+func (ri *redisInvalidator) subscribe() (*redis.PubSubConn, error) {
+	conn, err := ri.er.pool.Dial()
+	if err != nil {
+		return nil, errors.Wrapf(err, "[backend] RedisInvalidator Dial %q", ri.er.url)
+	}
+	psc := &redis.PubSubConn{Conn: conn}
+
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	if ri.closed {
+		_ = conn.Close()
+		return nil, errors.AlreadyClosed.Newf("[backend] RedisInvalidator %q already closed", ri.er.url)
+	}
+	channels := make([]interface{}, 0, len(ri.keys))
+	for key := range ri.keys {
+		channels = append(channels, ri.prefix+key)
+	}
+	if len(channels) > 0 {
+		if err := psc.Subscribe(channels...); err != nil {
+			_ = conn.Close()
+			return nil, errors.Wrapf(err, "[backend] RedisInvalidator SUBSCRIBE %q", ri.er.url)
+		}
+	}
+	ri.psc = psc
+	return psc, nil
+}
+
+// receive handles the notifications until the connection fails or gets
+// closed. It returns the keys whose notifications might get lost until the
+// reconnect. Those keys become unconfirmed again.
+func (ri *redisInvalidator) receive(psc *redis.PubSubConn) (missed []string) {
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			if redisInvalidateEvents[string(v.Data)] && strings.HasPrefix(v.Channel, ri.prefix) {
+				ri.invalidate(v.Channel[len(ri.prefix):])
+			}
+		case redis.Subscription:
+			if v.Kind == "subscribe" && strings.HasPrefix(v.Channel, ri.prefix) {
+				ri.confirm(v.Channel[len(ri.prefix):])
+			}
+		case error:
+			ri.mu.Lock()
+			ri.psc = nil
+			for e := ri.lru.Front(); e != nil; e = e.Next() {
+				if w := e.Value.(*redisWatch); isConfirmed(w.ready) {
+					w.ready = make(chan struct{})
+					missed = append(missed, w.key)
+				}
+			}
+			ri.mu.Unlock()
+			_ = psc.Close()
+			return missed
+		}
+	}
+}
+
+// invalidate stops watching the key and purges its fragments.
+func (ri *redisInvalidator) invalidate(key string) {
+	ri.mu.Lock()
+	ri.remove(key)
+	ri.mu.Unlock()
+	ri.purge(key)
+}
+
+// purge removes the fragments of the keys from all caches. An error of a cache
+// cannot be handled here and gets dropped.
+func (ri *redisInvalidator) purge(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	sKeys := make([]string, len(keys))
+	for i, key := range keys {
+		sKeys[i] = ri.surrogateKey(key)
+	}
+	_ = esitag.InvalidateSurrogateKeys(sKeys...)
+}
+
+func (ri *redisInvalidator) isClosed() bool {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	return ri.closed
+}
+
+// Close stops the receiving goroutine.
+func (ri *redisInvalidator) Close() error {
+	ri.mu.Lock()
+	if ri.closed {
+		ri.mu.Unlock()
+		return nil
+	}
+	ri.closed = true
+	psc, running := ri.psc, ri.running
+	ri.mu.Unlock()
+
+	if psc != nil {
+		_ = psc.Close() // lets Receive return with an error
+	}
+	if running {
+		<-ri.done
+	}
+	return nil
+}
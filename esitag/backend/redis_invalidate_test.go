@@ -0,0 +1,61 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+// +build esiall esiredis
+
+package backend
+
+import (
+	"testing"
+
+	"github.com/corestoreio/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisInvalidator_Watch(t *testing.T) {
+	// t.Parallel() not possible due to redisInvalidateMaxKeys
+
+	defer func(max int) { redisInvalidateMaxKeys = max }(redisInvalidateMaxKeys)
+	redisInvalidateMaxKeys = 2
+
+	ri := newRedisInvalidator(&esiRedis{url: "redis://localhost:6379/?db=0"}, "localhost:6379", "0")
+	ri.running = true // no receiving goroutine and no connection
+
+	hdrA, readyA, err := ri.watch("a")
+	require.NoError(t, err)
+	assert.NotEmpty(t, hdrA.Get("Surrogate-Key"))
+	_, _, err = ri.watch("b")
+	require.NoError(t, err)
+	_, readyA2, err := ri.watch("a") // a becomes the most recently served key
+	require.NoError(t, err)
+	assert.True(t, readyA == readyA2, "Same key must return the same channel")
+
+	_, _, err = ri.watch("c")
+	require.NoError(t, err)
+	assert.Len(t, ri.keys, 2)
+	assert.Exactly(t, 2, ri.lru.Len())
+	_, ok := ri.keys["b"]
+	assert.False(t, ok, "Least recently served key b must be evicted")
+
+	ri.confirm("a")
+	assert.True(t, isConfirmed(ri.keys["a"].Value.(*redisWatch).ready))
+	ri.invalidate("a")
+	assert.Len(t, ri.keys, 1)
+
+	close(ri.done) // there is no receiving goroutine to wait for
+	require.NoError(t, ri.Close())
+	_, _, err = ri.watch("a")
+	assert.True(t, errors.AlreadyClosed.Match(err), "%+v", err)
+}
@@ -26,9 +26,12 @@ import (
 	"time"
 
 	"github.com/alicebob/miniredis"
+	"github.com/corestoreio/caddy-esi/esicache"
 	"github.com/corestoreio/caddy-esi/esitag"
 	"github.com/corestoreio/caddy-esi/esitag/backend"
 	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log"
+	"github.com/gomodule/redigo/redis"
 	"github.com/mitchellh/go-ps"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -361,3 +364,76 @@ func TestRedisNewResourceHandler(t *testing.T) {
 		assert.True(t, errors.NotSupported.Match(err), "%+v", err)
 	})
 }
+
+func TestNewRedisCacher(t *testing.T) {
+	t.Parallel()
+
+	mr := miniredis.NewMiniRedis()
+	if err := mr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	c, err := esicache.NewCacher(fmt.Sprintf("redis://%s", mr.Addr()))
+	require.NoError(t, err, "%+v", err)
+
+	v, err := c.Get("cart_4711")
+	assert.Nil(t, v)
+	assert.True(t, errors.NotFound.Match(err), "%+v", err)
+
+	require.NoError(t, c.Set("cart_4711", []byte(`Cart`), time.Minute))
+
+	v, err = c.Get("cart_4711")
+	require.NoError(t, err, "%+v", err)
+	assert.Exactly(t, `Cart`, string(v))
+}
+
+func TestNewRedis_Invalidate(t *testing.T) {
+	// t.Parallel() not possible due to the global esicache.MainRegistry
+
+	if isRedisRunning < 2 {
+		t.Skip("Redis not running or not installed. Skipping...")
+	}
+
+	defer esicache.MainRegistry.Clear()
+	require.NoError(t, esicache.MainRegistry.Register("/redis_inv", "inmemory", false))
+
+	be, err := backend.NewRedis(esitag.NewResourceOptions("redis://localhost:6379/?db=0&invalidate=1"))
+	require.NoError(t, err, "%+v", err)
+	defer be.Close()
+	defer esitag.RegisterResourceHandler("redisInv", be).DeferredDeregister()
+
+	conn, err := redis.Dial("tcp", "localhost:6379")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Do("SET", "esi_inv_cart_4711", "Cart 1")
+	require.NoError(t, err)
+
+	ets, err := esitag.Parse(strings.NewReader(`<esi:include src="redisInv" key="esi_inv_cart_4711" ttl="1h" timeout="1s" maxbodysize="1KB"/>`))
+	require.NoError(t, err)
+	ets.ApplyLogger(log.BlackHole{})
+	ets[0].SetDefaultConfig(esitag.Config{Cache: esicache.MainRegistry.Get("/redis_inv")})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	_, data, err := ets[0].QueryResourcesHeader(req)
+	require.NoError(t, err, "%+v", err)
+	assert.Exactly(t, `Cart 1`, string(data))
+
+	// The subscription has been confirmed before the GET, so the channel
+	// already has a subscriber. The notification gets published here too
+	// because the Redis server might not have enabled the keyspace
+	// notifications.
+	prevInvalidations := esitag.Invalidations()
+	_, err = conn.Do("SET", "esi_inv_cart_4711", "Cart 2")
+	require.NoError(t, err)
+	receivers, err := redis.Int(conn.Do("PUBLISH", "__keyspace@0__:esi_inv_cart_4711", "set"))
+	require.NoError(t, err)
+	assert.Exactly(t, 1, receivers, "Subscription must be active when DoRequest returns")
+	for i := 0; i < 100 && esitag.Invalidations() == prevInvalidations; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, data, err = ets[0].QueryResourcesHeader(req)
+	require.NoError(t, err, "%+v", err)
+	assert.Exactly(t, `Cart 2`, string(data))
+}
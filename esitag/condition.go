@@ -16,6 +16,10 @@ package esitag
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/corestoreio/errors"
 )
 
 // Conditioner does not represent your favorite shampoo but it gives you the
@@ -25,10 +29,310 @@ type Conditioner interface {
 	OK(r *http.Request) bool
 }
 
+// NewCondition parses a test expression as used in the attribute test of an
+// esi:when tag. Operands can be placeholders as known from the Replacer, e.g.
+// {CGroup} or {HAccept-Language}, ESI variables like $(HTTP_COOKIE{group}),
+// quoted string literals or numbers. Supported
+// operators are ==, !=, <, <=, >, >=, ! and the logical && (&) and || (|),
+// grouped by parentheses. Two numeric operands get compared as numbers, all
+// other operands as strings. A single operand evaluates to true if it is not
+// empty, not "0" and not "false".
+//		{Cgroup} == 'advanced'
+//		({HX-Gopher} != '') && !({Fpage} > 3)
+func NewCondition(expr string) (Conditioner, error) {
+	toks, err := condTokenize(expr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "[esitag] NewCondition failed to tokenize %q", expr)
+	}
+	if len(toks) == 0 {
+		return nil, errors.Empty.Newf("[esitag] NewCondition: Empty expression")
+	}
+	p := &condParser{toks: toks}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, errors.Wrapf(err, "[esitag] NewCondition failed to parse %q", expr)
+	}
+	if p.pos < len(p.toks) {
+		return nil, errors.NotValid.Newf("[esitag] NewCondition unexpected token %q in %q", p.toks[p.pos].val, expr)
+	}
+	return condition{expr: expr, root: n}, nil
+}
+
+// condition implements Conditioner and holds the parsed expression tree.
 type condition struct {
+	expr string
+	root condNode
 }
 
+// OK evaluates the expression against the request. The placeholders get
+// resolved with the same Replacer as used for the src and key attributes.
 func (c condition) OK(r *http.Request) bool {
-	// todo
-	return false
+	if c.root == nil || r == nil {
+		return false
+	}
+	return c.root.eval(MakeReplacer(r, "")).truthy()
+}
+
+// String returns the raw expression.
+func (c condition) String() string {
+	return c.expr
+}
+
+type condTokenKind uint8
+
+const (
+	condTokOperand condTokenKind = iota + 1 // placeholder or bare word/number
+	condTokString                           // quoted literal
+	condTokOp                               // operator or parenthesis
+)
+
+type condToken struct {
+	kind condTokenKind
+	val  string
+}
+
+func condTokenize(s string) ([]condToken, error) {
+	toks := make([]condToken, 0, 8)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, errors.NotValid.Newf("[esitag] Unterminated string literal at position %d", i)
+			}
+			toks = append(toks, condToken{kind: condTokString, val: s[i+1 : i+1+end]})
+			i += end + 2
+		case c == '$' && strings.HasPrefix(s[i:], "$("):
+			_, _, _, _, n := parseESIVar(s[i:])
+			if n == 0 {
+				return nil, errors.NotValid.Newf("[esitag] Malformed ESI variable at position %d", i)
+			}
+			toks = append(toks, condToken{kind: condTokOperand, val: s[i : i+n]})
+			i += n
+		case c == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return nil, errors.NotValid.Newf("[esitag] Unterminated placeholder at position %d", i)
+			}
+			toks = append(toks, condToken{kind: condTokOperand, val: s[i : i+end+1]})
+			i += end + 1
+		case strings.IndexByte("()!=<>&|", c) >= 0:
+			op := string(c)
+			if i+1 < len(s) {
+				switch two := s[i : i+2]; two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = two
+				}
+			}
+			i += len(op)
+			switch op {
+			case "=":
+				return nil, errors.NotValid.Newf("[esitag] Single = at position %d, did you mean ==", i-1)
+			case "&":
+				op = "&&"
+			case "|":
+				op = "||"
+			}
+			toks = append(toks, condToken{kind: condTokOp, val: op})
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t\n\r()!=<>&|'\"{", s[j]) < 0 {
+				j++
+			}
+			toks = append(toks, condToken{kind: condTokOperand, val: s[i:j]})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// condParser a recursive descent parser with the precedence: || lowest, then
+// &&, then the comparison operators and the highest precedence has the unary !.
+type condParser struct {
+	toks []condToken
+	pos  int
+}
+
+func (p *condParser) peekOp(ops ...string) (string, bool) {
+	if p.pos >= len(p.toks) || p.toks[p.pos].kind != condTokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.toks[p.pos].val == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *condParser) parseOr() (condNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOp("||"); !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = condLogical{or: true, left: left, right: right}
+	}
+}
+
+func (p *condParser) parseAnd() (condNode, error) {
+	left, err := p.parseCompare()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOp("&&"); !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseCompare()
+		if err != nil {
+			return nil, err
+		}
+		left = condLogical{left: left, right: right}
+	}
+}
+
+func (p *condParser) parseCompare() (condNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.peekOp("==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return condCompare{op: op, left: left, right: right}, nil
+}
+
+func (p *condParser) parseUnary() (condNode, error) {
+	if p.pos >= len(p.toks) {
+		return nil, errors.NotValid.Newf("[esitag] Unexpected end of expression")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	switch {
+	case t.kind == condTokOp && t.val == "!":
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return condNot{n: n}, nil
+	case t.kind == condTokOp && t.val == "(":
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.peekOp(")"); !ok {
+			return nil, errors.NotValid.Newf("[esitag] Missing closing parenthesis")
+		}
+		p.pos++
+		return n, nil
+	case t.kind == condTokString:
+		return condLiteral(t.val), nil
+	case t.kind == condTokOperand && len(t.val) > 2 && (t.val[0] == '{' || t.val[0] == '$'):
+		return condPlaceholder(t.val), nil
+	case t.kind == condTokOperand:
+		return condLiteral(t.val), nil
+	}
+	return nil, errors.NotValid.Newf("[esitag] Unexpected operator %q", t.val)
+}
+
+// condValue represents the result of an evaluated node.
+type condValue string
+
+func (v condValue) truthy() bool {
+	return v != "" && v != "0" && v != "false"
+}
+
+func condBool(b bool) condValue {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+type condNode interface {
+	eval(Replacer) condValue
+}
+
+type condLiteral string
+
+func (l condLiteral) eval(Replacer) condValue { return condValue(l) }
+
+type condPlaceholder string
+
+func (ph condPlaceholder) eval(r Replacer) condValue { return condValue(r.Replace(string(ph))) }
+
+type condNot struct {
+	n condNode
+}
+
+func (n condNot) eval(r Replacer) condValue { return condBool(!n.n.eval(r).truthy()) }
+
+type condLogical struct {
+	or          bool
+	left, right condNode
+}
+
+func (l condLogical) eval(r Replacer) condValue {
+	if l.or {
+		return condBool(l.left.eval(r).truthy() || l.right.eval(r).truthy())
+	}
+	return condBool(l.left.eval(r).truthy() && l.right.eval(r).truthy())
+}
+
+type condCompare struct {
+	op          string
+	left, right condNode
+}
+
+func (c condCompare) eval(r Replacer) condValue {
+	lv, rv := string(c.left.eval(r)), string(c.right.eval(r))
+
+	cmp := strings.Compare(lv, rv)
+	if lf, err := strconv.ParseFloat(lv, 64); err == nil {
+		if rf, err := strconv.ParseFloat(rv, 64); err == nil {
+			switch {
+			case lf < rf:
+				cmp = -1
+			case lf > rf:
+				cmp = 1
+			default:
+				cmp = 0
+			}
+		}
+	}
+
+	switch c.op {
+	case "==":
+		return condBool(cmp == 0)
+	case "!=":
+		return condBool(cmp != 0)
+	case "<":
+		return condBool(cmp < 0)
+	case "<=":
+		return condBool(cmp <= 0)
+	case ">":
+		return condBool(cmp > 0)
+	case ">=":
+		return condBool(cmp >= 0)
+	}
+	return condBool(false)
 }
@@ -0,0 +1,66 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package esitag_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/corestoreio/caddy-esi/esitag"
+	"github.com/corestoreio/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCondition(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest("GET", "https://corestore.io/catalog/product?page=4&q=gopher", nil)
+	req.Header.Set("X-Gopher", "Rob")
+	req.Header.Set("Cookie", "group=advanced; currency=CHF")
+
+	runner := func(expr string, want bool, wantErrBhf errors.Kind) func(*testing.T) {
+		return func(t *testing.T) {
+			c, err := esitag.NewCondition(expr)
+			if wantErrBhf > 0 {
+				assert.Nil(t, c)
+				assert.True(t, wantErrBhf.Match(err), "%+v", err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			assert.Exactly(t, want, c.OK(req), "Expression: %q", expr)
+		}
+	}
+
+	t.Run("cookie equal", runner(`{Cgroup}=='advanced'`, true, errors.NoKind))
+	t.Run("cookie not equal", runner(`{Cgroup} != "advanced"`, false, errors.NoKind))
+	t.Run("header and cookie", runner(`{HX-Gopher} == 'Rob' && {Ccurrency} == 'CHF'`, true, errors.NoKind))
+	t.Run("single ampersand", runner(`{HX-Gopher} == 'Rob' & {Ccurrency} == 'EUR'`, false, errors.NoKind))
+	t.Run("or", runner(`{HX-Gopher} == 'Ken' || {Ccurrency} == 'CHF'`, true, errors.NoKind))
+	t.Run("numeric greater", runner(`{Fpage} > 3`, true, errors.NoKind))
+	t.Run("numeric not string compare", runner(`{Fpage} < 10`, true, errors.NoKind))
+	t.Run("negation with parentheses", runner(`!({Fpage} >= 4)`, false, errors.NoKind))
+	t.Run("single operand not empty", runner(`{Fq}`, true, errors.NoKind))
+	t.Run("single operand empty", runner(`{Fnot_set}`, false, errors.NoKind))
+	t.Run("precedence and before or", runner(`1 == 2 && 3 == 3 || 'a' == 'a'`, true, errors.NoKind))
+	t.Run("ESI variable", runner(`$(HTTP_COOKIE{group})=='advanced' && $(QUERY_STRING{page}) > 3`, true, errors.NoKind))
+	t.Run("malformed ESI variable", runner(`$(HTTP_COOKIE{group}=='advanced'`, false, errors.NotValid))
+	t.Run("empty expression", runner(``, false, errors.Empty))
+	t.Run("single equal sign", runner(`{Cgroup}='advanced'`, false, errors.NotValid))
+	t.Run("unterminated string", runner(`{Cgroup}=='advanced`, false, errors.NotValid))
+	t.Run("missing parenthesis", runner(`({Cgroup}=='advanced'`, false, errors.NotValid))
+	t.Run("dangling operator", runner(`{Cgroup}==`, false, errors.NotValid))
+}
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net/http"
 
 	"github.com/corestoreio/errors"
 )
@@ -29,6 +30,9 @@ type DataTag struct {
 	Data  []byte // Data from the micro service gathered in a goroutine. Can be nil.
 	Start int    // Start position in the stream
 	End   int    // End position in the stream. Never smaller than Start.
+	// Header contains the headers which the micro service returns to the
+	// client as defined in the attribute returnheaders. Can be nil.
+	Header http.Header
 }
 
 // String prints human readable the data tag for debugging purposes.
@@ -64,24 +68,6 @@ func NewDataTagsCapped(cap int) *DataTags {
 	}
 }
 
-// fullNextTag looks ahead if the next tag is fully contained in the current
-// data slice. Returns the relative start position of the next tag. Returns also
-// true if we reach the last tag in the Slice.
-func (dts *DataTags) fullNextTag(nextIdx, dataLen int) (relPosStart int, hasNext, isLast bool) {
-	if nextIdx > dts.Len() {
-		return 0, false, false
-	}
-	if nextIdx == dts.Len() { // reached end of slice
-		return dataLen, true, true
-	}
-
-	dt := dts.Slice[nextIdx]
-	relPosStart = dt.Start - dts.streamPrev
-	relPosEnd := dataLen - (dts.streamCur - dt.End)
-	hasFullTagInData := dt.Start >= dts.streamPrev && dt.End <= dts.streamCur && relPosStart > 0 && relPosEnd > 0 && relPosStart < dataLen && relPosEnd <= dataLen
-	return relPosStart, hasFullTagInData, false
-}
-
 // ResetStates exported for Benchmarks. Resets the internal state machine to
 // re-run the injector without instantiating a new object.
 func (dts *DataTags) ResetStates() {
@@ -97,8 +83,9 @@ func (dts *DataTags) ResetStates() {
 // argument and then writes the output to w. DataTags must be a sorted slice.
 // Usually this function receives the data from Entities.QueryResources(). This
 // function can be called multiple times. It tracks the stream position and
-// inserts the ESI tag once the correct position has been reached. This function
-// cannot yet be used in parallel.
+// inserts the ESI tag once the correct position has been reached. A tag can
+// span several calls, e.g. a large esi:choose block, and one call can contain
+// several tags. This function cannot yet be used in parallel.
 func (dts *DataTags) InjectContent(data []byte, w io.Writer) (nWritten int, _ error) {
 	if dts.writeStates == nil {
 		dts.writeStates = make([]uint8, len(dts.Slice))
@@ -111,8 +98,6 @@ func (dts *DataTags) InjectContent(data []byte, w io.Writer) (nWritten int, _ er
 		writeStateDone
 	)
 
-	//fmt.Printf("INPUT: %q\n", data)
-
 	dataLen := len(data)
 
 	if dts.Len() == 0 || dataLen == 0 {
@@ -123,124 +108,52 @@ func (dts *DataTags) InjectContent(data []byte, w io.Writer) (nWritten int, _ er
 
 	dts.streamCur += dataLen
 
-	tagWritten := false
-	prevRelPosEnd := 0
+	// pos is the relative position in data up to which the data has been
+	// written or skipped because it belongs to a tag.
+	pos := 0
 	for di, dt := range dts.Slice {
-		// - InjectContent can be called n-times with an unknown amount of streamed data.
-		// - one DataTag can only be inserted once
-		//   - DataTag can occur completely in `data`
-		//   - DataTag cannot be found in `data`
-		//   - DataTag can have a start position but no End position
-		//   - DataTag can wait until the data comes in with the end position
-		//   - DataTags can occur 1+n times in the data; complex case
+		if dts.writeStates[di] == writeStateDone {
+			continue
+		}
 
 		relPosStart := dt.Start - dts.streamPrev
-		relPosEnd := dataLen - (dts.streamCur - dt.End)
-
-		hasPosStartInData := relPosStart < dataLen && relPosEnd > dataLen && dt.Start < dts.streamCur
-		hasPosEndInData := relPosStart < 0 && relPosEnd > 0 && relPosEnd < dataLen && dt.End <= dts.streamCur
-		hasFullTagInData := dt.Start >= dts.streamPrev && dt.End <= dts.streamCur && relPosStart > 0 && relPosEnd > 0 && relPosStart < dataLen && relPosEnd <= dataLen
-
-		//fmt.Printf("TagID[%d]: Data[%03d] dt.Start[%03d] dt.End[%03d] dts.streamPrev[%03d] dts.streamCur[%03d] relPosStart[%03d] relPosEnd[%03d] hasPosStartInData[%t] hasPosEndInData[%t] hasFullTagInData[%t]\n",
-		//	di, dataLen, dt.Start, dt.End, dts.streamPrev, dts.streamCur, relPosStart, relPosEnd,
-		//	hasPosStartInData, hasPosEndInData, hasFullTagInData)
+		relPosEnd := dt.End - dts.streamPrev
+		if relPosStart >= dataLen {
+			break // this and all following tags start in a later chunk
+		}
 
-		switch dts.writeStates[di] {
-		case writeStateDone:
-			// do nothing
-		case writeStateProgress:
-			if hasPosEndInData {
-				wn, err := w.Write(data[relPosEnd:])
+		if dts.writeStates[di] == writeStateWaiting {
+			if relPosStart > pos {
+				wn, err := w.Write(data[pos:relPosStart])
 				if err != nil {
 					return nWritten, errors.WriteFailed.New(err, writeErr, di, dt.Start, dt.End)
 				}
 				nWritten += wn
-				dts.writeStates[di] = writeStateDone
 			}
-			tagWritten = true
-		case writeStateWaiting:
-			switch {
-			case hasFullTagInData:
-				// data can contain:
-				// - one esi tag: write before, write tag, write after, hasNext is false!
-				// - two esi tags where we need to write the middle part between the ESI tags
-				// - n ESI tags.
-
-				// look ahead to see if the next DataTag is fully contained in the current data
-				// byte slice.
-				if nextStartPos, hasNext, isLast := dts.fullNextTag(di+1, dataLen); hasNext {
-					//fmt.Printf("TagID[%d] nextStartPos[%d] prevRelPosEnd[%d]\n", di, nextStartPos, prevRelPosEnd)
-					//fmt.Printf("TagID[%d] before: %q\n", di, data[prevRelPosEnd:relPosStart])
-					//fmt.Printf("TagID[%d] after: %q\n", di, data[relPosEnd:nextStartPos])
-					wn, err := w.Write(data[prevRelPosEnd:relPosStart])
-					if err != nil {
-						return nWritten, errors.WriteFailed.New(err, writeErr, di, dt.Start, dt.End)
-					}
-					nWritten += wn
-
-					wn, err = w.Write(dt.Data)
-					if err != nil {
-						return nWritten, errors.WriteFailed.New(err, writeErr, di, dt.Start, dt.End)
-					}
-					nWritten += wn
-
-					if isLast {
-						wn, err := w.Write(data[relPosEnd:nextStartPos])
-						if err != nil {
-							return nWritten, errors.WriteFailed.New(err, writeErr, di, dt.Start, dt.End)
-						}
-						nWritten += wn
-					}
-				} else {
-					// We only have one full tag in the current data slice.
-					// write before tag, write DataTag itself, then write the remaining chunks
-					wn, err := w.Write(data[:relPosStart])
-					if err != nil {
-						return nWritten, errors.WriteFailed.New(err, writeErr, di, dt.Start, dt.End)
-					}
-					nWritten += wn
-
-					wn, err = w.Write(dt.Data)
-					if err != nil {
-						return nWritten, errors.WriteFailed.New(err, writeErr, di, dt.Start, dt.End)
-					}
-					nWritten += wn
-
-					wn, err = w.Write(data[relPosEnd:])
-					if err != nil {
-						return nWritten, errors.WriteFailed.New(err, writeErr, di, dt.Start, dt.End)
-					}
-					nWritten += wn
-				}
-				dts.writeStates[di] = writeStateDone
-				prevRelPosEnd = relPosEnd
-				tagWritten = true
-
-			case hasPosStartInData:
-				wn, err := w.Write(data[:relPosStart])
-				if err != nil {
-					return nWritten, errors.WriteFailed.New(err, writeErr, di, dt.Start, dt.End)
-				}
-				nWritten += wn
-
-				wn, err = w.Write(dt.Data)
-				if err != nil {
-					return nWritten, errors.WriteFailed.New(err, writeErr, di, dt.Start, dt.End)
-				}
-				nWritten += wn
-
-				dts.writeStates[di] = writeStateProgress
-				tagWritten = true
+			wn, err := w.Write(dt.Data)
+			if err != nil {
+				return nWritten, errors.WriteFailed.New(err, writeErr, di, dt.Start, dt.End)
 			}
+			nWritten += wn
+			dts.writeStates[di] = writeStateProgress
+		}
+
+		if relPosEnd > dataLen {
+			pos = dataLen // the tag continues in the next chunk
+			break
 		}
+		if relPosEnd > pos {
+			pos = relPosEnd
+		}
+		dts.writeStates[di] = writeStateDone
 	}
 
-	if !tagWritten {
-		n, err := w.Write(data)
-		nWritten += n
+	if pos < dataLen {
+		wn, err := w.Write(data[pos:])
 		if err != nil {
 			return nWritten, errors.WriteFailed.New(err, "[esitag] InjectContent failed to copy remaining data to w")
 		}
+		nWritten += wn
 	}
 
 	dts.streamPrev += dataLen
@@ -248,6 +161,17 @@ func (dts *DataTags) InjectContent(data []byte, w io.Writer) (nWritten int, _ er
 	return nWritten, nil
 }
 
+// InProgress returns true if InjectContent has written the data of a tag but
+// the raw tag continues in the next chunk.
+func (dts *DataTags) InProgress() bool {
+	for _, ws := range dts.writeStates {
+		if ws == 1 {
+			return true
+		}
+	}
+	return false
+}
+
 // DataLen returns the total length of all data fields in bytes.
 func (dts *DataTags) DataLen() (l int) {
 	for _, dt := range dts.Slice {
@@ -261,6 +185,35 @@ func (dts *DataTags) DataLen() (l int) {
 	return
 }
 
+// MergeHeader merges the headers returned by the micro services into dst. The
+// Slice must be sorted to get the order of the tags in the page. Rules:
+// Set-Cookie values get appended. All other headers already present in dst
+// stay untouched, e.g. set by the page itself, otherwise the first tag in the
+// page which returns the header wins. Headers listed in DropHeadersReturn never
+// get merged.
+func (dts *DataTags) MergeHeader(dst http.Header) {
+	for _, dt := range dts.Slice {
+		for hn, hvs := range dt.Header {
+			switch {
+			case DropHeadersReturn[hn]:
+			case hn == "Set-Cookie":
+				dst[hn] = append(dst[hn], hvs...)
+			case len(dst[hn]) == 0:
+				dst[hn] = append([]string(nil), hvs...)
+			}
+		}
+	}
+}
+
+func (dts *DataTags) hasHeader() bool {
+	for _, dt := range dts.Slice {
+		if len(dt.Header) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (dts *DataTags) Len() int           { return len(dts.Slice) }
 func (dts *DataTags) Swap(i, j int)      { dts.Slice[i], dts.Slice[j] = dts.Slice[j], dts.Slice[i] }
 func (dts *DataTags) Less(i, j int) bool { return dts.Slice[i].Start < dts.Slice[j].Start }
@@ -16,6 +16,7 @@ package esitag_test
 
 import (
 	"fmt"
+	"net/http"
 	"testing"
 
 	"github.com/corestoreio/caddy-esi/esitag"
@@ -44,3 +45,47 @@ func TestDataTags_String(t *testing.T) {
 		"IDX(1/2): Start:000100 End:000200 Tag:\"Content \\\"testE2b://micro2.service2\\\" Timeout 2s MaxBody 3.0 kB\"\nIDX(2/2): Start:001000 End:002000 Tag:\"Content \\\"testE1b://micro2.service2\\\" Timeout 3s MaxBody 5.0 kB\"\n",
 		tags.String())
 }
+
+func TestDataTags_MergeHeader(t *testing.T) {
+	t.Parallel()
+
+	tags := newTestDataTags(
+		esitag.DataTag{
+			Start: 100,
+			End:   200,
+			Header: http.Header{
+				"Set-Cookie": []string{"cart=1"},
+				"X-Foo":      []string{"Tag1"},
+			},
+		},
+		esitag.DataTag{
+			Start: 300,
+			End:   400,
+			Header: http.Header{
+				"Set-Cookie":   []string{"wishlist=2", "user=3"},
+				"X-Foo":        []string{"Tag2"},
+				"X-Bar":        []string{"Tag2"},
+				"X-Page":       []string{"Tag2"},
+				"Content-Type": []string{"application/json"},
+			},
+		},
+		esitag.DataTag{
+			Start: 500,
+			End:   600,
+		},
+	)
+	dst := http.Header{
+		"Set-Cookie":   []string{"session=0"},
+		"X-Page":       []string{"Page"},
+		"Content-Type": []string{"text/html"},
+	}
+	tags.MergeHeader(dst)
+
+	assert.Exactly(t, http.Header{
+		"Set-Cookie":   []string{"session=0", "cart=1", "wishlist=2", "user=3"},
+		"X-Page":       []string{"Page"},
+		"Content-Type": []string{"text/html"},
+		"X-Foo":        []string{"Tag1"},
+		"X-Bar":        []string{"Tag2"},
+	}, dst)
+}
@@ -0,0 +1,225 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package esitag
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+
+	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log"
+)
+
+// Block represents the content between an opening and a closing ESI block tag,
+// for example esi:when, esi:otherwise or esi:attempt. A block gets rendered by replacing
+// its nested entities with the data from their resources.
+type Block struct {
+	// RawTag contains the content of the opening tag, e.g. `when test="..."`.
+	// Empty for the content of a <!--esi ... --> section.
+	RawTag []byte
+	// Test gets evaluated for each request to decide whether the esi:when block
+	// gets rendered. Nil for esi:otherwise.
+	Test Conditioner
+	// Body contains the raw markup between the opening and the closing tag.
+	Body []byte
+	// Entities nested within the Body. Their DataTag positions are relative to
+	// the beginning of the Body.
+	Entities Entities
+	// ReplaceVars gets set for esi:vars. The ESI variables in the Body outside
+	// of the nested entities get replaced with HTML-escaped values.
+	ReplaceVars bool
+}
+
+// ParseRaw parses the RawTag field and the nested entities.
+func (b *Block) ParseRaw() error {
+	if err := b.parseAttributes(); err != nil {
+		return err
+	}
+	return errors.Wrapf(b.Entities.ParseRaw(), "[esitag] Block %q", b.RawTag)
+}
+
+// parseAttributes parses only the RawTag field.
+func (b *Block) parseAttributes() error {
+	matches, err := SplitAttributes(string(b.RawTag))
+	if err != nil {
+		return errors.Wrap(err, "[esitag] Block SplitAttributes")
+	}
+	name := tagName(b.RawTag)
+	for j := 0; j < len(matches); j = j + 2 {
+		attr := matches[j]
+		value := matches[j+1]
+
+		switch {
+		case attr == "test" && name == tagWhen:
+			if b.Test, err = NewCondition(value); err != nil {
+				return errors.Wrapf(err, "[esitag] Failed to parse test %q in tag %q", value, b.RawTag)
+			}
+		case len(attr) > 1 && attr[0] == 'x':
+			// temporarily disabled attribute
+		default:
+			return errors.NotSupported.Newf("[esitag] Unsupported attribute name %q with value %q in tag %q", attr, value, b.RawTag)
+		}
+	}
+	if name == tagWhen && b.Test == nil {
+		return errors.Empty.Newf("[esitag] Missing attribute test in tag %q", b.RawTag)
+	}
+	return nil
+}
+
+// render queries the resources of the nested entities and injects their data
+// into a copy of the Body. If strict is true, a failing nested include returns
+// an error instead of its onerror content. The returned header contains the
+// merged return headers of the nested entities and might be nil.
+func (b *Block) render(r *http.Request, strict bool) (http.Header, []byte, error) {
+	if len(b.Entities) == 0 {
+		if b.ReplaceVars {
+			return nil, []byte(replaceVarsHTML(r, string(b.Body))), nil
+		}
+		return nil, b.Body, nil
+	}
+
+	cTag := make(chan DataTag, len(b.Entities))
+	if err := b.Entities.queryResources(cTag, r, strict); err != nil {
+		return nil, nil, errors.Wrapf(err, "[esitag] Block %q QueryResources", b.RawTag)
+	}
+	close(cTag)
+
+	tags := NewDataTagsCapped(len(b.Entities))
+	for t := range cTag {
+		tags.Slice = append(tags.Slice, t)
+	}
+	sort.Sort(tags)
+
+	body := b.Body
+	if b.ReplaceVars {
+		body = replaceBlockVars(r, body, tags)
+	}
+
+	var hdr http.Header
+	if tags.hasHeader() {
+		hdr = make(http.Header)
+		tags.MergeHeader(hdr)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(body)+tags.DataLen()))
+	if _, err := tags.InjectContent(body, buf); err != nil {
+		return nil, nil, errors.Wrapf(err, "[esitag] Block %q InjectContent", b.RawTag)
+	}
+	return hdr, buf.Bytes(), nil
+}
+
+// replaceBlockVars replaces the ESI variables in body outside of the sorted
+// tags and moves the positions of the tags accordingly.
+func replaceBlockVars(r *http.Request, body []byte, tags *DataTags) []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(body))
+	prev := 0
+	for i, t := range tags.Slice {
+		buf.WriteString(replaceVarsHTML(r, string(body[prev:t.Start])))
+		tags.Slice[i].Start = buf.Len()
+		buf.Write(body[t.Start:t.End])
+		tags.Slice[i].End = buf.Len()
+		prev = t.End
+	}
+	buf.WriteString(replaceVarsHTML(r, string(body[prev:])))
+	return buf.Bytes()
+}
+
+// chooseBlock returns the first esi:when block whose test evaluates to true or
+// the esi:otherwise block. Returns nil if no block matches.
+func (et *Entity) chooseBlock(r *http.Request) *Block {
+	var otherwise *Block
+	for _, b := range et.Choose {
+		switch {
+		case b.Test == nil:
+			if otherwise == nil {
+				otherwise = b
+			}
+		case b.Test.OK(r):
+			return b
+		}
+	}
+	return otherwise
+}
+
+// queryChoose renders the selected block of an esi:choose. The not selected
+// blocks and their resources won't get touched.
+func (et *Entity) queryChoose(r *http.Request, strict bool) (http.Header, []byte, error) {
+	b := et.chooseBlock(r)
+	if b == nil {
+		return nil, nil, nil
+	}
+	return b.render(r, strict)
+}
+
+// queryTry renders the esi:attempt block of an esi:try. If any include within
+// the attempt fails, the esi:except block gets rendered instead. Without an
+// esi:except block nothing gets rendered.
+func (et *Entity) queryTry(r *http.Request) (http.Header, []byte, error) {
+	hdr, data, err := et.Attempt.render(r, true)
+	if err == nil {
+		return hdr, data, nil
+	}
+	if et.Log.IsInfo() {
+		et.Log.Info("esitag.Entity.QueryResources.Try.Except", log.Err(err), log.Bool("has_except", et.Except != nil))
+	}
+	if et.Except == nil {
+		return nil, nil, nil
+	}
+	return et.Except.render(r, false)
+}
+
+// queryBlock renders the entity if it represents a block tag. Returns false if
+// the entity is a normal include tag. If strict is true, a failing nested
+// include returns an error instead of its onerror content.
+func (et *Entity) queryBlock(r *http.Request, strict bool) (_ http.Header, _ []byte, ok bool, _ error) {
+	var hdr http.Header
+	var data []byte
+	var err error
+	switch {
+	case et.Remove:
+		return nil, nil, true, nil
+	case et.Choose != nil:
+		hdr, data, err = et.queryChoose(r, strict)
+	case et.Attempt != nil:
+		hdr, data, err = et.queryTry(r)
+	case et.Unwrap != nil:
+		hdr, data, err = et.Unwrap.render(r, strict)
+	case et.Vars != nil:
+		hdr, data, err = et.Vars.render(r, strict)
+	default:
+		return nil, nil, false, nil
+	}
+	return hdr, data, true, err
+}
+
+// blocks returns all blocks of an esi:choose, esi:try, esi:vars or <!--esi
+// tag.
+func (et *Entity) blocks() []*Block {
+	switch {
+	case et.Unwrap != nil:
+		return []*Block{et.Unwrap}
+	case et.Vars != nil:
+		return []*Block{et.Vars}
+	}
+	if et.Attempt == nil {
+		return et.Choose
+	}
+	if et.Except == nil {
+		return []*Block{et.Attempt}
+	}
+	return []*Block{et.Attempt, et.Except}
+}
@@ -0,0 +1,610 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package esitag
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/corestoreio/caddy-esi/bufpool"
+	"github.com/corestoreio/caddy-esi/esicache"
+	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log"
+	"github.com/gavv/monotime"
+	"github.com/pierrec/xxHash/xxHash64"
+)
+
+// SurrogateKeyHeader a backend resource can return this header with a space
+// separated list of keys. A purge of one of these keys invalidates the cached
+// fragment, see PurgeSurrogateKeys.
+const SurrogateKeyHeader = "Surrogate-Key"
+
+// cacheEntryVersion identifies the format of an encoded cacheEntry.
+const cacheEntryVersion byte = 4
+
+// cacheEntryHeaderLen version byte, flags byte, the fresh until and the stored
+// at time in Unix nano seconds and the number of tags.
+const cacheEntryHeaderLen = 1 + 1 + 8 + 8 + 2
+
+// cacheEntryNegative flag of an entry which stores the error of the resources.
+const cacheEntryNegative byte = 1 << 0
+
+// HTTPCacheRevalidateWindow defines in the HTTP cache mode how long the Cache
+// keeps a fragment with an ETag or Last-Modified validator after it has been
+// expired. Within this window the fragment gets revalidated instead of
+// requested again.
+var HTTPCacheRevalidateWindow = 10 * time.Minute
+
+// cacheEntry gets stored in the Cache. The Cache keeps the entry longer than
+// its TTL to serve it stale, so the entry knows itself until when it is fresh.
+// The tags contain the surrogate keys of the fragment. The etag and
+// lastModified validators of the HTTP cache mode revalidate a stale entry. A
+// negative entry contains the error message of the failed resources as data.
+type cacheEntry struct {
+	negative     bool
+	freshUntil   time.Time
+	storedAt     time.Time
+	tags         []string
+	etag         string
+	lastModified string
+	data         []byte
+}
+
+func (ce cacheEntry) encode() []byte {
+	size := cacheEntryHeaderLen + 4 + len(ce.etag) + len(ce.lastModified) + len(ce.data)
+	for _, t := range ce.tags {
+		size += 2 + len(t)
+	}
+	buf := make([]byte, cacheEntryHeaderLen, size)
+	buf[0] = cacheEntryVersion
+	if ce.negative {
+		buf[1] |= cacheEntryNegative
+	}
+	binary.BigEndian.PutUint64(buf[2:10], uint64(ce.freshUntil.UnixNano()))
+	binary.BigEndian.PutUint64(buf[10:18], uint64(ce.storedAt.UnixNano()))
+	binary.BigEndian.PutUint16(buf[18:20], uint16(len(ce.tags)))
+	for _, t := range ce.tags {
+		buf = appendCacheString(buf, t)
+	}
+	buf = appendCacheString(buf, ce.etag)
+	buf = appendCacheString(buf, ce.lastModified)
+	return append(buf, ce.data...)
+}
+
+func appendCacheString(buf []byte, s string) []byte {
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(s)))
+	buf = append(buf, l[:]...)
+	return append(buf, s...)
+}
+
+// readCacheString returns the length prefixed string and the remaining buffer.
+func readCacheString(buf []byte) (string, []byte, bool) {
+	if len(buf) < 2 {
+		return "", nil, false
+	}
+	l := int(binary.BigEndian.Uint16(buf[:2]))
+	if len(buf) < 2+l {
+		return "", nil, false
+	}
+	return string(buf[2 : 2+l]), buf[2+l:], true
+}
+
+func decodeCacheEntry(buf []byte) (cacheEntry, error) {
+	if len(buf) < cacheEntryHeaderLen || buf[0] != cacheEntryVersion {
+		return cacheEntry{}, errors.NotValid.Newf("[esitag] Invalid cache entry with length %d", len(buf))
+	}
+	ce := cacheEntry{
+		negative:   buf[1]&cacheEntryNegative != 0,
+		freshUntil: time.Unix(0, int64(binary.BigEndian.Uint64(buf[2:10]))),
+		storedAt:   time.Unix(0, int64(binary.BigEndian.Uint64(buf[10:18]))),
+	}
+	tagCount := int(binary.BigEndian.Uint16(buf[18:20]))
+	buf = buf[cacheEntryHeaderLen:]
+	if tagCount > 0 {
+		ce.tags = make([]string, 0, tagCount)
+	}
+	for i := 0; i < tagCount; i++ {
+		t, rest, ok := readCacheString(buf)
+		if !ok {
+			return cacheEntry{}, errors.NotValid.Newf("[esitag] Invalid cache entry, tag %d is too short", i)
+		}
+		ce.tags = append(ce.tags, t)
+		buf = rest
+	}
+	var ok bool
+	if ce.etag, buf, ok = readCacheString(buf); !ok {
+		return cacheEntry{}, errors.NotValid.Newf("[esitag] Invalid cache entry, ETag is too short")
+	}
+	if ce.lastModified, buf, ok = readCacheString(buf); !ok {
+		return cacheEntry{}, errors.NotValid.Newf("[esitag] Invalid cache entry, Last-Modified is too short")
+	}
+	ce.data = buf
+	return ce, nil
+}
+
+// hasValidators reports whether the entry can be revalidated with a
+// conditional request.
+func (ce cacheEntry) hasValidators() bool {
+	return ce.etag != "" || ce.lastModified != ""
+}
+
+// header returns the tags as SurrogateKeyHeader, so that a fragment which
+// contains this cached fragment can collect the keys. Returns nil without
+// tags.
+func (ce cacheEntry) header() http.Header {
+	if len(ce.tags) == 0 {
+		return nil
+	}
+	return http.Header{SurrogateKeyHeader: []string{strings.Join(ce.tags, " ")}}
+}
+
+// surrogateKeys extracts the keys of all SurrogateKeyHeader from h.
+func surrogateKeys(h http.Header) []string {
+	var keys []string
+	for hn, hvs := range h {
+		if http.CanonicalHeaderKey(hn) != SurrogateKeyHeader {
+			continue
+		}
+		for _, hv := range hvs {
+			keys = append(keys, strings.Fields(hv)...)
+		}
+	}
+	return keys
+}
+
+// uniqueStrings removes duplicates and keeps the order.
+func uniqueStrings(ss []string) []string {
+	if len(ss) < 2 {
+		return ss
+	}
+	seen := make(map[string]bool, len(ss))
+	ret := ss[:0]
+	for _, s := range ss {
+		if !seen[s] {
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// purgeMarkerKey hashes the surrogate key to satisfy the key restrictions of
+// services like memcache.
+func purgeMarkerKey(surrogateKey string) string {
+	h := xxHash64.New(hashSeed)
+	_, _ = h.Write([]byte(surrogateKey))
+	return "esi_sk_" + strconv.FormatUint(h.Sum64(), 36)
+}
+
+// DefaultPurgeMarkerTTL defines how long a purge marker lives if no fragment
+// has been configured with a TTL or stored in a cache yet.
+var DefaultPurgeMarkerTTL = 24 * time.Hour
+
+// maxCacheExpiration contains the longest expiration of a fragment configured
+// via SetDefaultConfig or stored by cacheSet, including the stale windows.
+// Gets accessed atomically.
+var maxCacheExpiration int64
+
+// updateMaxCacheExpiration raises maxCacheExpiration to d.
+func updateMaxCacheExpiration(d time.Duration) {
+	for {
+		cur := atomic.LoadInt64(&maxCacheExpiration)
+		if int64(d) <= cur || atomic.CompareAndSwapInt64(&maxCacheExpiration, cur, int64(d)) {
+			return
+		}
+	}
+}
+
+// PurgeSurrogateKeys invalidates all cached fragments which carry at least one
+// of the keys. The keys come from the SurrogateKeyHeader of a backend resource
+// or from the cachetags attribute. For each key a purge marker with the current
+// time gets written to all tiers of the Cache. A fragment stored before the
+// marker counts then as not found.
+//
+// A lost marker would let a purged fragment come back, so the markers get
+// pinned in the tiers which evict on their size limit, see
+// esicache.PinnedSetter. Those tiers limit the pinned bytes and drop the
+// oldest markers first. A marker expires after the longest fragment lifetime
+// known to this process, because then all fragments stored before the purge
+// have been expired, too. Without a known lifetime the marker expires after
+// DefaultPurgeMarkerTTL. A persistent tier might still contain fragments with
+// a longer lifetime of a previous process, e.g. after the TTL in the Caddyfile
+// has been lowered.
+func PurgeSurrogateKeys(c esicache.Cacher, keys ...string) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(time.Now().UnixNano()))
+	expiration := time.Duration(atomic.LoadInt64(&maxCacheExpiration))
+	if expiration < 1 {
+		expiration = DefaultPurgeMarkerTTL
+	}
+	for _, k := range keys {
+		if err := esicache.SetPinned(c, purgeMarkerKey(k), buf[:], expiration); err != nil {
+			return errors.Wrapf(err, "[esitag] PurgeSurrogateKeys failed for key %q", k)
+		}
+	}
+	return nil
+}
+
+// invalidations counts the calls to InvalidateSurrogateKeys.
+var invalidations uint64
+
+// InvalidateSurrogateKeys purges the keys, like PurgeSurrogateKeys, in the
+// caches of all scopes registered in esicache.MainRegistry. A backend resource
+// calls it when it detects a change of its data. Returns the first error.
+func InvalidateSurrogateKeys(keys ...string) error {
+	atomic.AddUint64(&invalidations, 1)
+	var firstErr error
+	for _, scope := range esicache.MainRegistry.Scopes() {
+		c := esicache.MainRegistry.Get(scope)
+		if c == nil {
+			continue
+		}
+		if err := PurgeSurrogateKeys(c, keys...); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "[esitag] InvalidateSurrogateKeys failed for scope %q", scope)
+		}
+	}
+	return firstErr
+}
+
+// Invalidations returns the number of calls to InvalidateSurrogateKeys. The
+// coalesced requests include it in their key, so a request after an
+// invalidation does not receive the result of a query started before.
+func Invalidations() uint64 {
+	return atomic.LoadUint64(&invalidations)
+}
+
+// isPurged checks the purge markers of all tags of the entry. Each cache hit
+// costs therefore one additional Get per tag of the fragment.
+func (et *Entity) isPurged(ce cacheEntry) bool {
+	for _, t := range ce.tags {
+		buf, err := et.Cache.Get(purgeMarkerKey(t))
+		if err != nil || len(buf) != 8 {
+			continue
+		}
+		if purgedAt := int64(binary.BigEndian.Uint64(buf)); purgedAt >= ce.storedAt.UnixNano() {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheTags resolves the variables in the cachetags attribute and appends the
+// surrogate keys of the header.
+func (et *Entity) cacheTags(externalReq *http.Request, hdr http.Header) []string {
+	var tags []string
+	if len(et.CacheTags) > 0 {
+		repl := MakeReplacer(externalReq, "")
+		for _, t := range et.CacheTags {
+			tags = append(tags, strings.Fields(repl.Replace(t))...)
+		}
+	}
+	return uniqueStrings(append(tags, surrogateKeys(hdr)...))
+}
+
+// cacheVaryCookie prefix of a cookie name in the cachevary attribute.
+const cacheVaryCookie = "Cookie:"
+
+// cacheKey generates the key for the Cache from the resolved src attributes and
+// the resolved key attribute. With the cachekey attribute the resolved
+// cachekey replaces them. The unresolved src and key attributes still keep
+// the keys of different tags apart. The values of the cachevary headers and
+// cookies get appended. The key gets hashed, like the page ID, to satisfy the
+// key length and character restrictions of services like memcache.
+func (et *Entity) cacheKey(externalReq *http.Request) string {
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+
+	repl := MakeReplacer(externalReq, "")
+	if et.CacheKey != "" {
+		_, _ = buf.WriteString(et.Key)
+		for _, r := range et.Resources {
+			_ = buf.WriteByte(0) // separator
+			_, _ = buf.WriteString(r.url)
+		}
+		_ = buf.WriteByte(0)
+		_, _ = buf.WriteString(repl.Replace(et.CacheKey))
+	} else {
+		_, _ = buf.WriteString(repl.Replace(et.Key))
+		for _, r := range et.Resources {
+			_ = buf.WriteByte(0)
+			_, _ = buf.WriteString(repl.Replace(r.url))
+		}
+	}
+
+	for _, v := range et.CacheVary {
+		_ = buf.WriteByte(0)
+		_, _ = buf.WriteString(v)
+		_ = buf.WriteByte('=')
+		if strings.HasPrefix(v, cacheVaryCookie) {
+			if keks, _ := externalReq.Cookie(v[len(cacheVaryCookie):]); keks != nil {
+				_, _ = buf.WriteString(keks.Value)
+			}
+			continue
+		}
+		_, _ = buf.WriteString(strings.Join(externalReq.Header[v], ","))
+	}
+	return "esi_" + strconv.FormatUint(xxHash64.Checksum(buf.Bytes(), hashSeed), 36)
+}
+
+// cacheGet returns the entry from the Cache. A failing Cache gets treated as a
+// miss and logged.
+func (et *Entity) cacheGet(cacheKey string, timeStart time.Duration) (cacheEntry, bool) {
+	buf, err := et.Cache.Get(cacheKey)
+	if err == nil {
+		var ce cacheEntry
+		if ce, err = decodeCacheEntry(buf); err == nil {
+			if et.isPurged(ce) {
+				if et.Log.IsDebug() {
+					et.Log.Debug("esitag.Entity.QueryResources.Cache.Purged",
+						log.Duration(log.KeyNameDuration, monotime.Since(timeStart)), log.String("cache_key", cacheKey),
+						log.String("cache_tags", strings.Join(ce.tags, " ")))
+				}
+				return cacheEntry{}, false
+			}
+			if et.Log.IsDebug() {
+				et.Log.Debug("esitag.Entity.QueryResources.Cache.Hit",
+					log.Duration(log.KeyNameDuration, monotime.Since(timeStart)), log.String("cache_key", cacheKey),
+					log.Stringer("fresh_until", ce.freshUntil))
+			}
+			return ce, true
+		}
+	}
+	if !errors.NotFound.Match(err) && et.Log.IsInfo() {
+		et.Log.Info("esitag.Entity.QueryResources.Cache.Get.Error",
+			log.Duration(log.KeyNameDuration, monotime.Since(timeStart)), log.Err(err), log.String("cache_key", cacheKey))
+	}
+	return cacheEntry{}, false
+}
+
+// httpFreshness calculates the freshness lifetime of a response from the
+// headers Cache-Control, Age, Expires and Date as described in RFC 7234. Only
+// the directives relevant for a shared cache get considered. Returns false if
+// the response must not be stored. Without any freshness information the
+// lifetime is zero and the response can only be stored for revalidation.
+func httpFreshness(h http.Header, now time.Time) (time.Duration, bool) {
+	var maxAge, sMaxAge time.Duration = -1, -1
+	for _, hv := range h["Cache-Control"] {
+		for _, d := range strings.Split(hv, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			name, value := d, ""
+			if idx := strings.IndexByte(d, '='); idx > 0 {
+				name, value = d[:idx], strings.Trim(d[idx+1:], `"`)
+			}
+			switch name {
+			case "no-store", "private":
+				return 0, false
+			case "no-cache":
+				return 0, true
+			case "max-age":
+				maxAge = parseDeltaSeconds(value)
+			case "s-maxage":
+				sMaxAge = parseDeltaSeconds(value)
+			}
+		}
+	}
+
+	var lifetime time.Duration
+	switch {
+	case sMaxAge >= 0:
+		lifetime = sMaxAge
+	case maxAge >= 0:
+		lifetime = maxAge
+	case h.Get("Expires") != "":
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			return 0, true // an invalid date means already expired
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		lifetime = expires.Sub(date)
+	}
+	if age := parseDeltaSeconds(h.Get("Age")); age > 0 {
+		lifetime -= age
+	}
+	if lifetime < 0 {
+		lifetime = 0
+	}
+	return lifetime, true
+}
+
+// parseDeltaSeconds returns -1 if the value is not a valid number of seconds.
+func parseDeltaSeconds(value string) time.Duration {
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || sec < 0 {
+		return -1
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// cacheResult stores the result of the resources in the Cache and returns the
+// header and the data for the response. A resource which confirms the stale
+// entry with a 304 status code returns no data, so the data of the stale entry
+// gets reused. In the HTTP cache mode without a TTL the headers of the
+// resource define the freshness.
+func (et *Entity) cacheResult(externalReq *http.Request, cacheKey string, hdr http.Header, data []byte, ra *ResourceArgs, stale cacheEntry, timeStart time.Duration) (http.Header, []byte) {
+	ce := cacheEntry{
+		tags: et.cacheTags(externalReq, hdr),
+		data: data,
+	}
+	if ra != nil && ra.NotModified {
+		ce.tags = uniqueStrings(append(ce.tags, stale.tags...))
+		ce.data = stale.data
+		ce.etag, ce.lastModified = stale.etag, stale.lastModified
+		if len(ce.tags) > 0 {
+			if hdr == nil {
+				hdr = make(http.Header)
+			}
+			hdr[SurrogateKeyHeader] = []string{strings.Join(ce.tags, " ")}
+		}
+	}
+
+	ttl := et.TTL
+	if et.HTTPCache && ra != nil {
+		if v := ra.ResponseHeader.Get("ETag"); v != "" {
+			ce.etag = v
+		}
+		if v := ra.ResponseHeader.Get("Last-Modified"); v != "" {
+			ce.lastModified = v
+		}
+		if ttl < 1 {
+			var ok bool
+			if ttl, ok = httpFreshness(ra.ResponseHeader, time.Now()); !ok {
+				return hdr, ce.data
+			}
+		}
+	}
+	et.cacheSet(cacheKey, ce, ttl, timeStart)
+	return hdr, ce.data
+}
+
+// cacheExpiration returns how long the Cache keeps a fragment which is fresh
+// for the TTL: additionally the longer duration of Stale and StaleIfError. In
+// the HTTP cache mode an entry with validators stays for
+// HTTPCacheRevalidateWindow longer to get revalidated.
+func (et *Entity) cacheExpiration(ttl time.Duration, validators bool) time.Duration {
+	expiration := ttl
+	if et.Stale > et.StaleIfError {
+		expiration += et.Stale
+	} else {
+		expiration += et.StaleIfError
+	}
+	if et.HTTPCache && validators {
+		expiration += HTTPCacheRevalidateWindow
+	}
+	return expiration
+}
+
+// cacheSet stores the entry fresh for the TTL and keeps it for the
+// cacheExpiration.
+func (et *Entity) cacheSet(cacheKey string, ce cacheEntry, ttl time.Duration, timeStart time.Duration) {
+	expiration := et.cacheExpiration(ttl, ce.hasValidators())
+	if expiration < 1 {
+		return // zero means for the Cache to store it forever
+	}
+	updateMaxCacheExpiration(expiration)
+	now := time.Now()
+	ce.freshUntil = now.Add(ttl)
+	ce.storedAt = now
+	// A failing cache must not break the response, so only log it.
+	if err := et.Cache.Set(cacheKey, ce.encode(), expiration); err != nil && et.Log.IsInfo() {
+		et.Log.Info("esitag.Entity.QueryResources.Cache.Set.Error",
+			log.Duration(log.KeyNameDuration, monotime.Since(timeStart)), log.Err(err), log.String("cache_key", cacheKey))
+	}
+}
+
+// cacheSetNegative stores the error of the resources for the NegativeTTL.
+func (et *Entity) cacheSetNegative(cacheKey string, err error, timeStart time.Duration) {
+	now := time.Now()
+	ce := cacheEntry{
+		negative:   true,
+		freshUntil: now.Add(et.NegativeTTL),
+		storedAt:   now,
+		data:       []byte(err.Error()),
+	}
+	if err := et.Cache.Set(cacheKey, ce.encode(), et.NegativeTTL); err != nil && et.Log.IsInfo() {
+		et.Log.Info("esitag.Entity.QueryResources.Cache.SetNegative.Error",
+			log.Duration(log.KeyNameDuration, monotime.Since(timeStart)), log.Err(err), log.String("cache_key", cacheKey))
+	}
+}
+
+// staleRefreshKey identifies a cache key in the Cache of a scope.
+type staleRefreshKey struct {
+	scope    string
+	cacheKey string
+}
+
+// staleRefreshes contains the cache keys which get currently refreshed in the
+// background. Concurrent requests for the same stale content trigger only one
+// refresh.
+var staleRefreshes = struct {
+	sync.Mutex
+	keys map[staleRefreshKey]struct{}
+}{
+	keys: make(map[staleRefreshKey]struct{}),
+}
+
+// refreshStale queries the resources in the background and updates the Cache.
+// The refresh uses a copy of the external request, see detachRequest, because
+// the external request finishes before the refresh. In the HTTP cache mode the
+// stale entry gets revalidated.
+func (et *Entity) refreshStale(externalReq *http.Request, cacheKey string, stale cacheEntry) {
+	rk := staleRefreshKey{scope: et.CacheScope, cacheKey: cacheKey}
+	staleRefreshes.Lock()
+	_, running := staleRefreshes.keys[rk]
+	if !running {
+		staleRefreshes.keys[rk] = struct{}{}
+	}
+	staleRefreshes.Unlock()
+	if running {
+		return
+	}
+
+	req := detachRequest(externalReq)
+	go func() {
+		defer func() {
+			staleRefreshes.Lock()
+			delete(staleRefreshes.keys, rk)
+			staleRefreshes.Unlock()
+		}()
+
+		timeStart := monotime.Now()
+		hdr, data, _, ra, _, err := et.queryResources(req, timeStart, stale)
+		if err != nil {
+			if et.Log.IsInfo() {
+				et.Log.Info("esitag.Entity.QueryResources.Stale.Refresh.Error",
+					log.Duration(log.KeyNameDuration, monotime.Since(timeStart)), log.Err(err), log.String("cache_key", cacheKey))
+			}
+			return
+		}
+		et.cacheResult(req, cacheKey, hdr, data, ra, stale, timeStart)
+	}()
+}
+
+// detachRequest copies the parts of r which the resources, the replacer and
+// the cache key read: method, URL, headers with the cookies and the remote
+// address. The copy has no body and a background context, so it stays valid
+// after r has finished.
+func detachRequest(r *http.Request) *http.Request {
+	u := *r.URL
+	if r.URL.User != nil {
+		user := *r.URL.User
+		u.User = &user
+	}
+	hdr := make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		hdr[k] = append([]string(nil), v...)
+	}
+	req := &http.Request{
+		Method:     r.Method,
+		URL:        &u,
+		Proto:      r.Proto,
+		ProtoMajor: r.ProtoMajor,
+		ProtoMinor: r.ProtoMinor,
+		Header:     hdr,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		TLS:        r.TLS,
+	}
+	return req.WithContext(context.Background())
+}
@@ -0,0 +1,471 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package esitag_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/corestoreio/caddy-esi/esicache"
+	"github.com/corestoreio/caddy-esi/esitag"
+	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCachedEntity(t *testing.T, page string) *esitag.Entity {
+	ets, err := esitag.Parse(strings.NewReader(page))
+	require.NoError(t, err)
+	ets.ApplyLogger(log.BlackHole{})
+	c, err := esicache.NewCacher("inmemory")
+	require.NoError(t, err)
+	ets[0].SetDefaultConfig(esitag.Config{Cache: c})
+	return ets[0]
+}
+
+func TestEntity_QueryResources_Cache(t *testing.T) {
+
+	var calls int
+	defer esitag.RegisterResourceHandler("cached1", resourceMock{
+		DoRequestFn: func(args *esitag.ResourceArgs) (http.Header, []byte, error) {
+			calls++
+			return nil, []byte(fmt.Sprintf("Cart %d %s", calls, args.URL)), nil
+		},
+	}).DeferredDeregister()
+
+	runner := func(page string, wantCalls int, wantData ...string) func(*testing.T) {
+		return func(t *testing.T) {
+			calls = 0
+			et := newCachedEntity(t, page)
+
+			for i, want := range wantData {
+				req := httptest.NewRequest("GET", fmt.Sprintf("http://cyrillschumacher.com/esi/endpoint%d", i%2), nil)
+				data, err := et.QueryResources(req)
+				require.NoError(t, err)
+				assert.Exactly(t, want, string(data), "Index %d", i)
+			}
+			assert.Exactly(t, wantCalls, calls, "Calls to the resource")
+		}
+	}
+
+	t.Run("ttl caches the content", runner(
+		`<esi:include src="cached1://cart" ttl="1m" timeout="1s" maxbodysize="1KB"/>`,
+		1, `Cart 1 cached1://cart`, `Cart 1 cached1://cart`, `Cart 1 cached1://cart`))
+	t.Run("without ttl no cache", runner(
+		`<esi:include src="cached1://cart" timeout="1s" maxbodysize="1KB"/>`,
+		2, `Cart 1 cached1://cart`, `Cart 2 cached1://cart`))
+	t.Run("resolved src is part of the key", runner(
+		`<esi:include src="cached1://{path}" ttl="1m" timeout="1s" maxbodysize="1KB"/>`,
+		2, `Cart 1 cached1:///esi/endpoint0`, `Cart 2 cached1:///esi/endpoint1`, `Cart 1 cached1:///esi/endpoint0`))
+}
+
+func TestEntity_QueryResources_Stale(t *testing.T) {
+
+	var calls int32
+	var failing int32
+	defer esitag.RegisterResourceHandler("stale1", resourceMock{
+		DoRequestFn: func(args *esitag.ResourceArgs) (http.Header, []byte, error) {
+			if atomic.LoadInt32(&failing) == 1 {
+				return nil, nil, errors.ConnectionFailed.Newf("Cart service down")
+			}
+			return nil, []byte(fmt.Sprintf("Cart %d", atomic.AddInt32(&calls, 1))), nil
+		},
+	}).DeferredDeregister()
+
+	req := httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint1", nil)
+	query := func(t *testing.T, et *esitag.Entity, want string) {
+		data, err := et.QueryResources(req)
+		require.NoError(t, err)
+		assert.Exactly(t, want, string(data))
+	}
+
+	t.Run("stale while revalidate", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		et := newCachedEntity(t, `<esi:include src="stale1://cart" ttl="50ms" stale="1m" timeout="1s" maxbodysize="1KB"/>`)
+
+		query(t, et, `Cart 1`)
+		time.Sleep(60 * time.Millisecond)
+		query(t, et, `Cart 1`) // stale, triggers the refresh
+		query(t, et, `Cart 1`) // stale, refresh already running or done
+
+		for i := 0; i < 100 && atomic.LoadInt32(&calls) < 2; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		time.Sleep(5 * time.Millisecond) // let the refresh write to the cache
+		query(t, et, `Cart 2`)
+		assert.Exactly(t, int32(2), atomic.LoadInt32(&calls), "Only one refresh allowed")
+	})
+
+	t.Run("refresh with a copy of the finished request", func(t *testing.T) {
+		refreshed := make(chan *http.Request, 1)
+		defer esitag.RegisterResourceHandler("stale2", resourceMock{
+			DoRequestFn: func(args *esitag.ResourceArgs) (http.Header, []byte, error) {
+				if args.ExternalReq.Context().Err() != nil {
+					return nil, nil, errors.Fatal.New(args.ExternalReq.Context().Err(), "Context of the request")
+				}
+				select {
+				case refreshed <- args.ExternalReq:
+				default:
+				}
+				return nil, []byte(`Cart`), nil
+			},
+		}).DeferredDeregister()
+
+		et := newCachedEntity(t, `<esi:include src="stale2://cart" ttl="50ms" stale="1m" timeout="1s" maxbodysize="1KB"/>`)
+		query(t, et, `Cart`)
+		<-refreshed
+		time.Sleep(60 * time.Millisecond)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		extReq := httptest.NewRequest("POST", "http://cyrillschumacher.com/esi/endpoint1?q=1", strings.NewReader(`body`)).WithContext(ctx)
+		extReq.AddCookie(&http.Cookie{Name: "session", Value: "x1"})
+		data, err := et.QueryResources(extReq)
+		require.NoError(t, err)
+		assert.Exactly(t, `Cart`, string(data))
+		cancel()
+
+		select {
+		case r := <-refreshed:
+			assert.Nil(t, r.Body)
+			assert.Exactly(t, "/esi/endpoint1?q=1", r.URL.RequestURI())
+			c, err := r.Cookie("session")
+			require.NoError(t, err)
+			assert.Exactly(t, "x1", c.Value)
+		case <-time.After(time.Second):
+			t.Fatal("Missing the refresh")
+		}
+	})
+
+	t.Run("stale if error", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		atomic.StoreInt32(&failing, 0)
+		defer atomic.StoreInt32(&failing, 0)
+		et := newCachedEntity(t, `<esi:include src="stale1://cart" ttl="50ms" staleiferror="1m" timeout="1s" maxbodysize="1KB"/>`)
+
+		query(t, et, `Cart 1`)
+		time.Sleep(60 * time.Millisecond)
+		atomic.StoreInt32(&failing, 1)
+		query(t, et, `Cart 1`)
+	})
+
+	t.Run("expired without stale", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		atomic.StoreInt32(&failing, 0)
+		defer atomic.StoreInt32(&failing, 0)
+		et := newCachedEntity(t, `<esi:include src="stale1://cart" ttl="50ms" timeout="1s" maxbodysize="1KB"/>`)
+
+		query(t, et, `Cart 1`)
+		time.Sleep(60 * time.Millisecond)
+		atomic.StoreInt32(&failing, 1)
+		data, err := et.QueryResources(req)
+		assert.Nil(t, data)
+		assert.True(t, errors.Temporary.Match(err), "%+v", err)
+	})
+
+	t.Run("invalid stale attribute", func(t *testing.T) {
+		_, err := esitag.Parse(strings.NewReader(`<esi:include src="stale1://cart" stale="1y" timeout="1s"/>`))
+		assert.True(t, errors.NotValid.Match(err), "%+v", err)
+	})
+}
+
+func TestEntity_QueryResources_SurrogateKeys(t *testing.T) {
+
+	var calls int32
+	defer esitag.RegisterResourceHandler("sk1", resourceMock{
+		DoRequestFn: func(args *esitag.ResourceArgs) (http.Header, []byte, error) {
+			n := atomic.AddInt32(&calls, 1)
+			return http.Header{"surrogate-key": []string{"cart  product-42"}}, []byte(fmt.Sprintf("Cart %d", n)), nil
+		},
+	}).DeferredDeregister()
+
+	req := httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint1", nil)
+	req.Header.Set("X-Store", "de")
+
+	runner := func(purgeKey string, wantCalls int32) func(*testing.T) {
+		return func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			et := newCachedEntity(t, `<esi:include src="sk1://cart" ttl="1m" cachetags="store-{HX-Store},cart" timeout="1s" maxbodysize="1KB"/>`)
+			wantHdr := http.Header{esitag.SurrogateKeyHeader: []string{"store-de cart product-42"}}
+
+			hdr, data, err := et.QueryResourcesHeader(req)
+			require.NoError(t, err)
+			assert.Exactly(t, `Cart 1`, string(data))
+			hdr, data, err = et.QueryResourcesHeader(req)
+			require.NoError(t, err)
+			assert.Exactly(t, `Cart 1`, string(data))
+			assert.Exactly(t, wantHdr, hdr, "Cache hit must return the surrogate keys")
+
+			require.NoError(t, esitag.PurgeSurrogateKeys(et.Cache, purgeKey))
+			_, _, err = et.QueryResourcesHeader(req)
+			require.NoError(t, err)
+			assert.Exactly(t, wantCalls, atomic.LoadInt32(&calls))
+		}
+	}
+	t.Run("purge key from header", runner("product-42", 2))
+	t.Run("purge key from attribute with variable", runner("store-de", 2))
+	t.Run("purge unknown key", runner("store-fr", 1))
+
+	t.Run("invalidate key in all scopes", func(t *testing.T) {
+		defer esicache.MainRegistry.Clear()
+		require.NoError(t, esicache.MainRegistry.Register("/sk1", "inmemory", false))
+
+		atomic.StoreInt32(&calls, 0)
+		ets, err := esitag.Parse(strings.NewReader(`<esi:include src="sk1://cart" ttl="1m" timeout="1s" maxbodysize="1KB"/>`))
+		require.NoError(t, err)
+		ets.ApplyLogger(log.BlackHole{})
+		ets[0].SetDefaultConfig(esitag.Config{Cache: esicache.MainRegistry.Get("/sk1")})
+
+		_, _, err = ets[0].QueryResourcesHeader(req)
+		require.NoError(t, err)
+		prevInvalidations := esitag.Invalidations()
+		require.NoError(t, esitag.InvalidateSurrogateKeys("product-42"))
+		assert.Exactly(t, prevInvalidations+1, esitag.Invalidations())
+
+		_, data, err := ets[0].QueryResourcesHeader(req)
+		require.NoError(t, err)
+		assert.Exactly(t, `Cart 2`, string(data))
+	})
+
+	t.Run("purge marker survives the LRU eviction", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		c, err := esicache.NewCacher("inmemory?max_size=4KB")
+		require.NoError(t, err)
+		rc := &recordingCache{Cacher: c}
+		ets, err := esitag.Parse(strings.NewReader(`<esi:include src="sk1://cart" ttl="1m" timeout="1s" maxbodysize="1KB"/>`))
+		require.NoError(t, err)
+		ets.ApplyLogger(log.BlackHole{})
+		ets[0].SetDefaultConfig(esitag.Config{Cache: rc})
+
+		_, _, err = ets[0].QueryResourcesHeader(req)
+		require.NoError(t, err)
+		fragmentKey := rc.lastKey
+		require.NoError(t, esitag.PurgeSurrogateKeys(rc, "cart"))
+
+		// The fragment stays the most recently used entry while the fillers
+		// push the marker to the end of the LRU list.
+		for i := 0; i < 100; i++ {
+			require.NoError(t, c.Set(fmt.Sprintf("filler%d", i), make([]byte, 100), 0))
+			_, err := c.Get(fragmentKey)
+			require.NoError(t, err, "Fragment must stay in the cache")
+		}
+
+		_, data, err := ets[0].QueryResourcesHeader(req)
+		require.NoError(t, err)
+		assert.Exactly(t, `Cart 2`, string(data))
+	})
+
+	t.Run("keys do not reach the client", func(t *testing.T) {
+		ets, err := esitag.Parse(strings.NewReader(`<esi:include src="sk1://cart" timeout="1s" maxbodysize="1KB"/>`))
+		require.NoError(t, err)
+		ets.ApplyLogger(log.BlackHole{})
+
+		tags := make(chan esitag.DataTag, 1)
+		require.NoError(t, ets.QueryResources(tags, req))
+		dt := <-tags
+		assert.Empty(t, dt.Header)
+	})
+}
+
+func TestEntity_QueryResources_CacheKeyVary(t *testing.T) {
+
+	var calls int32
+	defer esitag.RegisterResourceHandler("vary1", resourceMock{
+		DoRequestFn: func(args *esitag.ResourceArgs) (http.Header, []byte, error) {
+			return nil, []byte(fmt.Sprintf("Call %d", atomic.AddInt32(&calls, 1))), nil
+		},
+	}).DeferredDeregister()
+
+	newReq := func(session, currency, lang string) *http.Request {
+		req := httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint1", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		req.AddCookie(&http.Cookie{Name: "currency", Value: currency})
+		req.Header.Set("Accept-Language", lang)
+		return req
+	}
+
+	runner := func(page string, reqs []*http.Request, wantData ...string) func(*testing.T) {
+		return func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			et := newCachedEntity(t, page)
+			for i, req := range reqs {
+				data, err := et.QueryResources(req)
+				require.NoError(t, err)
+				assert.Exactly(t, wantData[i], string(data), "Index %d", i)
+			}
+		}
+	}
+
+	reqs := []*http.Request{
+		newReq("a", "EUR", "de"),
+		newReq("b", "EUR", "de"),
+		newReq("c", "USD", "de"),
+		newReq("d", "EUR", "en"),
+	}
+
+	t.Run("session in src without cachekey", runner(
+		`<esi:include src="vary1://cart/{Csession}" ttl="1m" timeout="1s" maxbodysize="1KB"/>`,
+		reqs, `Call 1`, `Call 2`, `Call 3`, `Call 4`))
+	t.Run("cachekey per segment", runner(
+		`<esi:include src="vary1://cart/{Csession}" cachekey="{Ccurrency}-{HAccept-Language}" ttl="1m" timeout="1s" maxbodysize="1KB"/>`,
+		reqs, `Call 1`, `Call 1`, `Call 2`, `Call 3`))
+	t.Run("cachevary", runner(
+		`<esi:include src="vary1://cart" cachevary="cookie:currency, accept-language" ttl="1m" timeout="1s" maxbodysize="1KB"/>`,
+		reqs, `Call 1`, `Call 1`, `Call 2`, `Call 3`))
+	t.Run("cachevary only cookie", runner(
+		`<esi:include src="vary1://cart" cachevary="Cookie:currency" ttl="1m" timeout="1s" maxbodysize="1KB"/>`,
+		reqs, `Call 1`, `Call 1`, `Call 2`, `Call 1`))
+
+	t.Run("cachevary with empty cookie name", func(t *testing.T) {
+		_, err := esitag.Parse(strings.NewReader(`<esi:include src="vary1://cart" cachevary="Cookie:" timeout="1s"/>`))
+		assert.True(t, errors.NotValid.Match(err), "%+v", err)
+	})
+}
+
+func TestEntity_QueryResources_HTTPCache(t *testing.T) {
+
+	var calls int
+	var cacheControl string
+	var ifNoneMatch []string
+	defer esitag.RegisterResourceHandler("httpcache1", resourceMock{
+		DoRequestFn: func(args *esitag.ResourceArgs) (http.Header, []byte, error) {
+			calls++
+			ifNoneMatch = append(ifNoneMatch, args.IfNoneMatch)
+			args.ResponseHeader = http.Header{
+				"Cache-Control": []string{cacheControl},
+				"Etag":          []string{`"v1"`},
+			}
+			if args.IfNoneMatch == `"v1"` {
+				args.NotModified = true
+				return nil, nil, nil
+			}
+			return nil, []byte(fmt.Sprintf("Cart %d", calls)), nil
+		},
+	}).DeferredDeregister()
+
+	runner := func(page, cc string, wantCalls int, wantIfNoneMatch []string, wantData ...string) func(*testing.T) {
+		return func(t *testing.T) {
+			calls = 0
+			cacheControl = cc
+			ifNoneMatch = nil
+			et := newCachedEntity(t, page)
+
+			for i, want := range wantData {
+				data, err := et.QueryResources(httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint", nil))
+				require.NoError(t, err)
+				assert.Exactly(t, want, string(data), "Index %d", i)
+			}
+			assert.Exactly(t, wantCalls, calls, "Calls to the resource")
+			assert.Exactly(t, wantIfNoneMatch, ifNoneMatch, "If-None-Match")
+		}
+	}
+
+	t.Run("max-age caches the content", runner(
+		`<esi:include src="httpcache1://cart" httpcache="true" timeout="1s" maxbodysize="1KB"/>`,
+		"public, max-age=60", 1, []string{""}, `Cart 1`, `Cart 1`))
+	t.Run("s-maxage caches the content", runner(
+		`<esi:include src="httpcache1://cart" httpcache="true" timeout="1s" maxbodysize="1KB"/>`,
+		"max-age=0, s-maxage=60", 1, []string{""}, `Cart 1`, `Cart 1`))
+	t.Run("no-store does not cache", runner(
+		`<esi:include src="httpcache1://cart" httpcache="true" timeout="1s" maxbodysize="1KB"/>`,
+		"no-store", 2, []string{"", ""}, `Cart 1`, `Cart 2`))
+	t.Run("no-cache revalidates with 304", runner(
+		`<esi:include src="httpcache1://cart" httpcache="true" timeout="1s" maxbodysize="1KB"/>`,
+		"no-cache", 3, []string{"", `"v1"`, `"v1"`}, `Cart 1`, `Cart 1`, `Cart 1`))
+	t.Run("ttl wins over the headers", runner(
+		`<esi:include src="httpcache1://cart" httpcache="true" ttl="1m" timeout="1s" maxbodysize="1KB"/>`,
+		"no-store", 1, []string{""}, `Cart 1`, `Cart 1`))
+	t.Run("without httpcache the headers get ignored", runner(
+		`<esi:include src="httpcache1://cart" timeout="1s" maxbodysize="1KB"/>`,
+		"max-age=60", 2, []string{"", ""}, `Cart 1`, `Cart 2`))
+}
+
+func TestEntity_QueryResources_NegativeTTL(t *testing.T) {
+
+	var calls int32
+	defer esitag.RegisterResourceHandler("negative1", resourceMock{
+		DoRequestFn: func(args *esitag.ResourceArgs) (http.Header, []byte, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, nil, errors.NotFound.Newf("Key %q not found", args.URL)
+		},
+	}).DeferredDeregister()
+
+	et := newCachedEntity(t, `<esi:include src="negative1://cart" negativettl="50ms" timeout="1s" maxbodysize="1KB"/>`)
+	req := httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint1", nil)
+
+	for i := 0; i < 3; i++ {
+		data, err := et.QueryResources(req)
+		assert.Nil(t, data)
+		assert.True(t, errors.Temporary.Match(err), "%+v", err)
+	}
+	assert.Exactly(t, int32(1), atomic.LoadInt32(&calls), "the failure gets served from the cache")
+
+	time.Sleep(60 * time.Millisecond)
+	_, err := et.QueryResources(req)
+	assert.True(t, errors.Temporary.Match(err), "%+v", err)
+	assert.Exactly(t, int32(2), atomic.LoadInt32(&calls), "negative TTL expired")
+}
+
+func TestEntity_QueryResources_RefreshAhead(t *testing.T) {
+
+	var calls int32
+	defer esitag.RegisterResourceHandler("ahead1", resourceMock{
+		DoRequestFn: func(args *esitag.ResourceArgs) (http.Header, []byte, error) {
+			return nil, []byte(fmt.Sprintf("Cart %d", atomic.AddInt32(&calls, 1))), nil
+		},
+	}).DeferredDeregister()
+
+	et := newCachedEntity(t, `<esi:include src="ahead1://cart" ttl="200ms" refreshahead="150ms" timeout="1s" maxbodysize="1KB"/>`)
+	req := httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint1", nil)
+	query := func(want string) {
+		data, err := et.QueryResources(req)
+		require.NoError(t, err)
+		assert.Exactly(t, want, string(data))
+	}
+
+	query(`Cart 1`)
+	query(`Cart 1`) // fresh, outside of the refresh ahead window
+	assert.Exactly(t, int32(1), atomic.LoadInt32(&calls))
+
+	time.Sleep(80 * time.Millisecond)
+	query(`Cart 1`) // fresh, triggers the refresh
+	for i := 0; i < 100 && atomic.LoadInt32(&calls) < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond) // let the refresh write to the cache
+	query(`Cart 2`)
+	assert.Exactly(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+// recordingCache remembers the key of the last Set.
+type recordingCache struct {
+	esicache.Cacher
+	lastKey string
+}
+
+func (rc *recordingCache) Set(key string, value []byte, expiration time.Duration) error {
+	rc.lastKey = key
+	return rc.Cacher.Set(key, value, expiration)
+}
+
+func (rc *recordingCache) SetPinned(key string, value []byte, expiration time.Duration) error {
+	return esicache.SetPinned(rc.Cacher, key, value, expiration)
+}
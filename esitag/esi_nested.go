@@ -0,0 +1,190 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package esitag
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log"
+	"github.com/gavv/monotime"
+	"github.com/pierrec/xxHash/xxHash64"
+)
+
+// ctxKeyNesting type is unique for the context key to avoid collisions.
+type ctxKeyNesting struct{}
+
+// nestingChain contains the identifiers of the include tags whose fragments
+// are currently getting processed, ordered from the page down to the current
+// fragment. Its length equals the nesting depth.
+type nestingChain []string
+
+func nestingFromContext(ctx context.Context) nestingChain {
+	nc, _ := ctx.Value(ctxKeyNesting{}).(nestingChain)
+	return nc
+}
+
+func (nc nestingChain) contains(id string) bool {
+	for _, c := range nc {
+		if c == id {
+			return true
+		}
+	}
+	return false
+}
+
+// nestingID identifies an include tag by its src and key attributes for the
+// loop detection.
+func (et *Entity) nestingID() string {
+	var buf strings.Builder
+	for _, r := range et.Resources {
+		buf.WriteString(r.String())
+		buf.WriteByte('|')
+	}
+	buf.WriteString(et.Key)
+	return buf.String()
+}
+
+// hasESITags quickly checks if data might contain ESI tags.
+func hasESITags(data []byte) bool {
+	return bytes.Contains(data, []byte("<esi:")) || bytes.Contains(data, []byte("<!--esi"))
+}
+
+// nestedEntitiesMax limits the number of cached parsed nested fragments. The
+// whole cache gets cleared when the limit has been reached.
+const nestedEntitiesMax = 1024
+
+// nestedKey identifies a nested fragment by its parent tag and the hash of its
+// content.
+type nestedKey struct {
+	parent *Entity
+	hash   uint64
+	size   int
+}
+
+// nestedEntities caches the parsed and configured entities of the nested
+// fragments, so that the same fragment gets parsed only once. The entities
+// depend on the configuration of their parent tag, therefore the parent is
+// part of the key.
+var nestedEntities = struct {
+	sync.RWMutex
+	m map[nestedKey]Entities
+}{
+	m: make(map[nestedKey]Entities),
+}
+
+// parseNested returns the entities of a nested fragment. They inherit the
+// configuration of et and their timeout gets limited to the et.Timeout. A
+// fragment gets parsed only once per content.
+func (et *Entity) parseNested(data []byte) (Entities, error) {
+	key := nestedKey{parent: et, hash: xxHash64.Checksum(data, hashSeed), size: len(data)}
+	nestedEntities.RLock()
+	ets, ok := nestedEntities.m[key]
+	nestedEntities.RUnlock()
+	if ok {
+		return ets, nil
+	}
+
+	ets, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "[esitag] Failed to parse the nested fragment of tag %q", et.RawTag)
+	}
+	ets.Walk(func(e *Entity) {
+		e.Log = et.Log
+		if len(e.OnError) == 0 {
+			e.OnError = et.OnError
+		}
+		e.SetDefaultConfig(et.Config)
+		if et.Timeout > 0 && (e.Timeout < 1 || e.Timeout > et.Timeout) {
+			e.Timeout = et.Timeout
+		}
+	})
+
+	nestedEntities.Lock()
+	if len(nestedEntities.m) >= nestedEntitiesMax {
+		nestedEntities.m = make(map[nestedKey]Entities)
+	}
+	nestedEntities.m[key] = ets
+	nestedEntities.Unlock()
+	return ets, nil
+}
+
+// processNested resolves the ESI tags within a fragment returned by a
+// resource, if MaxDepth allows it. The nested tags inherit the configuration
+// of et and must finish within the remaining time of the et.Timeout, which
+// started at timeStart. A nested tag with the same src and key attributes as
+// one of its parents gets reported as a loop. When the maximum depth has been
+// reached, the fragment gets returned unprocessed. The returned header contains
+// the return headers of the nested tags and might be nil.
+func (et *Entity) processNested(r *http.Request, data []byte, timeStart time.Duration) (http.Header, []byte, error) {
+	if et.MaxDepth < 1 || !hasESITags(data) {
+		return nil, data, nil
+	}
+
+	chain := nestingFromContext(r.Context())
+	if len(chain) >= et.MaxDepth {
+		if et.Log.IsInfo() {
+			et.Log.Info("esitag.Entity.QueryResources.Nested.MaxDepth",
+				log.Int("max_depth", et.MaxDepth), log.String("tag", string(et.RawTag)))
+		}
+		return nil, data, nil
+	}
+
+	ets, err := et.parseNested(data)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "[esitag] processNested")
+	}
+	if len(ets) == 0 {
+		return nil, data, nil
+	}
+
+	remaining := et.Timeout - monotime.Since(timeStart)
+	if et.Timeout > 0 && remaining <= 0 {
+		return nil, nil, errors.Timeout.Newf("[esitag] No time left to process the nested fragment of tag %q", et.RawTag)
+	}
+
+	id := et.nestingID()
+	chain = append(chain[:len(chain):len(chain)], id)
+
+	var loopErr error
+	ets.Walk(func(e *Entity) {
+		if loopErr == nil && len(e.Resources) > 0 && chain.contains(e.nestingID()) {
+			loopErr = errors.NotAcceptable.Newf("[esitag] Loop detected: Tag %q includes itself. Chain: %q", e.RawTag, chain)
+		}
+	})
+	if loopErr != nil {
+		return nil, nil, loopErr
+	}
+
+	// The context limits the nested requests to the remaining time.
+	ctx := context.WithValue(r.Context(), ctxKeyNesting{}, chain)
+	if et.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, remaining)
+		defer cancel()
+	}
+
+	nested := &Block{
+		RawTag:   et.RawTag,
+		Body:     data,
+		Entities: ets,
+	}
+	return nested.render(r.WithContext(ctx), false)
+}
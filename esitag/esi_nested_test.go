@@ -0,0 +1,47 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package esitag
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntity_parseNested(t *testing.T) {
+	parent := &Entity{Config: Config{Timeout: time.Second, MaxDepth: 2}, OnError: []byte(`Sorry`)}
+	data := []byte(`<p><esi:remove>Gone</esi:remove></p>`)
+
+	ets, err := parent.parseNested(data)
+	require.NoError(t, err)
+	require.Len(t, ets, 1)
+	assert.Exactly(t, `Sorry`, string(ets[0].OnError))
+	assert.Exactly(t, time.Second, ets[0].Timeout)
+
+	ets2, err := parent.parseNested(append([]byte(nil), data...))
+	require.NoError(t, err)
+	assert.True(t, ets[0] == ets2[0], "Same content must be parsed only once")
+
+	other := &Entity{Config: Config{Timeout: time.Minute, MaxDepth: 2}}
+	ets3, err := other.parseNested(data)
+	require.NoError(t, err)
+	assert.False(t, ets[0] == ets3[0], "Another parent needs its own entities")
+	assert.Exactly(t, time.Minute, ets3[0].Timeout)
+
+	_, err = parent.parseNested([]byte(`<esi:vars><esi:vars>X</esi:vars></esi:vars>`))
+	assert.Error(t, err)
+}
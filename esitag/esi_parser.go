@@ -15,8 +15,10 @@
 package esitag
 
 import (
-	"bufio"
+	"bytes"
+	"fmt"
 	"io"
+	"strings"
 
 	"github.com/corestoreio/caddy-esi/bufpool"
 	"github.com/corestoreio/errors"
@@ -27,42 +29,543 @@ import (
 // returned from a dice roll.
 const MaxSizeESITag = 4096
 
-// Parse parses a stream of data to extract Tag Tags. Malformed Tag tags won't
-// trigger any errors, instead the parser skips them.
+// Names of the ESI block tags which can contain other tags and markup.
+const (
+	tagInclude   = "include"
+	tagChoose    = "choose"
+	tagWhen      = "when"
+	tagOtherwise = "otherwise"
+	tagTry       = "try"
+	tagAttempt   = "attempt"
+	tagExcept    = "except"
+	tagRemove    = "remove"
+	tagComment   = "comment"
+	tagVars      = "vars"
+	// tagESIComment identifies the <!--esi ... --> construct on the stack.
+	tagESIComment = "!--esi"
+)
+
+// Syntax defines a bit mask of the tag syntaxes which the parser accepts.
+type Syntax uint8
+
+// The supported syntaxes. Every syntax produces the same Entities.
+const (
+	// SyntaxESI the namespaced tags like <esi:include src="..."/> and the
+	// <!--esi ... --> section.
+	SyntaxESI Syntax = 1 << iota
+	// SyntaxElement the HTML custom elements like <esi-include
+	// src="..."></esi-include> or <esi-choose>. An esi-include requires a
+	// closing tag, everything between both tags gets replaced.
+	SyntaxElement
+	// SyntaxSSI the Apache/Nginx server side include <!--#include
+	// virtual="/path" -->. The path gets requested from
+	// ParseOptions.SSIUpstream. All other SSI commands stay untouched in the
+	// page.
+	SyntaxSSI
+)
+
+// ParseOptions modifies the behaviour of ParseWithOptions.
+type ParseOptions struct {
+	// Syntax enables the accepted tag syntaxes. Defaults to SyntaxESI.
+	Syntax Syntax
+	// Lenient skips a broken tag, logs it and parses the rest of the page
+	// instead of failing. A broken esi:include gets removed from the page, the
+	// markup of a broken block tag stays in the page as it is.
+	Lenient bool
+	// Log reports the skipped tags in lenient mode. Defaults to a black hole.
+	Log log.Logger
+	// SSIUpstream the base URL like http://127.0.0.1:2015 from which the
+	// virtual paths of SSI includes get requested. Required for SyntaxSSI. It
+	// must never be derived from the Host header because the client controls
+	// it.
+	SSIUpstream string
+}
+
+// ParseError describes a malformed tag and its position within the parsed
+// data. Line and Column start at one, the Column counts bytes.
+type ParseError struct {
+	Line   int
+	Column int
+	Offset int
+	// Tag contains the name of the tag, e.g. include or choose. Might be empty.
+	Tag string
+	Err error
+}
+
+func newParseError(data []byte, offset int, tag string, err error) *ParseError {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	return &ParseError{
+		Line:   bytes.Count(data[:offset], []byte{'\n'}) + 1,
+		Column: offset - bytes.LastIndexByte(data[:offset], '\n'),
+		Offset: offset,
+		Tag:    tag,
+		Err:    err,
+	}
+}
+
+// Error implements the error interface.
+func (pe *ParseError) Error() string {
+	if pe.Tag == "" {
+		return fmt.Sprintf("[esitag] Parse error at line %d, column %d, offset %d: %s", pe.Line, pe.Column, pe.Offset, pe.Err)
+	}
+	return fmt.Sprintf("[esitag] Parse error in tag %q at line %d, column %d, offset %d: %s", pe.Tag, pe.Line, pe.Column, pe.Offset, pe.Err)
+}
+
+// Cause returns the underlying error, so its kind can still be matched.
+func (pe *ParseError) Cause() error {
+	return pe.Err
+}
+
+// Parse parses a stream of data to extract Tag Tags. The block tags esi:choose,
+// esi:when, esi:otherwise, esi:try, esi:attempt and esi:except build a tree:
+// The returned Entity of an esi:choose or esi:try contains the blocks and each
+// block its nested entities. The positions of nested entities are relative to
+// the body of their block. The regions of esi:remove and esi:comment become
+// entities which render nothing and a <!--esi ... --> section becomes an
+// entity which renders its unwrapped content. Malformed tags, unbalanced block
+// tags, unterminated tags and tags longer than MaxSizeESITag return a
+// *ParseError.
 func Parse(r io.Reader) (Entities, error) {
-	ret := make(Entities, 0, 5) // avg 5 tags per parse ...
+	return ParseWithOptions(r, ParseOptions{})
+}
 
-	sc := bufio.NewScanner(r)
+// ParseWithOptions same as Parse but the options allow to skip malformed tags.
+func ParseWithOptions(r io.Reader, opts ParseOptions) (Entities, error) {
 	buf := bufpool.Get()
 	defer bufpool.Put(buf)
-	sc.Buffer(buf.Bytes(), cap(buf.Bytes())+2)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, errors.Wrap(err, "[esitag] Parse read failed")
+	}
 
-	fdr := newFinder()
-	sc.Split(fdr.split)
+	tb := &treeBuilder{
+		data:        buf.Bytes(),
+		root:        make(Entities, 0, 5), // avg 5 tags per parse ...
+		lenient:     opts.Lenient,
+		log:         opts.Log,
+		ssiUpstream: strings.TrimRight(opts.SSIUpstream, "/"),
+	}
+	if tb.log == nil {
+		tb.log = log.BlackHole{}
+	}
+	if opts.Syntax == 0 {
+		opts.Syntax = SyntaxESI
+	}
+	fdr := newFinder(opts.Syntax)
+	for _, b := range tb.data {
+		found, err := fdr.scan(b)
+		if err != nil {
+			if err := tb.skip(err, fdr.begin, ""); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !found {
+			continue
+		}
+		raw := fdr.data()
+		if err := tb.add(fdr.kind, raw, fdr.begin, fdr.end); err != nil {
+			if err := tb.skip(err, fdr.begin, tagName(raw)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if fdr.inTag() {
+		err := errors.NotValid.Newf("[esitag] Unterminated tag at position %d", fdr.begin)
+		if err := tb.skip(err, fdr.begin, tagName(fdr.buf)); err != nil {
+			return nil, err
+		}
+	}
+	return tb.finish()
+}
+
+// openTag represents a not yet closed block tag on the stack of the
+// treeBuilder.
+type openTag struct {
+	name      string
+	begin     int     // absolute position of the <
+	bodyStart int     // absolute position after the >
+	entity    *Entity // set for esi:choose, esi:try, esi:remove, esi:comment and <!--esi
+	block     *Block  // set for esi:when, esi:otherwise, esi:attempt, esi:except and <!--esi
+	skip      bool    // true for esi:remove and esi:comment, the content gets dropped
+}
+
+// treeBuilder assembles the tokens found by the finder into a tree of
+// Entities.
+type treeBuilder struct {
+	data        []byte
+	root        Entities
+	stack       []*openTag
+	lenient     bool
+	log         log.Logger
+	ssiUpstream string
+}
+
+// skip converts err into a *ParseError. In lenient mode the error gets logged
+// and skip returns nil, so that the parser can continue with the next tag.
+func (tb *treeBuilder) skip(err error, begin int, tag string) error {
+	pe, ok := err.(*ParseError)
+	if !ok {
+		pe = newParseError(tb.data, begin, tag, err)
+	}
+	if !tb.lenient {
+		return pe
+	}
+	if tb.log.IsInfo() {
+		tb.log.Info("esitag.Parse.Lenient.Skip",
+			log.Err(pe.Err), log.String("tag", pe.Tag), log.Int("line", pe.Line),
+			log.Int("column", pe.Column), log.Int("offset", pe.Offset),
+		)
+	}
+	return nil
+}
 
-	var tagIndex int
-	for sc.Scan() {
-		if sc.Err() != nil {
-			return nil, errors.Wrap(sc.Err(), "[esitag] Parse scan failed")
+func (tb *treeBuilder) top() *openTag {
+	if len(tb.stack) == 0 {
+		return nil
+	}
+	return tb.stack[len(tb.stack)-1]
+}
+
+// offset returns the absolute position where the body of the current block
+// begins. Positions of nested entities are relative to that body.
+func (tb *treeBuilder) offset() int {
+	if t := tb.top(); t != nil && t.block != nil {
+		return t.bodyStart
+	}
+	return 0
+}
+
+// appendEntity adds the entity to the current block or to the root.
+func (tb *treeBuilder) appendEntity(e *Entity) error {
+	t := tb.top()
+	switch {
+	case t == nil:
+		tb.root = append(tb.root, e)
+	case t.block != nil:
+		t.block.Entities = append(t.block.Entities, e)
+	default:
+		return errors.NotValid.Newf("[esitag] Tag %q at position %d not allowed directly within esi:%s", e.RawTag, tb.offset()+e.DataTag.Start, t.name)
+	}
+	return nil
+}
+
+func (tb *treeBuilder) add(kind tokenKind, raw []byte, begin, end int) error {
+	name := tagName(raw)
+	element := kind == tokenElementOpen
+	if element {
+		kind = tokenOpen
+	}
+
+	// The content of esi:remove and esi:comment gets dropped, so all tags
+	// within are ignored until the matching closing tag shows up.
+	if t := tb.top(); t != nil && t.skip {
+		if kind != tokenClose || name != t.name {
+			return nil
+		}
+		tb.stack = tb.stack[:len(tb.stack)-1]
+		t.entity.DataTag.End = end - tb.offset()
+		return tb.appendEntity(t.entity)
+	}
+
+	switch kind {
+	case tokenSelfClosing:
+		e, err := tb.newInclude(raw, name, begin, end)
+		if err != nil {
+			return err
+		}
+		return tb.appendEntity(e)
+
+	case tokenSSI:
+		return tb.addSSI(raw, begin, end)
+
+	case tokenCommentOpen:
+		if t := tb.top(); t != nil && (t.block == nil || t.name == tagESIComment) {
+			return errors.NotValid.Newf("[esitag] <!--esi at position %d not allowed directly within esi:%s", begin, t.name)
+		}
+		blk := &Block{}
+		tb.stack = append(tb.stack, &openTag{
+			name:      tagESIComment,
+			begin:     begin,
+			bodyStart: end,
+			entity: &Entity{
+				Config: Config{
+					Log: log.BlackHole{},
+				},
+				RawTag: []byte(tagESIComment),
+				DataTag: DataTag{
+					Start: begin - tb.offset(),
+				},
+				Unwrap: blk,
+			},
+			block: blk,
+		})
+
+	case tokenCommentClose:
+		t := tb.top()
+		if t == nil || t.name != tagESIComment {
+			return nil // end of a normal HTML comment
+		}
+		return tb.closeBlockEntity(begin, end)
+
+	case tokenOpen, tokenClose:
+		if element && name == tagInclude {
+			return tb.addElement(raw, begin, end)
+		}
+		if name == tagVars {
+			return tb.addVars(kind, raw, begin, end)
+		}
+		return tb.addBlock(kind, name, raw, begin, end)
+	}
+	return nil
+}
+
+// newInclude creates the entity of an include tag and parses its attributes.
+// In lenient mode a broken tag gets removed from the page.
+func (tb *treeBuilder) newInclude(raw []byte, name string, begin, end int) (*Entity, error) {
+	off := tb.offset()
+	e := &Entity{
+		Config: Config{
+			Log: log.BlackHole{},
+		},
+		RawTag: raw,
+		DataTag: DataTag{
+			Start: begin - off,
+			End:   end - off,
+		},
+		Remove: name == tagComment,
+	}
+	if err := e.ParseRaw(); err != nil {
+		if err := tb.skip(err, begin, name); err != nil {
+			return nil, err
+		}
+		e.Remove = true
+	}
+	return e, nil
+}
+
+// addElement handles the opening tag of the custom element esi-include. Its
+// content gets skipped until the closing tag </esi-include> which sets the end
+// of the entity.
+func (tb *treeBuilder) addElement(raw []byte, begin, end int) error {
+	e, err := tb.newInclude(raw, tagInclude, begin, end)
+	if err != nil {
+		return err
+	}
+	tb.stack = append(tb.stack, &openTag{
+		name:      tagInclude,
+		begin:     begin,
+		bodyStart: end,
+		entity:    e,
+		skip:      true,
+	})
+	return nil
+}
+
+// addSSI converts the server side include <!--#include virtual="/path" -->
+// into an include entity which requests the path from the configured upstream.
+func (tb *treeBuilder) addSSI(raw []byte, begin, end int) error {
+	if tagName(raw) != tagInclude {
+		return nil // other SSI commands stay in the page
+	}
+	if tb.ssiUpstream == "" {
+		return errors.Empty.Newf("[esitag] SSI %q requires an upstream base URL", raw)
+	}
+	attrs, err := SplitAttributes(string(raw))
+	if err != nil {
+		return errors.Wrap(err, "[esitag] SSI SplitAttributes")
+	}
+	var src string
+	for j := 0; j < len(attrs); j = j + 2 {
+		switch attr, value := attrs[j], attrs[j+1]; {
+		case attr == "virtual" && strings.HasPrefix(value, "/"):
+			src = tb.ssiUpstream + value
+		case attr == "virtual":
+			return errors.NotSupported.Newf("[esitag] SSI virtual path %q must be absolute", value)
+		default:
+			return errors.NotSupported.Newf("[esitag] Unsupported SSI attribute name %q with value %q", attr, value)
 		}
+	}
+	if src == "" {
+		return errors.Empty.Newf("[esitag] Missing attribute virtual in SSI %q", raw)
+	}
+	e, err := tb.newInclude([]byte(`include src="`+src+`"`), tagInclude, begin, end)
+	if err != nil {
+		return err
+	}
+	return tb.appendEntity(e)
+}
 
-		ret = append(ret, &Entity{
+// addVars handles the esi:vars block which is an entity and a block at the
+// same time, like <!--esi.
+func (tb *treeBuilder) addVars(kind tokenKind, raw []byte, begin, end int) error {
+	if kind == tokenClose {
+		if t := tb.top(); t == nil || t.name != tagVars {
+			return errors.NotValid.Newf("[esitag] Unexpected closing tag esi:%s at position %d", tagVars, begin)
+		}
+		return tb.closeBlockEntity(begin, end)
+	}
+	if t := tb.top(); t != nil && (t.block == nil || t.name == tagVars) {
+		return errors.NotValid.Newf("[esitag] esi:%s at position %d not allowed directly within esi:%s", tagVars, begin, t.name)
+	}
+	blk := &Block{
+		RawTag:      raw,
+		ReplaceVars: true,
+	}
+	if err := blk.parseAttributes(); err != nil {
+		return err
+	}
+	tb.stack = append(tb.stack, &openTag{
+		name:      tagVars,
+		begin:     begin,
+		bodyStart: end,
+		entity: &Entity{
 			Config: Config{
 				Log: log.BlackHole{},
 			},
-			RawTag: sc.Bytes(),
+			RawTag: raw,
 			DataTag: DataTag{
-				Start: fdr.begin,
-				End:   fdr.end,
+				Start: begin - tb.offset(),
 			},
-		})
-		tagIndex++
+			Vars: blk,
+		},
+		block: blk,
+	})
+	return nil
+}
+
+// closeBlockEntity pops an entity from the stack which is also its own block,
+// e.g. esi:vars or <!--esi, and appends it to its parent.
+func (tb *treeBuilder) closeBlockEntity(begin, end int) error {
+	t := tb.top()
+	tb.stack = tb.stack[:len(tb.stack)-1]
+	// data gets reused by the buffer pool, so copy the body.
+	t.block.Body = make([]byte, begin-t.bodyStart)
+	copy(t.block.Body, tb.data[t.bodyStart:begin])
+	t.entity.DataTag.End = end - tb.offset()
+	return tb.appendEntity(t.entity)
+}
+
+// addBlock handles the opening and closing tags of esi:choose, esi:try,
+// esi:remove, esi:comment and their child blocks.
+func (tb *treeBuilder) addBlock(kind tokenKind, name string, raw []byte, begin, end int) error {
+	switch kind {
+	case tokenOpen:
+		ot := &openTag{
+			name:      name,
+			begin:     begin,
+			bodyStart: end,
+		}
+		switch name {
+		case tagChoose, tagTry, tagRemove, tagComment:
+			if t := tb.top(); t != nil && t.block == nil {
+				return errors.NotValid.Newf("[esitag] esi:%s at position %d not allowed directly within esi:%s", name, begin, t.name)
+			}
+			ot.entity = &Entity{
+				Config: Config{
+					Log: log.BlackHole{},
+				},
+				RawTag: raw,
+				DataTag: DataTag{
+					Start: begin - tb.offset(),
+				},
+			}
+			switch name {
+			case tagChoose:
+				ot.entity.Choose = make([]*Block, 0, 2)
+			case tagRemove, tagComment:
+				ot.entity.Remove = true
+				ot.skip = true
+			}
+		case tagWhen, tagOtherwise:
+			if t := tb.top(); t == nil || t.name != tagChoose {
+				return errors.NotValid.Newf("[esitag] esi:%s at position %d must be a direct child of esi:choose", name, begin)
+			}
+			ot.block = &Block{
+				RawTag: raw,
+			}
+		case tagAttempt, tagExcept:
+			if t := tb.top(); t == nil || t.name != tagTry {
+				return errors.NotValid.Newf("[esitag] esi:%s at position %d must be a direct child of esi:try", name, begin)
+			}
+			ot.block = &Block{
+				RawTag: raw,
+			}
+		default:
+			return nil // not a block tag, skip it
+		}
+		if ot.block != nil {
+			if err := ot.block.parseAttributes(); err != nil {
+				return err
+			}
+		}
+		tb.stack = append(tb.stack, ot)
+
+	case tokenClose:
+		switch name {
+		case tagChoose, tagWhen, tagOtherwise, tagTry, tagAttempt, tagExcept:
+		case tagRemove, tagComment:
+			return errors.NotValid.Newf("[esitag] Unexpected closing tag esi:%s at position %d", name, begin)
+		default:
+			return nil // not a block tag, skip it
+		}
+		t := tb.top()
+		if t == nil || t.name != name {
+			return errors.NotValid.Newf("[esitag] Unexpected closing tag esi:%s at position %d", name, begin)
+		}
+		tb.stack = tb.stack[:len(tb.stack)-1]
+
+		if t.block != nil {
+			// data gets reused by the buffer pool, so copy the body.
+			t.block.Body = make([]byte, begin-t.bodyStart)
+			copy(t.block.Body, tb.data[t.bodyStart:begin])
+			parent := tb.top().entity
+			switch t.name {
+			case tagAttempt:
+				if parent.Attempt != nil {
+					return errors.NotValid.Newf("[esitag] Duplicate esi:attempt at position %d", t.begin)
+				}
+				parent.Attempt = t.block
+			case tagExcept:
+				if parent.Except != nil {
+					return errors.NotValid.Newf("[esitag] Duplicate esi:except at position %d", t.begin)
+				}
+				parent.Except = t.block
+			default:
+				parent.Choose = append(parent.Choose, t.block)
+			}
+			return nil
+		}
+		if t.name == tagTry && t.entity.Attempt == nil {
+			return errors.NotValid.Newf("[esitag] Missing esi:attempt in esi:try at position %d", t.begin)
+		}
+		t.entity.DataTag.End = end - tb.offset()
+		return tb.appendEntity(t.entity)
 	}
+	return nil
+}
 
-	if err := ret.ParseRaw(); err != nil {
-		return nil, errors.Wrap(err, "[esitag] Slice.ParseRaw")
+// finish reports the not yet closed block tags. In lenient mode they get
+// dropped and their markup stays in the page.
+func (tb *treeBuilder) finish() (Entities, error) {
+	for t := tb.top(); t != nil; t = tb.top() {
+		tb.stack = tb.stack[:len(tb.stack)-1]
+		err := errors.NotValid.Newf("[esitag] Missing closing tag for esi:%s at position %d", t.name, t.begin)
+		if err := tb.skip(err, t.begin, t.name); err != nil {
+			return nil, err
+		}
 	}
-	return ret, nil
+	return tb.root, nil
+}
+
+// tagName returns the leading letters of the raw tag, e.g. include or choose.
+func tagName(raw []byte) string {
+	i := 0
+	for i < len(raw) && (raw[i] >= 'a' && raw[i] <= 'z' || raw[i] >= 'A' && raw[i] <= 'Z') {
+		i++
+	}
+	return string(raw[:i])
 }
 
 type tagState int
@@ -74,59 +577,127 @@ const (
 	stateTagES           // read <es
 	stateTagESI          // read <esi
 	//stateTagESIc          // read <esi:
-	stateData  // now reading stuff behind :
-	stateSlash // found / which might be start of />
-	stateFound // found /> as end of esi tag
+	stateData      // now reading stuff behind :
+	stateSlash     // found / which might be start of />
+	stateFound     // found /> as end of esi tag or > as end of a block tag
+	stateBang      // read <!
+	stateBangDash  // read <!-
+	stateComment   // read <!--
+	stateCommentE  // read <!--e
+	stateCommentES // read <!--es
+	stateSSI       // read <!--#
+)
+
+type tokenKind uint8
+
+const (
+	tokenSelfClosing  tokenKind = iota + 1 // <esi:include />
+	tokenOpen                              // <esi:choose>
+	tokenClose                             // </esi:choose>
+	tokenCommentOpen                       // <!--esi
+	tokenCommentClose                      // -->
+	tokenElementOpen                       // <esi-include>
+	tokenSSI                               // <!--#include virtual="" -->
 )
 
 // finder represents a state machine
 type finder struct {
 	tagState
+	syntax     Syntax
+	kind       tokenKind
+	closing    bool // read </
+	element    bool // read <esi- instead of <esi:
+	quote      byte // current quotation mark within the attributes
+	dashes     int  // number of consecutive - outside of a tag to detect -->
 	n          int
 	begin, end int
 	buf        []byte
 }
 
-func newFinder() *finder {
+func newFinder(s Syntax) *finder {
 	var buf [MaxSizeESITag]byte
 	return &finder{
 		tagState: stateStart,
+		syntax:   s,
 		buf:      buf[:0], // for now max size of one esi tag
 	}
 }
 
-// split used in bufio.Scanner and matches the signature of bufio.SplitFunc. the
-// variable names for the returned values are for documentation purposes only.
-func (e *finder) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
-	}
-	for i, b := range data {
-		ok, err := e.scan(b)
-		if err != nil {
-			return 0, nil, errors.Wrap(err, "[esitag] finder split scan failed")
-		}
-		if ok {
-			return i, e.data(), nil
-		}
-	}
-	return len(data), nil, nil
-}
-
 // scan scans the next byte in the input stream and returns whether a <esi: ...
-// /> tag was found in which case a call to data() reveals the what the ...
-// matched.
-func (e *finder) scan(b byte) (bool, error) {
+// />, <esi: ... > or </esi: ... > tag was found in which case a call to data()
+// reveals the what the ... matched and the field kind the type of the tag.
+// Quotation marks get tracked so that a > within an attribute value does not
+// end a tag. The start <!--esi and the end --> of a comment are reported with
+// an empty data().
+func (e *finder) scan(b byte) (found bool, err error) {
 	switch e.tagState {
 	case stateStart, stateFound:
-		if b == '<' {
+		switch {
+		case b == '<':
 			e.tagState = stateTag
+			e.closing = false
 			e.begin = e.n
+			e.dashes = 0
+		case b == '-':
+			e.dashes++
+		case b == '>' && e.dashes >= 2:
+			e.tagState = stateFound
+			e.kind = tokenCommentClose
+			e.begin = e.n - 2
+			e.end = e.n + 1
+			e.buf = e.buf[:0]
+			e.dashes = 0
+			found = true
+		default:
+			e.dashes = 0
 		}
 	case stateTag:
 		e.tagState = stateStart
-		if b == 'e' {
+		switch {
+		case b == 'e':
 			e.tagState = stateTagE
+		case b == '/' && !e.closing:
+			e.tagState = stateTag
+			e.closing = true
+		case b == '!' && !e.closing:
+			e.tagState = stateBang
+		}
+	case stateBang:
+		e.tagState = stateStart
+		if b == '-' {
+			e.tagState = stateBangDash
+		}
+	case stateBangDash:
+		e.tagState = stateStart
+		if b == '-' {
+			e.tagState = stateComment
+		}
+	case stateComment:
+		e.tagState = stateStart
+		switch {
+		case b == 'e' && e.syntax&SyntaxESI != 0:
+			e.tagState = stateCommentE
+		case b == '#' && e.syntax&SyntaxSSI != 0:
+			e.tagState = stateSSI
+			e.buf = e.buf[:0]
+			e.quote = 0
+			e.dashes = 0
+		}
+	case stateSSI:
+		found, err = e.scanSSI(b)
+	case stateCommentE:
+		e.tagState = stateStart
+		if b == 's' {
+			e.tagState = stateCommentES
+		}
+	case stateCommentES:
+		e.tagState = stateStart
+		if b == 'i' {
+			e.tagState = stateFound
+			e.kind = tokenCommentOpen
+			e.end = e.n + 1
+			e.buf = e.buf[:0]
+			found = true
 		}
 	case stateTagE:
 		e.tagState = stateStart
@@ -140,27 +711,102 @@ func (e *finder) scan(b byte) (bool, error) {
 		}
 	case stateTagESI:
 		e.tagState = stateStart
-		if b == ':' {
+		if b == ':' && e.syntax&SyntaxESI != 0 || b == '-' && e.syntax&SyntaxElement != 0 {
 			e.tagState = stateData
+			e.element = b == '-'
 			e.buf = e.buf[:0]
-		}
-	case stateData:
-		e.buf = append(e.buf, b)
-		if b == '/' {
-			e.tagState = stateSlash
+			e.quote = 0
 		}
 	case stateSlash:
 		if b == '>' {
 			e.tagState = stateFound
+			e.kind = tokenSelfClosing
 			e.end = e.n + 1 // to also exclude the >.
-			return true, nil
+			found = !e.closing
+			break
 		}
-		e.buf = append(e.buf, b)
 		e.tagState = stateData
+		found, err = e.scanData(b)
+	case stateData:
+		found, err = e.scanData(b)
 	default:
-		return false, errors.NotImplemented.Newf("[esitag] Parser detected an unknown state in machine: %d with Byte: %q", e.tagState, rune(b))
+		err = errors.NotImplemented.Newf("[esitag] Parser detected an unknown state in machine: %d with Byte: %q", e.tagState, rune(b))
+		e.tagState = stateStart
 	}
 	e.n++
+	return found, err
+}
+
+// inTag reports whether the scanner stopped within an esi tag or an SSI
+// include.
+func (e *finder) inTag() bool {
+	return e.tagState == stateData || e.tagState == stateSlash || e.tagState == stateSSI && e.isSSIInclude()
+}
+
+func (e *finder) isSSIInclude() bool {
+	return bytes.HasPrefix(e.buf, []byte(tagInclude))
+}
+
+// scanSSI reads the content of <!--# until the closing -->. The trailing
+// dashes get removed from the buffer.
+func (e *finder) scanSSI(b byte) (bool, error) {
+	switch {
+	case e.quote != 0:
+		if b == e.quote {
+			e.quote = 0
+		}
+	case b == '"' || b == '\'':
+		e.quote = b
+	case b == '>' && e.dashes >= 2:
+		e.tagState = stateFound
+		e.kind = tokenSSI
+		e.end = e.n + 1
+		e.buf = e.buf[:len(e.buf)-2]
+		e.dashes = 0
+		return true, nil
+	}
+	if b == '-' && e.quote == 0 {
+		e.dashes++
+	} else {
+		e.dashes = 0
+	}
+	e.buf = append(e.buf, b)
+	if len(e.buf) > MaxSizeESITag {
+		e.tagState = stateStart
+		if e.isSSIInclude() {
+			return false, errors.TooLarge.Newf("[esitag] SSI at position %d exceeds the maximum size of %d bytes", e.begin, MaxSizeESITag)
+		}
+	}
+	return false, nil
+}
+
+func (e *finder) scanData(b byte) (bool, error) {
+	switch {
+	case e.quote != 0:
+		if b == e.quote {
+			e.quote = 0
+		}
+	case b == '"' || b == '\'':
+		e.quote = b
+	case b == '/':
+		e.tagState = stateSlash
+	case b == '>':
+		e.tagState = stateFound
+		e.kind = tokenOpen
+		switch {
+		case e.closing:
+			e.kind = tokenClose
+		case e.element:
+			e.kind = tokenElementOpen
+		}
+		e.end = e.n + 1
+		return true, nil
+	}
+	e.buf = append(e.buf, b)
+	if len(e.buf) > MaxSizeESITag {
+		e.tagState = stateStart // too long, skip it
+		return false, errors.TooLarge.Newf("[esitag] Tag at position %d exceeds the maximum size of %d bytes", e.begin, MaxSizeESITag)
+	}
 	return false, nil
 }
 
@@ -171,8 +817,11 @@ func (e *finder) data() []byte {
 	if e.tagState != stateFound {
 		return nil
 	}
-
-	ret := make([]byte, len(e.buf)-1)
-	copy(ret, e.buf[:len(e.buf)-1]) // trim last /
+	l := len(e.buf)
+	if e.kind == tokenSelfClosing {
+		l-- // trim last /
+	}
+	ret := make([]byte, l)
+	copy(ret, e.buf[:l])
 	return ret
 }
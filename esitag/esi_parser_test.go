@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
@@ -27,6 +28,7 @@ import (
 	_ "github.com/corestoreio/caddy-esi/esitag/backend" // import registered handlers
 	"github.com/corestoreio/caddy-esi/esitesting"
 	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log/logw"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -310,3 +312,359 @@ src="https://micro4.service4/esi/foo"/>@<esi:include src="https://micro5.service
 		errors.NoKind,
 	))
 }
+
+func TestParse_Choose(t *testing.T) {
+	t.Parallel()
+
+	defer esitag.RegisterResourceHandler("choose1", esitesting.MockRequestContent("Any content")).DeferredDeregister()
+
+	t.Run("when and otherwise with nested include", func(t *testing.T) {
+		page := `<p>A</p><esi:choose>
+	<esi:when test="{Cgroup}=='advanced'"><esi:include src="choose1://advanced"/></esi:when>
+	<esi:when test="{Cgroup} == 'basic' && {HX-Test} > 2">basic</esi:when>
+	<esi:otherwise><b>default</b></esi:otherwise>
+</esi:choose><esi:include src="choose1://footer"/>`
+
+		ets, err := esitag.Parse(strings.NewReader(page))
+		require.NoError(t, err)
+		require.Len(t, ets, 2)
+
+		ch := ets[0]
+		assert.Exactly(t, "choose", string(ch.RawTag))
+		assert.Exactly(t, 8, ch.DataTag.Start)
+		assert.True(t, strings.HasSuffix(page[:ch.DataTag.End], "</esi:choose>"), "Should end with the closing tag")
+		require.Len(t, ch.Choose, 3)
+
+		assert.Exactly(t, `when test="{Cgroup}=='advanced'"`, string(ch.Choose[0].RawTag))
+		assert.NotNil(t, ch.Choose[0].Test)
+		assert.Exactly(t, `<esi:include src="choose1://advanced"/>`, string(ch.Choose[0].Body))
+		require.Len(t, ch.Choose[0].Entities, 1)
+		assert.Exactly(t, 0, ch.Choose[0].Entities[0].DataTag.Start, "Position relative to the body")
+		assert.Exactly(t, 39, ch.Choose[0].Entities[0].DataTag.End, "Position relative to the body")
+
+		assert.Exactly(t, `basic`, string(ch.Choose[1].Body))
+		assert.Nil(t, ch.Choose[2].Test, "otherwise has no test")
+		assert.Exactly(t, `<b>default</b>`, string(ch.Choose[2].Body))
+
+		assert.Exactly(t, `include src="choose1://footer"`, string(ets[1].RawTag))
+		assert.Exactly(t, `<esi:include src="choose1://footer"/>`, page[ets[1].DataTag.Start:ets[1].DataTag.End])
+	})
+
+	t.Run("nested choose", func(t *testing.T) {
+		ets, err := esitag.Parse(strings.NewReader(`<esi:choose><esi:when test="1"><esi:choose><esi:otherwise>X</esi:otherwise></esi:choose></esi:when></esi:choose>`))
+		require.NoError(t, err)
+		require.Len(t, ets, 1)
+		inner := ets[0].Choose[0].Entities
+		require.Len(t, inner, 1)
+		assert.Exactly(t, 0, inner[0].DataTag.Start)
+		assert.Exactly(t, 57, inner[0].DataTag.End)
+		assert.Exactly(t, `X`, string(inner[0].Choose[0].Body))
+	})
+
+	t.Run("greater than sign in test attribute", func(t *testing.T) {
+		ets, err := esitag.Parse(strings.NewReader(`<esi:choose><esi:when test="{Fpage} > 2">X</esi:when></esi:choose>`))
+		require.NoError(t, err)
+		assert.Exactly(t, `X`, string(ets[0].Choose[0].Body))
+	})
+
+	t.Run("missing closing tag", testRunner(`<esi:choose><esi:when test="1">X</esi:when>`, nil, errors.NotValid))
+	t.Run("unbalanced closing tag", testRunner(`<esi:choose><esi:when test="1">X</esi:choose></esi:when>`, nil, errors.NotValid))
+	t.Run("when outside of choose", testRunner(`<esi:when test="1">X</esi:when>`, nil, errors.NotValid))
+	t.Run("include directly within choose", testRunner(`<esi:choose><esi:include src="choose1://x"/></esi:choose>`, nil, errors.NotValid))
+	t.Run("when without test", testRunner(`<esi:choose><esi:when>X</esi:when></esi:choose>`, nil, errors.Empty))
+	t.Run("when with unsupported attribute", testRunner(`<esi:choose><esi:when test="1" src="x">X</esi:when></esi:choose>`, nil, errors.NotSupported))
+}
+
+func TestParse_Try(t *testing.T) {
+	t.Parallel()
+
+	defer esitag.RegisterResourceHandler("try1", esitesting.MockRequestContent("Any content")).DeferredDeregister()
+
+	t.Run("attempt and except with nested includes", func(t *testing.T) {
+		page := `<p>A</p><esi:try>
+	<esi:attempt><esi:include src="try1://cart"/></esi:attempt>
+	<esi:except><b>Cart not available</b> <esi:include src="try1://fallback"/></esi:except>
+</esi:try>`
+
+		ets, err := esitag.Parse(strings.NewReader(page))
+		require.NoError(t, err)
+		require.Len(t, ets, 1)
+
+		try := ets[0]
+		assert.Exactly(t, "try", string(try.RawTag))
+		assert.Exactly(t, 8, try.DataTag.Start)
+		assert.Exactly(t, len(page), try.DataTag.End)
+		assert.Nil(t, try.Choose)
+
+		require.NotNil(t, try.Attempt)
+		assert.Exactly(t, `<esi:include src="try1://cart"/>`, string(try.Attempt.Body))
+		require.Len(t, try.Attempt.Entities, 1)
+		assert.Exactly(t, 0, try.Attempt.Entities[0].DataTag.Start, "Position relative to the body")
+
+		require.NotNil(t, try.Except)
+		assert.Exactly(t, `<b>Cart not available</b> <esi:include src="try1://fallback"/>`, string(try.Except.Body))
+		require.Len(t, try.Except.Entities, 1)
+		assert.Exactly(t, 26, try.Except.Entities[0].DataTag.Start, "Position relative to the body")
+	})
+
+	t.Run("try within when", func(t *testing.T) {
+		ets, err := esitag.Parse(strings.NewReader(`<esi:choose><esi:when test="1"><esi:try><esi:attempt>X</esi:attempt></esi:try></esi:when></esi:choose>`))
+		require.NoError(t, err)
+		inner := ets[0].Choose[0].Entities
+		require.Len(t, inner, 1)
+		assert.Exactly(t, `X`, string(inner[0].Attempt.Body))
+		assert.Nil(t, inner[0].Except)
+	})
+
+	t.Run("missing attempt", testRunner(`<esi:try><esi:except>X</esi:except></esi:try>`, nil, errors.NotValid))
+	t.Run("duplicate attempt", testRunner(`<esi:try><esi:attempt>X</esi:attempt><esi:attempt>Y</esi:attempt></esi:try>`, nil, errors.NotValid))
+	t.Run("except outside of try", testRunner(`<esi:except>X</esi:except>`, nil, errors.NotValid))
+	t.Run("when within try", testRunner(`<esi:try><esi:when test="1">X</esi:when></esi:try>`, nil, errors.NotValid))
+	t.Run("attempt with unsupported attribute", testRunner(`<esi:try><esi:attempt test="1">X</esi:attempt></esi:try>`, nil, errors.NotSupported))
+}
+
+func TestParse_RemoveComment(t *testing.T) {
+	t.Parallel()
+
+	defer esitag.RegisterResourceHandler("remove1", esitesting.MockRequestContent("Any content")).DeferredDeregister()
+
+	t.Run("remove, comment and esi comment", func(t *testing.T) {
+		page := `<esi:remove><a href="/cart"><esi:include src="remove1://ignored"/></a></esi:remove>` +
+			`<esi:comment text="only for the editor"/>` +
+			`<!-- normal comment --><!--esi <p><esi:include src="remove1://cart"/></p> -->` +
+			`<esi:comment><esi:choose></esi:comment>`
+
+		ets, err := esitag.Parse(strings.NewReader(page))
+		require.NoError(t, err)
+		require.Len(t, ets, 4)
+
+		assert.True(t, ets[0].Remove)
+		assert.Empty(t, ets[0].Resources, "Tags within esi:remove must be ignored")
+		assert.Exactly(t, `<esi:remove><a href="/cart"><esi:include src="remove1://ignored"/></a></esi:remove>`, page[ets[0].DataTag.Start:ets[0].DataTag.End])
+
+		assert.True(t, ets[1].Remove)
+		assert.Exactly(t, `<esi:comment text="only for the editor"/>`, page[ets[1].DataTag.Start:ets[1].DataTag.End])
+
+		assert.False(t, ets[2].Remove)
+		require.NotNil(t, ets[2].Unwrap)
+		assert.Exactly(t, `<!--esi <p><esi:include src="remove1://cart"/></p> -->`, page[ets[2].DataTag.Start:ets[2].DataTag.End])
+		assert.Exactly(t, ` <p><esi:include src="remove1://cart"/></p> `, string(ets[2].Unwrap.Body))
+		require.Len(t, ets[2].Unwrap.Entities, 1)
+		assert.Exactly(t, 4, ets[2].Unwrap.Entities[0].DataTag.Start, "Position relative to the body")
+
+		assert.True(t, ets[3].Remove)
+		assert.Exactly(t, `<esi:comment><esi:choose></esi:comment>`, page[ets[3].DataTag.Start:ets[3].DataTag.End])
+	})
+
+	t.Run("esi comment within when", func(t *testing.T) {
+		ets, err := esitag.Parse(strings.NewReader(`<esi:choose><esi:when test="1"><!--esi X--></esi:when></esi:choose>`))
+		require.NoError(t, err)
+		inner := ets[0].Choose[0].Entities
+		require.Len(t, inner, 1)
+		assert.Exactly(t, ` X`, string(inner[0].Unwrap.Body))
+	})
+
+	t.Run("unclosed esi comment", testRunner(`<!--esi <esi:include src="remove1://cart"/>`, nil, errors.NotValid))
+	t.Run("unclosed remove", testRunner(`<esi:remove>X`, nil, errors.NotValid))
+	t.Run("unexpected closing remove", testRunner(`X</esi:remove>`, nil, errors.NotValid))
+	t.Run("remove directly within choose", testRunner(`<esi:choose><esi:remove>X</esi:remove></esi:choose>`, nil, errors.NotValid))
+}
+
+func TestParse_Vars(t *testing.T) {
+	t.Parallel()
+
+	defer esitag.RegisterResourceHandler("vars1", esitesting.MockRequestContent("Any content")).DeferredDeregister()
+
+	page := `<p>A</p><esi:vars><img src="/avatar/$(HTTP_COOKIE{user})"/><esi:include src="vars1://cart/$(HTTP_COOKIE{user})"/></esi:vars>`
+	ets, err := esitag.Parse(strings.NewReader(page))
+	require.NoError(t, err)
+	require.Len(t, ets, 1)
+
+	require.NotNil(t, ets[0].Vars)
+	assert.True(t, ets[0].Vars.ReplaceVars)
+	assert.Exactly(t, page[8:], page[ets[0].DataTag.Start:ets[0].DataTag.End])
+	require.Len(t, ets[0].Vars.Entities, 1)
+	assert.Exactly(t, 41, ets[0].Vars.Entities[0].DataTag.Start, "Position relative to the body")
+
+	t.Run("nested vars", testRunner(`<esi:vars><esi:vars>X</esi:vars></esi:vars>`, nil, errors.NotValid))
+	t.Run("unclosed vars", testRunner(`<esi:vars>X`, nil, errors.NotValid))
+	t.Run("unexpected closing vars", testRunner(`X</esi:vars>`, nil, errors.NotValid))
+	t.Run("vars with unsupported attribute", testRunner(`<esi:vars name="x">X</esi:vars>`, nil, errors.NotSupported))
+}
+
+func TestParse_Diagnostics(t *testing.T) {
+	t.Parallel()
+
+	defer esitag.RegisterResourceHandler("diag1", esitesting.MockRequestContent("Any content")).DeferredDeregister()
+
+	runner := func(page string, wantKind errors.Kind, wantLine, wantColumn, wantOffset int, wantTag string) func(*testing.T) {
+		return func(t *testing.T) {
+			ets, err := esitag.Parse(strings.NewReader(page))
+			assert.Nil(t, ets)
+			assert.True(t, wantKind.Match(err), "%+v", err)
+			pe, ok := err.(*esitag.ParseError)
+			require.True(t, ok, "Expecting a *esitag.ParseError but got %T", err)
+			assert.Exactly(t, wantLine, pe.Line, "Line")
+			assert.Exactly(t, wantColumn, pe.Column, "Column")
+			assert.Exactly(t, wantOffset, pe.Offset, "Offset")
+			assert.Exactly(t, wantTag, pe.Tag, "Tag")
+		}
+	}
+	t.Run("bad duration", runner(
+		"<html>\n<body>\n  <esi:include src=\"diag1://a\" timeout=\"10xyz\" />",
+		errors.NotValid, 3, 3, 16, "include",
+	))
+	t.Run("unknown attribute", runner(
+		"<p>\n<esi:include src=\"diag1://a\" sourc=\"x\"/>\n</p>",
+		errors.NotSupported, 2, 1, 4, "include",
+	))
+	t.Run("unterminated tag", runner(
+		"<p>\n\n<b><esi:include src=\"diag1://a\"",
+		errors.NotValid, 3, 4, 8, "include",
+	))
+	t.Run("tag too long", runner(
+		"<p>\n<esi:include src=\""+strings.Repeat("x", esitag.MaxSizeESITag)+"\"/>",
+		errors.TooLarge, 2, 1, 4, "",
+	))
+	t.Run("missing closing tag", runner(
+		"<div>\n<esi:choose>\n<esi:when test=\"1\">X</esi:when>",
+		errors.NotValid, 2, 1, 6, "choose",
+	))
+	t.Run("bad test in when", runner(
+		"<esi:choose>\n\t<esi:when test=\"{Fa} ==\">X</esi:when></esi:choose>",
+		errors.NotValid, 2, 2, 14, "when",
+	))
+}
+
+func TestParseWithOptions_Lenient(t *testing.T) {
+	t.Parallel()
+
+	defer esitag.RegisterResourceHandler("lenient1", esitesting.MockRequestContent("Any content")).DeferredDeregister()
+
+	t.Run("broken include gets removed", func(t *testing.T) {
+		page := `<p><esi:include src="lenient1://a" timeout="10xyz"/></p><esi:include src="lenient1://b"/>`
+		ets, err := esitag.ParseWithOptions(strings.NewReader(page), esitag.ParseOptions{Lenient: true})
+		require.NoError(t, err)
+		require.Len(t, ets, 2)
+		assert.True(t, ets[0].Remove, "Broken tag must be removed")
+		assert.False(t, ets[1].Remove)
+		assert.Len(t, ets[1].Resources, 1)
+	})
+	t.Run("broken block tags stay in the page", func(t *testing.T) {
+		page := `<esi:when test="1">X</esi:when><esi:include src="lenient1://b"/><esi:try><esi:attempt>Y`
+		ets, err := esitag.ParseWithOptions(strings.NewReader(page), esitag.ParseOptions{Lenient: true})
+		require.NoError(t, err)
+		require.Len(t, ets, 1)
+		assert.Exactly(t, `include src="lenient1://b"`, string(ets[0].RawTag))
+	})
+	t.Run("unterminated and too long tags", func(t *testing.T) {
+		page := `<esi:include src="` + strings.Repeat("x", esitag.MaxSizeESITag) + `"/><esi:include src="lenient1://b"/><esi:include src="lenient1://c"`
+		ets, err := esitag.ParseWithOptions(strings.NewReader(page), esitag.ParseOptions{Lenient: true})
+		require.NoError(t, err)
+		require.Len(t, ets, 1)
+		assert.Exactly(t, `include src="lenient1://b"`, string(ets[0].RawTag))
+	})
+	t.Run("skipped tags get logged", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		lg := logw.NewLog(logw.WithLevel(logw.LevelInfo), logw.WithWriter(buf))
+		_, err := esitag.ParseWithOptions(strings.NewReader("<p>\n<esi:include src=\"lenient1://a\" sourc=\"x\"/>"), esitag.ParseOptions{
+			Lenient: true,
+			Log:     lg,
+		})
+		require.NoError(t, err)
+		assert.Contains(t, buf.String(), `esitag.Parse.Lenient.Skip`)
+		assert.Contains(t, buf.String(), `sourc`)
+	})
+}
+
+func TestParseWithOptions_Syntax(t *testing.T) {
+	t.Parallel()
+
+	defer esitag.RegisterResourceHandler("syntax1", esitesting.MockRequestContent("Any content")).DeferredDeregister()
+
+	parse := func(page string, s esitag.Syntax) (esitag.Entities, error) {
+		return esitag.ParseWithOptions(strings.NewReader(page), esitag.ParseOptions{Syntax: s, SSIUpstream: "http://127.0.0.1:2015/"})
+	}
+
+	t.Run("custom element", func(t *testing.T) {
+		page := `<p><esi-include src="syntax1://a" timeout="5ms"><b>Fallback</b></esi-include></p>`
+		ets, err := parse(page, esitag.SyntaxElement)
+		require.NoError(t, err)
+		require.Len(t, ets, 1)
+		assert.Exactly(t, `include src="syntax1://a" timeout="5ms"`, string(ets[0].RawTag))
+		assert.Exactly(t, page[3:len(page)-4], page[ets[0].DataTag.Start:ets[0].DataTag.End])
+		assert.Len(t, ets[0].Resources, 1)
+	})
+	t.Run("custom element block tags mixed with esi", func(t *testing.T) {
+		page := `<esi-choose><esi-when test="1"><esi:include src="syntax1://a"/></esi-when></esi-choose><esi-include src="syntax1://b"/>`
+		ets, err := parse(page, esitag.SyntaxESI|esitag.SyntaxElement)
+		require.NoError(t, err)
+		require.Len(t, ets, 2)
+		require.Len(t, ets[0].Choose, 1)
+		require.Len(t, ets[0].Choose[0].Entities, 1)
+		assert.Exactly(t, `include src="syntax1://a"`, string(ets[0].Choose[0].Entities[0].RawTag))
+		assert.Exactly(t, `include src="syntax1://b"`, string(ets[1].RawTag))
+	})
+	t.Run("custom element disabled", func(t *testing.T) {
+		ets, err := parse(`<esi-include src="syntax1://a"></esi-include><esi:include src="syntax1://b"/>`, 0)
+		require.NoError(t, err)
+		require.Len(t, ets, 1)
+		assert.Exactly(t, `include src="syntax1://b"`, string(ets[0].RawTag))
+	})
+	t.Run("custom element without closing tag", func(t *testing.T) {
+		ets, err := parse(`<esi-include src="syntax1://a"><p>X</p>`, esitag.SyntaxElement)
+		assert.Nil(t, ets)
+		assert.True(t, errors.NotValid.Match(err), "%+v", err)
+	})
+
+	t.Run("SSI include", func(t *testing.T) {
+		page := `<p><!--#include virtual="/esi/cart?id=1" --></p><!--#echo var="DATE_LOCAL" --><!-- -->`
+		ets, err := parse(page, esitag.SyntaxSSI)
+		require.NoError(t, err)
+		require.Len(t, ets, 1)
+		assert.Exactly(t, `<!--#include virtual="/esi/cart?id=1" -->`, page[ets[0].DataTag.Start:ets[0].DataTag.End])
+		require.Len(t, ets[0].Resources, 1)
+		assert.Exactly(t, `http://127.0.0.1:2015/esi/cart?id=1`, ets[0].Resources[0].String())
+	})
+	t.Run("SSI ignores a forged Host header", func(t *testing.T) {
+		ets, err := parse(`<!--#include virtual="/esi/cart" -->`, esitag.SyntaxSSI)
+		require.NoError(t, err)
+		require.Len(t, ets, 1)
+		req := httptest.NewRequest("GET", "http://shop.example/page.html", nil)
+		req.Host = "169.254.169.254:80"
+		assert.Exactly(t, `http://127.0.0.1:2015/esi/cart`, esitag.MakeReplacer(req, "").Replace(ets[0].Resources[0].String()))
+	})
+	t.Run("SSI without upstream", func(t *testing.T) {
+		ets, err := esitag.ParseWithOptions(strings.NewReader(`<!--#include virtual="/esi/cart" -->`), esitag.ParseOptions{Syntax: esitag.SyntaxSSI})
+		assert.Nil(t, ets)
+		assert.True(t, errors.Empty.Match(err), "%+v", err)
+	})
+	t.Run("SSI and esi disabled", func(t *testing.T) {
+		ets, err := parse(`<esi:include src="syntax1://a"/><!--esi <esi:include src="syntax1://b"/> -->`, esitag.SyntaxSSI)
+		require.NoError(t, err)
+		assert.Len(t, ets, 0)
+	})
+	t.Run("SSI disabled", func(t *testing.T) {
+		ets, err := parse(`<!--#include virtual="/esi/cart" -->`, esitag.SyntaxESI)
+		require.NoError(t, err)
+		assert.Len(t, ets, 0)
+	})
+	t.Run("SSI relative path", func(t *testing.T) {
+		ets, err := parse(`<!--#include virtual="cart.html" -->`, esitag.SyntaxSSI)
+		assert.Nil(t, ets)
+		assert.True(t, errors.NotSupported.Match(err), "%+v", err)
+	})
+	t.Run("SSI file attribute", func(t *testing.T) {
+		ets, err := parse(`<!--#include file="cart.html" -->`, esitag.SyntaxSSI)
+		assert.Nil(t, ets)
+		assert.True(t, errors.NotSupported.Match(err), "%+v", err)
+	})
+	t.Run("SSI unterminated", func(t *testing.T) {
+		ets, err := parse("<p>\n<!--#include virtual=\"/esi/cart\" ", esitag.SyntaxSSI)
+		assert.Nil(t, ets)
+		pe, ok := err.(*esitag.ParseError)
+		require.True(t, ok, "%T", err)
+		assert.Exactly(t, 2, pe.Line)
+		assert.True(t, errors.NotValid.Match(err), "%+v", err)
+	})
+}
@@ -16,16 +16,19 @@ package esitag
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode"
 
 	"github.com/corestoreio/caddy-esi/bufpool"
+	"github.com/corestoreio/caddy-esi/esicache"
 	"github.com/corestoreio/caddy-esi/helper"
 	"github.com/corestoreio/errors"
 	"github.com/corestoreio/log"
@@ -43,11 +46,25 @@ type Entity struct {
 	// tag when all reuqests are failing to its backends. If onError in the Tag
 	// tag contains a file name, then that content gets loaded.
 	OnError []byte
+	// OnErrorAjax gets set by the attribute onerror="ajax". When all requests
+	// to the backends are failing and at least one has timed out, the content
+	// of AjaxPlaceholder gets injected instead of OnError and the browser
+	// loads the content later. Other failures, a cached failure and nested
+	// tags get the OnError content.
+	OnErrorAjax bool
+	// AjaxPlaceholder creates the placeholder and the JS loader for the
+	// OnErrorAjax mode. Gets set by the middleware. If nil, OnError gets used.
+	AjaxPlaceholder func(externalReq *http.Request) []byte
 	Config
-	// Race TODO(CyS) From the README: Add the attribute `race="true"` to fire
-	// all resource requests at once and the one which is the fastest gets
-	// served and the others dropped.
+	// Race if true, all resources get requested at once. The fastest
+	// successful response gets served and the other requests get cancelled.
+	// Set via the attribute race="true".
 	Race bool
+	// Deferred if true, the streaming mode writes a placeholder instead of
+	// waiting for the content. The content gets appended at the end of the
+	// page together with a script which swaps it into the placeholder. Set
+	// via the attribute deferred="true".
+	Deferred bool
 	// Resources contains multiple unique Resource entries, aka backend systems
 	// likes redis instances or other micro services. Resources occur within one
 	// single Tag tag. The resource attribute (src="") can occur multiple times.
@@ -58,6 +75,27 @@ type Entity struct {
 	Resources []*Resource // Any 3rd party servers
 	// Conditioner TODO(CyS) depending on a condition an Tag tag gets executed or not.
 	Conditioner
+	// Choose contains the esi:when and esi:otherwise blocks in the order of
+	// their occurrence if the entity represents an esi:choose tag. The DataTag
+	// then covers the whole esi:choose block. Nil for all other tags.
+	Choose []*Block
+	// Attempt contains the esi:attempt block if the entity represents an
+	// esi:try tag. If any include within the attempt fails, the Except block
+	// gets rendered instead. Nil for all other tags.
+	Attempt *Block
+	// Except contains the optional esi:except block of an esi:try tag.
+	Except *Block
+	// Unwrap contains the content of a <!--esi ... --> section. The comment
+	// markers get stripped and the nested entities resolved. Nil for all
+	// other tags.
+	Unwrap *Block
+	// Vars contains the content of an esi:vars block. The ESI variables in its
+	// body get replaced and the nested entities resolved. Nil for all other
+	// tags.
+	Vars *Block
+	// Remove gets set for esi:remove and esi:comment tags. Their whole region
+	// gets dropped from the output.
+	Remove bool
 }
 
 // Config provides the configuration of a single Tag tag. This information gets
@@ -83,11 +121,51 @@ type Config struct {
 	// TTL retrieved content from a backend can live this time in the middleware
 	// cache.
 	TTL time.Duration // optional
+	// Stale defines how long after the TTL an expired cached content gets
+	// still served while one background request refreshes it.
+	Stale time.Duration // optional
+	// StaleIfError defines how long after the TTL an expired cached content
+	// gets served when all resources fail.
+	StaleIfError time.Duration // optional
+	// NegativeTTL caches for this duration that all resources have failed or
+	// have not found the content. Until then the resources do not get
+	// queried again and the onerror content gets served.
+	NegativeTTL time.Duration // optional
+	// RefreshAhead refreshes a cached content in the background when it gets
+	// requested within this duration before the TTL expires. Frequently
+	// requested content expires then never.
+	RefreshAhead time.Duration // optional
+	// Cache stores the retrieved content for the duration of TTL. Gets set via
+	// the cache directive in the Caddyfile. Nil disables the cache.
+	Cache esicache.Cacher // optional
+	// CacheScope names the Cache, the path of the Caddyfile. The background
+	// refreshes of the same cache key in different Caches run separately.
+	CacheScope string // optional
+	// HTTPCache derives the freshness of a cached fragment from the headers
+	// Cache-Control and Expires of the HTTP resource, if no TTL has been set.
+	// Stale fragments get revalidated with the ETag and Last-Modified
+	// validators and a 304 response reuses the cached fragment.
+	HTTPCache bool // optional
 	// MaxBodySize allowed max body size to read from the backend resource.
 	MaxBodySize uint64 // required
+	// MaxDepth defines how many levels of ESI tags in the returned fragments
+	// get processed. Zero disables the processing of nested tags and the
+	// fragments get injected as they are.
+	MaxDepth int
 	// Key defines the name of the key in an NoSQL service or as additional
 	// identifier in a gRPC request.
 	Key string
+	// CacheTags surrogate keys of the cached content, in addition to the keys
+	// returned by the resource in the Surrogate-Key header. Can contain
+	// variables. See PurgeSurrogateKeys.
+	CacheTags []string // optional
+	// CacheKey replaces the resolved src and key attributes in the key for the
+	// Cache. Can contain variables, e.g. {CCurrency}-{HAccept-Language}, to
+	// cache a fragment per segment of users.
+	CacheKey string // optional
+	// CacheVary lists the header names and cookies, prefixed with "Cookie:",
+	// whose values of the request become part of the key for the Cache.
+	CacheVary []string // optional
 	// Above fields are special aligned to save space, see "aligncheck"
 }
 
@@ -135,7 +213,15 @@ func SplitAttributes(raw string) ([]string, error) {
 // ParseRaw parses the RawTag field and fills the remaining fields of the
 // struct.
 func (et *Entity) ParseRaw() error {
-	if len(et.RawTag) == 0 {
+	if len(et.RawTag) == 0 || et.Remove {
+		return nil
+	}
+	if et.Choose != nil || et.Attempt != nil || et.Unwrap != nil || et.Vars != nil {
+		for i, b := range et.blocks() {
+			if err := b.ParseRaw(); err != nil {
+				return errors.Wrapf(err, "[esitag] Failed to parse block %d in tag %q", i, et.RawTag)
+			}
+		}
 		return nil
 	}
 	et.Resources = make([]*Resource, 0, 2)
@@ -159,12 +245,38 @@ func (et *Entity) ParseRaw() error {
 			srcCounter++
 		case "key":
 			et.Key = value
+		case "cachetags":
+			et.CacheTags = helper.CommaListToSlice(value)
+		case "cachekey":
+			et.CacheKey = value
+		case "cachevary":
+			if err := et.parseCacheVary(value); err != nil {
+				return errors.Wrapf(err, "[caddyesi] Failed to parse cachevary %q in tag %q", value, et.RawTag)
+			}
 		case "coalesce":
 			b, err := strconv.ParseBool(value)
 			if err != nil {
 				return errors.NotValid.Newf("[caddyesi] Failed to parse coalesce %q into bool value in tag %q with error %s", value, et.RawTag, err)
 			}
 			et.Coalesce = b
+		case "httpcache":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.NotValid.Newf("[caddyesi] Failed to parse httpcache %q into bool value in tag %q with error %s", value, et.RawTag, err)
+			}
+			et.HTTPCache = b
+		case "race":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.NotValid.Newf("[caddyesi] Failed to parse race %q into bool value in tag %q with error %s", value, et.RawTag, err)
+			}
+			et.Race = b
+		case "deferred":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.NotValid.Newf("[caddyesi] Failed to parse deferred %q into bool value in tag %q with error %s", value, et.RawTag, err)
+			}
+			et.Deferred = b
 		case "printdebug":
 			b, err := strconv.ParseBool(value)
 			if err != nil {
@@ -191,6 +303,30 @@ func (et *Entity) ParseRaw() error {
 			if err != nil {
 				return errors.NotValid.Newf("[caddyesi] ESITag.ParseRaw. Cannot parse duration in ttl: %s => %q\nTag: %q", err, value, et.RawTag)
 			}
+		case "stale":
+			var err error
+			et.Stale, err = time.ParseDuration(value)
+			if err != nil {
+				return errors.NotValid.Newf("[caddyesi] ESITag.ParseRaw. Cannot parse duration in stale: %s => %q\nTag: %q", err, value, et.RawTag)
+			}
+		case "staleiferror":
+			var err error
+			et.StaleIfError, err = time.ParseDuration(value)
+			if err != nil {
+				return errors.NotValid.Newf("[caddyesi] ESITag.ParseRaw. Cannot parse duration in staleiferror: %s => %q\nTag: %q", err, value, et.RawTag)
+			}
+		case "negativettl":
+			var err error
+			et.NegativeTTL, err = time.ParseDuration(value)
+			if err != nil {
+				return errors.NotValid.Newf("[caddyesi] ESITag.ParseRaw. Cannot parse duration in negativettl: %s => %q\nTag: %q", err, value, et.RawTag)
+			}
+		case "refreshahead":
+			var err error
+			et.RefreshAhead, err = time.ParseDuration(value)
+			if err != nil {
+				return errors.NotValid.Newf("[caddyesi] ESITag.ParseRaw. Cannot parse duration in refreshahead: %s => %q\nTag: %q", err, value, et.RawTag)
+			}
 		case "maxbodysize":
 			var err error
 			et.MaxBodySize, err = humanize.ParseBytes(value)
@@ -234,6 +370,10 @@ func (et *Entity) ParseRaw() error {
 }
 
 func (et *Entity) parseOnError(val string) (err error) {
+	if strings.ToLower(val) == "ajax" {
+		et.OnErrorAjax = true
+		return nil
+	}
 	var fileExt string
 	if li := strings.LastIndexByte(val, '.'); li > 0 {
 		fileExt = strings.ToLower(val[li+1:])
@@ -252,6 +392,22 @@ func (et *Entity) parseOnError(val string) (err error) {
 	return nil
 }
 
+func (et *Entity) parseCacheVary(val string) error {
+	et.CacheVary = helper.CommaListToSlice(val)
+	for i, v := range et.CacheVary {
+		if len(v) >= len(cacheVaryCookie) && strings.EqualFold(v[:len(cacheVaryCookie)], cacheVaryCookie) {
+			name := strings.TrimSpace(v[len(cacheVaryCookie):])
+			if name == "" {
+				return errors.NotValid.Newf("[caddyesi] ESITag.ParseRaw. Cookie name in cachevary cannot be empty: %q\nTag: %q", val, et.RawTag)
+			}
+			et.CacheVary[i] = cacheVaryCookie + name
+			continue
+		}
+		et.CacheVary[i] = http.CanonicalHeaderKey(v)
+	}
+	return nil
+}
+
 func (et *Entity) parseCondition(s string) error {
 	et.Conditioner = condition{}
 	return nil
@@ -283,95 +439,419 @@ func (et *Entity) SetDefaultConfig(tag Config) {
 	if et.Config.TTL < 1 && tag.TTL > 0 {
 		et.Config.TTL = tag.TTL
 	}
+	if et.Config.Stale < 1 && tag.Stale > 0 {
+		et.Config.Stale = tag.Stale
+	}
+	if et.Config.StaleIfError < 1 && tag.StaleIfError > 0 {
+		et.Config.StaleIfError = tag.StaleIfError
+	}
+	if et.Config.NegativeTTL < 1 && tag.NegativeTTL > 0 {
+		et.Config.NegativeTTL = tag.NegativeTTL
+	}
+	if et.Config.RefreshAhead < 1 && tag.RefreshAhead > 0 {
+		et.Config.RefreshAhead = tag.RefreshAhead
+	}
+	if et.Config.Cache == nil && tag.Cache != nil {
+		et.Config.Cache = tag.Cache
+		et.Config.CacheScope = tag.CacheScope
+	}
+	if !et.Config.HTTPCache && tag.HTTPCache {
+		et.Config.HTTPCache = true
+	}
+	if et.Config.MaxDepth < 1 && tag.MaxDepth > 0 {
+		et.Config.MaxDepth = tag.MaxDepth
+	}
+	if et.Config.Cache != nil && et.Config.TTL > 0 {
+		// the purge markers must live at least as long as the fragments.
+		updateMaxCacheExpiration(et.cacheExpiration(et.Config.TTL, true))
+	}
 }
 
 // QueryResources iterates sequentially over the resources and executes requests
 // as defined in the ResourceHandler. If one resource fails it will be marked as
 // timed out and the next resource gets tried. The exponential back-off stops
-// when MaxBackOffs have been reached and then tries again. Returns a Temporary
-// error behaviour when all requests to all resources have failed.
+// when MaxBackOffs have been reached and then tries again. With Race enabled
+// all resources get requested concurrently, see queryRace. If a Cache and a TTL
+// have been set, the content gets served from the cache and only on a miss
+// the resources get queried. Within the Stale duration after the TTL the
+// expired content gets served while a background request refreshes it. Within
+// the StaleIfError duration the expired content gets served if all resources
+// fail. Within the NegativeTTL the failure gets served from the cache and
+// within the RefreshAhead duration before the TTL expires a background request
+// refreshes the cached content. Returns a Temporary error behaviour when all
+// requests to all resources have failed.
 func (et *Entity) QueryResources(externalReq *http.Request) ([]byte, error) {
+	_, data, err := et.QueryResourcesHeader(externalReq)
+	return data, err
+}
+
+// QueryResourcesHeader same as QueryResources but additionally returns the
+// headers of the resource as defined in the attribute returnheaders and the
+// Surrogate-Key header. The returned header might be nil. Only the
+// Surrogate-Key header gets cached, so a response served from the cache
+// returns only that header.
+func (et *Entity) QueryResourcesHeader(externalReq *http.Request) (http.Header, []byte, error) {
+	hdr, data, _, err := et.queryResourcesHeader(externalReq)
+	return hdr, data, err
+}
+
+// queryResourcesHeader implements QueryResourcesHeader and returns
+// additionally true if all resources have failed and at least one of them has
+// timed out.
+func (et *Entity) queryResourcesHeader(externalReq *http.Request) (http.Header, []byte, bool, error) {
+	if hdr, data, ok, err := et.queryBlock(externalReq, false); ok {
+		return hdr, data, false, err
+	}
 	var timeStart time.Duration
-	if et.Log.IsInfo() || et.Log.IsDebug() {
+	if et.MaxDepth > 0 || et.PrintDebug || et.Log.IsInfo() || et.Log.IsDebug() {
 		timeStart = monotime.Now()
 	}
-	// mErr: just for collecting errors for informational purposes at the
+
+	var cacheKey string
+	var stale cacheEntry
+	if et.Cache != nil && (et.TTL > 0 || et.HTTPCache || et.NegativeTTL > 0) {
+		cacheKey = et.cacheKey(externalReq)
+		if ce, ok := et.cacheGet(cacheKey, timeStart); ok {
+			now := time.Now()
+			switch {
+			case ce.negative && now.Before(ce.freshUntil):
+				return nil, nil, false, errors.Temporary.Newf("[esitag] Negative cached result of the resources for cache key %q: %s", cacheKey, ce.data)
+			case ce.negative:
+				// expired, query the resources again.
+			case now.Before(ce.freshUntil):
+				if et.RefreshAhead > 0 && now.After(ce.freshUntil.Add(-et.RefreshAhead)) {
+					et.refreshStale(externalReq, cacheKey, ce)
+				}
+				return ce.header(), ce.data, false, nil
+			case now.Before(ce.freshUntil.Add(et.Stale)):
+				et.refreshStale(externalReq, cacheKey, ce)
+				return ce.header(), ce.data, false, nil
+			default:
+				stale = ce
+			}
+		}
+	}
+
+	hdr, data, winner, ra, timedOut, err := et.queryResources(externalReq, timeStart, stale)
+	if err != nil {
+		if stale.data != nil && time.Now().Before(stale.freshUntil.Add(et.StaleIfError)) {
+			if et.Log.IsInfo() {
+				et.Log.Info("esitag.Entity.QueryResources.StaleIfError",
+					log.Duration(log.KeyNameDuration, monotime.Since(timeStart)), log.Err(err),
+					log.String("cache_key", cacheKey), log.Stringer("fresh_until", stale.freshUntil))
+			}
+			return stale.header(), stale.data, false, nil
+		}
+		if cacheKey != "" && et.NegativeTTL > 0 {
+			et.cacheSetNegative(cacheKey, err, timeStart)
+		}
+		return nil, nil, timedOut, err
+	}
+	if cacheKey != "" {
+		hdr, data = et.cacheResult(externalReq, cacheKey, hdr, data, ra, stale, timeStart)
+	}
+	if et.Race && et.PrintDebug {
+		// gets tested by an integration test in package "ht".
+		var buf bytes.Buffer
+		buf.Write(data)
+		fmt.Fprintf(&buf, "\n<!-- Race Winner:%d URL:%q Duration:%s -->\n", winner.Index, winner.String(), monotime.Since(timeStart))
+		data = buf.Bytes()
+	}
+	return hdr, data, false, nil
+}
+
+// queryResources requests the resources, sequentially or in race mode, and
+// processes the nested tags of the returned data. If the nested tags of a
+// resource cannot be processed, the next resource gets requested like after a
+// failed request. The validators of the stale entry make the requests
+// conditional. It returns the winning resource and its arguments. Returns a
+// Temporary error behaviour when all requests to all resources have failed and
+// additionally true if at least one of them has timed out.
+func (et *Entity) queryResources(externalReq *http.Request, timeStart time.Duration, stale cacheEntry) (http.Header, []byte, *Resource, *ResourceArgs, bool, error) {
+	// qErr: just for collecting errors for informational purposes at the
 	// Temporary error at the end.
-	var mErr *errors.MultiErr
-	ra := NewResourceArgs(externalReq, "", et.Config)
+	var qErr queryErrors
+	var hdr http.Header
+	var data []byte
+	var winner *Resource
+	var winnerArgs *ResourceArgs
+
+	if et.Race && len(et.Resources) > 1 {
+		hdr, data, winner, winnerArgs = et.queryRace(externalReq, timeStart, stale, &qErr)
+		if winner != nil {
+			var err error
+			if hdr, data, err = et.resolveNested(externalReq, winner, winnerArgs, hdr, data, timeStart); err != nil {
+				// the other resources serve as fallback in their order.
+				qErr.append(err)
+				hdr, data, winner, winnerArgs = et.querySequential(externalReq, timeStart, stale, winner, &qErr)
+			}
+		}
+	} else {
+		hdr, data, winner, winnerArgs = et.querySequential(externalReq, timeStart, stale, nil, &qErr)
+	}
+	if winner == nil {
+		// error temporarily timeout so fall back to a maybe provided file.
+		return nil, nil, nil, nil, qErr.timeout, errors.Temporary.Newf("[esitag] Requests to all resources have temporarily failed: %s", qErr.mErr)
+	}
+	return hdr, data, winner, winnerArgs, false, nil
+}
 
+// queryErrors collects the errors of the requests to the resources.
+type queryErrors struct {
+	mErr *errors.MultiErr
+	// timeout gets set if at least one of the errors is a timeout.
+	timeout bool
+}
+
+func (qe *queryErrors) append(err error) {
+	qe.mErr = qe.mErr.AppendErrors(err)
+	if isTimeout(err) {
+		qe.timeout = true
+	}
+}
+
+// isTimeout returns true if err or one of its causes has the Timeout
+// behaviour, like an exceeded deadline of a context.
+func isTimeout(err error) bool {
+	for err != nil {
+		if errors.Timeout.Match(err) {
+			return true
+		}
+		if te, ok := err.(interface{ Timeout() bool }); ok && te.Timeout() {
+			return true
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok || c.Cause() == err {
+			return false
+		}
+		err = c.Cause()
+	}
+	return false
+}
+
+// querySequential requests the resources, except skip, one after another until
+// one delivers data whose nested tags can be processed. The errors get
+// appended to qErr.
+func (et *Entity) querySequential(externalReq *http.Request, timeStart time.Duration, stale cacheEntry, skip *Resource, qErr *queryErrors) (http.Header, []byte, *Resource, *ResourceArgs) {
+	ra := et.newResourceArgs(externalReq, stale)
 	for i, r := range et.Resources {
+		if r == skip {
+			continue
+		}
+		h, d, ok, err := et.requestResource(i, r, ra, timeStart, nil)
+		if err != nil {
+			qErr.append(err)
+		}
+		if !ok {
+			continue // go to next resource
+		}
+		if h, d, err = et.resolveNested(externalReq, r, ra, h, d, timeStart); err != nil {
+			qErr.append(err)
+			ra = et.newResourceArgs(externalReq, stale)
+			continue
+		}
+		return h, d, r, ra
+	}
+	return nil, nil, nil, nil
+}
 
-		var lFields log.Fields
-		if et.Log.IsDebug() {
-			lFields = log.Fields{log.Int("resource_index", r.Index), log.String("resource_url", r.String()), log.Marshal("resource_arguments", ra)}
+// resolveNested processes the nested tags of the data returned by the resource
+// r and merges their headers into hdr. Data confirmed by a 304 status code has
+// already been processed when it got cached.
+func (et *Entity) resolveNested(externalReq *http.Request, r *Resource, ra *ResourceArgs, hdr http.Header, data []byte, timeStart time.Duration) (http.Header, []byte, error) {
+	if ra.NotModified {
+		return hdr, data, nil
+	}
+
+	// TODO(CyS): Log header, create special function to log header; LOG ra with special format
+	nestedHdr, data, err := et.processNested(externalReq, data, timeStart)
+	if err != nil {
+		if et.Log.IsInfo() {
+			et.Log.Info("esitag.Entity.QueryResources.Nested.Error",
+				log.Duration(log.KeyNameDuration, monotime.Since(timeStart)), log.Err(err),
+				log.Int("resource_index", r.Index), log.String("resource_url", r.String()))
 		}
+		return nil, nil, errors.Wrapf(err, "[esitag] Failed to process the nested tags of resource %q", r.String())
+	}
+	if len(nestedHdr) > 0 {
+		// the header of the resource itself wins over the nested headers but
+		// the surrogate keys of both get collected.
+		keys := uniqueStrings(append(surrogateKeys(hdr), surrogateKeys(nestedHdr)...))
+		tags := &DataTags{Slice: []DataTag{{Header: hdr}, {Header: nestedHdr}}}
+		hdr = make(http.Header)
+		tags.MergeHeader(hdr)
+		if len(keys) > 0 {
+			hdr[SurrogateKeyHeader] = []string{strings.Join(keys, " ")}
+		}
+	}
+	return hdr, data, nil
+}
 
-		switch state, lastFailure := r.CBState(); state {
+// newResourceArgs creates the arguments for the resources. The validators of
+// the stale entry get only set in the HTTP cache mode.
+func (et *Entity) newResourceArgs(externalReq *http.Request, stale cacheEntry) *ResourceArgs {
+	ra := NewResourceArgs(externalReq, "", et.Config)
+	if et.HTTPCache && stale.data != nil {
+		ra.IfNoneMatch = stale.etag
+		ra.IfModifiedSince = stale.lastModified
+	}
+	return ra
+}
 
-		case CBStateHalfOpen, CBStateClosed:
-			// TODO(CyS) add ReturnHeader
-			_, data, err := r.DoRequest(ra)
+// requestResource queries a single resource and takes care of the circuit
+// breaker. It returns true if the resource has delivered the data and its
+// headers filtered by the attribute returnheaders. A returned
+// error has been recorded as a failure in the circuit breaker. The optional
+// function cancelled reports in race mode whether another resource has
+// already won. Then the failure of the cancelled request does not count.
+func (et *Entity) requestResource(idx int, r *Resource, ra *ResourceArgs, timeStart time.Duration, cancelled func() bool) (http.Header, []byte, bool, error) {
+
+	var lFields log.Fields
+	if et.Log.IsDebug() {
+		lFields = log.Fields{log.Int("resource_index", r.Index), log.String("resource_url", r.String()), log.Marshal("resource_arguments", ra)}
+	}
 
-			if err != nil {
+	state, lastFailure := r.CBState()
+	if state == CBStateOpen {
+		if et.Log.IsDebug() {
+			et.Log.Debug("esitag.Entity.QueryResources.ResourceHandler.CBStateOpen",
+				log.Duration(log.KeyNameDuration, monotime.Since(timeStart)),
+				log.Uint64("failure_count", r.CBFailures()), log.Stringer("last_failure", lastFailure), lFields)
+		}
+		return nil, nil, false, nil
+	}
 
-				if errors.NotFound.Match(err) {
-					if et.Log.IsDebug() {
-						et.Log.Debug("esitag.Entity.QueryResources.ResourceHandler.NotFound",
-							log.Err(err), log.Duration(log.KeyNameDuration, monotime.Since(timeStart)), lFields)
-					}
-					continue // go to next resource in this loop
-				}
+	hdr, data, err := r.DoRequest(ra)
+	if err != nil {
 
-				// A real error and we must trigger the circuit breaker
-				mErr = mErr.AppendErrors(errors.Errorf("\nIndex %d URL %q with %s\n", i, r.String(), err))
-				lastFailureTime := r.CBRecordFailure()
-				if et.Log.IsInfo() {
-					et.Log.Info("esitag.Entity.QueryResources.ResourceHandler.Error",
-						log.Duration(log.KeyNameDuration, monotime.Since(timeStart)),
-						log.Err(err), log.Uint64("failure_count", r.CBFailures()), log.UnixNanoHuman("last_failure", lastFailureTime), lFields)
-				}
-				continue // go to next resource in this loop
+		if errors.NotFound.Match(err) {
+			if et.Log.IsDebug() {
+				et.Log.Debug("esitag.Entity.QueryResources.ResourceHandler.NotFound",
+					log.Err(err), log.Duration(log.KeyNameDuration, monotime.Since(timeStart)), lFields)
 			}
+			return nil, nil, false, nil // go to next resource
+		}
 
-			if state == CBStateHalfOpen {
-				r.CBReset()
-				if et.Log.IsDebug() {
-					et.Log.Debug("esitag.Entity.QueryResources.ResourceHandler.CBStateHalfOpen",
-						log.Duration(log.KeyNameDuration, monotime.Since(timeStart)),
-						log.Uint64("failure_count", r.CBFailures()), log.Stringer("last_failure", lastFailure),
-						lFields, log.String("content", string(data)))
-				}
-			} else if et.Log.IsDebug() {
-				et.Log.Debug("esitag.Entity.QueryResources.ResourceHandler.CBStateClosed",
-					log.Duration(log.KeyNameDuration, monotime.Since(timeStart)),
-					log.Uint64("failure_count", r.CBFailures()), log.Stringer("last_failure", lastFailure),
-					lFields, log.String("content", string(data)))
+		if cancelled != nil && cancelled() {
+			if et.Log.IsDebug() {
+				et.Log.Debug("esitag.Entity.QueryResources.Race.Cancelled",
+					log.Err(err), log.Duration(log.KeyNameDuration, monotime.Since(timeStart)), lFields)
 			}
-			// TODO(CyS): Log header, create special function to log header; LOG ra with special format
-			return data, nil
+			return nil, nil, false, nil
+		}
+
+		// A real error and we must trigger the circuit breaker
+		lastFailureTime := r.CBRecordFailure()
+		if et.Log.IsInfo() {
+			et.Log.Info("esitag.Entity.QueryResources.ResourceHandler.Error",
+				log.Duration(log.KeyNameDuration, monotime.Since(timeStart)),
+				log.Err(err), log.Uint64("failure_count", r.CBFailures()), log.UnixNanoHuman("last_failure", lastFailureTime), lFields)
+		}
+		if isTimeout(err) {
+			return nil, nil, false, errors.Timeout.Newf("\nIndex %d URL %q with %s\n", idx, r.String(), err)
+		}
+		return nil, nil, false, errors.Errorf("\nIndex %d URL %q with %s\n", idx, r.String(), err)
+	}
+
+	if state == CBStateHalfOpen {
+		r.CBReset()
+		if et.Log.IsDebug() {
+			et.Log.Debug("esitag.Entity.QueryResources.ResourceHandler.CBStateHalfOpen",
+				log.Duration(log.KeyNameDuration, monotime.Since(timeStart)),
+				log.Uint64("failure_count", r.CBFailures()), log.Stringer("last_failure", lastFailure),
+				lFields, log.String("content", string(data)))
+		}
+	} else if et.Log.IsDebug() {
+		et.Log.Debug("esitag.Entity.QueryResources.ResourceHandler.CBStateClosed",
+			log.Duration(log.KeyNameDuration, monotime.Since(timeStart)),
+			log.Uint64("failure_count", r.CBFailures()), log.Stringer("last_failure", lastFailure),
+			lFields, log.String("content", string(data)))
+	}
+	// Not all backends filter the headers, so do it here. The surrogate keys
+	// get always returned for the cache and removed before the headers reach
+	// the client.
+	retHdr := ra.PrepareReturnHeaders(hdr)
+	if keys := surrogateKeys(hdr); len(keys) > 0 {
+		if retHdr == nil {
+			retHdr = make(http.Header)
+		}
+		retHdr[SurrogateKeyHeader] = []string{strings.Join(keys, " ")}
+	}
+	return retHdr, data, true, nil
+}
 
-		case CBStateOpen:
+// queryRace requests all resources concurrently. The first successful response
+// wins and the context of the slower requests gets cancelled. Returns a nil
+// winner if all resources have failed. The errors get appended to qErr.
+func (et *Entity) queryRace(externalReq *http.Request, timeStart time.Duration, stale cacheEntry, qErr *queryErrors) (http.Header, []byte, *Resource, *ResourceArgs) {
+	ctx, cancel := context.WithCancel(externalReq.Context())
+	defer cancel()
+	req := externalReq.WithContext(ctx)
+
+	var won uint32
+	cancelled := func() bool {
+		return atomic.LoadUint32(&won) == 1
+	}
+
+	type result struct {
+		hdr  http.Header
+		data []byte
+		ok   bool
+		err  error
+		r    *Resource
+		ra   *ResourceArgs
+	}
+	results := make(chan result, len(et.Resources))
+	for i, r := range et.Resources {
+		go func(i int, r *Resource) {
+			// Each request needs its own arguments because DoRequest
+			// modifies them.
+			ra := et.newResourceArgs(req, stale)
+			hdr, data, ok, err := et.requestResource(i, r, ra, timeStart, cancelled)
+			results <- result{hdr: hdr, data: data, ok: ok, err: err, r: r, ra: ra}
+		}(i, r)
+	}
+
+	for range et.Resources {
+		res := <-results
+		if res.err != nil {
+			qErr.append(res.err)
+		}
+		if res.ok {
+			atomic.StoreUint32(&won, 1) // before cancel, so the losers know it
+			cancel()
 			if et.Log.IsDebug() {
-				et.Log.Debug("esitag.Entity.QueryResources.ResourceHandler.CBStateOpen",
+				et.Log.Debug("esitag.Entity.QueryResources.Race.Winner",
 					log.Duration(log.KeyNameDuration, monotime.Since(timeStart)),
-					log.Uint64("failure_count", r.CBFailures()), log.Stringer("last_failure", lastFailure), lFields)
+					log.Int("resource_index", res.r.Index), log.String("resource_url", res.r.String()))
 			}
+			return res.hdr, res.data, res.r, res.ra
 		}
-
-		// go to next resource
 	}
-	// error temporarily timeout so fall back to a maybe provided file.
-	return nil, errors.Temporary.Newf("[esitag] Requests to all resources have temporarily failed: %s", mErr)
+	return nil, nil, nil, nil
 }
 
+// hashSeed for now this seed will be used, found under the kitchen table.
+const hashSeed = 235711131719
+
 // Entities represents a list of Tag tags found in one HTML page.
 type Entities []*Entity
 
-// ApplyLogger sets a logger to each entity.
+// ApplyLogger sets a logger to each entity including the nested entities.
 func (et Entities) ApplyLogger(l log.Logger) {
-	for _, e := range et {
+	et.Walk(func(e *Entity) {
 		e.Log = l
+	})
+}
+
+// Walk calls fn for each entity and for all entities nested in block tags like
+// esi:choose, esi:try, esi:vars or <!--esi. A parent gets visited before its children.
+func (et Entities) Walk(fn func(*Entity)) {
+	for _, e := range et {
+		fn(e)
+		for _, b := range e.blocks() {
+			b.Entities.Walk(fn)
+		}
 	}
 }
 
@@ -425,7 +905,7 @@ func (et Entities) HasCoalesce() bool {
 // UniqueID calculates a unique ID for all tags in the slice.
 func (et Entities) UniqueID() uint64 {
 	// can be put into a hash pool ;-)
-	h := xxHash64.New(235711131719) // for now this seed will be used, found under the kitchen table.
+	h := xxHash64.New(hashSeed)
 	for _, e := range et {
 		_, _ = h.Write(e.RawTag)
 	}
@@ -438,6 +918,13 @@ func (et Entities) UniqueID() uint64 {
 // channel. The developer must take care for the correct order. If the request
 // gets canceled via its context then all resource requests gets cancelled too.
 func (et Entities) QueryResources(cTag chan<- DataTag, r *http.Request) error {
+	return et.queryResources(cTag, r, false)
+}
+
+// queryResources implements QueryResources. If strict is true, the first
+// failing include returns an error instead of falling back to its onerror
+// content. This reports the failure to the surrounding esi:attempt block.
+func (et Entities) queryResources(cTag chan<- DataTag, r *http.Request, strict bool) error {
 
 	if len(et) == 0 {
 		return nil
@@ -452,21 +939,32 @@ func (et Entities) QueryResources(cTag chan<- DataTag, r *http.Request) error {
 			if e.PrintDebug {
 				start = monotime.Now()
 			}
-			data, err := e.QueryResources(r)
+			hdr, data, ok, err := e.queryBlock(r, strict)
+			var timedOut bool
+			if !ok {
+				hdr, data, timedOut, err = e.queryResourcesHeader(r)
+			}
 			// A temporary error describes that we have problems reaching the
 			// backend resource and that the circuit breaker has been triggered
 			// or maybe even stopped querying.
 			isTempErr := errors.Temporary.Match(err)
 
-			if err != nil && !isTempErr {
+			if err != nil && (strict || !isTempErr) {
 				// err should have in most cases temporary error behaviour.
 				return errors.Wrapf(err, "[esitag] QueryResources.Resources.DoRequest failed for Tag %q", e.RawTag)
 			}
 
 			t := e.DataTag
 			t.Data = data
+			t.Header = hdr
+			// the surrogate keys are only meant for the cache.
+			delete(t.Header, SurrogateKeyHeader)
 			if isTempErr {
 				t.Data = e.OnError
+				if timedOut && e.OnErrorAjax && e.AjaxPlaceholder != nil {
+					t.Data = e.AjaxPlaceholder(r)
+				}
+				t.Header = nil
 			}
 			if e.PrintDebug {
 				// gets tested by an integration test in package "ht".
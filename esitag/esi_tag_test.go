@@ -29,6 +29,7 @@ import (
 	"github.com/corestoreio/caddy-esi/esitag"
 	"github.com/corestoreio/caddy-esi/esitesting"
 	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log"
 	"github.com/corestoreio/log/logw"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -147,6 +148,9 @@ func TestESITag_ParseRaw(t *testing.T) {
 			assert.Exactly(t, wantET.ReturnHeaders, haveET.ReturnHeaders, "ReturnHeaders")
 			assert.Exactly(t, wantET.ReturnHeadersAll, haveET.ReturnHeadersAll, "ReturnHeadersAll")
 			assert.Exactly(t, wantET.Key, haveET.Key, "Key")
+			assert.Exactly(t, wantET.Race, haveET.Race, "Race")
+			assert.Exactly(t, wantET.Deferred, haveET.Deferred, "Deferred")
+			assert.Exactly(t, wantET.OnErrorAjax, haveET.OnErrorAjax, "OnErrorAjax")
 		}
 	}
 
@@ -284,6 +288,55 @@ func TestESITag_ParseRaw(t *testing.T) {
 		nil,
 	))
 
+	t.Run("enable race", runner(
+		[]byte(`include src="awsRedis1" src="awsRedis2" race="true"`),
+		errors.NoKind,
+		&esitag.Entity{
+			Resources: []*esitag.Resource{
+				esitag.MustNewResource(0, "awsRedis1"),
+				esitag.MustNewResource(1, "awsRedis2"),
+			},
+			Race: true,
+		},
+	))
+
+	t.Run("error in race", runner(
+		[]byte(`include src="awsRedis3" race="fastest"`),
+		errors.NotValid,
+		nil,
+	))
+
+	t.Run("enable deferred", runner(
+		[]byte(`include src="awsRedis3" deferred="true"`),
+		errors.NoKind,
+		&esitag.Entity{
+			Resources: []*esitag.Resource{
+				esitag.MustNewResource(0, "awsRedis3"),
+			},
+			Deferred: true,
+		},
+	))
+
+	t.Run("onerror ajax", runner(
+		[]byte(`include src="awsRedis3" timeout="9ms" onerror="AJAX"`),
+		errors.NoKind,
+		&esitag.Entity{
+			Resources: []*esitag.Resource{
+				esitag.MustNewResource(0, "awsRedis3"),
+			},
+			OnErrorAjax: true,
+			Config: esitag.Config{
+				Timeout: time.Millisecond * 9,
+			},
+		},
+	))
+
+	t.Run("error in deferred", runner(
+		[]byte(`include src="awsRedis3" deferred="later"`),
+		errors.NotValid,
+		nil,
+	))
+
 	t.Run("show not supported unknown attribute", runner(
 		[]byte(`include ykey='product_234234_{HmyHeaderKey}' src="awsRedis2"  returnheaders=" all  " forwardheaders=" all  "`),
 		errors.NotSupported,
@@ -626,6 +679,16 @@ Content from MicroService 1
 </html>`,
 	))
 
+	t.Run("ESI block and tags within one chunk", runner(
+		`<body>
+	<div><esi:remove><p>Fallback</p></esi:remove><esi:include src="https://_one_" /></div>
+	<div><esi:choose> <esi:when test="{Cgroup}=='a'"> <p>A</p> </esi:when> </esi:choose></div>
+</body>`,
+		`<body>
+	<div>Content from MicroService 0Content from MicroService 1</div>
+	<div>Content from MicroService 2</div>
+</body>`,
+	))
 }
 
 func TestDataTags_InjectContent(t *testing.T) {
@@ -1004,6 +1067,29 @@ func TestEntities_QueryResources(t *testing.T) {
 	})
 }
 
+func TestEntities_QueryResources_OnErrorAjax(t *testing.T) {
+	defer esitag.RegisterResourceHandler("ajaxslow01", esitesting.MockRequestError(errors.Timeout.Newf("Too slow"))).DeferredDeregister()
+	defer esitag.RegisterResourceHandler("ajaxdown01", esitesting.MockRequestError(errors.ConnectionFailed.Newf("Service down"))).DeferredDeregister()
+
+	runner := func(src, wantData string) func(*testing.T) {
+		return func(t *testing.T) {
+			entities, err := esitag.Parse(strings.NewReader(`<p><esi:include src="` + src + `" timeout="5ms" onerror="ajax"/></p>`))
+			require.NoError(t, err)
+			entities.ApplyLogger(log.BlackHole{})
+			entities[0].OnError = []byte(`Sorry`)
+			entities[0].AjaxPlaceholder = func(*http.Request) []byte {
+				return []byte(`<esi-ajax id="esi-ajax-1-0"></esi-ajax>`)
+			}
+
+			dtChan := make(chan esitag.DataTag, 1)
+			require.NoError(t, entities.QueryResources(dtChan, httptest.NewRequest("GET", "/page.html", nil)))
+			assert.Exactly(t, wantData, string((<-dtChan).Data))
+		}
+	}
+	t.Run("timeout injects the placeholder", runner("ajaxslow01://micro.service/cart", `<esi-ajax id="esi-ajax-1-0"></esi-ajax>`))
+	t.Run("other failure injects onerror", runner("ajaxdown01://micro.service/cart", `Sorry`))
+}
+
 func TestEntities_Coalesce(t *testing.T) {
 	t.Run("HasCoalesce", func(t *testing.T) {
 		et := esitag.Entities{
@@ -1065,3 +1151,321 @@ func BenchmarkEntities_UniqueID(b *testing.B) {
 		benchmarkEntities_UniqueID = et.UniqueID()
 	}
 }
+
+func TestEntity_QueryResources_Choose(t *testing.T) {
+
+	defer esitag.RegisterResourceHandler("testch1", esitesting.MockRequestContent("Advanced")).DeferredDeregister()
+	defer esitag.RegisterResourceHandler("testch2", esitesting.MockRequestError(errors.Fatal.Newf("Should not get called because the branch is not selected"))).DeferredDeregister()
+
+	entities, err := esitag.Parse(strings.NewReader(`<div><esi:choose>
+	<esi:when test="{Cgroup}=='advanced'"><p><esi:include src="testCh1://micro1" timeout="5s" maxbodysize="15KB"/></p></esi:when>
+	<esi:when test="{Cgroup}=='basic'"><esi:include src="testCh2://micro2" timeout="5s" maxbodysize="15KB"/></esi:when>
+	<esi:otherwise>Default</esi:otherwise>
+</esi:choose></div>`))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	entity := entities[0]
+
+	runner := func(cookieGroup string, wantResponse string) func(*testing.T) {
+		return func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint1", nil)
+			req.Header.Set("Cookie", "group="+cookieGroup)
+
+			content, err := entity.QueryResources(req)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			assert.Exactly(t, wantResponse, string(content))
+		}
+	}
+	t.Run("first when with resource", runner("advanced", `<p>Advanced "testCh1://micro1" Timeout 5s MaxBody 15 kB</p>`))
+	t.Run("otherwise", runner("gopher", `Default`))
+
+	t.Run("no matching block renders nothing", func(t *testing.T) {
+		ets, err := esitag.Parse(strings.NewReader(`<esi:choose><esi:when test="{Cgroup}=='advanced'">X</esi:when></esi:choose>`))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		content, err := ets[0].QueryResources(httptest.NewRequest("GET", "http://cyrillschumacher.com/", nil))
+		assert.NoError(t, err)
+		assert.Empty(t, content)
+	})
+}
+
+func TestEntity_QueryResources_Try(t *testing.T) {
+
+	defer esitag.RegisterResourceHandler("testtry1", esitesting.MockRequestContent("Cart")).DeferredDeregister()
+	defer esitag.RegisterResourceHandler("testtry2", esitesting.MockRequestError(errors.ConnectionFailed.Newf("Cart service down"))).DeferredDeregister()
+
+	runner := func(page string, wantResponse string) func(*testing.T) {
+		return func(t *testing.T) {
+			entities, err := esitag.Parse(strings.NewReader(page))
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			content, err := entities[0].QueryResources(httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint1", nil))
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			assert.Exactly(t, wantResponse, string(content))
+		}
+	}
+
+	t.Run("attempt succeeds", runner(
+		`<esi:try><esi:attempt><p><esi:include src="testTry1://micro1" timeout="5s" maxbodysize="15KB"/></p></esi:attempt><esi:except>Except</esi:except></esi:try>`,
+		`<p>Cart "testTry1://micro1" Timeout 5s MaxBody 15 kB</p>`,
+	))
+	t.Run("one failing include renders except", runner(
+		`<esi:try><esi:attempt><esi:include src="testTry1://micro1"/><esi:include src="testTry2://micro2" onerror="Attempt Error"/></esi:attempt><esi:except><b>Except</b></esi:except></esi:try>`,
+		`<b>Except</b>`,
+	))
+	t.Run("failing include in except uses onerror", runner(
+		`<esi:try><esi:attempt><esi:include src="testTry2://micro2"/></esi:attempt><esi:except><b><esi:include src="testTry2://micro3" onerror="Except Error"/></b></esi:except></esi:try>`,
+		`<b>Except Error</b>`,
+	))
+	t.Run("failing include in nested choose renders except", runner(
+		`<esi:try><esi:attempt><esi:choose><esi:otherwise><esi:include src="testTry2://micro2"/></esi:otherwise></esi:choose></esi:attempt><esi:except>Except</esi:except></esi:try>`,
+		`Except`,
+	))
+	t.Run("missing except renders nothing", runner(
+		`<esi:try><esi:attempt><esi:include src="testTry2://micro2"/></esi:attempt></esi:try>`,
+		``,
+	))
+}
+
+func TestEntities_QueryResources_RemoveComment(t *testing.T) {
+
+	defer esitag.RegisterResourceHandler("testrm1", esitesting.MockRequestContent("Cart")).DeferredDeregister()
+
+	const page = `<div><esi:remove><a href="/cart">Cart</a></esi:remove>` +
+		`<esi:comment text="Cart of the customer"/>` +
+		`<!--esi <p><esi:include src="testRm1://micro1" timeout="5s" maxbodysize="15KB"/></p>-->` +
+		`<!-- stays --></div>`
+
+	ets, err := esitag.Parse(strings.NewReader(page))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	cTag := make(chan esitag.DataTag, len(ets))
+	if err := ets.QueryResources(cTag, httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint1", nil)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	close(cTag)
+
+	tags := newTestDataTags()
+	for dt := range cTag {
+		tags.Slice = append(tags.Slice, dt)
+	}
+	sort.Sort(tags)
+
+	w := new(bytes.Buffer)
+	for _, part := range strings.SplitAfter(page, `>`) {
+		if _, err := tags.InjectContent([]byte(part), w); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	assert.Exactly(t, `<div> <p>Cart "testRm1://micro1" Timeout 5s MaxBody 15 kB</p><!-- stays --></div>`, w.String())
+	assert.Exactly(t, w.Len(), len(page)+tags.DataLen(), "Content-Length adjustment")
+}
+
+func TestEntity_QueryResources_Vars(t *testing.T) {
+
+	defer esitag.RegisterResourceHandler("testvars1", esitesting.MockRequestContent("Cart <b>")).DeferredDeregister()
+
+	ets, err := esitag.Parse(strings.NewReader(`<esi:vars><img src="/avatar/$(HTTP_COOKIE{user})" alt="{Cuser}"/> ` +
+		`<esi:include src="testVars1://cart/$(HTTP_COOKIE{user})" timeout="5s" maxbodysize="15KB"/> $(QUERY_STRING{q}|'none')</esi:vars>`))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint1", nil)
+	req.Header.Set("Cookie", `user=<script>`)
+
+	content, err := ets[0].QueryResources(req)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	assert.Exactly(t,
+		`<img src="/avatar/&lt;script&gt;" alt="{Cuser}"/> Cart <b> "testVars1://cart/<script>" Timeout 5s MaxBody 15 kB none`,
+		string(content))
+}
+
+func TestEntity_QueryResources_Nested(t *testing.T) {
+
+	defer esitag.RegisterResourceHandler("nest1", esitesting.MockRequestContent(`<b><esi:include src="nest2://cart" timeout="1s"/></b>`)).DeferredDeregister()
+	defer esitag.RegisterResourceHandler("nest2", esitesting.MockRequestContent(`Cart <esi:include src="nest3://item" timeout="100ms"/>`)).DeferredDeregister()
+	defer esitag.RegisterResourceHandler("nest3", esitesting.MockRequestContent(`Item`)).DeferredDeregister()
+	defer esitag.RegisterResourceHandler("nestloop", esitesting.MockRequestContent(`<esi:include src="nestLoop://self"/>`)).DeferredDeregister()
+	defer esitag.RegisterResourceHandler("nestbroken", esitesting.MockRequestContent(`<esi:vars><esi:vars>X</esi:vars></esi:vars>`)).DeferredDeregister()
+	defer esitag.RegisterResourceHandler("nestslow", esitesting.MockRequestContentCB(`<esi:include src="nest3://item"/>`, func() error {
+		time.Sleep(15 * time.Millisecond)
+		return nil
+	})).DeferredDeregister()
+
+	runner := func(tag string, maxDepth int, wantResponse string, wantErrBhf errors.Kind) func(*testing.T) {
+		return func(t *testing.T) {
+			ets, err := esitag.Parse(strings.NewReader(tag))
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			et := ets[0]
+			et.MaxDepth = maxDepth
+
+			content, err := et.QueryResources(httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint1", nil))
+			if wantErrBhf > 0 {
+				assert.Nil(t, content)
+				assert.True(t, wantErrBhf.Match(err), "%+v", err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			assert.Exactly(t, wantResponse, string(content))
+		}
+	}
+
+	const header = `<esi:include src="nest1://header" timeout="5s" maxbodysize="15KB"/>`
+	t.Run("disabled", runner(header, 0,
+		`<b><esi:include src="nest2://cart" timeout="1s"/></b> "nest1://header" Timeout 5s MaxBody 15 kB`,
+		errors.NoKind))
+	t.Run("depth one", runner(header, 1,
+		`<b>Cart <esi:include src="nest3://item" timeout="100ms"/> "nest2://cart" Timeout 1s MaxBody 15 kB</b> "nest1://header" Timeout 5s MaxBody 15 kB`,
+		errors.NoKind))
+	t.Run("depth two", runner(header, 2,
+		`<b>Cart Item "nest3://item" Timeout 100ms MaxBody 15 kB "nest2://cart" Timeout 1s MaxBody 15 kB</b> "nest1://header" Timeout 5s MaxBody 15 kB`,
+		errors.NoKind))
+	t.Run("loop detected", runner(`<esi:include src="nestLoop://self" timeout="5s" maxbodysize="15KB"/>`, 3, ``, errors.Temporary))
+	t.Run("no time left for nested tags", runner(`<esi:include src="nestSlow://slow" timeout="10ms" maxbodysize="15KB"/>`, 3, ``, errors.Temporary))
+	t.Run("invalid nested fragment falls back to the next resource", runner(
+		`<esi:include src="nestBroken://x" src="nest3://item" timeout="5s" maxbodysize="15KB"/>`, 1,
+		`Item "nest3://item" Timeout 5s MaxBody 15 kB`,
+		errors.NoKind))
+	t.Run("nested timeout falls back to the next resource", runner(
+		`<esi:include src="nestSlow://slow" src="nest3://item" timeout="10ms" maxbodysize="15KB"/>`, 3,
+		`Item "nest3://item" Timeout 10ms MaxBody 15 kB`,
+		errors.NoKind))
+
+	t.Run("invalid nested fragment renders onerror", func(t *testing.T) {
+		ets, err := esitag.Parse(strings.NewReader(`<esi:include src="nestBroken://x" onerror="Sorry" timeout="5s" maxbodysize="15KB"/>`))
+		require.NoError(t, err)
+		ets.ApplyLogger(log.BlackHole{})
+		ets[0].MaxDepth = 1
+
+		tags := make(chan esitag.DataTag, 1)
+		require.NoError(t, ets.QueryResources(tags, httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint1", nil)))
+		assert.Exactly(t, `Sorry`, string((<-tags).Data))
+	})
+}
+
+func TestEntity_QueryResources_Race(t *testing.T) {
+
+	// raceSlow blocks until its request gets cancelled.
+	defer esitag.RegisterResourceHandler("raceslow", resourceMock{
+		DoRequestFn: func(args *esitag.ResourceArgs) (http.Header, []byte, error) {
+			select {
+			case <-args.ExternalReq.Context().Done():
+				return nil, nil, errors.Wrap(args.ExternalReq.Context().Err(), "raceSlow")
+			case <-time.After(2 * time.Second):
+				return nil, []byte(`Slow`), nil
+			}
+		},
+	}).DeferredDeregister()
+	defer esitag.RegisterResourceHandler("racefast", esitesting.MockRequestContentCB("Fast", func() error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})).DeferredDeregister()
+	defer esitag.RegisterResourceHandler("racefail", esitesting.MockRequestError(errors.ConnectionFailed.Newf("raceFail: Service down"))).DeferredDeregister()
+
+	runner := func(tag string, wantResponse string, wantErrBhf errors.Kind) func(*testing.T) {
+		return func(t *testing.T) {
+			ets, err := esitag.Parse(strings.NewReader(tag))
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			et := ets[0]
+			et.Log = log.BlackHole{}
+
+			start := time.Now()
+			content, err := et.QueryResources(httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint1", nil))
+			assert.True(t, time.Since(start) < time.Second, "Race took too long: %s", time.Since(start))
+			if wantErrBhf > 0 {
+				assert.Nil(t, content)
+				assert.True(t, wantErrBhf.Match(err), "%+v", err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			assert.Contains(t, string(content), wantResponse)
+			for _, r := range et.Resources {
+				if strings.HasPrefix(r.String(), "raceSlow") {
+					assert.Exactly(t, uint64(0), r.CBFailures(), "Cancelled request must not trip the circuit breaker")
+				}
+			}
+		}
+	}
+
+	t.Run("fastest wins", runner(
+		`<esi:include src="raceSlow://a" src="raceFast://b" src="raceSlow://c" race="true" timeout="5s" maxbodysize="15KB"/>`,
+		`Fast "raceFast://b" Timeout 5s MaxBody 15 kB`, errors.NoKind))
+	t.Run("failing resource does not win", runner(
+		`<esi:include src="raceFail://a" src="raceFast://b" race="true" timeout="5s" maxbodysize="15KB"/>`,
+		`Fast "raceFast://b"`, errors.NoKind))
+	t.Run("printdebug shows the winner", runner(
+		`<esi:include src="raceSlow://a" src="raceFast://b" race="true" printdebug="true" timeout="5s" maxbodysize="15KB"/>`,
+		`<!-- Race Winner:1 URL:"raceFast://b" Duration:`, errors.NoKind))
+	t.Run("all resources fail", runner(
+		`<esi:include src="raceFail://a" src="raceFail://b" race="true" timeout="5s" maxbodysize="15KB"/>`,
+		``, errors.Temporary))
+}
+
+func TestEntity_QueryResourcesHeader(t *testing.T) {
+
+	defer esitag.RegisterResourceHandler("rethdr1", resourceMock{
+		DoRequestFn: func(args *esitag.ResourceArgs) (http.Header, []byte, error) {
+			return http.Header{
+				"Set-Cookie":   []string{"cart=1", "wishlist=2"},
+				"X-Foo":        []string{"Foo"},
+				"X-Bar":        []string{"Bar"},
+				"Content-Type": []string{"application/json"},
+			}, []byte(`Cart`), nil
+		},
+	}).DeferredDeregister()
+
+	runner := func(page string, wantData string, wantHeader http.Header) func(*testing.T) {
+		return func(t *testing.T) {
+			ets, err := esitag.Parse(strings.NewReader(page))
+			require.NoError(t, err)
+			ets.ApplyLogger(log.BlackHole{})
+
+			hdr, data, err := ets[0].QueryResourcesHeader(httptest.NewRequest("GET", "http://cyrillschumacher.com/esi/endpoint1", nil))
+			require.NoError(t, err)
+			assert.Exactly(t, wantData, string(data))
+			assert.Exactly(t, wantHeader, hdr)
+		}
+	}
+
+	t.Run("no returnheaders", runner(
+		`<esi:include src="retHdr1://a" timeout="1s" maxbodysize="1KB"/>`,
+		`Cart`, nil))
+	t.Run("some returnheaders", runner(
+		`<esi:include src="retHdr1://a" returnheaders="set-cookie,X-Foo" timeout="1s" maxbodysize="1KB"/>`,
+		`Cart`, http.Header{
+			"Set-Cookie": []string{"cart=1", "wishlist=2"},
+			"X-Foo":      []string{"Foo"},
+		}))
+	t.Run("all returnheaders without the dropped ones", runner(
+		`<esi:include src="retHdr1://a" returnheaders="all" timeout="1s" maxbodysize="1KB"/>`,
+		`Cart`, http.Header{
+			"Set-Cookie": []string{"cart=1", "wishlist=2"},
+			"X-Foo":      []string{"Foo"},
+			"X-Bar":      []string{"Bar"},
+		}))
+	t.Run("returnheaders within a block", runner(
+		`<esi:choose><esi:when test="1">[<esi:include src="retHdr1://a" returnheaders="X-Bar" timeout="1s" maxbodysize="1KB"/>]</esi:when></esi:choose>`,
+		`[Cart]`, http.Header{
+			"X-Bar": []string{"Bar"},
+		}))
+}
@@ -5,11 +5,13 @@
 package esitag
 
 import (
+	"html"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -47,40 +49,204 @@ func MakeReplacer(r *http.Request, emptyValue string) Replacer {
 }
 
 // Replace performs a replacement of values on s and returns the string with the
-// replaced values. Placeholders must be all lower case.
+// replaced values. Placeholders must be all lower case. Besides the
+// placeholders in braces, the ESI variables $(NAME), $(NAME{key}) and
+// $(NAME|default) get replaced, see function esiVar.
 func (r *replacer) Replace(s string) string {
 	// Do not attempt replacements if no placeholder is found.
-	if !strings.ContainsAny(s, "{}") {
+	if !strings.ContainsAny(s, "{}") && !strings.Contains(s, "$(") {
 		return s
 	}
+	return r.replace(s, true, nil)
+}
+
+// replaceVarsHTML replaces only the ESI variables in s and HTML-escapes the
+// substituted values. Placeholders in braces are kept because the content of
+// an esi:vars block can contain CSS or JavaScript.
+func replaceVarsHTML(req *http.Request, s string) string {
+	if !strings.Contains(s, "$(") {
+		return s
+	}
+	r := &replacer{
+		request: req,
+	}
+	return r.replace(s, false, html.EscapeString)
+}
+
+// replace implements Replace. If braces is false, only ESI variables get
+// replaced. escape, if not nil, gets applied to each substituted value.
+func (r *replacer) replace(s string, braces bool, escape func(string) string) string {
+	var buf strings.Builder
+	buf.Grow(len(s))
+	write := func(v string) {
+		if escape != nil {
+			v = escape(v)
+		}
+		buf.WriteString(v)
+	}
 
-	result := ""
 	for {
-		idxStart := strings.Index(s, "{")
+		idxVar := strings.Index(s, "$(")
+		idxStart := -1
+		if braces {
+			idxStart = strings.Index(s, "{")
+		}
+
+		if idxVar >= 0 && (idxStart == -1 || idxVar < idxStart) {
+			name, key, def, hasDef, n := parseESIVar(s[idxVar:])
+			if n == 0 {
+				// malformed variable, keep it
+				buf.WriteString(s[:idxVar+2])
+				s = s[idxVar+2:]
+				continue
+			}
+			v := r.esiVar(name, key)
+			if hasDef && (v == "" || v == r.emptyValue) {
+				v = def
+			}
+			buf.WriteString(s[:idxVar])
+			write(v)
+			s = s[idxVar+n:]
+			continue
+		}
+
 		if idxStart == -1 {
 			// no placeholder anymore
 			break
 		}
 		idxEnd := strings.Index(s[idxStart:], "}")
 		if idxEnd == -1 {
-			// unpaired placeholder
-			break
+			// unpaired placeholder, only ESI variables might follow.
+			braces = false
+			continue
 		}
 		idxEnd += idxStart
 
 		// get a replacement
 		placeholder := s[idxStart : idxEnd+1]
-		replacement := r.getSubstitution(placeholder)
 
 		// append prefix + replacement
-		result += s[:idxStart] + replacement
+		buf.WriteString(s[:idxStart])
+		write(r.getSubstitution(placeholder))
 
 		// strip out scanned parts
 		s = s[idxEnd+1:]
 	}
 
 	// append unscanned parts
-	return result + s
+	buf.WriteString(s)
+	return buf.String()
+}
+
+// parseESIVar parses an ESI variable at the beginning of s in the forms
+// $(NAME), $(NAME{key}), $(NAME|default) or $(NAME{key}|'default'). n contains
+// the length of the variable and is zero if s does not start with a valid
+// variable.
+func parseESIVar(s string) (name, key, def string, hasDef bool, n int) {
+	if !strings.HasPrefix(s, "$(") {
+		return "", "", "", false, 0
+	}
+	i := 2
+	for i < len(s) && (s[i] >= 'A' && s[i] <= 'Z' || s[i] >= 'a' && s[i] <= 'z' || s[i] >= '0' && s[i] <= '9' || s[i] == '_') {
+		i++
+	}
+	name = s[2:i]
+	if name == "" || i >= len(s) {
+		return "", "", "", false, 0
+	}
+	if s[i] == '{' {
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", "", "", false, 0
+		}
+		key = s[i+1 : i+end]
+		i += end + 1
+	}
+	if i < len(s) && s[i] == '|' {
+		hasDef = true
+		i++
+		if i < len(s) && (s[i] == '\'' || s[i] == '"') {
+			end := strings.IndexByte(s[i+1:], s[i])
+			if end < 0 {
+				return "", "", "", false, 0
+			}
+			def = s[i+1 : i+1+end]
+			i += end + 2
+		} else {
+			end := strings.IndexByte(s[i:], ')')
+			if end < 0 {
+				return "", "", "", false, 0
+			}
+			def = s[i : i+end]
+			i += end
+		}
+	}
+	if i >= len(s) || s[i] != ')' {
+		return "", "", "", false, 0
+	}
+	return name, key, def, hasDef, i + 1
+}
+
+// esiVar maps the ESI 1.0 variables to the placeholders of the replacer:
+//		$(HTTP_COOKIE)                 {HCookie}
+//		$(HTTP_COOKIE{name})           {Cname}
+//		$(HTTP_ACCEPT_LANGUAGE)        {HAccept-Language}
+//		$(HTTP_ACCEPT_LANGUAGE{de})    true or false
+//		$(HTTP_HOST)                   {host}
+//		$(QUERY_STRING)                {query}
+//		$(QUERY_STRING{q})             value of the query parameter q
+//		$(REMOTE_ADDR)                 {remote}
+//		$(REQUEST_METHOD)              {method}
+//		$(REQUEST_PATH)                {path}
+//		$(HTTP_X_ANY_HEADER)           {HX-Any-Header}
+func (r *replacer) esiVar(name, key string) string {
+	switch name {
+	case "HTTP_COOKIE":
+		if key == "" {
+			return r.getSubstitution("{HCookie}")
+		}
+		return r.getSubstitution("{C" + key + "}")
+	case "HTTP_ACCEPT_LANGUAGE":
+		if key == "" {
+			return r.getSubstitution("{HAccept-Language}")
+		}
+		return strconv.FormatBool(acceptsLanguage(r.request.Header.Get("Accept-Language"), key))
+	case "HTTP_HOST":
+		return r.getSubstitution("{host}")
+	case "QUERY_STRING":
+		if key == "" {
+			return r.getSubstitution("{query}")
+		}
+		if v := r.request.URL.Query().Get(key); v != "" {
+			return v
+		}
+		return r.emptyValue
+	case "REMOTE_ADDR":
+		return r.getSubstitution("{remote}")
+	case "REQUEST_METHOD":
+		return r.getSubstitution("{method}")
+	case "REQUEST_PATH":
+		return r.getSubstitution("{path}")
+	}
+	if strings.HasPrefix(name, "HTTP_") && len(name) > 5 {
+		return r.getSubstitution("{H" + strings.Replace(name[5:], "_", "-", -1) + "}")
+	}
+	return r.emptyValue
+}
+
+// acceptsLanguage reports whether lang occurs in the Accept-Language header
+// value. The language de matches also de-CH.
+func acceptsLanguage(header, lang string) bool {
+	for _, l := range strings.Split(header, ",") {
+		if i := strings.IndexByte(l, ';'); i >= 0 {
+			l = l[:i]
+		}
+		l = strings.TrimSpace(l)
+		if strings.EqualFold(l, lang) || (len(l) > len(lang) && l[len(lang)] == '-' && strings.EqualFold(l[:len(lang)], lang)) {
+			return true
+		}
+	}
+	return false
 }
 
 // getSubstitution retrieves value from corresponding key
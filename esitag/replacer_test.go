@@ -175,3 +175,44 @@ func TestReplace(t *testing.T) {
 	}
 
 }
+
+func TestReplace_ESIVariables(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest("GET", "http://corestore.io/catalog?q=gopher&empty=", nil)
+	req.Header.Set("Accept-Language", "de-CH, fr;q=0.8")
+	req.Header.Set("X-Gopher-ID", "<rob>")
+	req.AddCookie(&http.Cookie{Name: "group", Value: "advanced"})
+	repl := MakeReplacer(req, "-")
+
+	testCases := []struct {
+		template string
+		expect   string
+	}{
+		{"$(HTTP_COOKIE{group})", "advanced"},
+		{"$(HTTP_COOKIE{missing}|'guest')", "guest"},
+		{"$(HTTP_COOKIE{missing}|guest)", "guest"},
+		{"$(HTTP_COOKIE{missing})", "-"},
+		{"$(HTTP_COOKIE)", "group=advanced"},
+		{"de:$(HTTP_ACCEPT_LANGUAGE{de}) fr:$(HTTP_ACCEPT_LANGUAGE{fr}) en:$(HTTP_ACCEPT_LANGUAGE{en})", "de:true fr:true en:false"},
+		{"$(QUERY_STRING{q})", "gopher"},
+		{"$(QUERY_STRING)", "q=gopher&empty="},
+		{"$(HTTP_HOST)/$(REQUEST_METHOD)", "corestore.io/GET"},
+		{"$(HTTP_X_GOPHER_ID)", "<rob>"},
+		{"$(UNKNOWN)", "-"},
+		{"both {Cgroup} $(HTTP_COOKIE{group})", "both advanced advanced"},
+		{"Bad $(HTTP_COOKIE", "Bad $(HTTP_COOKIE"},
+		{"Bad {HCustom placeholder $(HTTP_HOST)", "Bad {HCustom placeholder corestore.io"},
+		{"$() is not a variable", "$() is not a variable"},
+	}
+
+	for _, c := range testCases {
+		if expected, actual := c.expect, repl.Replace(c.template); expected != actual {
+			t.Errorf("for template '%s', expected '%s', got '%s'", c.template, expected, actual)
+		}
+	}
+
+	if have, want := replaceVarsHTML(req, `<b>$(HTTP_X_GOPHER_ID)</b> {Cgroup} function(){}`), `<b>&lt;rob&gt;</b> {Cgroup} function(){}`; have != want {
+		t.Errorf("replaceVarsHTML: expected '%s', got '%s'", want, have)
+	}
+}
@@ -47,6 +47,18 @@ type ResourceArgs struct {
 	URL string
 	// Tag the configuration of a single ESI tag.
 	Tag Config
+	// IfNoneMatch and IfModifiedSince contain the validators of a stale cached
+	// fragment in the HTTP cache mode. The HTTP backend sends them as
+	// conditional request headers.
+	IfNoneMatch     string
+	IfModifiedSince string
+	// NotModified gets set by the backend if the resource confirms with a 304
+	// status code that the cached fragment is still valid. The returned body
+	// is then empty.
+	NotModified bool
+	// ResponseHeader gets set by the backend with the unfiltered header of the
+	// response. The HTTP cache mode reads the caching headers from it.
+	ResponseHeader http.Header
 }
 
 // NewResourceArgs creates a new argument and initializes the internal string
@@ -177,7 +189,8 @@ func (a *ResourceArgs) PrepareForwardHeaders() []string {
 
 // PrepareReturnHeaders extracts the required headers fromBE as defined in the
 // struct fields ReturnHeaders*. fromBE means: From Back End. These are the
-// headers from the queried backend resource. Might return a nil map.
+// headers from the queried backend resource. Multiple values of a header, like
+// Set-Cookie, get preserved. Might return a nil map.
 func (a *ResourceArgs) PrepareReturnHeaders(fromBE http.Header) http.Header {
 	if !a.Tag.ReturnHeadersAll && len(a.Tag.ReturnHeaders) == 0 {
 		return nil
@@ -186,10 +199,8 @@ func (a *ResourceArgs) PrepareReturnHeaders(fromBE http.Header) http.Header {
 	ret := make(http.Header) // using len(fromBE) as 2nd a makes the benchmark slower!
 	if a.Tag.ReturnHeadersAll {
 		for hn, hvs := range fromBE {
-			if !DropHeadersReturn[hn] {
-				for _, hv := range hvs {
-					ret.Set(hn, hv)
-				}
+			if hn = http.CanonicalHeaderKey(hn); !DropHeadersReturn[hn] {
+				ret[hn] = append(ret[hn], hvs...)
 			}
 		}
 		return ret
@@ -197,9 +208,7 @@ func (a *ResourceArgs) PrepareReturnHeaders(fromBE http.Header) http.Header {
 
 	for _, hn := range a.Tag.ReturnHeaders {
 		if hvs, ok := fromBE[hn]; ok && !DropHeadersReturn[hn] {
-			for _, hv := range hvs {
-				ret.Set(hn, hv)
-			}
+			ret[hn] = append(ret[hn], hvs...)
 		}
 	}
 	return ret
@@ -472,7 +481,9 @@ func MustNewResource(idx int, url string) *Resource {
 }
 
 // NewResource creates a new resource to one backend. Inspects the URL if it
-// contains a template and parses that template.
+// contains a template and parses that template. The URL can start with the
+// placeholder {scheme}:// to request the current scheme, e.g.
+// {scheme}://{host}/esi/cart.
 func NewResource(idx int, url string) (*Resource, error) {
 	r := &Resource{
 		Index: idx,
@@ -483,6 +494,10 @@ func NewResource(idx int, url string) (*Resource, error) {
 	if pos := strings.Index(r.url, "://"); pos > 1 {
 		schemeAlias = strings.ToLower(r.url[:pos])
 	}
+	if schemeAlias == "{scheme}" {
+		// resolved per request to http or https, both share the same handler.
+		schemeAlias = "http"
+	}
 
 	var ok bool
 	r.handler, ok = LookupResourceHandler(schemeAlias)
@@ -505,6 +520,9 @@ func (r *Resource) DoRequest(args *ResourceArgs) (http.Header, []byte, error) {
 
 	args.URL = args.repl.Replace(r.url)
 	args.Tag.Key = args.repl.Replace(args.Tag.Key)
+	// the arguments get reused for the next resource.
+	args.NotModified = false
+	args.ResponseHeader = nil
 
 	h, b, err := r.handler.DoRequest(args)
 	if err != nil {
@@ -350,6 +350,15 @@ func TestResourceArgs_PrepareReturnHeaders(t *testing.T) {
 			rfa.PrepareReturnHeaders(resourceRespWithExtendedHeaders),
 		)
 	})
+	t.Run("ReturnHeaders multiple values", func(t *testing.T) {
+		rfa.Tag.ReturnHeadersAll = false
+		rfa.Tag.ReturnHeaders = []string{"Set-Cookie"}
+
+		assert.Exactly(t,
+			http.Header{"Set-Cookie": []string{"a=1", "b=2"}},
+			rfa.PrepareReturnHeaders(http.Header{"Set-Cookie": []string{"a=1", "b=2"}}),
+		)
+	})
 }
 
 func TestParseNoSQLURL(t *testing.T) {
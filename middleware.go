@@ -16,12 +16,15 @@ package caddyesi
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/corestoreio/caddy-esi/bufpool"
+	"github.com/corestoreio/caddy-esi/esicache"
 	"github.com/corestoreio/caddy-esi/esitag"
 	"github.com/corestoreio/errors"
 	"github.com/corestoreio/log"
@@ -48,6 +51,11 @@ type Middleware struct {
 	// coalesce guarantees the execution of one backend request when n-external
 	// incoming requests occur. Pointer type not needed.
 	coalesce singleflight.Group
+	// warmupStop stops the background warm-up of the caches. Protected by
+	// warmupMu because the start and stop callbacks of Caddy can run in
+	// different goroutines.
+	warmupMu   sync.Mutex
+	warmupStop chan struct{}
 }
 
 // ServeHTTP implements the http.Handler interface.
@@ -56,6 +64,12 @@ func (mw *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, er
 	if cfg == nil {
 		return mw.Next.ServeHTTP(w, r) // exit early
 	}
+	if r.URL.Path == cfg.ajaxPath() {
+		return mw.serveAjax(cfg, w, r)
+	}
+	if cfg.IsPathExcluded(r.URL.Path) {
+		return mw.Next.ServeHTTP(w, r)
+	}
 	if !cfg.IsRequestAllowed(r) {
 		if cfg.Log.IsDebug() {
 			cfg.Log.Debug("caddyesi.Middleware.ServeHTTP.IsRequestAllowed",
@@ -87,6 +101,12 @@ func (mw *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, er
 		logR = loghttp.ShallowCloneRequest(r)
 	}
 
+	var positions []streamTag
+	if cfg.Streaming {
+		// entities gets split in the goroutine for the coalesce requests.
+		positions = streamPositions(entities, r)
+	}
+
 	chanTag := make(chan esitag.DataTag)
 	go func() {
 		var wg *sync.WaitGroup
@@ -105,7 +125,9 @@ func (mw *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, er
 			go func() {
 				defer wg.Done()
 				coaID := coaEnt.UniqueID()
-				doRes, _, _ := mw.coalesce.Do(strconv.FormatUint(coaID, 10), func() (interface{}, error) {
+				// A data change invalidates the result of a running query.
+				coaKey := strconv.FormatUint(coaID, 10) + "-" + strconv.FormatUint(esitag.Invalidations(), 10)
+				doRes, _, _ := mw.coalesce.Do(coaKey, func() (interface{}, error) {
 					coaChanTag := make(chan esitag.DataTag)
 					// wow this is ugly (3 level of goroutines) but for now the
 					// best I can come up with. but not using coalesce will
@@ -158,7 +180,24 @@ func (mw *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, er
 		}
 		close(chanTag)
 	}()
-	return mw.Next.ServeHTTP(responseWrapInjector(chanTag, w), r)
+
+	if cfg.Streaming {
+		sw := responseWrapStreamer(cfg, positions, chanTag, r.Header.Get("Accept-Encoding"), w)
+		code, err := mw.Next.ServeHTTP(sw, r)
+		// The header has already been sent, so an error can only be logged.
+		if cErr := sw.Close(); cErr != nil && cfg.Log.IsInfo() {
+			cfg.Log.Info("caddyesi.Middleware.ServeHTTP.Streaming.Close.Error",
+				log.Err(cErr), log.Uint64("page_id", pageID), loghttp.Request("request", logR))
+		}
+		return code, err
+	}
+	iw := responseWrapInjector(cfg, chanTag, r.Header.Get("Accept-Encoding"), w)
+	code, err := mw.Next.ServeHTTP(iw, r)
+	if cErr := iw.Close(); cErr != nil && cfg.Log.IsInfo() {
+		cfg.Log.Info("caddyesi.Middleware.ServeHTTP.Injector.Close.Error",
+			log.Err(cErr), log.Uint64("page_id", pageID), loghttp.Request("request", logR))
+	}
+	return code, err
 }
 
 // serveBuffered creates a http.ResponseWriter buffer, calls the next handler,
@@ -170,16 +209,34 @@ func (mw *Middleware) serveBuffered(cfg *PathConfig, pageID uint64, w http.Respo
 	buf := bufpool.Get()
 	defer bufpool.Put(buf)
 
-	bufResW := responseWrapBuffer(buf, w)
+	bufResW := responseWrapBuffer(cfg, buf, w)
 
 	// We must wait until every single byte has been written into the buffer.
 	code, err := mw.Next.ServeHTTP(bufResW, r)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
+	if bufResW.PassedThrough() {
+		return code, nil
+	}
+
+	// A compressed page gets decoded for the content type detection and the
+	// parsing. The original buffer gets written if decoding is not possible.
+	page := buf
+	coding, decodable := responseCoding(bufResW.Header())
+	if coding != "" && decodable {
+		plain := bufpool.Get()
+		defer bufpool.Put(plain)
+		if err := decodeBody(coding, buf.Bytes(), plain, cfg.decodeLimit()); err == nil {
+			page = plain
+		} else if cfg.Log.IsDebug() {
+			cfg.Log.Debug("caddyesi.Middleware.ServeHTTP.decodeBody.Error",
+				log.Err(err), log.Uint64("page_id", pageID), loghttp.Request("request", r))
+		}
+	}
 
 	// Only plain text response is benchIsResponseAllowed, so detect content type
-	if !isResponseAllowed(buf.Bytes()) {
+	if (coding != "" && page == buf) || cfg.isPageTooLarge(page.Len()) || !cfg.isContentAllowed(page.Bytes()) {
 		bufResW.TriggerRealWrite(0)
 		if _, err := bufResW.Write(buf.Bytes()); err != nil {
 			return http.StatusInternalServerError, err
@@ -196,14 +253,19 @@ func (mw *Middleware) serveBuffered(cfg *PathConfig, pageID uint64, w http.Respo
 	// run a performance load test to see if it's worth to switch to Group.DoChan
 	groupEntitiesResult, err, shared := mw.Group.Do(strconv.FormatUint(pageID, 10), func() (interface{}, error) {
 
-		entities, err := esitag.Parse(newSimpleReader(buf.Bytes()))
+		entities, err := esitag.ParseWithOptions(newSimpleReader(page.Bytes()), esitag.ParseOptions{
+			Syntax:      cfg.Syntax,
+			Lenient:     cfg.ParseLenient,
+			Log:         cfg.Log,
+			SSIUpstream: cfg.ssiUpstream(),
+		})
 		if cfg.Log.IsDebug() {
 			const contentMaxLength = 512
 			var content string
-			if buf.Len() < contentMaxLength {
-				content = buf.String()
+			if page.Len() < contentMaxLength {
+				content = page.String()
 			} else {
-				content = buf.String()[:contentMaxLength]
+				content = page.String()[:contentMaxLength]
 			}
 
 			cfg.Log.Debug("caddyesi.Middleware.ServeHTTP.ESITagsByRequest.Parse",
@@ -215,6 +277,7 @@ func (mw *Middleware) serveBuffered(cfg *PathConfig, pageID uint64, w http.Respo
 			return nil, errors.Wrapf(err, "[caddyesi] Grouped parsing failed ID %d", pageID)
 		}
 		cfg.UpsertESITags(pageID, entities)
+		cfg.rememberPage(pageID, r)
 
 		return entities, nil
 	})
@@ -248,21 +311,62 @@ func (mw *Middleware) serveBuffered(cfg *PathConfig, pageID uint64, w http.Respo
 		close(cTags)
 	}()
 
+	if cfg.Streaming {
+		// The Content-Length is not known ahead, so chunked encoding applies.
+		var sw io.Writer = bufResW
+		bufResW.Header().Del("Content-Length")
+		var ew *encodingWriter
+		if coding != "" {
+			outCoding := acceptedCoding(r.Header.Get("Accept-Encoding"))
+			setEncodingHeader(bufResW.Header(), outCoding)
+			ew = newEncodingWriter(outCoding, bufResW)
+			sw = ew
+		}
+		si := newStreamInjector(streamPositions(groupEntitiesResult.(esitag.Entities), r), cTags, sw)
+		bufResW.TriggerRealWrite(0)
+		if _, err := si.Write(page.Bytes()); err != nil {
+			si.drain()
+			return http.StatusInternalServerError, err
+		}
+		if err := si.finish(); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if ew != nil {
+			if err := ew.Close(); err != nil {
+				return http.StatusInternalServerError, err
+			}
+		}
+		return code, nil
+	}
+
 	tags := esitag.NewDataTagsCapped(avgESITagsPerPage)
 	for t := range cTags {
 		tags.Slice = append(tags.Slice, t)
 	}
 
+	// restore original order as occurred in the HTML document.
+	sort.Sort(tags)
+
+	// Merge the headers returned by the resources before the real write sends
+	// the header to the client.
+	tags.MergeHeader(bufResW.Header())
+
+	if coding != "" {
+		// The Content-Length gets calculated from the encoded page.
+		bufResW.TriggerRealWrite(0)
+		if err := writeEncoded(bufResW, code, r.Header.Get("Accept-Encoding"), page.Bytes(), tags); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return code, nil
+	}
+
 	// Calculates the correct Content-Length and enables now the real writing to the
 	// client.
 	bufResW.TriggerRealWrite(tags.DataLen())
 
-	// restore original order as occurred in the HTML document.
-	sort.Sort(tags)
-
 	// read the 2nd time from the buffer to finally inject the content from the resource backends
 	// into the HTML page
-	if _, err := tags.InjectContent(buf.Bytes(), bufResW); err != nil {
+	if _, err := tags.InjectContent(page.Bytes(), bufResW); err != nil {
 		return http.StatusInternalServerError, err
 	}
 
@@ -270,17 +374,67 @@ func (mw *Middleware) serveBuffered(cfg *PathConfig, pageID uint64, w http.Respo
 }
 
 // handleHeaderCommands allows to execute certain commands to influence the
-// behaviour of the Tag tag middleware.
-func handleHeaderCommands(pc *PathConfig, w http.ResponseWriter, r *http.Request) (err error) {
+// behaviour of the Tag tag middleware. With a cluster bus the command gets
+// published to all other nodes.
+func handleHeaderCommands(pc *PathConfig, w http.ResponseWriter, r *http.Request) error {
 	if pc.CmdHeaderName == "" {
 		return nil
 	}
+	cmd := strings.Fields(r.Header.Get(pc.CmdHeaderName))
+	if len(cmd) == 0 {
+		return nil
+	}
+	res, err := pc.executeCommand(cmd)
+	if err != nil {
+		return errors.Wrap(err, "[caddyesi] handleHeaderCommands")
+	}
+	if res == "" {
+		return nil // unknown command
+	}
+	w.Header().Set(pc.CmdHeaderName, res)
+	if cmd[0] != `stats` { // the counters belong to this node
+		pc.publishCommand(cmd)
+	}
+	return nil
+}
+
+// executeCommand executes a command of the command header or of the cluster
+// bus. Returns the result for the response header or an empty string if the
+// command is unknown.
+func (pc *PathConfig) executeCommand(cmd []string) (result string, err error) {
 	var logLevel string
 
-	switch r.Header.Get(pc.CmdHeaderName) {
+	switch cmd[0] {
 	case `purge`:
 		prevItemsInMap := pc.purgeESICache()
-		w.Header().Set(pc.CmdHeaderName, fmt.Sprintf("purge-ok-%d", prevItemsInMap))
+		result = fmt.Sprintf("purge-ok-%d", prevItemsInMap)
+	case `purge-keys`:
+		// purge-keys product-42 cart
+		keys := cmd[1:]
+		c := esicache.MainRegistry.Get(pc.Scope)
+		if c == nil || len(keys) == 0 {
+			result = "purge-keys-ok-0"
+			break
+		}
+		if err := esitag.PurgeSurrogateKeys(c, keys...); err != nil {
+			return "", errors.Wrap(err, "[caddyesi] executeCommand.PurgeSurrogateKeys")
+		}
+		if pc.Log.IsDebug() {
+			pc.Log.Debug("caddyesi.handleHeaderCommands.PurgeSurrogateKeys", log.String("path_scope", pc.Scope), log.String("keys", strings.Join(keys, " ")))
+		}
+		result = fmt.Sprintf("purge-keys-ok-%d", len(keys))
+	case `stats`:
+		// stats-ok-1; hits=42 misses=3 ... one part per inmemory tier
+		sts := esicache.InMemoryStatsOf(esicache.MainRegistry.Get(pc.Scope))
+		parts := make([]string, 0, len(sts)+1)
+		parts = append(parts, fmt.Sprintf("stats-ok-%d", len(sts)))
+		for _, st := range sts {
+			parts = append(parts, st.String())
+		}
+		result = strings.Join(parts, "; ")
+		if pc.Log.IsDebug() {
+			pc.Log.Debug("caddyesi.handleHeaderCommands.Stats", log.String("path_scope", pc.Scope), log.String("stats", result))
+		}
 	case `log-debug`:
 		logLevel = "debug"
 	case `log-info`:
@@ -297,10 +451,9 @@ func handleHeaderCommands(pc *PathConfig, w http.ResponseWriter, r *http.Request
 		err = setupLogger(pc)
 		pc.esiMU.Unlock()
 		if err != nil {
-			return errors.Wrap(err, "[caddyesi] handleHeaderCommands.setupLogger")
+			return "", errors.Wrap(err, "[caddyesi] executeCommand.setupLogger")
 		}
-		w.Header().Set(pc.CmdHeaderName, fmt.Sprintf("log-%s-ok", prevLevel))
+		result = fmt.Sprintf("log-%s-ok", prevLevel)
 	}
-
-	return nil
+	return result, nil
 }
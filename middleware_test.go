@@ -209,6 +209,91 @@ func TestMiddleware_ServeHTTP_Once(t *testing.T) {
 		errors.NoKind,
 	))
 
+	t.Run("Stream three resources in page02.html", mwTestRunner(
+		`esi {
+			streaming
+		}`,
+		httptest.NewRequest("GET", "/page02.html", nil),
+		`<p>Micro1Service1 "mwTest02A://microService1" Timeout 5ms MaxBody 10 kB</p>
+<p>Micro2Service2 "mwTest02B://microService2" Timeout 6ms MaxBody 20 kB</p>
+<p>Micro3Service3 "mwTest02C://microService3" Timeout 7ms MaxBody 30 kB</p>`,
+		errors.NoKind,
+	))
+
+	defer esitag.RegisterResourceHandler("mwtest10a", esitesting.MockRequestContent("Micro1Service1")).DeferredDeregister()
+	defer esitag.RegisterResourceHandler("mwtest10b", esitesting.MockRequestError(errors.Fatal.Newf("mwTest10B: must not be called"))).DeferredDeregister()
+	t.Run("Choose the esi:when block in page10-choose.html by cookie", mwTestRunner(
+		`esi`,
+		func() *http.Request {
+			req := httptest.NewRequest("GET", "/page10-choose.html", nil)
+			req.Header.Set("Cookie", "group=advanced")
+			return req
+		}(),
+		"<body>\n<p>Micro1Service1 \"mwTest10A://microService1\" Timeout 5ms MaxBody 10 kB</p>\n    <h1>Hello World</h1>",
+		errors.NoKind,
+	))
+	t.Run("Choose the esi:otherwise block in page10-choose.html", mwTestRunner(
+		`esi`,
+		httptest.NewRequest("GET", "/page10-choose.html", nil),
+		"<body>\n<p>No group</p>\n    <h1>Hello World</h1>",
+		errors.NoKind,
+	))
+
+	defer esitag.RegisterResourceHandler("mwtest11a", esitesting.MockRequestContent("Micro1Service1")).DeferredDeregister()
+	defer esitag.RegisterResourceHandler("mwtest11b", esitesting.MockRequestError(errors.ConnectionFailed.Newf("mwTest11B: Cart service down"))).DeferredDeregister()
+	t.Run("Render the esi:except block in page11-try.html because of a failing include", mwTestRunner(
+		`esi`,
+		httptest.NewRequest("GET", "/page11-try.html", nil),
+		"<body>\n<p>Cart not available</p>\n    <h1>Hello World</h1>",
+		errors.NoKind,
+	))
+
+	defer esitag.RegisterResourceHandler("mwtest12a", esitesting.MockRequestContent("Micro1Service1")).DeferredDeregister()
+	t.Run("Strip esi:remove and unwrap <!--esi in page12-remove.html", mwTestRunner(
+		`esi`,
+		httptest.NewRequest("GET", "/page12-remove.html", nil),
+		"<body>\n\n <p>Micro1Service1 \"mwTest12A://microService1\" Timeout 5ms MaxBody 10 kB</p> \n\n    <h1>Hello World</h1>",
+		errors.NoKind,
+	))
+
+	defer esitag.RegisterResourceHandler("mwtest13a", esitesting.MockRequestContent("Micro1Service1")).DeferredDeregister()
+	t.Run("Replace ESI variables in page13-vars.html", mwTestRunner(
+		`esi`,
+		func() *http.Request {
+			req := httptest.NewRequest("GET", "/page13-vars.html?page=2", nil)
+			req.Header.Set("Cookie", "name=<Gopher>")
+			return req
+		}(),
+		"<body>\n<p>Hello &lt;Gopher&gt;</p>Micro1Service1 \"mwTest13A://microService1/2\" Timeout 5ms MaxBody 10 kB\n    <h1>Hello World</h1>",
+		errors.NoKind,
+	))
+
+	defer esitag.RegisterResourceHandler("mwtest14a", esitesting.MockRequestContent("Micro1Service1")).DeferredDeregister()
+	t.Run("Strict parse mode fails page14-lenient.html", mwTestRunner(
+		`esi`,
+		httptest.NewRequest("GET", "/page14-lenient.html", nil),
+		"",
+		errors.NotValid,
+	))
+	t.Run("Lenient parse mode skips the broken tag in page14-lenient.html", mwTestRunner(
+		`esi {
+			parse_mode lenient
+		}`,
+		httptest.NewRequest("GET", "/page14-lenient.html", nil),
+		"<body>\n<p></p>\nMicro1Service1 \"mwTest14A://microService2\" Timeout 5ms MaxBody 10 kB\n    <h1>Hello World</h1>",
+		errors.NoKind,
+	))
+
+	defer esitag.RegisterResourceHandler("mwtest15a", esitesting.MockRequestContent("Micro1Service1")).DeferredDeregister()
+	t.Run("Replace the custom element esi-include in page15-element.html", mwTestRunner(
+		`esi {
+			syntax esi,element
+		}`,
+		httptest.NewRequest("GET", "/page15-element.html", nil),
+		"<body>\n<p>Micro1Service1 \"mwTest15A://microService1\" Timeout 5ms MaxBody 10 kB</p>\n    <h1>Hello World</h1>",
+		errors.NoKind,
+	))
+
 	t.Run("ESI tags not present in page07.html", mwTestRunner(
 		`esi`,
 		httptest.NewRequest("GET", "/page07.html", nil),
@@ -0,0 +1,244 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package caddyesi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/corestoreio/caddy-esi/bufpool"
+	"github.com/corestoreio/caddy-esi/esitag"
+	"github.com/corestoreio/errors"
+)
+
+// supportedCodings lists the content codings which can be decoded and
+// encoded, ordered by preference when the client accepts several of them
+// with the same quality.
+var supportedCodings = [...]string{"br", "gzip", "deflate"}
+
+// responseCoding returns the content coding of a response. An empty coding
+// means the body is not encoded. ok is false if the coding cannot be decoded,
+// e.g. "compress" or several codings applied after each other.
+func responseCoding(h http.Header) (coding string, ok bool) {
+	coding = strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding")))
+	switch coding {
+	case "", "identity":
+		return "", true
+	case "x-gzip":
+		return "gzip", true
+	}
+	for _, c := range supportedCodings {
+		if c == coding {
+			return coding, true
+		}
+	}
+	return coding, false
+}
+
+// acceptedCoding returns the preferred supported coding of the client header
+// Accept-Encoding. An empty string means the client accepts only the
+// unencoded body.
+func acceptedCoding(acceptEncoding string) string {
+	qualities := make(map[string]float64, 4)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, q := parseAcceptPart(part)
+		qualities[coding] = q
+	}
+	var best string
+	var bestQ float64
+	for _, c := range supportedCodings {
+		q, ok := qualities[c]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ = c, q
+		}
+	}
+	return best
+}
+
+// parseAcceptPart parses one element of the Accept-Encoding header like
+// "gzip;q=0.8". A missing or malformed quality value counts as 1.
+func parseAcceptPart(part string) (coding string, q float64) {
+	q = 1
+	coding = part
+	if i := strings.IndexByte(part, ';'); i >= 0 {
+		coding = part[:i]
+		params := strings.TrimSpace(part[i+1:])
+		if strings.HasPrefix(params, "q=") {
+			if f, err := strconv.ParseFloat(params[2:], 64); err == nil {
+				q = f
+			}
+		}
+	}
+	coding = strings.ToLower(strings.TrimSpace(coding))
+	if coding == "x-gzip" {
+		coding = "gzip"
+	}
+	return coding, q
+}
+
+// decodeMaxSize limits the size of a decoded page if the PathConfig has no
+// MaxPageSize, so a small compressed body cannot fill the memory.
+const decodeMaxSize = 64 << 20 // 64 MiB
+
+// decodeLimit returns the maximum size of a decoded page.
+func (pc *PathConfig) decodeLimit() uint64 {
+	if pc != nil && pc.MaxPageSize > 0 {
+		return pc.MaxPageSize
+	}
+	return decodeMaxSize
+}
+
+// decodeBody decodes the body with the content coding and writes the result
+// into dst. A decoded body larger than limit returns a TooLarge error, dst
+// contains then limit+1 bytes.
+func decodeBody(coding string, body []byte, dst io.Writer, limit uint64) error {
+	var r io.Reader
+	switch coding {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return errors.NotValid.New(err, "[caddyesi] Failed to read the gzip header")
+		}
+		defer zr.Close()
+		r = zr
+	case "deflate":
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return errors.NotValid.New(err, "[caddyesi] Failed to read the deflate header")
+		}
+		defer zr.Close()
+		r = zr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return errors.NotSupported.Newf("[caddyesi] Content-Encoding %q not supported", coding)
+	}
+	n, err := io.Copy(dst, io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return errors.NotValid.New(err, "[caddyesi] Failed to decode the %q body", coding)
+	}
+	if uint64(n) > limit {
+		return errors.TooLarge.Newf("[caddyesi] Decoded %q body exceeds %d bytes", coding, limit)
+	}
+	return nil
+}
+
+// flushWriteCloser gets implemented by the encoders of all supported codings.
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// encodingWriter encodes the data written to it and writes the result to w.
+// It implements http.Flusher to send the already written data, used by the
+// streaming mode.
+type encodingWriter struct {
+	w   io.Writer
+	enc flushWriteCloser
+}
+
+func newEncodingWriter(coding string, w io.Writer) *encodingWriter {
+	ew := &encodingWriter{w: w}
+	switch coding {
+	case "br":
+		ew.enc = brotli.NewWriter(w)
+	case "gzip":
+		ew.enc = gzip.NewWriter(w)
+	case "deflate":
+		ew.enc = zlib.NewWriter(w)
+	default:
+		ew.enc = nopFlushWriteCloser{w}
+	}
+	return ew
+}
+
+func (ew *encodingWriter) Write(p []byte) (int, error) {
+	return ew.enc.Write(p)
+}
+
+// Flush sends the encoded data written so far to the client.
+func (ew *encodingWriter) Flush() {
+	if err := ew.enc.Flush(); err != nil {
+		return
+	}
+	if fl, ok := ew.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Close writes the remaining encoded data. It does not close w.
+func (ew *encodingWriter) Close() error {
+	return ew.enc.Close()
+}
+
+type nopFlushWriteCloser struct {
+	io.Writer
+}
+
+func (nopFlushWriteCloser) Flush() error { return nil }
+func (nopFlushWriteCloser) Close() error { return nil }
+
+// setEncodingHeader sets the header for a page whose length changes and
+// which gets encoded with the coding accepted by the client. An empty coding
+// sends the page unencoded.
+func setEncodingHeader(h http.Header, coding string) {
+	h.Del("Content-Length")
+	if coding == "" {
+		h.Del("Content-Encoding")
+	} else {
+		h.Set("Content-Encoding", coding)
+	}
+	for _, v := range h["Vary"] {
+		if strings.Contains(strings.ToLower(v), "accept-encoding") {
+			return
+		}
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
+
+// writeEncoded injects the data of the tags into the decoded page, encodes
+// it with the coding accepted by the client and writes the header with the
+// correct Content-Length and then the page to w.
+func writeEncoded(w http.ResponseWriter, code int, acceptEncoding string, page []byte, tags *esitag.DataTags) error {
+	out := bufpool.Get()
+	defer bufpool.Put(out)
+
+	coding := acceptedCoding(acceptEncoding)
+	ew := newEncodingWriter(coding, out)
+	if _, err := tags.InjectContent(page, ew); err != nil {
+		return errors.Wrap(err, "[caddyesi] writeEncoded.InjectContent")
+	}
+	if err := ew.Close(); err != nil {
+		return errors.WriteFailed.New(err, "[caddyesi] Failed to encode the page with %q", coding)
+	}
+
+	setEncodingHeader(w.Header(), coding)
+	w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+	if code == 0 {
+		code = http.StatusOK
+	}
+	w.WriteHeader(code)
+	_, err := w.Write(out.Bytes())
+	return errors.Wrap(err, "[caddyesi] writeEncoded.Write")
+}
@@ -0,0 +1,276 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package caddyesi
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/corestoreio/caddy-esi/esitag"
+	"github.com/corestoreio/caddy-esi/esitesting"
+	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ http.Flusher = (*encodingWriter)(nil)
+
+func encodeTestBody(t *testing.T, coding string, data string) []byte {
+	var buf bytes.Buffer
+	ew := newEncodingWriter(coding, &buf)
+	_, err := ew.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, ew.Close())
+	return buf.Bytes()
+}
+
+func decodeTestBody(t *testing.T, coding string, data []byte) string {
+	if coding == "" {
+		return string(data)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, decodeBody(coding, data, &buf, decodeMaxSize))
+	return buf.String()
+}
+
+func TestAcceptedCoding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"br;q=0, gzip;q=0.8", "gzip"},
+		{"*", "br"},
+		{"*;q=0.1, br;q=0", "gzip"},
+		{"x-gzip", "gzip"},
+		{"compress", ""},
+	}
+	for _, test := range tests {
+		assert.Exactly(t, test.want, acceptedCoding(test.acceptEncoding), "Accept-Encoding %q", test.acceptEncoding)
+	}
+}
+
+func TestResponseCoding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		contentEncoding string
+		wantCoding      string
+		wantOK          bool
+	}{
+		{"", "", true},
+		{"identity", "", true},
+		{"GZIP", "gzip", true},
+		{"x-gzip", "gzip", true},
+		{"br", "br", true},
+		{"deflate", "deflate", true},
+		{"compress", "compress", false},
+		{"gzip, br", "gzip, br", false},
+	}
+	for _, test := range tests {
+		h := http.Header{}
+		h.Set("Content-Encoding", test.contentEncoding)
+		coding, ok := responseCoding(h)
+		assert.Exactly(t, test.wantCoding, coding, "Content-Encoding %q", test.contentEncoding)
+		assert.Exactly(t, test.wantOK, ok, "Content-Encoding %q", test.contentEncoding)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	t.Parallel()
+
+	const page = `<html><body><esi:include src="x"/></body></html>`
+	for _, coding := range supportedCodings {
+		assert.Exactly(t, page, decodeTestBody(t, coding, encodeTestBody(t, coding, page)), "Coding %q", coding)
+	}
+
+	t.Run("invalid gzip data", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := decodeBody("gzip", []byte(page), &buf, decodeMaxSize)
+		assert.True(t, errors.NotValid.Match(err), "%+v", err)
+	})
+	t.Run("unsupported coding", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := decodeBody("compress", []byte(page), &buf, decodeMaxSize)
+		assert.True(t, errors.NotSupported.Match(err), "%+v", err)
+	})
+	t.Run("decoded body exceeds the limit", func(t *testing.T) {
+		bomb := encodeTestBody(t, "gzip", strings.Repeat("a", 1<<20))
+		var buf bytes.Buffer
+		err := decodeBody("gzip", bomb, &buf, 1024)
+		assert.True(t, errors.TooLarge.Match(err), "%+v", err)
+		assert.Exactly(t, 1025, buf.Len(), "Decoding must stop after the limit")
+	})
+}
+
+func TestResponseWrapInjector_Encoded(t *testing.T) {
+	t.Parallel()
+
+	const html = `<HtMl><bOdY>blah blah blah</body></html>`
+	const want = `<HtMl><bOdY>Hello XML blah blah</body></html>`
+
+	runner := func(acceptEncoding, wantCoding string) func(*testing.T) {
+		return func(t *testing.T) {
+			dtChan := make(chan esitag.DataTag, 1)
+			dtChan <- esitag.DataTag{Data: []byte(`Hello XML`), Start: 12, End: 16}
+			close(dtChan)
+
+			gz := encodeTestBody(t, "gzip", html)
+			rec := httptest.NewRecorder()
+			rwi := responseWrapInjector(nil, dtChan, acceptEncoding, rec)
+			rwi.Header().Set("Content-Encoding", "gzip")
+			rwi.Header().Set("Content-Length", strconv.Itoa(len(gz)))
+			rwi.WriteHeader(http.StatusAccepted)
+			_, err := rwi.Write(gz)
+			require.NoError(t, err)
+			assert.Empty(t, rec.Body.Bytes(), "Page must be buffered until Close")
+			require.NoError(t, rwi.Close())
+
+			assert.Exactly(t, http.StatusAccepted, rec.Code)
+			assert.Exactly(t, wantCoding, rec.Header().Get("Content-Encoding"))
+			assert.Exactly(t, "Accept-Encoding", rec.Header().Get("Vary"))
+			assert.Exactly(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get("Content-Length"))
+			assert.Exactly(t, want, decodeTestBody(t, wantCoding, rec.Body.Bytes()))
+		}
+	}
+	t.Run("client accepts gzip", runner("gzip", "gzip"))
+	t.Run("client accepts br", runner("gzip, br", "br"))
+	t.Run("client accepts identity", runner("", ""))
+
+	t.Run("not decodable page unmodified", func(t *testing.T) {
+		dtChan := make(chan esitag.DataTag, 1)
+		dtChan <- esitag.DataTag{Data: []byte(`Hello XML`), Start: 12, End: 16}
+		close(dtChan)
+
+		rec := httptest.NewRecorder()
+		rwi := responseWrapInjector(nil, dtChan, "gzip", rec)
+		rwi.Header().Set("Content-Encoding", "gzip")
+		_, err := rwi.Write([]byte(html))
+		require.NoError(t, err)
+		assert.True(t, errors.NotValid.Match(rwi.Close()))
+		assert.Exactly(t, "gzip", rec.Header().Get("Content-Encoding"))
+		assert.Exactly(t, html, rec.Body.String())
+	})
+
+	t.Run("too large decoded page unmodified", func(t *testing.T) {
+		pc := NewPathConfig()
+		pc.MaxPageSize = 64 << 10
+		bomb := encodeTestBody(t, "gzip", html+strings.Repeat(" ", 1<<20))
+		require.True(t, len(bomb) < int(pc.MaxPageSize), "Compressed page must fit into MaxPageSize")
+
+		dtChan := make(chan esitag.DataTag)
+		close(dtChan)
+		rec := httptest.NewRecorder()
+		rwi := responseWrapInjector(pc, dtChan, "gzip", rec)
+		rwi.Header().Set("Content-Encoding", "gzip")
+		_, err := rwi.Write(bomb)
+		require.NoError(t, err)
+		require.NoError(t, rwi.Close())
+		assert.Exactly(t, "gzip", rec.Header().Get("Content-Encoding"))
+		assert.Exactly(t, bomb, rec.Body.Bytes())
+	})
+}
+
+func TestResponseWrapStreamer_Encoded(t *testing.T) {
+	t.Parallel()
+
+	html := `<HtMl><bOdY>blah blah blah</body></html>`
+	positions := []streamTag{{start: 12, end: 16}}
+
+	dtChan := make(chan esitag.DataTag, 1)
+	dtChan <- esitag.DataTag{Data: []byte(`Hello XML`), Start: 12, End: 16}
+	close(dtChan)
+
+	gz := encodeTestBody(t, "gzip", html)
+	rec := httptest.NewRecorder()
+	sw := responseWrapStreamer(nil, positions, dtChan, "deflate", rec)
+	sw.Header().Set("Content-Encoding", "gzip")
+	sw.Header().Set("Content-Length", strconv.Itoa(len(gz)))
+	_, err := sw.Write(gz)
+	require.NoError(t, err)
+	require.NoError(t, sw.Close())
+
+	assert.Exactly(t, "deflate", rec.Header().Get("Content-Encoding"))
+	assert.Empty(t, rec.Header().Get("Content-Length"))
+	assert.Exactly(t, `<HtMl><bOdY>Hello XML blah blah</body></html>`, decodeTestBody(t, "deflate", rec.Body.Bytes()))
+}
+
+func TestMiddleware_serveBuffered_Encoded(t *testing.T) {
+	// t.Parallel() not possible due to the global map in backend
+
+	defer esitag.RegisterResourceHandler("enctest01", esitesting.MockRequestContent("Micro1Service1")).DeferredDeregister()
+
+	const html = `<html><body><p><esi:include src="encTest01://micro.service"/></p></body></html>`
+
+	newMW := func(coding string) *Middleware {
+		return &Middleware{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				body := encodeTestBody(t, coding, html)
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.Header().Set("Content-Encoding", coding)
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				w.WriteHeader(http.StatusOK)
+				_, err := w.Write(body)
+				return http.StatusOK, err
+			}),
+		}
+	}
+	newPC := func(streaming bool) *PathConfig {
+		pc := NewPathConfig()
+		pc.Scope = "/"
+		pc.Log = log.BlackHole{}
+		pc.Streaming = streaming
+		return pc
+	}
+
+	runner := func(upstream, acceptEncoding, wantCoding string, streaming bool) func(*testing.T) {
+		return func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/page.html", nil)
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+			rec := httptest.NewRecorder()
+
+			code, err := newMW(upstream).serveBuffered(newPC(streaming), 1, rec, req)
+			require.NoError(t, err)
+			assert.Exactly(t, http.StatusOK, code)
+
+			assert.Exactly(t, wantCoding, rec.Header().Get("Content-Encoding"))
+			if streaming {
+				assert.Empty(t, rec.Header().Get("Content-Length"))
+			} else {
+				assert.Exactly(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get("Content-Length"))
+			}
+			page := decodeTestBody(t, wantCoding, rec.Body.Bytes())
+			assert.Contains(t, page, "<p>Micro1Service1 ")
+			assert.NotContains(t, page, "esi:include")
+		}
+	}
+	t.Run("gzip to gzip", runner("gzip", "gzip", "gzip", false))
+	t.Run("br to gzip", runner("br", "gzip, deflate", "gzip", false))
+	t.Run("deflate to identity", runner("deflate", "", "", false))
+	t.Run("gzip to br streaming", runner("gzip", "br", "br", true))
+}
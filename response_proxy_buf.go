@@ -16,6 +16,7 @@ package caddyesi
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 	"net"
 	"net/http"
@@ -25,17 +26,23 @@ import (
 type responseBufferWriter interface {
 	http.ResponseWriter
 	TriggerRealWrite(addContentLength int)
+	// PassedThrough returns true if the response has been written directly
+	// to the client because the PathConfig does not allow to process it.
+	PassedThrough() bool
 }
 
 // responseWrapBuffer wraps an http.ResponseWriter, returning a proxy which only writes
-// into the provided io.Writer.
-func responseWrapBuffer(buf io.Writer, w http.ResponseWriter) responseBufferWriter {
+// into the provided buffer. A response not allowed by pc, detected by the
+// header or by exceeding the maximum page size, gets written directly to w. pc
+// can be nil.
+func responseWrapBuffer(pc *PathConfig, buf *bytes.Buffer, w http.ResponseWriter) responseBufferWriter {
 	_, cn := w.(http.CloseNotifier)
 	_, fl := w.(http.Flusher)
 	_, hj := w.(http.Hijacker)
 	_, rf := w.(io.ReaderFrom)
 
 	bw := bufferedWriter{
+		pc:     pc,
 		rw:     w,
 		buf:    buf,
 		header: make(http.Header),
@@ -52,8 +59,9 @@ func responseWrapBuffer(buf io.Writer, w http.ResponseWriter) responseBufferWrit
 // bufferedWriter wraps a http.ResponseWriter that implements the minimal
 // http.ResponseWriter interface.
 type bufferedWriter struct {
+	pc     *PathConfig
 	rw     http.ResponseWriter
-	buf    io.Writer
+	buf    *bytes.Buffer
 	header http.Header
 	// addContentLength rewrites the Content-Length header to the correct
 	// returned length. Value can also be negative when the error message in an
@@ -64,6 +72,9 @@ type bufferedWriter struct {
 	// writeReal does not write to the buffer and writes directly to the original
 	// rw.
 	writeReal bool
+	// headerChecked the header has been checked against the PathConfig.
+	headerChecked bool
+	passedThrough bool
 }
 
 func (b *bufferedWriter) TriggerRealWrite(addContentLength int) {
@@ -75,34 +86,84 @@ func (b *bufferedWriter) Header() http.Header {
 	return b.header
 }
 
+func (b *bufferedWriter) PassedThrough() bool {
+	return b.passedThrough
+}
+
 func (b *bufferedWriter) WriteHeader(code int) {
 	// WriteHeader gets called before TriggerRealWrite
 	if b.code == 0 {
 		b.code = code
 	}
+	if !b.writeReal {
+		b.checkHeader()
+	}
+}
+
+// checkHeader passes the response through, if the PathConfig does not allow
+// the status code or the header.
+func (b *bufferedWriter) checkHeader() {
+	if b.headerChecked {
+		return
+	}
+	b.headerChecked = true
+	if !b.pc.isHeaderAllowed(b.code, b.header) {
+		b.passThrough()
+	}
+}
+
+// passThrough sends the header and the already buffered data to the client.
+// All further writes go directly to the client.
+func (b *bufferedWriter) passThrough() error {
+	b.passedThrough = true
+	b.writeReal = true
+	b.addContentLength = 0
+	if b.code == 0 {
+		b.code = http.StatusOK
+	}
+	b.writeHeader()
+	if b.buf.Len() == 0 {
+		return nil
+	}
+	_, err := b.rw.Write(b.buf.Bytes())
+	b.buf.Reset()
+	return err
+}
+
+func (b *bufferedWriter) writeHeader() {
+	if b.wroteHeader {
+		return
+	}
+	b.wroteHeader = true
+
+	const clName = "Content-Length"
+	if b.addContentLength != 0 {
+		clRaw := b.header.Get(clName)
+		cl, _ := strconv.Atoi(clRaw) // ignoring that err ... for now
+		b.header.Set(clName, strconv.Itoa(cl+b.addContentLength))
+	}
+
+	for k, v := range b.header {
+		b.rw.Header()[k] = v
+	}
+	b.rw.WriteHeader(b.code)
 }
 
 // Write does not write to the client instead it writes in the underlying
 // buffer.
 func (b *bufferedWriter) Write(p []byte) (int, error) {
 	if !b.writeReal {
-		return b.buf.Write(p)
+		b.checkHeader()
 	}
-
-	const clName = "Content-Length"
-	if !b.wroteHeader {
-		b.wroteHeader = true
-		if b.addContentLength != 0 {
-			clRaw := b.header.Get(clName)
-			cl, _ := strconv.Atoi(clRaw) // ignoring that err ... for now
-			b.header.Set(clName, strconv.Itoa(cl+b.addContentLength))
-		}
-
-		for k, v := range b.header {
-			b.rw.Header()[k] = v
+	if !b.writeReal && b.pc.isPageTooLarge(b.buf.Len()+len(p)) {
+		if err := b.passThrough(); err != nil {
+			return 0, err
 		}
-		b.rw.WriteHeader(b.code)
 	}
+	if !b.writeReal {
+		return b.buf.Write(p)
+	}
+	b.writeHeader()
 	return b.rw.Write(p)
 }
 
@@ -37,7 +37,7 @@ func TestWrapBuffered(t *testing.T) {
 
 	wOrg := httptest.NewRecorder()
 	buf := new(bytes.Buffer)
-	wb := responseWrapBuffer(buf, wOrg)
+	wb := responseWrapBuffer(nil, buf, wOrg)
 	data := []byte(`Commander Data encrypts the computer with a fractal algorithm to protect it from the Borgs.`)
 	n, err := wb.Write(data)
 	assert.NoError(t, err)
@@ -57,3 +57,53 @@ func TestWrapBuffered(t *testing.T) {
 	assert.Exactly(t, http.StatusTeapot, wOrg.Code, "HTTP Status Code")
 	assert.Exactly(t, `3321`, wOrg.Header().Get("Content-Length"))
 }
+
+func TestWrapBuffered_PassThrough(t *testing.T) {
+	t.Parallel()
+
+	data := []byte(`Commander Data encrypts the computer with a fractal algorithm to protect it from the Borgs.`)
+
+	t.Run("status code not allowed", func(t *testing.T) {
+		wOrg := httptest.NewRecorder()
+		buf := new(bytes.Buffer)
+		wb := responseWrapBuffer(&PathConfig{StatusCodes: []int{http.StatusOK}}, buf, wOrg)
+		wb.Header().Set("Content-Length", "91")
+		wb.WriteHeader(http.StatusNotFound)
+		_, err := wb.Write(data)
+		assert.NoError(t, err)
+
+		assert.True(t, wb.PassedThrough())
+		assert.Exactly(t, 0, buf.Len(), "Nothing must be buffered")
+		assert.Exactly(t, http.StatusNotFound, wOrg.Code)
+		assert.Exactly(t, "91", wOrg.Header().Get("Content-Length"))
+		assert.Exactly(t, data, wOrg.Body.Bytes())
+	})
+
+	t.Run("max page size exceeded while buffering", func(t *testing.T) {
+		wOrg := httptest.NewRecorder()
+		buf := new(bytes.Buffer)
+		wb := responseWrapBuffer(&PathConfig{MaxPageSize: 100}, buf, wOrg)
+		for i := 0; i < 2; i++ {
+			_, err := wb.Write(data)
+			assert.NoError(t, err)
+		}
+
+		assert.True(t, wb.PassedThrough())
+		assert.Exactly(t, 0, buf.Len())
+		assert.Exactly(t, http.StatusOK, wOrg.Code)
+		assert.Exactly(t, append(append([]byte{}, data...), data...), wOrg.Body.Bytes())
+	})
+
+	t.Run("allowed response gets buffered", func(t *testing.T) {
+		wOrg := httptest.NewRecorder()
+		buf := new(bytes.Buffer)
+		wb := responseWrapBuffer(&PathConfig{ContentTypes: []string{"text/html"}, MaxPageSize: 100}, buf, wOrg)
+		wb.Header().Set("Content-Type", "text/html")
+		_, err := wb.Write(data)
+		assert.NoError(t, err)
+
+		assert.False(t, wb.PassedThrough())
+		assert.Exactly(t, len(data), buf.Len())
+		assert.Exactly(t, 0, wOrg.Body.Len())
+	})
+}
@@ -16,25 +16,41 @@ package caddyesi
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 	"net"
 	"net/http"
 	"sort"
 	"strconv"
 
+	"github.com/corestoreio/caddy-esi/bufpool"
 	"github.com/corestoreio/caddy-esi/esitag"
+	"github.com/corestoreio/errors"
 )
 
-func responseWrapInjector(cTag <-chan esitag.DataTag, w http.ResponseWriter) http.ResponseWriter {
+type injectResponseWriter interface {
+	http.ResponseWriter
+	// Close writes a compressed page, which has been buffered for decoding.
+	// Must be called after the next handler has returned.
+	Close() error
+}
+
+// responseWrapInjector wraps w and injects the data of the tags. A page
+// compressed by the next handler gets buffered and written in Close, encoded
+// with the coding of acceptEncoding, the header of the client. A response not
+// allowed by pc gets written unmodified. pc can be nil.
+func responseWrapInjector(pc *PathConfig, cTag <-chan esitag.DataTag, acceptEncoding string, w http.ResponseWriter) injectResponseWriter {
 	_, cn := w.(http.CloseNotifier)
 	_, fl := w.(http.Flusher)
 	_, hj := w.(http.Hijacker)
 	_, rf := w.(io.ReaderFrom)
 
 	bw := injectingWriter{
-		rw:      w,
-		chanTag: cTag,
-		header:  make(http.Header),
+		pc:             pc,
+		rw:             w,
+		chanTag:        cTag,
+		header:         make(http.Header),
+		acceptEncoding: acceptEncoding,
 	}
 
 	if cn && fl && hj && rf {
@@ -49,12 +65,21 @@ func responseWrapInjector(cTag <-chan esitag.DataTag, w http.ResponseWriter) htt
 // injectingWriter wraps a http.ResponseWriter that implements the minimal
 // http.ResponseWriter interface.
 type injectingWriter struct {
+	pc              *PathConfig
 	rw              http.ResponseWriter
 	chanTag         <-chan esitag.DataTag
 	lazyTags        *esitag.DataTags
 	responseAllowed uint8 // 0 not yet tested, 1 yes, 2 no
 	wroteHeader     bool
 	header          http.Header
+	acceptEncoding  string
+	// coding of the page written by the next handler. If not empty the page
+	// gets buffered in its encoded form until Close.
+	coding  string
+	code    int
+	encoded *bytes.Buffer
+	// written counts the bytes of a plain page written by the next handler.
+	written int
 }
 
 // initLazyTags reads only once from the chanTag and blocks until data is
@@ -75,17 +100,36 @@ func (b *injectingWriter) Header() http.Header {
 	return b.header
 }
 
+// WriteHeader waits for the data of the ESI tags to adjust the Content-Length
+// and to merge the headers returned by the resources, before the header gets
+// sent to the client.
 func (b *injectingWriter) WriteHeader(code int) {
 	if b.wroteHeader {
 		return
 	}
 	b.wroteHeader = true
+	if !b.pc.isHeaderAllowed(code, b.header) {
+		b.responseAllowed = 2 // no
+		b.code = code
+		b.writeHeaderUnmodified()
+		b.drain()
+		return
+	}
+	if coding, ok := responseCoding(b.header); ok && coding != "" {
+		// The compressed page cannot be scanned, so it gets decoded in Close.
+		b.coding = coding
+		b.code = code
+		b.encoded = bufpool.Get()
+		return
+	}
 	b.initLazyTags()
+	b.lazyTags.MergeHeader(b.header)
 	dataTagLen := b.lazyTags.DataLen()
 
-	if dataTagLen != 0 {
-		const clName = "Content-Length"
-		clRaw := b.header.Get(clName)
+	// Only adjust an already set Content-Length, the implicit WriteHeader call
+	// in Write would otherwise create a header with a wrong value.
+	const clName = "Content-Length"
+	if clRaw := b.header.Get(clName); dataTagLen != 0 && clRaw != "" {
 		cl, _ := strconv.Atoi(clRaw) // ignoring that err ... for now
 		b.header.Set(clName, strconv.Itoa(cl+dataTagLen))
 	}
@@ -111,10 +155,34 @@ func (b *injectingWriter) Write(p []byte) (int, error) {
 		no
 	)
 
+	if !b.wroteHeader {
+		// copies our header to the client
+		b.WriteHeader(http.StatusOK)
+	}
+	if b.encoded != nil {
+		if !b.pc.isPageTooLarge(b.encoded.Len() + len(p)) {
+			return b.encoded.Write(p)
+		}
+		if err := b.passThrough(); err != nil {
+			return 0, err
+		}
+	}
+
 	if b.responseAllowed == notTested {
 		// Hopefully data is longer than 512 bytes ;-)
 		b.responseAllowed = yes
-		if !isResponseAllowed(p) {
+		if !b.pc.isContentAllowed(p) {
+			b.responseAllowed = no
+		}
+	}
+
+	b.written += len(p)
+	if b.responseAllowed == yes && b.pc.isPageTooLarge(b.written) {
+		// A page with a Content-Length above MaxPageSize never gets here. The
+		// remaining page gets written unmodified but not in the middle of a
+		// tag.
+		b.initLazyTags()
+		if !b.lazyTags.InProgress() {
 			b.responseAllowed = no
 		}
 	}
@@ -133,6 +201,72 @@ func (b *injectingWriter) Write(p []byte) (int, error) {
 	return len(p), err
 }
 
+// Close decodes a buffered compressed page, injects the data of the tags and
+// writes the page encoded with the coding accepted by the client. The
+// Content-Length gets calculated from the encoded page. A page which cannot
+// be decoded or is not text gets written unmodified.
+func (b *injectingWriter) Close() error {
+	if b.encoded == nil {
+		return nil
+	}
+	defer bufpool.Put(b.encoded)
+
+	page := bufpool.Get()
+	defer bufpool.Put(page)
+	err := decodeBody(b.coding, b.encoded.Bytes(), page, b.pc.decodeLimit())
+	tooLarge := errors.TooLarge.Match(err)
+	if tooLarge {
+		err = nil // passes through like a too large plain page
+	}
+	if err != nil || tooLarge || b.pc.isPageTooLarge(page.Len()) || !b.pc.isContentAllowed(page.Bytes()) {
+		b.writeHeaderUnmodified()
+		if _, wErr := b.rw.Write(b.encoded.Bytes()); wErr != nil && err == nil {
+			err = wErr
+		}
+		b.drain()
+		return errors.Wrap(err, "[caddyesi] injectingWriter.Close")
+	}
+
+	b.initLazyTags()
+	b.lazyTags.MergeHeader(b.header)
+	for k, v := range b.header {
+		b.rw.Header()[k] = v
+	}
+	return errors.Wrap(writeEncoded(b.rw, b.code, b.acceptEncoding, page.Bytes(), b.lazyTags), "[caddyesi] injectingWriter.Close")
+}
+
+// passThrough writes the buffered compressed page unmodified because it
+// exceeds the maximum page size. All further writes go directly to the
+// client.
+func (b *injectingWriter) passThrough() error {
+	b.responseAllowed = 2 // no
+	b.writeHeaderUnmodified()
+	_, err := b.rw.Write(b.encoded.Bytes())
+	bufpool.Put(b.encoded)
+	b.encoded = nil
+	b.drain()
+	return err
+}
+
+func (b *injectingWriter) writeHeaderUnmodified() {
+	for k, v := range b.header {
+		b.rw.Header()[k] = v
+	}
+	b.rw.WriteHeader(b.code)
+}
+
+// drain reads the remaining tags in the background, so that the goroutines
+// querying the resources can finish.
+func (b *injectingWriter) drain() {
+	if b.lazyTags != nil {
+		return
+	}
+	go func(c <-chan esitag.DataTag) {
+		for range c {
+		}
+	}(b.chanTag)
+}
+
 func newSimpleReader(p []byte) *simpleReader {
 	// can be in a sync.pool
 	return &simpleReader{
@@ -166,6 +300,9 @@ func (f *injectingFancyWriter) CloseNotify() <-chan bool {
 	return cn.CloseNotify()
 }
 func (f *injectingFancyWriter) Flush() {
+	if f.injectingWriter.encoded != nil {
+		return // the buffered page gets written in Close
+	}
 	fl := f.injectingWriter.rw.(http.Flusher)
 	fl.Flush()
 }
@@ -191,6 +328,9 @@ type injectingFlushWriter struct {
 }
 
 func (f *injectingFlushWriter) Flush() {
+	if f.injectingWriter.encoded != nil {
+		return // the buffered page gets written in Close
+	}
 	fl := f.injectingWriter.rw.(http.Flusher)
 	fl.Flush()
 }
@@ -81,7 +81,7 @@ func TestResponseWrapInjector(t *testing.T) {
 		close(dtChan)
 
 		rec := httptest.NewRecorder()
-		rwi := responseWrapInjector(dtChan, rec)
+		rwi := responseWrapInjector(nil, dtChan, "", rec)
 		rwi.Header().Set("Content-LENGTH", "300")
 
 		for i := 0; i < 3; i++ {
@@ -92,12 +92,53 @@ func TestResponseWrapInjector(t *testing.T) {
 		}
 	})
 
+	t.Run("WriteHeader merges returned headers", func(t *testing.T) {
+		dtChan := make(chan esitag.DataTag, 2)
+		dtChan <- esitag.DataTag{End: 5, Start: 1, Header: http.Header{
+			"Set-Cookie": []string{"a=1"},
+			"X-Foo":      []string{"backend"},
+		}}
+		dtChan <- esitag.DataTag{End: 15, Start: 11, Header: http.Header{
+			"Set-Cookie": []string{"b=2"},
+			"X-Bar":      []string{"bar"},
+		}}
+		close(dtChan)
+
+		rec := httptest.NewRecorder()
+		rwi := responseWrapInjector(nil, dtChan, "", rec)
+		rwi.Header().Set("X-Foo", "page")
+		rwi.Header().Set("Set-Cookie", "p=0")
+		rwi.WriteHeader(http.StatusOK)
+
+		assert.Exactly(t, []string{"p=0", "a=1", "b=2"}, rec.Header()["Set-Cookie"])
+		assert.Exactly(t, "page", rec.Header().Get("X-Foo"))
+		assert.Exactly(t, "bar", rec.Header().Get("X-Bar"))
+		assert.Empty(t, rec.Header().Get("Content-Length"), "Content-Length must not be created")
+	})
+
+	t.Run("Write merges returned headers without WriteHeader", func(t *testing.T) {
+		dtChan := make(chan esitag.DataTag, 1)
+		dtChan <- esitag.DataTag{Data: []byte(`Hello XML`), Start: 12, End: 16, Header: http.Header{
+			"Set-Cookie": []string{"a=1"},
+		}}
+		close(dtChan)
+
+		rec := httptest.NewRecorder()
+		rwi := responseWrapInjector(nil, dtChan, "", rec)
+		html := []byte(`<HtMl><bOdY>blah blah blah</body></html>`)
+		if _, err := rwi.Write(html); err != nil {
+			t.Fatal(err)
+		}
+		assert.Exactly(t, `<HtMl><bOdY>Hello XML blah blah</body></html>`, rec.Body.String())
+		assert.Exactly(t, "a=1", rec.Header().Get("Set-Cookie"))
+	})
+
 	t.Run("Get injecting Flush Writer", func(t *testing.T) {
 		dtChan := make(chan esitag.DataTag, 1)
 		dtChan <- esitag.DataTag{}
 		close(dtChan)
 
-		rwi := responseWrapInjector(dtChan, httptest.NewRecorder())
+		rwi := responseWrapInjector(nil, dtChan, "", httptest.NewRecorder())
 		_, ok := rwi.(*injectingFlushWriter)
 		assert.True(t, ok, "Expecting a injectingFlushWriter type")
 	})
@@ -107,7 +148,7 @@ func TestResponseWrapInjector(t *testing.T) {
 		dtChan <- esitag.DataTag{}
 		close(dtChan)
 
-		rwi := responseWrapInjector(dtChan, newResponseMock())
+		rwi := responseWrapInjector(nil, dtChan, "", newResponseMock())
 		_, ok := rwi.(*injectingFancyWriter)
 		assert.True(t, ok, "Expecting a injectingFancyWriter type")
 	})
@@ -118,7 +159,7 @@ func TestResponseWrapInjector(t *testing.T) {
 		close(dtChan)
 
 		rec := httptest.NewRecorder()
-		rwi := responseWrapInjector(dtChan, rec)
+		rwi := responseWrapInjector(nil, dtChan, "", rec)
 		png := []byte("\x89\x50\x4E\x47\x0D\x0A\x1A\x0A")
 		if _, err := rwi.Write(png); err != nil {
 			t.Fatal(err)
@@ -135,7 +176,7 @@ func TestResponseWrapInjector(t *testing.T) {
 		close(dtChan)
 
 		rec := httptest.NewRecorder()
-		rwi := responseWrapInjector(dtChan, rec)
+		rwi := responseWrapInjector(nil, dtChan, "", rec)
 		html := []byte(`<HtMl><bOdY>blah blah blah</body></html>`)
 		if _, err := rwi.Write(html); err != nil {
 			t.Fatal(err)
@@ -149,7 +190,7 @@ func TestResponseWrapInjector(t *testing.T) {
 		close(dtChan)
 
 		rec := httptest.NewRecorder()
-		rwi := responseWrapInjector(dtChan, rec)
+		rwi := responseWrapInjector(nil, dtChan, "", rec)
 		html1 := []byte(`<HtMl><bOdY> <esi:include src=""/>|`)
 		html2 := []byte(`<data>Text and much more content.</data></body></html>`)
 		if _, err := rwi.Write(html1); err != nil {
@@ -164,6 +205,28 @@ func TestResponseWrapInjector(t *testing.T) {
 			rec.Body.String())
 	})
 
+	t.Run("Pass through the rest of a page exceeding MaxPageSize", func(t *testing.T) {
+		dtChan := make(chan esitag.DataTag, 3)
+		dtChan <- esitag.DataTag{Data: []byte(`One`), Start: 13, End: 34}
+		dtChan <- esitag.DataTag{Data: []byte(`Two`), Start: 35, End: 56}
+		dtChan <- esitag.DataTag{Data: []byte(`Three`), Start: 56, End: 77}
+		close(dtChan)
+
+		rec := httptest.NewRecorder()
+		rwi := responseWrapInjector(&PathConfig{MaxPageSize: 30}, dtChan, "", rec)
+		for _, part := range []string{
+			`<HtMl><bOdY> <esi:include`,
+			` src=""/>|<esi:include src=""/>`, // exceeds but finishes the tag
+			`<esi:include src=""/></html>`,
+		} {
+			n, err := rwi.Write([]byte(part))
+			assert.NoError(t, err)
+			assert.Exactly(t, len(part), n)
+		}
+		assert.NoError(t, rwi.Close())
+		assert.Exactly(t, `<HtMl><bOdY> One|Two<esi:include src=""/></html>`, rec.Body.String())
+	})
+
 	t.Run("Run injector on large file with multiple different sized writes", func(t *testing.T) {
 		// Changing the page09.html content, you have also to adjust the DataTag ...
 
@@ -180,7 +243,7 @@ func TestResponseWrapInjector(t *testing.T) {
 		}
 
 		rec := httptest.NewRecorder()
-		rwi := responseWrapInjector(dtChan, rec)
+		rwi := responseWrapInjector(nil, dtChan, "", rec)
 
 		written := 0
 		for _, parts := range bytes.SplitAfter(html, []byte(`</div>`)) {
@@ -198,3 +261,25 @@ func TestResponseWrapInjector(t *testing.T) {
 		assert.Exactly(t, written+len(backendData)-(tg.End-tg.Start), rec.Body.Len())
 	})
 }
+
+func TestResponseWrapInjector_NotAllowed(t *testing.T) {
+	t.Parallel()
+
+	dtChan := make(chan esitag.DataTag)
+	go func() {
+		dtChan <- esitag.DataTag{Data: []byte(`Hello XML`), Start: 12, End: 16}
+		close(dtChan)
+	}()
+
+	rec := httptest.NewRecorder()
+	rwi := responseWrapInjector(&PathConfig{ContentTypes: []string{"text/html"}}, dtChan, "", rec)
+	rwi.Header().Set("Content-Type", "application/json")
+	rwi.Header().Set("Content-Length", "40")
+	html := []byte(`<HtMl><bOdY>blah blah blah</body></html>`)
+	_, err := rwi.Write(html)
+	assert.NoError(t, err)
+	assert.NoError(t, rwi.Close())
+
+	assert.Exactly(t, "40", rec.Header().Get("Content-Length"))
+	assert.Exactly(t, string(html), rec.Body.String())
+}
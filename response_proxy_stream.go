@@ -0,0 +1,630 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package caddyesi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/corestoreio/caddy-esi/bufpool"
+	"github.com/corestoreio/caddy-esi/esitag"
+	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log"
+)
+
+// streamTag position of a tag in the page and how the streaming writers handle
+// it.
+type streamTag struct {
+	start, end int
+	// deferred tags get a placeholder and their content gets appended at the
+	// end of the page.
+	deferred bool
+	// onError gets written for a deferred tag whose data has not arrived
+	// within its timeout.
+	onError []byte
+	timeout time.Duration
+}
+
+// streamPositions returns the sorted positions of the tags in the page. The
+// streaming writers wait for the data of a tag once they reach its position.
+// A deferred tag with onerror="ajax" gets the AJAX placeholder for r as
+// onerror content because it has timed out.
+func streamPositions(entities esitag.Entities, r *http.Request) []streamTag {
+	pos := make([]streamTag, 0, len(entities))
+	for _, e := range entities {
+		onError := e.OnError
+		if e.Deferred && e.OnErrorAjax && e.AjaxPlaceholder != nil {
+			onError = e.AjaxPlaceholder(r)
+		}
+		pos = append(pos, streamTag{
+			start:    e.DataTag.Start,
+			end:      e.DataTag.End,
+			deferred: e.Deferred,
+			onError:  onError,
+			timeout:  e.Timeout,
+		})
+	}
+	sort.Slice(pos, func(i, j int) bool { return pos[i].start < pos[j].start })
+	return pos
+}
+
+const (
+	// deferredPlaceholder gets written instead of a deferred tag. %d is the
+	// index of the tag in the page.
+	deferredPlaceholder = `<esi-deferred id="esi-deferred-%d"></esi-deferred>`
+	// deferredScript swaps the placeholder of a deferred tag with its content.
+	// %d is the index of the tag and %s the content escaped as a JavaScript
+	// string, so that the content cannot end the script element. The scripts
+	// of a contextual fragment get executed.
+	deferredScript = `<script>(function(){var p=document.getElementById("esi-deferred-%d");if(p){p.parentNode.replaceChild(document.createRange().createContextualFragment("%s"),p)}})();</script>`
+)
+
+// deferredTailStart starts the end of the page which gets held back until the
+// content of the deferred tags has been written.
+var deferredTailStart = []byte(`</body`)
+
+// tailIndex returns the index of the closing body tag in p. The closing body
+// tag can be split across two writes, so the index of a trailing part of p
+// which starts like the closing body tag gets returned, too. Holding back the
+// page from there only moves the content of the deferred tags a bit further to
+// the top. Returns -1 if not found.
+func tailIndex(p []byte) int {
+	lp := bytes.ToLower(p)
+	if i := bytes.Index(lp, deferredTailStart); i >= 0 {
+		return i
+	}
+	for n := len(deferredTailStart) - 1; n > 0; n-- {
+		if len(lp) >= n && bytes.Equal(lp[len(lp)-n:], deferredTailStart[:n]) {
+			return len(lp) - n
+		}
+	}
+	return -1
+}
+
+// streamInjector injects the data of the tags while the page gets written. It
+// writes the page up to the next tag, flushes the output and then blocks until
+// the data of that tag has been received. A tag whose data never arrives,
+// because the channel has been closed before, stays unmodified in the page,
+// like in the buffered mode. A deferred tag does not block: a placeholder gets
+// written and its content follows as a script chunk once it has arrived, at
+// the position of the next tag or before the closing body tag. The headers of
+// the tags get dropped because the header has already been sent.
+// streamInjector cannot be used in parallel.
+type streamInjector struct {
+	w         io.Writer
+	positions []streamTag
+	// states contains for each position: 0 not yet reached, 1 replaced by the
+	// data, 2 left unmodified.
+	states   []uint8
+	next     int
+	chanTag  <-chan esitag.DataTag
+	received map[int]esitag.DataTag // key is the start position
+	closed   bool
+	// streamPos position of the next byte in the page.
+	streamPos int
+	// wrote a flush before the first write would send the header too early.
+	wrote bool
+	// pending contains the indexes of the deferred tags whose placeholder has
+	// been written but not yet their content.
+	pending []int
+	// deadline until the content of the deferred tags gets awaited, afterwards
+	// their onerror content gets sent.
+	deadline time.Time
+	// tail contains the end of the page, starting with the closing body tag,
+	// which gets written after the content of the pending deferred tags.
+	tail []byte
+	// log can be nil.
+	log log.Logger
+}
+
+func newStreamInjector(positions []streamTag, cTag <-chan esitag.DataTag, w io.Writer) *streamInjector {
+	var maxTimeout time.Duration
+	for _, st := range positions {
+		if st.deferred && st.timeout > maxTimeout {
+			maxTimeout = st.timeout
+		}
+	}
+	return &streamInjector{
+		w:         w,
+		positions: positions,
+		states:    make([]uint8, len(positions)),
+		chanTag:   cTag,
+		received:  make(map[int]esitag.DataTag, len(positions)),
+		deadline:  time.Now().Add(maxTimeout),
+	}
+}
+
+// receive stores a tag from the channel. If block is false, it returns
+// immediately when no tag is available. Returns false if no tag has been
+// received.
+func (si *streamInjector) receive(block bool) bool {
+	if si.closed {
+		return false
+	}
+	var dt esitag.DataTag
+	var ok bool
+	if block {
+		dt, ok = <-si.chanTag
+	} else {
+		select {
+		case dt, ok = <-si.chanTag:
+		default:
+			return false
+		}
+	}
+	if !ok {
+		si.closed = true
+		return false
+	}
+	si.store(dt)
+	return true
+}
+
+// store remembers the received tag and logs its dropped headers.
+func (si *streamInjector) store(dt esitag.DataTag) {
+	si.received[dt.Start] = dt
+	if len(dt.Header) == 0 || si.log == nil || !si.log.IsDebug() {
+		return
+	}
+	names := make([]string, 0, len(dt.Header))
+	for hn := range dt.Header {
+		names = append(names, hn)
+	}
+	sort.Strings(names)
+	si.log.Debug("caddyesi.streamInjector.DroppedHeader",
+		log.Int("tag_start", dt.Start), log.String("header_names", strings.Join(names, ",")))
+}
+
+// wait returns the data tag starting at the position. Returns false if the
+// channel has been closed without delivering that tag.
+func (si *streamInjector) wait(start int) (esitag.DataTag, bool) {
+	for {
+		if dt, ok := si.received[start]; ok {
+			return dt, true
+		}
+		if !si.receive(true) && si.closed {
+			return esitag.DataTag{}, false
+		}
+	}
+}
+
+func (si *streamInjector) flush() {
+	if fl, ok := si.w.(http.Flusher); ok && si.wrote {
+		fl.Flush()
+	}
+}
+
+func (si *streamInjector) write(p []byte) error {
+	_, err := si.w.Write(p)
+	si.wrote = true
+	return err
+}
+
+// writeDeferred writes the content of the deferred tags which have arrived and
+// flushes them to the client. With onError true, the onerror content gets
+// written for all others.
+func (si *streamInjector) writeDeferred(onError bool) error {
+	for si.receive(false) {
+	}
+	pending := si.pending[:0]
+	written := false
+	for _, idx := range si.pending {
+		st := si.positions[idx]
+		data := st.onError
+		if dt, ok := si.received[st.start]; ok {
+			data = dt.Data
+		} else if !onError {
+			pending = append(pending, idx)
+			continue
+		}
+		if err := si.write([]byte(fmt.Sprintf(deferredScript, idx, template.JSEscapeString(string(data))))); err != nil {
+			return errors.WriteFailed.New(err, "[caddyesi] streamInjector failed to write the deferred tag at position %d", st.start)
+		}
+		written = true
+	}
+	si.pending = pending
+	if written {
+		si.flush()
+	}
+	return nil
+}
+
+// Write writes p and injects the data of the tags starting in p. A tag can
+// span several calls.
+func (si *streamInjector) Write(p []byte) (int, error) {
+	const (
+		stateWaiting uint8 = iota
+		stateReplaced
+		stateUnmodified
+	)
+	const writeErr = "[caddyesi] streamInjector failed to write the tag at position %d"
+
+	if si.tail != nil {
+		si.tail = append(si.tail, p...)
+		si.streamPos += len(p)
+		return len(p), nil
+	}
+
+	pos := 0 // relative position in p up to which data has been handled
+	for ; si.next < len(si.positions); si.next++ {
+		st := si.positions[si.next]
+		relStart := st.start - si.streamPos
+		relEnd := st.end - si.streamPos
+		if relStart >= len(p) {
+			break // this and all following tags start in a later chunk
+		}
+
+		if si.states[si.next] == stateWaiting {
+			if relStart > pos {
+				if err := si.write(p[pos:relStart]); err != nil {
+					return 0, errors.WriteFailed.New(err, writeErr, st.start)
+				}
+				pos = relStart
+			}
+			// The position of a tag is a safe place for the script chunks
+			// of the already arrived deferred tags.
+			if err := si.writeDeferred(false); err != nil {
+				return 0, errors.Wrap(err, "[caddyesi] streamInjector.Write")
+			}
+
+			switch {
+			case st.deferred:
+				if _, err := fmt.Fprintf(si.w, deferredPlaceholder, si.next); err != nil {
+					return 0, errors.WriteFailed.New(err, writeErr, st.start)
+				}
+				si.pending = append(si.pending, si.next)
+				si.states[si.next] = stateReplaced
+			default:
+				// the client receives the page up to here while we are
+				// waiting.
+				si.flush()
+				si.states[si.next] = stateUnmodified
+				if data, ok := si.wait(st.start); ok {
+					if err := si.write(data.Data); err != nil {
+						return 0, errors.WriteFailed.New(err, writeErr, st.start)
+					}
+					si.states[si.next] = stateReplaced
+				}
+			}
+		}
+
+		if si.states[si.next] == stateReplaced {
+			if relEnd > len(p) {
+				pos = len(p) // the tag continues in the next chunk
+				break
+			}
+			if relEnd > pos {
+				pos = relEnd
+			}
+		}
+	}
+
+	rest := p[pos:]
+	if len(si.pending) > 0 && si.next >= len(si.positions) {
+		// All tags have been reached, so the closing body tag is the last
+		// safe place for the content of the deferred tags.
+		if i := tailIndex(rest); i >= 0 {
+			si.tail = append([]byte(nil), rest[i:]...)
+			rest = rest[:i]
+		}
+	}
+	if len(rest) > 0 {
+		if err := si.write(rest); err != nil {
+			return 0, errors.WriteFailed.New(err, "[caddyesi] streamInjector failed to write the remaining data")
+		}
+	}
+	si.streamPos += len(p)
+	// See injectingWriter.Write for the reason of returning len(p).
+	return len(p), nil
+}
+
+// finish gets called after the whole page has been written. It writes the
+// content of the pending deferred tags as they arrive, each one gets flushed
+// to the client. At the deadline, or when the channel has been closed, the
+// remaining ones get their onerror content. Then the held back end of the page
+// gets written and the channel gets drained. Without a closing body tag the
+// content of the deferred tags gets appended to the page.
+func (si *streamInjector) finish() error {
+	defer si.drain()
+
+	timer := time.NewTimer(si.deadline.Sub(time.Now()))
+	defer timer.Stop()
+	for len(si.pending) > 0 {
+		if err := si.writeDeferred(si.closed); err != nil {
+			return errors.Wrap(err, "[caddyesi] streamInjector.finish")
+		}
+		if len(si.pending) == 0 {
+			break
+		}
+		select {
+		case dt, ok := <-si.chanTag:
+			if !ok {
+				si.closed = true
+				continue
+			}
+			si.store(dt)
+		case <-timer.C:
+			if err := si.writeDeferred(true); err != nil {
+				return errors.Wrap(err, "[caddyesi] streamInjector.finish")
+			}
+		}
+	}
+	if len(si.tail) > 0 {
+		if err := si.write(si.tail); err != nil {
+			return errors.WriteFailed.New(err, "[caddyesi] streamInjector failed to write the end of the page")
+		}
+		si.tail = si.tail[:0]
+	}
+	return nil
+}
+
+// drain reads the remaining tags in the background, so that the goroutines
+// querying the resources can finish.
+func (si *streamInjector) drain() {
+	if si.closed {
+		return
+	}
+	si.closed = true
+	go func(c <-chan esitag.DataTag) {
+		for range c {
+		}
+	}(si.chanTag)
+}
+
+// responseWrapStreamer wraps w and streams the page while the data of the tags
+// arrives. A page compressed by the next handler gets buffered, decoded and
+// streamed in Close, encoded with the coding of acceptEncoding, the header of
+// the client. A response not allowed by pc gets written unmodified. pc can be
+// nil.
+func responseWrapStreamer(pc *PathConfig, positions []streamTag, cTag <-chan esitag.DataTag, acceptEncoding string, w http.ResponseWriter) streamResponseWriter {
+	_, cn := w.(http.CloseNotifier)
+	_, fl := w.(http.Flusher)
+	_, hj := w.(http.Hijacker)
+	_, rf := w.(io.ReaderFrom)
+
+	sw := streamingWriter{
+		pc:             pc,
+		rw:             w,
+		header:         make(http.Header),
+		acceptEncoding: acceptEncoding,
+	}
+	sw.si = newStreamInjector(positions, cTag, w)
+	if pc != nil {
+		sw.si.log = pc.Log
+	}
+
+	if cn && fl && hj && rf {
+		return &streamingFancyWriter{sw}
+	}
+	if fl {
+		return &streamingFlushWriter{sw}
+	}
+	return &sw
+}
+
+type streamResponseWriter interface {
+	http.ResponseWriter
+	// Close sends the header, if not yet done, and the content of the
+	// deferred tags. Must be called after the next handler has returned.
+	Close() error
+}
+
+// streamingWriter wraps a http.ResponseWriter and sends the page with chunked
+// encoding while the data of the tags arrives. The headers returned by the
+// resources cannot be merged because the header has already been sent.
+type streamingWriter struct {
+	pc              *PathConfig
+	rw              http.ResponseWriter
+	si              *streamInjector
+	header          http.Header
+	code            int
+	wroteHeader     bool
+	responseAllowed uint8 // 0 not yet tested, 1 yes, 2 no
+	acceptEncoding  string
+	// coding of the page written by the next handler. If not empty the page
+	// gets buffered in its encoded form until Close.
+	coding  string
+	encoded *bytes.Buffer
+}
+
+func (b *streamingWriter) Header() http.Header {
+	return b.header
+}
+
+// WriteHeader gets delayed until the first Write, which detects the content
+// type.
+func (b *streamingWriter) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *streamingWriter) writeHeader() {
+	if b.wroteHeader {
+		return
+	}
+	b.wroteHeader = true
+	if b.responseAllowed == 1 {
+		// the length of the page changes and is not known ahead.
+		b.header.Del("Content-Length")
+	}
+	for k, v := range b.header {
+		b.rw.Header()[k] = v
+	}
+	if b.code == 0 {
+		b.code = http.StatusOK
+	}
+	b.rw.WriteHeader(b.code)
+}
+
+// Write flushes the page up to the next tag and then waits for its data.
+func (b *streamingWriter) Write(p []byte) (int, error) {
+	const (
+		notTested uint8 = iota
+		yes
+		no
+	)
+	if b.responseAllowed == notTested && !b.pc.isHeaderAllowed(b.code, b.header) {
+		b.responseAllowed = no
+	}
+	if b.responseAllowed == notTested && b.encoded == nil {
+		if coding, ok := responseCoding(b.header); ok && coding != "" {
+			// The compressed page cannot be scanned, so it gets decoded in
+			// Close.
+			b.coding = coding
+			b.encoded = bufpool.Get()
+		}
+	}
+	if b.encoded != nil {
+		if !b.pc.isPageTooLarge(b.encoded.Len() + len(p)) {
+			return b.encoded.Write(p)
+		}
+		if err := b.passThrough(); err != nil {
+			return 0, err
+		}
+	}
+	if b.responseAllowed == notTested {
+		b.responseAllowed = yes
+		if !b.pc.isContentAllowed(p) {
+			b.responseAllowed = no
+		}
+	}
+	b.writeHeader()
+	if b.responseAllowed == no {
+		return b.rw.Write(p)
+	}
+	return b.si.Write(p)
+}
+
+func (b *streamingWriter) Close() error {
+	if b.encoded != nil {
+		return errors.Wrap(b.closeEncoded(), "[caddyesi] streamingWriter.Close")
+	}
+	if b.code != 0 {
+		b.writeHeader()
+	}
+	if b.responseAllowed == 1 {
+		return errors.Wrap(b.si.finish(), "[caddyesi] streamingWriter.Close")
+	}
+	b.si.drain()
+	return nil
+}
+
+// passThrough writes the buffered compressed page unmodified because it
+// exceeds the maximum page size. All further writes go directly to the
+// client.
+func (b *streamingWriter) passThrough() error {
+	b.responseAllowed = 2
+	b.writeHeader()
+	_, err := b.rw.Write(b.encoded.Bytes())
+	bufpool.Put(b.encoded)
+	b.encoded = nil
+	b.si.drain()
+	return err
+}
+
+// closeEncoded decodes the buffered compressed page and streams it encoded
+// with the coding accepted by the client. A page which cannot be decoded or
+// is not text gets written unmodified.
+func (b *streamingWriter) closeEncoded() error {
+	defer bufpool.Put(b.encoded)
+
+	page := bufpool.Get()
+	defer bufpool.Put(page)
+	err := decodeBody(b.coding, b.encoded.Bytes(), page, b.pc.decodeLimit())
+	tooLarge := errors.TooLarge.Match(err)
+	if tooLarge {
+		err = nil // passes through like a too large plain page
+	}
+	if err != nil || tooLarge || b.pc.isPageTooLarge(page.Len()) || !b.pc.isContentAllowed(page.Bytes()) {
+		b.responseAllowed = 2
+		b.writeHeader()
+		if _, wErr := b.rw.Write(b.encoded.Bytes()); wErr != nil && err == nil {
+			err = wErr
+		}
+		b.si.drain()
+		return err
+	}
+
+	b.responseAllowed = 1
+	coding := acceptedCoding(b.acceptEncoding)
+	setEncodingHeader(b.header, coding)
+	ew := newEncodingWriter(coding, b.rw)
+	b.si.w = ew
+	b.writeHeader()
+	if _, err := b.si.Write(page.Bytes()); err != nil {
+		b.si.drain()
+		return err
+	}
+	if err := b.si.finish(); err != nil {
+		return err
+	}
+	if err := ew.Close(); err != nil {
+		return errors.WriteFailed.New(err, "[caddyesi] Failed to encode the page with %q", coding)
+	}
+	return nil
+}
+
+// flush flushes only after the header has been sent, otherwise the header
+// would be sent without the content type detection of the first Write.
+func (b *streamingWriter) flush() {
+	if b.wroteHeader {
+		b.rw.(http.Flusher).Flush()
+	}
+}
+
+type streamingFancyWriter struct {
+	streamingWriter
+}
+
+func (f *streamingFancyWriter) CloseNotify() <-chan bool {
+	cn := f.streamingWriter.rw.(http.CloseNotifier)
+	return cn.CloseNotify()
+}
+func (f *streamingFancyWriter) Flush() {
+	f.streamingWriter.flush()
+}
+func (f *streamingFancyWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj := f.streamingWriter.rw.(http.Hijacker)
+	return hj.Hijack()
+}
+func (f *streamingFancyWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := f.streamingWriter.rw.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return nil
+}
+
+// ReadFrom writes r into the underlying buffer
+func (f *streamingFancyWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(&f.streamingWriter, r)
+}
+
+// streamingFlushWriter implements only http.Flusher mostly used
+type streamingFlushWriter struct {
+	streamingWriter
+}
+
+func (f *streamingFlushWriter) Flush() {
+	f.streamingWriter.flush()
+}
@@ -0,0 +1,251 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package caddyesi
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/corestoreio/caddy-esi/esitag"
+	"github.com/corestoreio/log/logw"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Check if types have the interfaces implemented.
+var _ http.CloseNotifier = (*streamingFancyWriter)(nil)
+var _ http.Flusher = (*streamingFancyWriter)(nil)
+var _ http.Hijacker = (*streamingFancyWriter)(nil)
+var _ http.Pusher = (*streamingFancyWriter)(nil)
+var _ io.ReaderFrom = (*streamingFancyWriter)(nil)
+var _ http.Flusher = (*streamingFlushWriter)(nil)
+
+// flushRecorder reports the body at each Flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan string
+}
+
+func (fr *flushRecorder) Flush() {
+	fr.ResponseRecorder.Flush()
+	fr.flushed <- fr.Body.String()
+}
+
+func TestResponseWrapStreamer(t *testing.T) {
+	t.Parallel()
+
+	html := []byte(`<HtMl><bOdY>blah blah blah</body></html>`)
+	positions := []streamTag{{start: 12, end: 16}, {start: 22, end: 26}}
+
+	t.Run("Flushes the page before waiting for a tag", func(t *testing.T) {
+		dtChan := make(chan esitag.DataTag)
+		rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan string, 10)}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			assert.Exactly(t, `<HtMl><bOdY>`, <-rec.flushed)
+			// the second tag arrives first but gets written later
+			dtChan <- esitag.DataTag{Data: []byte(`World`), Start: 22, End: 26}
+			dtChan <- esitag.DataTag{Data: []byte(`Hello`), Start: 12, End: 16}
+			assert.Exactly(t, `<HtMl><bOdY>Hello blah `, <-rec.flushed)
+			close(dtChan)
+		}()
+
+		sw := responseWrapStreamer(nil, positions, dtChan, "", rec)
+		_, ok := sw.(*streamingFlushWriter)
+		assert.True(t, ok, "Expecting a streamingFlushWriter type")
+		sw.Header().Set("Content-Length", "40")
+		sw.WriteHeader(http.StatusAccepted)
+		n, err := sw.Write(html)
+		require.NoError(t, err)
+		assert.Exactly(t, len(html), n)
+		require.NoError(t, sw.Close())
+		<-done
+
+		assert.Exactly(t, `<HtMl><bOdY>Hello blah World</body></html>`, rec.Body.String())
+		assert.Exactly(t, http.StatusAccepted, rec.Code)
+		assert.Empty(t, rec.Header().Get("Content-Length"), "Content-Length must be removed")
+	})
+
+	t.Run("Tags spanning multiple writes", func(t *testing.T) {
+		dtChan := make(chan esitag.DataTag, 2)
+		dtChan <- esitag.DataTag{Data: []byte(`Hello`), Start: 12, End: 16}
+		dtChan <- esitag.DataTag{Data: []byte(`World`), Start: 22, End: 26}
+		close(dtChan)
+
+		rec := httptest.NewRecorder()
+		sw := responseWrapStreamer(nil, positions, dtChan, "", rec)
+		for _, p := range [][]byte{html[:14], html[14:24], html[24:]} {
+			_, err := sw.Write(p)
+			require.NoError(t, err)
+		}
+		require.NoError(t, sw.Close())
+		assert.Exactly(t, `<HtMl><bOdY>Hello blah World</body></html>`, rec.Body.String())
+	})
+
+	t.Run("Missing tag stays unmodified", func(t *testing.T) {
+		dtChan := make(chan esitag.DataTag, 1)
+		dtChan <- esitag.DataTag{Data: []byte(`World`), Start: 22, End: 26}
+		close(dtChan)
+
+		rec := httptest.NewRecorder()
+		sw := responseWrapStreamer(nil, positions, dtChan, "", rec)
+		_, err := sw.Write(html)
+		require.NoError(t, err)
+		require.NoError(t, sw.Close())
+		assert.Exactly(t, `<HtMl><bOdY>blah blah World</body></html>`, rec.Body.String())
+	})
+
+	t.Run("Headers of tags get dropped and logged", func(t *testing.T) {
+		dtChan := make(chan esitag.DataTag, 1)
+		dtChan <- esitag.DataTag{Data: []byte(`Hello`), Start: 12, End: 16, Header: http.Header{"Set-Cookie": []string{"a=b"}}}
+		close(dtChan)
+
+		buf := new(bytes.Buffer)
+		pc := NewPathConfig()
+		pc.Log = logw.NewLog(logw.WithLevel(logw.LevelDebug), logw.WithWriter(buf))
+		rec := httptest.NewRecorder()
+		sw := responseWrapStreamer(pc, positions, dtChan, "", rec)
+		_, err := sw.Write(html)
+		require.NoError(t, err)
+		require.NoError(t, sw.Close())
+		assert.Exactly(t, `<HtMl><bOdY>Hello blah blah</body></html>`, rec.Body.String())
+		assert.Empty(t, rec.Header().Get("Set-Cookie"))
+		assert.Contains(t, buf.String(), `caddyesi.streamInjector.DroppedHeader`)
+		assert.Contains(t, buf.String(), `Set-Cookie`)
+	})
+
+	t.Run("Binary data passes with Content-Length", func(t *testing.T) {
+		dtChan := make(chan esitag.DataTag)
+		rec := httptest.NewRecorder()
+		sw := responseWrapStreamer(nil, positions, dtChan, "", rec)
+		sw.Header().Set("Content-Length", "8")
+		png := []byte("\x89\x50\x4E\x47\x0D\x0A\x1A\x0A")
+		_, err := sw.Write(png)
+		require.NoError(t, err)
+		require.NoError(t, sw.Close())
+		close(dtChan) // drain must not block
+		assert.Exactly(t, png, rec.Body.Bytes())
+		assert.Exactly(t, "8", rec.Header().Get("Content-Length"))
+	})
+
+	t.Run("Deferred tag gets appended", func(t *testing.T) {
+		dtChan := make(chan esitag.DataTag)
+		rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan string, 10)}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			// the first tag does not block the second one
+			assert.Exactly(t, `<HtMl><bOdY><esi-deferred id="esi-deferred-0"></esi-deferred> blah `, <-rec.flushed)
+			dtChan <- esitag.DataTag{Data: []byte(`World`), Start: 22, End: 26}
+			dtChan <- esitag.DataTag{Data: []byte(`Hello`), Start: 12, End: 16}
+			// the script chunk gets flushed before the end of the page.
+			assert.True(t, strings.HasSuffix(<-rec.flushed, `</script>`))
+			close(dtChan)
+		}()
+
+		deferred := []streamTag{{start: 12, end: 16, deferred: true, timeout: time.Second}, {start: 22, end: 26}}
+		sw := responseWrapStreamer(nil, deferred, dtChan, "", rec)
+		_, err := sw.Write(html)
+		require.NoError(t, err)
+		require.NoError(t, sw.Close())
+		<-done
+
+		assert.Exactly(t, `<HtMl><bOdY><esi-deferred id="esi-deferred-0"></esi-deferred> blah World<script>(function(){var p=document.getElementById("esi-deferred-0");if(p){p.parentNode.replaceChild(document.createRange().createContextualFragment("Hello"),p)}})();</script></body></html>`,
+			rec.Body.String())
+	})
+
+	t.Run("Deferred tag gets onerror content at the deadline", func(t *testing.T) {
+		dtChan := make(chan esitag.DataTag)
+		defer close(dtChan)
+
+		deferred := []streamTag{{start: 12, end: 16, deferred: true, onError: []byte(`Sorry`), timeout: 20 * time.Millisecond}}
+		rec := httptest.NewRecorder()
+		sw := responseWrapStreamer(nil, deferred, dtChan, "", rec)
+		_, err := sw.Write(html)
+		require.NoError(t, err)
+		require.NoError(t, sw.Close())
+		assert.True(t, strings.HasSuffix(rec.Body.String(), `.createContextualFragment("Sorry"),p)}})();</script></body></html>`), rec.Body.String())
+	})
+
+	t.Run("Deferred content cannot end the script", func(t *testing.T) {
+		dtChan := make(chan esitag.DataTag, 1)
+		dtChan <- esitag.DataTag{Data: []byte(`</script></template><b>Hi</b>`), Start: 12, End: 16}
+		close(dtChan)
+
+		deferred := []streamTag{{start: 12, end: 16, deferred: true, timeout: time.Second}}
+		rec := httptest.NewRecorder()
+		sw := responseWrapStreamer(nil, deferred, dtChan, "", rec)
+		// the end of the page arrives in a second write and waits for the
+		// deferred content.
+		_, err := sw.Write(html[:30])
+		require.NoError(t, err)
+		_, err = sw.Write(html[30:])
+		require.NoError(t, err)
+		require.NoError(t, sw.Close())
+		body := rec.Body.String()
+		assert.Contains(t, body, `.createContextualFragment("\u003C/script\u003E\u003C/template\u003E\u003Cb\u003EHi\u003C/b\u003E"),p)}})();</script></body></html>`)
+		assert.Exactly(t, 1, strings.Count(body, `</script>`), body)
+	})
+
+	t.Run("Get streaming Fancy Writer", func(t *testing.T) {
+		sw := responseWrapStreamer(nil, nil, nil, "", newResponseMock())
+		_, ok := sw.(*streamingFancyWriter)
+		assert.True(t, ok, "Expecting a streamingFancyWriter type")
+	})
+}
+
+func TestStreamPositions(t *testing.T) {
+	t.Parallel()
+
+	entities, err := esitag.Parse(strings.NewReader(`<p><esi:include src="https://micro.service/b" onerror="ajax" deferred="true"/></p><esi:include src="https://micro.service/a" onerror="ajax"/>`))
+	require.NoError(t, err)
+	for _, e := range entities {
+		e.OnError = []byte(`Sorry`)
+		e.AjaxPlaceholder = func(r *http.Request) []byte { return []byte(`<esi-ajax>` + r.URL.Path + `</esi-ajax>`) }
+	}
+
+	positions := streamPositions(entities, httptest.NewRequest("GET", "/page.html", nil))
+	require.Len(t, positions, 2)
+	assert.True(t, positions[0].start < positions[1].start)
+	assert.Exactly(t, `<esi-ajax>/page.html</esi-ajax>`, string(positions[0].onError), "deferred tag times out")
+	assert.Exactly(t, `Sorry`, string(positions[1].onError))
+}
+
+func TestTailIndex(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		have string
+		want int
+	}{
+		{`blah</BODY></html>`, 4},
+		{`blah</bo`, 4},
+		{`blah<`, 4},
+		{`blah</b>blah`, -1},
+		{`blah`, -1},
+		{``, -1},
+	}
+	for _, test := range tests {
+		assert.Exactly(t, test.want, tailIndex([]byte(test.have)), "%q", test.have)
+	}
+}
@@ -16,11 +16,18 @@ package caddyesi
 
 import (
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/corestoreio/caddy-esi/esibus"
 	"github.com/corestoreio/caddy-esi/esicache"
 	"github.com/corestoreio/caddy-esi/esitag"
 	_ "github.com/corestoreio/caddy-esi/esitag/backend" // Let them register depending on the build tag
@@ -50,6 +57,9 @@ func PluginSetup(c *caddy.Controller) error {
 	}
 
 	cfg := httpserver.GetConfig(c)
+	for _, pc := range pcs {
+		pc.siteAddress = siteAddress(cfg)
+	}
 
 	mw := &Middleware{
 		Root:        cfg.Root,
@@ -62,20 +72,60 @@ func PluginSetup(c *caddy.Controller) error {
 		return mw
 	})
 
+	c.OnStartup(func() error {
+		mw.startWarmup()
+		return errors.Wrap(mw.startClusterBus(), "[caddyesi] OnStartup")
+	})
 	c.OnShutdown(func() error {
+		mw.stopWarmup()
+		if err := mw.closeClusterBus(); err != nil {
+			return errors.Wrap(err, "[caddyesi] OnShutdown")
+		}
+		if err := esicache.MainRegistry.Clear(); err != nil {
+			return errors.Wrap(err, "[caddyesi] OnShutdown")
+		}
 		return errors.Wrap(esitag.CloseAllResourceHandler(), "[caddyesi] OnShutdown")
 	})
 	c.OnRestart(func() error {
+		mw.stopWarmup()
+		if err := mw.closeClusterBus(); err != nil {
+			return errors.Wrap(err, "[caddyesi] OnRestart")
+		}
 		// really necessary? investigate later
 		for _, pc := range pcs {
 			pc.purgeESICache()
 		}
+		// The setup registers the caches again, so drop the old ones.
+		if err := esicache.MainRegistry.Clear(); err != nil {
+			return errors.Wrap(err, "[caddyesi] OnRestart")
+		}
 		return errors.Wrap(esitag.CloseAllResourceHandler(), "[caddyesi] OnRestart")
 	})
 
 	return nil
 }
 
+// siteAddress returns the configured address of the site for the requests
+// which the middleware sends to its own site. A wildcard or missing host falls
+// back to localhost.
+func siteAddress(cfg *httpserver.SiteConfig) string {
+	scheme := cfg.Addr.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if cfg.Addr.Port == "443" {
+			scheme = "https"
+		}
+	}
+	host := cfg.Addr.Host
+	if host == "" || strings.Contains(host, "*") {
+		host = "localhost"
+	}
+	if cfg.Addr.Port != "" {
+		host = net.JoinHostPort(host, cfg.Addr.Port)
+	}
+	return scheme + "://" + host
+}
+
 func configEsiParse(c *caddy.Controller) (PathConfigs, error) {
 	pcs := make(PathConfigs, 0, 2)
 
@@ -112,6 +162,13 @@ func configEsiParse(c *caddy.Controller) (PathConfigs, error) {
 		if len(pc.OnError) == 0 {
 			pc.OnError = []byte(DefaultOnError)
 		}
+		if len(pc.ajaxSecret) == 0 {
+			s, err := newAjaxSecret()
+			if err != nil {
+				return nil, errors.Wrap(err, "[caddyesi] Failed to setup the ajax secret")
+			}
+			pc.ajaxSecret = s
+		}
 
 		pcs = append(pcs, pc)
 	}
@@ -207,6 +264,85 @@ func configLoadParams(c *caddy.Controller, pc *PathConfig) error {
 		}
 		pc.TTL = d
 
+	case "negative_ttl":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] negative_ttl: %s", c.ArgErr())
+		}
+		d, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return errors.NotValid.Newf("[caddyesi] Invalid duration in negative_ttl configuration: %q Error: %s", c.Val(), err)
+		}
+		pc.NegativeTTL = d
+
+	case "refresh_ahead":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] refresh_ahead: %s", c.ArgErr())
+		}
+		d, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return errors.NotValid.Newf("[caddyesi] Invalid duration in refresh_ahead configuration: %q Error: %s", c.Val(), err)
+		}
+		pc.RefreshAhead = d
+
+	case "warmup":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] warmup: %s", c.ArgErr())
+		}
+		if err := pc.parseWarmup(c.Val(), c.RemainingArgs()); err != nil {
+			return errors.Wrap(err, "[caddyesi] warmup")
+		}
+
+	case "max_depth":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] max_depth: %s", c.ArgErr())
+		}
+		d, err := strconv.Atoi(c.Val())
+		if err != nil || d < 0 {
+			return errors.NotValid.Newf("[caddyesi] Invalid max_depth configuration: %q Error: %v", c.Val(), err)
+		}
+		pc.MaxDepth = d
+
+	case "parse_mode":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] parse_mode: %s", c.ArgErr())
+		}
+		switch c.Val() {
+		case "strict":
+			pc.ParseLenient = false
+		case "lenient":
+			pc.ParseLenient = true
+		default:
+			return errors.NotValid.Newf("[caddyesi] Invalid parse_mode configuration: %q. Allowed values: strict or lenient", c.Val())
+		}
+
+	case "syntax":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] syntax: %s", c.ArgErr())
+		}
+		pc.Syntax = 0
+		for _, s := range helper.CommaListToSlice(c.Val()) {
+			switch s {
+			case "esi":
+				pc.Syntax |= esitag.SyntaxESI
+			case "element":
+				pc.Syntax |= esitag.SyntaxElement
+			case "ssi":
+				pc.Syntax |= esitag.SyntaxSSI
+			default:
+				return errors.NotValid.Newf("[caddyesi] Invalid syntax configuration: %q. Allowed values: esi, element or ssi", s)
+			}
+		}
+
+	case "ssi_upstream":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] ssi_upstream: %s", c.ArgErr())
+		}
+		u, err := url.Parse(c.Val())
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+			return errors.NotValid.Newf("[caddyesi] Invalid ssi_upstream configuration: %q. Must be a base URL like http://127.0.0.1:8080", c.Val())
+		}
+		pc.SSIUpstream = u.Scheme + "://" + u.Host
+
 	case "max_body_size":
 		if !c.NextArg() {
 			return errors.NotValid.Newf("[caddyesi] max_body_size: %s", c.ArgErr())
@@ -222,10 +358,52 @@ func configLoadParams(c *caddy.Controller, pc *PathConfig) error {
 			return errors.NotValid.Newf("[caddyesi] cache: %s", c.ArgErr())
 		}
 
-		if err := esicache.MainRegistry.Register(pc.Scope, c.Val()); err != nil {
-			return errors.Wrapf(err, "[caddyesi] esicache.MainRegistry.Register Key %q with URL: %q", key, c.Val())
+		url := c.Val()
+		var writeBehind bool
+		if c.NextArg() {
+			switch c.Val() {
+			case "sync":
+			case "async":
+				writeBehind = true
+			default:
+				return errors.NotValid.Newf("[caddyesi] Invalid cache write mode: %q. Allowed values: sync or async", c.Val())
+			}
+		}
+
+		if err := esicache.MainRegistry.Register(pc.Scope, url, writeBehind); err != nil {
+			return errors.Wrapf(err, "[caddyesi] esicache.MainRegistry.Register Key %q with URL: %q", key, url)
+		}
+
+	case "streaming":
+		pc.Streaming = true
+		if c.NextArg() {
+			b, err := strconv.ParseBool(c.Val())
+			if err != nil {
+				return errors.NotValid.Newf("[caddyesi] Invalid streaming configuration: %q Error: %s", c.Val(), err)
+			}
+			pc.Streaming = b
 		}
 
+	case "http_cache":
+		pc.HTTPCache = true
+		if c.NextArg() {
+			b, err := strconv.ParseBool(c.Val())
+			if err != nil {
+				return errors.NotValid.Newf("[caddyesi] Invalid http_cache configuration: %q Error: %s", c.Val(), err)
+			}
+			pc.HTTPCache = b
+		}
+
+	case "cluster_bus":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] cluster_bus: %s", c.ArgErr())
+		}
+		b, err := esibus.New(c.Val())
+		if err != nil {
+			return errors.Wrapf(err, "[caddyesi] cluster_bus with URL: %q", c.Val())
+		}
+		pc.clusterBus = b
+
 	case "page_id_source":
 		if !c.NextArg() {
 			return errors.NotValid.Newf("[caddyesi] page_id_source: %s", c.ArgErr())
@@ -237,6 +415,41 @@ func configLoadParams(c *caddy.Controller, pc *PathConfig) error {
 			return errors.NotValid.Newf("[caddyesi] allowed_methods: %s", c.ArgErr())
 		}
 		pc.AllowedMethods = helper.CommaListToSlice(strings.ToUpper(c.Val()))
+	case "except":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] except: %s", c.ArgErr())
+		}
+		pc.Except = helper.CommaListToSlice(c.Val())
+		for _, e := range pc.Except {
+			if _, err := path.Match(e, ""); err != nil {
+				return errors.NotValid.Newf("[caddyesi] Invalid pattern in except configuration: %q Error: %s", e, err)
+			}
+		}
+	case "content_types":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] content_types: %s", c.ArgErr())
+		}
+		pc.ContentTypes = helper.CommaListToSlice(strings.ToLower(c.Val()))
+	case "status_codes":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] status_codes: %s", c.ArgErr())
+		}
+		for _, sc := range helper.CommaListToSlice(c.Val()) {
+			code, err := strconv.Atoi(sc)
+			if err != nil || code < 100 || code > 999 {
+				return errors.NotValid.Newf("[caddyesi] Invalid status code in status_codes configuration: %q", sc)
+			}
+			pc.StatusCodes = append(pc.StatusCodes, code)
+		}
+	case "max_page_size":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] max_page_size: %s", c.ArgErr())
+		}
+		d, err := humanize.ParseBytes(c.Val())
+		if err != nil {
+			return errors.NotValid.Newf("[caddyesi] Invalid max page size value configuration: %q Error: %s", c.Val(), err)
+		}
+		pc.MaxPageSize = d
 	case "cmd_header_name":
 		if !c.NextArg() {
 			return errors.NotValid.Newf("[caddyesi] cmd_header_name: %s", c.ArgErr())
@@ -249,6 +462,37 @@ func configLoadParams(c *caddy.Controller, pc *PathConfig) error {
 		if err := pc.parseOnError(c.Val()); err != nil {
 			return errors.Wrap(err, "[caddyesi] PathConfig.parseOnError")
 		}
+	case "ajax_path":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] ajax_path: %s", c.ArgErr())
+		}
+		pc.AjaxPath = path.Clean("/" + c.Val())
+	case "ajax_ttl":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] ajax_ttl: %s", c.ArgErr())
+		}
+		d, err := time.ParseDuration(c.Val())
+		if err != nil || d < 1 {
+			return errors.NotValid.Newf("[caddyesi] Invalid duration in ajax_ttl configuration: %q Error: %v", c.Val(), err)
+		}
+		pc.AjaxTTL = d
+	case "ajax_secret":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] ajax_secret: %s", c.ArgErr())
+		}
+		pc.ajaxSecret = []byte(c.Val())
+	case "ajax_loader":
+		if !c.NextArg() {
+			return errors.NotValid.Newf("[caddyesi] ajax_loader: %s", c.ArgErr())
+		}
+		pc.AjaxLoader = c.Val()
+		if strings.HasSuffix(strings.ToLower(pc.AjaxLoader), ".js") {
+			js, err := ioutil.ReadFile(filepath.Clean(pc.AjaxLoader))
+			if err != nil {
+				return errors.Fatal.Newf("[caddyesi] Failed to read the ajax_loader file %q with error: %s", pc.AjaxLoader, err)
+			}
+			pc.AjaxLoader = strings.TrimSpace(string(js))
+		}
 	case "log_file":
 		if !c.NextArg() {
 			return errors.NotValid.Newf("[caddyesi] log_file: %s", c.ArgErr())
@@ -61,10 +61,33 @@ func testPluginSetup(config string, wantPC PathConfigs, cacheCount int, requestF
 			assert.Exactly(t, wantC.Scope, haveC.Scope, "Scope (Path) %s", t.Name())
 			assert.Exactly(t, wantC.Timeout, haveC.Timeout, "Timeout %s", t.Name())
 			assert.Exactly(t, wantC.TTL, haveC.TTL, "TTL %s", t.Name())
+			assert.Exactly(t, wantC.MaxDepth, haveC.MaxDepth, "MaxDepth %s", t.Name())
+			assert.Exactly(t, wantC.HTTPCache, haveC.HTTPCache, "HTTPCache %s", t.Name())
+			assert.Exactly(t, wantC.Streaming, haveC.Streaming, "Streaming %s", t.Name())
+			assert.Exactly(t, wantC.NegativeTTL, haveC.NegativeTTL, "NegativeTTL %s", t.Name())
+			assert.Exactly(t, wantC.RefreshAhead, haveC.RefreshAhead, "RefreshAhead %s", t.Name())
+			assert.Exactly(t, wantC.Warmup, haveC.Warmup, "Warmup %s", t.Name())
+			assert.Exactly(t, wantC.WarmupInterval, haveC.WarmupInterval, "WarmupInterval %s", t.Name())
+			assert.Exactly(t, wantC.WarmupURLs, haveC.WarmupURLs, "WarmupURLs %s", t.Name())
+			assert.Exactly(t, wantC.ParseLenient, haveC.ParseLenient, "ParseLenient %s", t.Name())
+			assert.Exactly(t, wantC.Syntax, haveC.Syntax, "Syntax %s", t.Name())
+			assert.Exactly(t, wantC.SSIUpstream, haveC.SSIUpstream, "SSIUpstream %s", t.Name())
 			assert.Exactly(t, wantC.PageIDSource, haveC.PageIDSource, "PageIDSource %s", t.Name())
 			assert.Exactly(t, wantC.AllowedMethods, haveC.AllowedMethods, "AllowedMethods %s", t.Name())
+			assert.Exactly(t, wantC.Except, haveC.Except, "Except %s", t.Name())
+			assert.Exactly(t, wantC.ContentTypes, haveC.ContentTypes, "ContentTypes %s", t.Name())
+			assert.Exactly(t, wantC.StatusCodes, haveC.StatusCodes, "StatusCodes %s", t.Name())
+			assert.Exactly(t, wantC.MaxPageSize, haveC.MaxPageSize, "MaxPageSize %s", t.Name())
 			assert.Exactly(t, wantC.LogFile, haveC.LogFile, "LogFile %s", t.Name())
 			assert.Exactly(t, wantC.LogLevel, haveC.LogLevel, "LogLevel %s", t.Name())
+			assert.Exactly(t, wantC.AjaxPath, haveC.AjaxPath, "AjaxPath %s", t.Name())
+			assert.Exactly(t, wantC.AjaxTTL, haveC.AjaxTTL, "AjaxTTL %s", t.Name())
+			assert.Exactly(t, wantC.AjaxLoader, haveC.AjaxLoader, "AjaxLoader %s", t.Name())
+			if len(wantC.ajaxSecret) > 0 {
+				assert.Exactly(t, wantC.ajaxSecret, haveC.ajaxSecret, "ajaxSecret %s", t.Name())
+			} else {
+				assert.Len(t, haveC.ajaxSecret, ajaxSecretLen, "ajaxSecret %s", t.Name())
+			}
 			if len(wantC.OnError) > 0 {
 				assert.Exactly(t, string(wantC.OnError), string(haveC.OnError), "OnError %s", t.Name())
 			}
@@ -98,6 +121,198 @@ func TestPluginSetup(t *testing.T) {
 		errors.NoKind,
 	))
 
+	t.Run("config with inmemory tiers", testPluginSetup(
+		`esi {
+			ttl 10ms
+			cache inmemory?max_size=1MB
+			cache inmemory sync
+			cache inmemory async
+		}`,
+		PathConfigs{
+			&PathConfig{
+				Scope:   "/",
+				Timeout: DefaultTimeOut,
+				TTL:     time.Millisecond * 10,
+			},
+		},
+		3,   // cache length
+		nil, // kv services []string
+		errors.NoKind,
+	))
+
+	t.Run("config with invalid cache write mode", testPluginSetup(
+		`esi {
+			cache inmemory later
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.NotValid,
+	))
+
+	t.Run("config with http_cache", testPluginSetup(
+		`esi {
+			http_cache
+		}`,
+		PathConfigs{
+			&PathConfig{
+				Scope:     "/",
+				Timeout:   DefaultTimeOut,
+				HTTPCache: true,
+			},
+		},
+		0,   // cache length
+		nil, // kv services []string
+		errors.NoKind,
+	))
+
+	t.Run("config with streaming", testPluginSetup(
+		`esi {
+			streaming
+		}`,
+		PathConfigs{
+			&PathConfig{
+				Scope:     "/",
+				Timeout:   DefaultTimeOut,
+				Streaming: true,
+			},
+		},
+		0,   // cache length
+		nil, // kv services []string
+		errors.NoKind,
+	))
+	t.Run("config with streaming invalid", testPluginSetup(
+		`esi {
+			streaming yes-please
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.NotValid,
+	))
+
+	t.Run("config with response filters", testPluginSetup(
+		`esi {
+			except /api,/static/*.html
+			content_types "text/html, application/XHTML+xml"
+			status_codes 200,404
+			max_page_size 2MB
+		}`,
+		PathConfigs{
+			&PathConfig{
+				Scope:        "/",
+				Timeout:      DefaultTimeOut,
+				Except:       []string{"/api", "/static/*.html"},
+				ContentTypes: []string{"text/html", "application/xhtml+xml"},
+				StatusCodes:  []int{200, 404},
+				MaxPageSize:  2000000,
+			},
+		},
+		0,   // cache length
+		nil, // kv services []string
+		errors.NoKind,
+	))
+	t.Run("config with invalid status_codes", testPluginSetup(
+		`esi {
+			status_codes 200,ok
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.NotValid,
+	))
+	t.Run("config with invalid except pattern", testPluginSetup(
+		`esi {
+			except /static/[a-
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.NotValid,
+	))
+
+	t.Run("config with ajax", testPluginSetup(
+		`esi {
+			ajax_path esi-ajax
+			ajax_ttl 30s
+			ajax_secret s3cr3t
+			ajax_loader "function(id,url){myLoader(id,url)}"
+		}`,
+		PathConfigs{
+			&PathConfig{
+				Scope:      "/",
+				Timeout:    DefaultTimeOut,
+				AjaxPath:   "/esi-ajax",
+				AjaxTTL:    30 * time.Second,
+				AjaxLoader: "function(id,url){myLoader(id,url)}",
+				ajaxSecret: []byte("s3cr3t"),
+			},
+		},
+		0,   // cache length
+		nil, // kv services []string
+		errors.NoKind,
+	))
+	t.Run("config with ajax_loader file not found", testPluginSetup(
+		`esi {
+			ajax_loader testdata/not_found.js
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.Fatal,
+	))
+	t.Run("config with invalid ajax_ttl", testPluginSetup(
+		`esi {
+			ajax_ttl 0s
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.NotValid,
+	))
+
+	t.Run("config with negative_ttl, refresh_ahead and warmup", testPluginSetup(
+		`esi {
+			negative_ttl 30s
+			refresh_ahead 5s
+			warmup 10m https://shop.local/ https://shop.local/cart.html
+		}`,
+		PathConfigs{
+			&PathConfig{
+				Scope:          "/",
+				Timeout:        DefaultTimeOut,
+				NegativeTTL:    30 * time.Second,
+				RefreshAhead:   5 * time.Second,
+				Warmup:         true,
+				WarmupInterval: 10 * time.Minute,
+				WarmupURLs:     []string{"https://shop.local/", "https://shop.local/cart.html"},
+			},
+		},
+		0,   // cache length
+		nil, // kv services []string
+		errors.NoKind,
+	))
+
+	t.Run("config with invalid warmup", testPluginSetup(
+		`esi {
+			warmup often
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.NotValid,
+	))
+
+	t.Run("config with invalid http_cache", testPluginSetup(
+		`esi {
+			http_cache maybe
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.NotValid,
+	))
+
 	t.Run("config with allowed_methods", testPluginSetup(
 		`esi {
 			allowed_methods "GET,pUT , POsT"
@@ -114,6 +329,107 @@ func TestPluginSetup(t *testing.T) {
 		errors.NoKind,
 	))
 
+	t.Run("config with max_depth", testPluginSetup(
+		`esi {
+			max_depth 3
+		}`,
+		PathConfigs{
+			&PathConfig{
+				Scope:    "/",
+				Timeout:  DefaultTimeOut,
+				MaxDepth: 3,
+			},
+		},
+		0,   // cache length
+		nil, // kv services []string
+		errors.NoKind,
+	))
+	t.Run("config with invalid max_depth", testPluginSetup(
+		`esi {
+			max_depth -1
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.NotValid,
+	))
+
+	t.Run("config with parse_mode lenient", testPluginSetup(
+		`esi {
+			parse_mode lenient
+		}`,
+		PathConfigs{
+			&PathConfig{
+				Scope:        "/",
+				Timeout:      DefaultTimeOut,
+				ParseLenient: true,
+			},
+		},
+		0,   // cache length
+		nil, // kv services []string
+		errors.NoKind,
+	))
+	t.Run("config with invalid parse_mode", testPluginSetup(
+		`esi {
+			parse_mode sloppy
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.NotValid,
+	))
+
+	t.Run("config with syntax", testPluginSetup(
+		`esi {
+			syntax esi,ssi
+		}`,
+		PathConfigs{
+			&PathConfig{
+				Scope:   "/",
+				Timeout: DefaultTimeOut,
+				Syntax:  esitag.SyntaxESI | esitag.SyntaxSSI,
+			},
+		},
+		0,   // cache length
+		nil, // kv services []string
+		errors.NoKind,
+	))
+	t.Run("config with invalid syntax", testPluginSetup(
+		`esi {
+			syntax esi,jsp
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.NotValid,
+	))
+	t.Run("config with ssi_upstream", testPluginSetup(
+		`esi {
+			syntax ssi
+			ssi_upstream http://127.0.0.1:8080/
+		}`,
+		PathConfigs{
+			&PathConfig{
+				Scope:       "/",
+				Timeout:     DefaultTimeOut,
+				Syntax:      esitag.SyntaxSSI,
+				SSIUpstream: "http://127.0.0.1:8080",
+			},
+		},
+		0,   // cache length
+		nil, // kv services []string
+		errors.NoKind,
+	))
+	t.Run("config with invalid ssi_upstream", testPluginSetup(
+		`esi {
+			ssi_upstream 127.0.0.1:8080/esi
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.NotValid,
+	))
+
 	t.Run("config with cmd_header_name", testPluginSetup(
 		`esi {
 			cmd_header_name X-Esi-CMD
@@ -139,6 +455,25 @@ func TestPluginSetup(t *testing.T) {
 		errors.NotValid,
 	))
 
+	t.Run("config with cluster_bus but value not provided", testPluginSetup(
+		`esi {
+			cluster_bus
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.NotValid,
+	))
+	t.Run("config with cluster_bus scheme not supported", testPluginSetup(
+		`esi {
+			cluster_bus nats://localhost:4222
+		}`,
+		nil,
+		0,   // cache length
+		nil, // kv services []string
+		errors.NotSupported,
+	))
+
 	t.Run("config with page_id_source", testPluginSetup(
 		`esi {
 			page_id_source "pAth,host , IP, header-X-GitHub-Request-Id, header-Server, cookie-__Host-user_session_same_site"
@@ -257,6 +592,24 @@ func TestPluginSetup(t *testing.T) {
 
 }
 
+func TestSiteAddress(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		addr httpserver.Address
+		want string
+	}{
+		{httpserver.Address{}, "http://localhost"},
+		{httpserver.Address{Port: "2015"}, "http://localhost:2015"},
+		{httpserver.Address{Host: "*.example.com", Port: "8080"}, "http://localhost:8080"},
+		{httpserver.Address{Host: "example.com", Port: "443"}, "https://example.com:443"},
+		{httpserver.Address{Scheme: "https", Host: "::1", Port: "8443"}, "https://[::1]:8443"},
+	}
+	for _, test := range tests {
+		assert.Exactly(t, test.want, siteAddress(&httpserver.SiteConfig{Addr: test.addr}), "%#v", test.addr)
+	}
+}
+
 func TestSetupLogger(t *testing.T) {
 
 	buf := new(bytes.Buffer)
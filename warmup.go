@@ -0,0 +1,222 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package caddyesi
+
+import (
+	"bufio"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log"
+)
+
+// warmupMaxPages limits the number of parsed pages remembered for the warm-up
+// of a PathConfig.
+const warmupMaxPages = 1000
+
+// parseWarmup parses the arguments of the warmup directive. The interval can
+// be "startup" to warm the caches only once. A URL ending with .txt is a file
+// containing one URL per line. Empty lines and lines starting with # get
+// skipped.
+func (pc *PathConfig) parseWarmup(interval string, urls []string) error {
+	pc.Warmup = true
+	pc.WarmupInterval = 0
+	if interval != "startup" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d < 1 {
+			return errors.NotValid.Newf("[caddyesi] Invalid interval in warmup configuration: %q. Allowed values: startup or a positive duration", interval)
+		}
+		pc.WarmupInterval = d
+	}
+
+	for _, u := range urls {
+		if !strings.HasSuffix(strings.ToLower(u), ".txt") {
+			if err := pc.addWarmupURL(u); err != nil {
+				return err
+			}
+			continue
+		}
+		fileURLs, err := readWarmupFile(u)
+		if err != nil {
+			return errors.Wrapf(err, "[caddyesi] Failed to read the warmup file %q. Scope %q", u, pc.Scope)
+		}
+		for _, fu := range fileURLs {
+			if err := pc.addWarmupURL(fu); err != nil {
+				return errors.Wrapf(err, "[caddyesi] Warmup file %q", u)
+			}
+		}
+	}
+	return nil
+}
+
+func (pc *PathConfig) addWarmupURL(u string) error {
+	if pu, err := url.Parse(u); err != nil || !pu.IsAbs() {
+		return errors.NotValid.Newf("[caddyesi] Invalid URL in warmup configuration: %q. The URL must contain the scheme and the host", u)
+	}
+	pc.WarmupURLs = append(pc.WarmupURLs, u)
+	return nil
+}
+
+func readWarmupFile(file string) ([]string, error) {
+	f, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return nil, errors.Fatal.New(err, "[caddyesi] Failed to open the warmup file")
+	}
+	defer f.Close()
+
+	var urls []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if l := strings.TrimSpace(s.Text()); l != "" && l[0] != '#' {
+			urls = append(urls, l)
+		}
+	}
+	return urls, errors.Wrap(s.Err(), "[caddyesi] Failed to scan the warmup file")
+}
+
+// rememberPage stores the URL of a parsed page for the warm-up. The URL
+// contains the configured site address because the client controls the Host
+// header. Without a site address or after warmupMaxPages pages the page does
+// not get remembered.
+func (pc *PathConfig) rememberPage(pageID uint64, r *http.Request) {
+	if !pc.Warmup || pc.siteAddress == "" {
+		return
+	}
+	pc.esiMU.Lock()
+	defer pc.esiMU.Unlock()
+	if _, ok := pc.esiPages[pageID]; !ok && len(pc.esiPages) >= warmupMaxPages {
+		if pc.Log.IsDebug() {
+			pc.Log.Debug("caddyesi.PathConfig.rememberPage.Limit", log.String("path_scope", pc.Scope), log.Int("max_pages", warmupMaxPages))
+		}
+		return
+	}
+	pc.esiPages[pageID] = pc.siteAddress + r.URL.RequestURI()
+}
+
+// warmupURLs returns the configured URLs and the URLs of the known pages
+// without duplicates.
+func (pc *PathConfig) warmupURLs() []string {
+	urls := make([]string, 0, len(pc.WarmupURLs)+len(pc.esiPages))
+	urls = append(urls, pc.WarmupURLs...)
+	pc.esiMU.RLock()
+	for _, u := range pc.esiPages {
+		urls = append(urls, u)
+	}
+	pc.esiMU.RUnlock()
+	seen := make(map[string]bool, len(urls))
+	ret := urls[:0]
+	for _, u := range urls {
+		if !seen[u] {
+			seen[u] = true
+			ret = append(ret, u)
+		}
+	}
+	return ret
+}
+
+// discardResponseWriter swallows the pages requested during the warm-up. It
+// implements http.Flusher, so that a page gets processed like for a client,
+// also in the streaming mode.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (dw *discardResponseWriter) Header() http.Header         { return dw.header }
+func (dw *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (dw *discardResponseWriter) WriteHeader(int)             {}
+func (dw *discardResponseWriter) Flush()                      {}
+
+// warmup requests the pages like a client would do. The middleware parses the
+// pages and queries the resources, which stores the fragments in the caches.
+// Fragments close to their expiration get refreshed, if the ESI tags have a
+// refresh ahead duration. The requests contain neither cookies nor headers of
+// a client, so fragments whose cachekey or cachevary depends on them get only
+// warmed for the empty values. The requests do not pass the Caddy server,
+// they lack the remote address and the values which the server adds to the
+// context of a request, e.g. the original URL for the rewrite directive. A
+// next handler depending on them might return a different page. Returns the
+// number of successfully requested pages.
+func (mw *Middleware) warmup(pc *PathConfig) (pages int) {
+	for _, u := range pc.warmupURLs() {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			if pc.Log.IsInfo() {
+				pc.Log.Info("caddyesi.Middleware.Warmup.NewRequest.Error", log.Err(err), log.String("url", u))
+			}
+			continue
+		}
+		code, err := mw.ServeHTTP(&discardResponseWriter{header: make(http.Header)}, req)
+		if err != nil {
+			if pc.Log.IsInfo() {
+				pc.Log.Info("caddyesi.Middleware.Warmup.ServeHTTP.Error", log.Err(err), log.String("url", u), log.Int("code", code))
+			}
+			continue
+		}
+		pages++
+	}
+	if pc.Log.IsDebug() {
+		pc.Log.Debug("caddyesi.Middleware.Warmup", log.String("path_scope", pc.Scope), log.Int("pages", pages))
+	}
+	return pages
+}
+
+// startWarmup starts for each PathConfig with enabled warm-up a goroutine which
+// warms the caches immediately and then in the configured interval.
+func (mw *Middleware) startWarmup() {
+	mw.warmupMu.Lock()
+	defer mw.warmupMu.Unlock()
+	if mw.warmupStop != nil {
+		return // already running
+	}
+	mw.warmupStop = make(chan struct{})
+	for _, pc := range mw.PathConfigs {
+		if pc.Warmup {
+			go mw.runWarmup(pc, mw.warmupStop)
+		}
+	}
+}
+
+func (mw *Middleware) runWarmup(pc *PathConfig, stop <-chan struct{}) {
+	mw.warmup(pc)
+	if pc.WarmupInterval < 1 {
+		return
+	}
+	t := time.NewTicker(pc.WarmupInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			mw.warmup(pc)
+		}
+	}
+}
+
+// stopWarmup stops the goroutines of startWarmup. Can be called multiple
+// times and concurrently.
+func (mw *Middleware) stopWarmup() {
+	mw.warmupMu.Lock()
+	defer mw.warmupMu.Unlock()
+	if mw.warmupStop != nil {
+		close(mw.warmupStop)
+		mw.warmupStop = nil
+	}
+}
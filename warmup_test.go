@@ -0,0 +1,151 @@
+// Copyright 2015-present, Cyrill @ Schumacher.fm and the CoreStore contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package caddyesi
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/corestoreio/caddy-esi/esicache"
+	"github.com/corestoreio/caddy-esi/esitag"
+	"github.com/corestoreio/caddy-esi/esitesting"
+	"github.com/corestoreio/errors"
+	"github.com/corestoreio/log"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ http.Flusher = (*discardResponseWriter)(nil)
+
+func TestPathConfig_parseWarmup(t *testing.T) {
+	t.Parallel()
+
+	tmpFile, clean := esitesting.Tempfile(t)
+	defer clean()
+	tmpFile += ".txt"
+	defer os.Remove(tmpFile)
+	require.NoError(t, ioutil.WriteFile(tmpFile, []byte("# pages\nhttp://shop.local/a.html\n\n  http://shop.local/b.html  \n"), 0600))
+
+	runner := func(interval string, urls []string, wantInterval time.Duration, wantURLs []string, wantErrBhf errors.Kind) func(*testing.T) {
+		return func(t *testing.T) {
+			pc := NewPathConfig()
+			err := pc.parseWarmup(interval, urls)
+			if wantErrBhf > 0 {
+				assert.True(t, wantErrBhf.Match(err), "%+v", err)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, pc.Warmup, "Warmup")
+			assert.Exactly(t, wantInterval, pc.WarmupInterval)
+			assert.Exactly(t, wantURLs, pc.WarmupURLs)
+		}
+	}
+	t.Run("startup only", runner("startup", nil, 0, nil, errors.NoKind))
+	t.Run("interval with URLs", runner("5m", []string{"https://shop.local/"}, 5*time.Minute, []string{"https://shop.local/"}, errors.NoKind))
+	t.Run("URL file", runner("1h", []string{tmpFile}, time.Hour, []string{"http://shop.local/a.html", "http://shop.local/b.html"}, errors.NoKind))
+	t.Run("invalid interval", runner("-1s", nil, 0, nil, errors.NotValid))
+	t.Run("relative URL", runner("startup", []string{"/a.html"}, 0, nil, errors.NotValid))
+	t.Run("missing file", runner("startup", []string{"not_existent_urls.txt"}, 0, nil, errors.Fatal))
+}
+
+func TestMiddleware_warmup(t *testing.T) {
+	defer esicache.MainRegistry.Clear()
+	require.NoError(t, esicache.MainRegistry.Register("/", "inmemory", false))
+
+	var calls int32
+	defer esitag.RegisterResourceHandler("warmup01", esitesting.MockRequestContentCB("Cart", func() error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})).DeferredDeregister()
+
+	pc := NewPathConfig()
+	pc.Scope = "/"
+	pc.Log = log.BlackHole{}
+	pc.MaxBodySize = DefaultMaxBodySize
+	pc.Warmup = true
+	pc.WarmupURLs = []string{"http://shop.local/page.html"}
+	pc.siteAddress = "http://shop.local"
+
+	mw := &Middleware{
+		PathConfigs: PathConfigs{pc},
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			_, err := w.Write([]byte(`<html><body><esi:include src="warmup01://cart" ttl="1m" timeout="1s"/></body></html>`))
+			return http.StatusOK, err
+		}),
+	}
+
+	assert.Exactly(t, 1, mw.warmup(pc), "warmed pages")
+	assert.Exactly(t, int32(1), atomic.LoadInt32(&calls), "calls to the resource")
+	assert.Exactly(t, []string{"http://shop.local/page.html"}, pc.warmupURLs(), "the known page equals the configured URL")
+
+	// a client gets the warmed fragment from the cache.
+	rec := httptest.NewRecorder()
+	_, err := mw.ServeHTTP(rec, httptest.NewRequest("GET", "http://shop.local/page.html", nil))
+	require.NoError(t, err)
+	assert.Contains(t, rec.Body.String(), "Cart")
+	assert.Exactly(t, int32(1), atomic.LoadInt32(&calls), "calls to the resource")
+
+	// a forged Host header does not end up in the warm-up.
+	req := httptest.NewRequest("GET", "http://shop.local/other.html", nil)
+	req.Host = "169.254.169.254"
+	_, err = mw.ServeHTTP(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	assert.Exactly(t, []string{"http://shop.local/page.html", "http://shop.local/other.html"}, pc.warmupURLs())
+}
+
+func TestMiddleware_stopWarmup(t *testing.T) {
+	mw := &Middleware{}
+	mw.startWarmup()
+	stop := mw.warmupStop
+	mw.startWarmup()
+	assert.True(t, stop == mw.warmupStop, "A second start must not replace the running warm-up")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mw.stopWarmup()
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, mw.warmupStop)
+	_, open := <-stop
+	assert.False(t, open, "stop channel must be closed")
+}
+
+func TestPathConfig_rememberPage(t *testing.T) {
+	pc := NewPathConfig()
+	pc.Log = log.BlackHole{}
+	pc.Warmup = true
+
+	req := httptest.NewRequest("GET", "http://shop.local/page.html?id=1", nil)
+	pc.rememberPage(1, req)
+	assert.Empty(t, pc.warmupURLs(), "Without a site address no page gets remembered")
+
+	pc.siteAddress = "https://shop.local:443"
+	for i := 0; i < warmupMaxPages+10; i++ {
+		pc.rememberPage(uint64(i), req)
+	}
+	assert.Len(t, pc.esiPages, warmupMaxPages)
+	assert.Exactly(t, []string{"https://shop.local:443/page.html?id=1"}, pc.warmupURLs())
+}